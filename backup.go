@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	backupFormat  = "todo-app-backup"
+	backupVersion = 1
+
+	backupMaxSize = 256 << 20
+)
+
+// backupTables are the tables a backup holds, in the order they are
+// restored. dav_changes and dav_sync_floors are left out: they are CalDAV
+// bookkeeping, and the triggers on todos record restored and removed todos
+// there so that clients pick the restore up.
+var backupTables = []string{
+	"projects",
+	"todos",
+	"notification_channels",
+	"reminders",
+	"ics_subscriptions",
+	"ics_subscription_items",
+	"ics_refreshes",
+	"ics_refresh_changes",
+	"api_tokens",
+	"push_subscriptions",
+	"settings",
+}
+
+// backupReference is a column holding the id of a row of another table.
+type backupReference struct {
+	table string
+	// Rows pointing to a row that was not restored keep NULL rather than
+	// being skipped
+	optional bool
+}
+
+// backupReferences are the columns a merge rewrites to the ids the rows they
+// point to were given.
+var backupReferences = map[string]map[string]backupReference{
+	"todos": {
+		"project_id": {table: "projects"},
+		"parent_id":  {table: "todos", optional: true},
+	},
+	"reminders": {
+		"todo_id":    {table: "todos"},
+		"channel_id": {table: "notification_channels", optional: true},
+	},
+	"ics_subscriptions": {
+		"project_id": {table: "projects"},
+	},
+	"ics_subscription_items": {
+		"subscription_id": {table: "ics_subscriptions"},
+		"todo_id":         {table: "todos"},
+	},
+	"ics_refreshes": {
+		"subscription_id": {table: "ics_subscriptions"},
+	},
+	"ics_refresh_changes": {
+		"refresh_id": {table: "ics_refreshes"},
+		"todo_id":    {table: "todos", optional: true},
+	},
+}
+
+// backupSecretColumns hold values encrypted with the server's secret key.
+var backupSecretColumns = map[string]string{
+	"ics_subscriptions":     "credentials",
+	"notification_channels": "secrets",
+}
+
+// backupSecretSettings are settings holding the server's own keys. They are
+// neither exported nor restored, so a backup file never carries them.
+var backupSecretSettings = []string{"vapid_private_key"}
+
+// Backup is a copy of every table, with values as SQLite stores them.
+type Backup struct {
+	Format        string                 `json:"format"`
+	Version       int                    `json:"version"`
+	SchemaVersion uint                   `json:"schema_version"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Tables        map[string]BackupTable `json:"tables"`
+}
+
+type BackupTable struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Restore is the outcome of a restore, per table.
+type Restore struct {
+	Mode   string                  `json:"mode"`
+	Tables map[string]RestoreTable `json:"tables"`
+}
+
+type RestoreTable struct {
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execQueryer is a queryer that can also write, a *sql.DB or a *sql.Tx.
+type execQueryer interface {
+	queryer
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// schemaVersion returns the migration the database is at, as recorded by
+// golang-migrate.
+func schemaVersion(q queryer) (uint, error) {
+	var version uint
+	var dirty bool
+	if err := q.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty); err != nil {
+		return 0, fmt.Errorf("reading schema version: %v", err)
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema version %d is dirty", version)
+	}
+	return version, nil
+}
+
+func tableColumns(q queryer, table string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// dumpTable reads every row of a table. Columns are selected as
+// expressions (+column) so that the driver does not turn dates and booleans
+// into Go values, which would not be written back the same way.
+func dumpTable(q queryer, table string) (BackupTable, error) {
+	columns, err := tableColumns(q, table)
+	if err != nil {
+		return BackupTable{}, err
+	}
+	dump := BackupTable{Columns: columns, Rows: make([][]interface{}, 0)}
+
+	selects := make([]string, len(columns))
+	for i, column := range columns {
+		selects[i] = fmt.Sprintf("+%q", column)
+	}
+	rows, err := q.Query(fmt.Sprintf("SELECT %s FROM %q ORDER BY rowid", strings.Join(selects, ", "), table))
+	if err != nil {
+		return dump, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return dump, err
+		}
+		for i, value := range values {
+			// No column holds binary data, so blobs can only be text
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		dump.Rows = append(dump.Rows, values)
+	}
+	return dump, rows.Err()
+}
+
+// backupHandler downloads a backup of the whole database, read in one
+// transaction so that it is consistent.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	backup := Backup{
+		Format:        backupFormat,
+		Version:       backupVersion,
+		SchemaVersion: version,
+		CreatedAt:     time.Now().UTC(),
+		Tables:        make(map[string]BackupTable),
+	}
+	for _, table := range backupTables {
+		if backup.Tables[table], err = dumpTable(tx, table); err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", table, err), http.StatusInternalServerError)
+			return
+		}
+	}
+	removeSecretSettings(&backup)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		"todo-app-backup-"+backup.CreatedAt.Format("2006-01-02T150405Z")+".json"))
+	json.NewEncoder(w).Encode(backup)
+}
+
+// restoreHandler restores a backup in one transaction. With mode=replace
+// (the default) every table is emptied first; with mode=merge the rows are
+// added next to the existing ones under new ids. Settings the server already
+// has are kept in both modes, and credentials must be readable with the
+// server's SECRET_KEY.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "replace"
+	}
+	if mode != "replace" && mode != "merge" {
+		http.Error(w, "mode must be replace or merge", http.StatusBadRequest)
+		return
+	}
+
+	var backup Backup
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, backupMaxSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&backup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	removeSecretSettings(&backup)
+	if err := checkBackupSecrets(&backup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Nothing may change the tables between validation and the restore
+	icsApplyMu.Lock()
+	defer icsApplyMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := validateBackup(tx, &backup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restore := Restore{Mode: mode, Tables: make(map[string]RestoreTable)}
+	if mode == "replace" {
+		for i := len(backupTables) - 1; i >= 0; i-- {
+			if backupTables[i] == "settings" {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %q", backupTables[i])); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	// The ids merged rows were given, by table and id in the backup
+	ids := make(map[string]map[int64]int64)
+	for _, table := range backupTables {
+		dump, ok := backup.Tables[table]
+		if !ok {
+			continue
+		}
+		var result RestoreTable
+		if mode == "merge" {
+			result, err = mergeTable(tx, table, dump, ids)
+		} else {
+			result, err = restoreTable(tx, table, dump)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", table, err), http.StatusInternalServerError)
+			return
+		}
+		restore.Tables[table] = result
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restore)
+}
+
+// validateBackup checks that a backup can be restored into this database:
+// it must not come from a newer schema, and every table and column must
+// exist. Backups from older schemas are fine, as migrations only add
+// columns with defaults. Numbers are converted to the types SQLite expects.
+func validateBackup(q queryer, backup *Backup) error {
+	if backup.Format != backupFormat {
+		return fmt.Errorf("not a todo-app backup")
+	}
+	if backup.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d", backup.Version)
+	}
+	current, err := schemaVersion(q)
+	if err != nil {
+		return err
+	}
+	if backup.SchemaVersion > current {
+		return fmt.Errorf("backup is from schema version %d, newer than this server's %d", backup.SchemaVersion, current)
+	}
+
+	for table, dump := range backup.Tables {
+		if !slices.Contains(backupTables, table) {
+			return fmt.Errorf("unknown table %q", table)
+		}
+		columns, err := tableColumns(q, table)
+		if err != nil {
+			return err
+		}
+		for _, column := range dump.Columns {
+			if !slices.Contains(columns, column) {
+				return fmt.Errorf("%s: unknown column %q", table, column)
+			}
+		}
+		for i, row := range dump.Rows {
+			if len(row) != len(dump.Columns) {
+				return fmt.Errorf("%s: row %d has %d values for %d columns", table, i+1, len(row), len(dump.Columns))
+			}
+			for j, value := range row {
+				switch v := value.(type) {
+				case json.Number:
+					if n, err := v.Int64(); err == nil {
+						row[j] = n
+					} else if f, err := v.Float64(); err == nil {
+						row[j] = f
+					} else {
+						return fmt.Errorf("%s: row %d: invalid number %s", table, i+1, v)
+					}
+				case nil, string:
+				default:
+					return fmt.Errorf("%s: row %d: unsupported value for %s", table, i+1, dump.Columns[j])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// restoreTable inserts the rows of a table with their ids. Rows whose id is
+// taken are skipped.
+func restoreTable(tx *sql.Tx, table string, dump BackupTable) (RestoreTable, error) {
+	var result RestoreTable
+	if len(dump.Rows) == 0 {
+		return result, nil
+	}
+
+	columns := make([]string, len(dump.Columns))
+	for i, column := range dump.Columns {
+		columns[i] = fmt.Sprintf("%q", column)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT OR IGNORE INTO %q (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+
+	for _, row := range dump.Rows {
+		res, err := stmt.Exec(row...)
+		if err != nil {
+			return result, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			result.Restored++
+		} else {
+			result.Skipped++
+		}
+	}
+	return result, nil
+}
+
+// mergeTable inserts the rows of a table under new ids, which it records in
+// ids, with their references rewritten to the ids of the rows they point to.
+// Rows that clash with a unique value, such as the URL of a subscription the
+// server already has, are skipped, and so are rows depending on them.
+func mergeTable(tx *sql.Tx, table string, dump BackupTable, ids map[string]map[int64]int64) (RestoreTable, error) {
+	var result RestoreTable
+	ids[table] = make(map[int64]int64)
+	if len(dump.Rows) == 0 {
+		return result, nil
+	}
+
+	idColumn := slices.Index(dump.Columns, "id")
+	var columns []string
+	for i, column := range dump.Columns {
+		if i != idColumn {
+			columns = append(columns, fmt.Sprintf("%q", column))
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT OR IGNORE INTO %q (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+
+	// References within the table, such as subtasks listed before their
+	// parent, are set once every row has its id
+	type selfReference struct {
+		id     int64
+		column string
+		target int64
+	}
+	var selfReferences []selfReference
+
+	for _, row := range dump.Rows {
+		values := make([]interface{}, 0, len(columns))
+		var pending []selfReference
+		skip := false
+		for i, column := range dump.Columns {
+			if i == idColumn {
+				continue
+			}
+			value := row[i]
+			if ref, ok := backupReferences[table][column]; ok && value != nil {
+				target, _ := value.(int64)
+				newID, found := ids[ref.table][target]
+				switch {
+				case ref.table == table:
+					pending = append(pending, selfReference{column: column, target: target})
+					value = nil
+				case found:
+					value = newID
+				case ref.optional:
+					value = nil
+				default:
+					skip = true
+				}
+			}
+			values = append(values, value)
+		}
+		if skip {
+			result.Skipped++
+			continue
+		}
+
+		res, err := stmt.Exec(values...)
+		if err != nil {
+			return result, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			result.Skipped++
+			continue
+		}
+		result.Restored++
+		if idColumn < 0 {
+			continue
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return result, err
+		}
+		if oldID, ok := row[idColumn].(int64); ok {
+			ids[table][oldID] = newID
+		}
+		for _, ref := range pending {
+			ref.id = newID
+			selfReferences = append(selfReferences, ref)
+		}
+	}
+
+	for _, ref := range selfReferences {
+		newID, ok := ids[table][ref.target]
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %q SET %q = ? WHERE id = ?", table, ref.column), newID, ref.id); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// removeSecretSettings takes the server's keys out of a backup's settings.
+func removeSecretSettings(backup *Backup) {
+	settings, ok := backup.Tables["settings"]
+	if !ok {
+		return
+	}
+	keyColumn := slices.Index(settings.Columns, "key")
+	if keyColumn < 0 {
+		return
+	}
+	settings.Rows = slices.DeleteFunc(settings.Rows, func(row []interface{}) bool {
+		key, _ := row[keyColumn].(string)
+		return len(row) == len(settings.Columns) && slices.Contains(backupSecretSettings, key)
+	})
+	backup.Tables["settings"] = settings
+}
+
+// checkBackupSecrets makes sure this server can read the credentials in a
+// backup. Only the server's SECRET_KEY is tried: a backup made with another
+// one is refused rather than restored with credentials nothing can use.
+func checkBackupSecrets(backup *Backup) error {
+	for table, column := range backupSecretColumns {
+		dump := backup.Tables[table]
+		i := slices.Index(dump.Columns, column)
+		if i < 0 {
+			continue
+		}
+		for n, row := range dump.Rows {
+			if len(row) != len(dump.Columns) {
+				continue
+			}
+			encrypted, ok := row[i].(string)
+			if !ok {
+				continue
+			}
+			if _, err := decryptSecret(encrypted); err != nil {
+				if errors.Is(err, errNoSecretKey) {
+					return fmt.Errorf("%s: row %d: %v", table, n+1, err)
+				}
+				return fmt.Errorf("%s: row %d: %s was encrypted with a SECRET_KEY this server does not have", table, n+1, column)
+			}
+		}
+	}
+	return nil
+}
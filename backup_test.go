@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// useSecretKey sets SECRET_KEY for a test. The cipher derived from it is
+// cached, so it is derived again from the new key.
+func useSecretKey(t *testing.T, key string) {
+	t.Helper()
+	previous := config.SecretKey
+	config.SecretKey = key
+	secretKeyOnce = sync.Once{}
+	t.Cleanup(func() {
+		config.SecretKey = previous
+		secretKeyOnce = sync.Once{}
+	})
+}
+
+func execAll(t *testing.T, statements ...string) {
+	t.Helper()
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+// seedBackupData fills the database with rows referencing each other
+// across every kind of reference a restore rewrites.
+func seedBackupData(t *testing.T) {
+	t.Helper()
+	secrets, err := encryptSecret([]byte(`{"password":"hunter2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := encryptSecret([]byte(`{"bearer_token":"feed-token"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	execAll(t,
+		"INSERT INTO projects (id, title, position) VALUES (2, 'Work', 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (1, 'Write report', 2, 0)",
+		"INSERT INTO todos (id, title, project_id, position, parent_id) VALUES (2, 'Find sources', 2, 1, 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (3, 'Standup', 2, 2)",
+		"INSERT INTO notification_channels (id, name, type, config) VALUES (1, 'Mail', 'email', '{}')",
+		"INSERT INTO reminders (id, todo_id, offset_minutes, channel_id) VALUES (1, 2, 30, 1)",
+		"INSERT INTO ics_subscriptions (id, url, project_id, local_edit_policy, removed_policy) VALUES (1, 'https://example.com/work.ics', 2, 'keep', 'delete')",
+		"INSERT INTO ics_subscription_items (subscription_id, uid, todo_id, title) VALUES (1, 'standup', 3, 'Standup')",
+		"INSERT INTO api_tokens (id, name, token_hash) VALUES (1, 'phone', 'hash-1')",
+		"INSERT INTO settings (key, value) VALUES ('vapid_private_key', 'private')",
+	)
+	if _, err := db.Exec("UPDATE notification_channels SET secrets = ? WHERE id = 1", secrets); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE ics_subscriptions SET credentials = ? WHERE id = 1", credentials); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func takeBackup(t *testing.T) []byte {
+	t.Helper()
+	w := httptest.NewRecorder()
+	backupHandler(w, httptest.NewRequest(http.MethodGet, "/api/backup", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup status = %d: %s", w.Code, w.Body)
+	}
+	return w.Body.Bytes()
+}
+
+func restoreBackup(t *testing.T, mode string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	restoreHandler(w, httptest.NewRequest(http.MethodPost, "/api/restore?mode="+mode, bytes.NewReader(body)))
+	return w
+}
+
+func queryInt(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// checkRestoredSecrets decrypts the secrets of the rows with the given ids.
+func checkRestoredSecrets(t *testing.T, channelID, subscriptionID int) {
+	t.Helper()
+	var secrets, credentials string
+	if err := db.QueryRow("SELECT secrets FROM notification_channels WHERE id = ?", channelID).Scan(&secrets); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := decryptSecret(secrets); err != nil || string(plaintext) != `{"password":"hunter2"}` {
+		t.Errorf("channel secrets = %q, %v", plaintext, err)
+	}
+	if err := db.QueryRow("SELECT credentials FROM ics_subscriptions WHERE id = ?", subscriptionID).Scan(&credentials); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := decryptSecret(credentials); err != nil || string(plaintext) != `{"bearer_token":"feed-token"}` {
+		t.Errorf("feed credentials = %q, %v", plaintext, err)
+	}
+}
+
+func TestBackupLeavesOutServerKeys(t *testing.T) {
+	useSecretKey(t, "backup test key")
+	openTestDatabase(t)
+	seedBackupData(t)
+
+	var backup Backup
+	if err := json.Unmarshal(takeBackup(t), &backup); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range backup.Tables["settings"].Rows {
+		if row[0] == "vapid_private_key" {
+			t.Error("the backup holds the VAPID private key")
+		}
+	}
+	if got := len(backup.Tables["todos"].Rows); got != 3 {
+		t.Errorf("backup holds %d todos, want 3", got)
+	}
+}
+
+func TestBackupRestoreReplace(t *testing.T) {
+	useSecretKey(t, "backup test key")
+	openTestDatabase(t)
+	seedBackupData(t)
+	body := takeBackup(t)
+
+	openTestDatabase(t)
+	execAll(t,
+		"INSERT INTO todos (id, title, project_id, position) VALUES (1, 'Replaced', 1, 0)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (7, 'Also replaced', 1, 1)",
+		"INSERT INTO settings (key, value) VALUES ('vapid_private_key', 'this server')",
+	)
+	if w := restoreBackup(t, "replace", body); w.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", w.Code, w.Body)
+	}
+
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos"); n != 3 {
+		t.Errorf("%d todos, want the 3 of the backup", n)
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos WHERE id = 2 AND parent_id = 1 AND project_id = 2"); n != 1 {
+		t.Error("the subtask lost its parent or project")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM reminders WHERE todo_id = 2 AND channel_id = 1"); n != 1 {
+		t.Error("the reminder lost its todo or channel")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM ics_subscription_items WHERE subscription_id = 1 AND todo_id = 3"); n != 1 {
+		t.Error("the subscription item lost its todo")
+	}
+	var vapidKey string
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = 'vapid_private_key'").Scan(&vapidKey); err != nil || vapidKey != "this server" {
+		t.Errorf("VAPID key = %q, %v, want the server's own", vapidKey, err)
+	}
+	checkRestoredSecrets(t, 1, 1)
+}
+
+func TestBackupRestoreMerge(t *testing.T) {
+	useSecretKey(t, "backup test key")
+	openTestDatabase(t)
+	seedBackupData(t)
+	body := takeBackup(t)
+
+	// The server already has rows under every id the backup uses
+	openTestDatabase(t)
+	execAll(t,
+		"INSERT INTO projects (id, title, position) VALUES (2, 'Home', 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (1, 'Water plants', 2, 0)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (2, 'Feed cat', 2, 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (3, 'Clean', 2, 2)",
+		"INSERT INTO notification_channels (id, name, type, config) VALUES (1, 'Hook', 'webhook', '{}')",
+		"INSERT INTO reminders (id, todo_id, remind_at) VALUES (1, 1, '2030-01-01 09:00:00')",
+		"INSERT INTO ics_subscriptions (id, url, project_id, local_edit_policy, removed_policy) VALUES (1, 'https://example.com/home.ics', 2, 'keep', 'delete')",
+		"INSERT INTO api_tokens (id, name, token_hash) VALUES (1, 'laptop', 'hash-2')",
+	)
+	if w := restoreBackup(t, "merge", body); w.Code != http.StatusOK {
+		t.Fatalf("restore status = %d: %s", w.Code, w.Body)
+	}
+
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos"); n != 6 {
+		t.Errorf("%d todos, want the 3 existing and 3 merged ones", n)
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos WHERE id <= 3 AND project_id = 2 AND parent_id IS NULL"); n != 3 {
+		t.Error("the existing todos were changed")
+	}
+
+	workID := queryInt(t, "SELECT id FROM projects WHERE title = 'Work'")
+	parentID := queryInt(t, "SELECT id FROM todos WHERE title = 'Write report'")
+	childID := queryInt(t, "SELECT id FROM todos WHERE title = 'Find sources'")
+	standupID := queryInt(t, "SELECT id FROM todos WHERE title = 'Standup'")
+	channelID := queryInt(t, "SELECT id FROM notification_channels WHERE name = 'Mail'")
+	subscriptionID := queryInt(t, "SELECT id FROM ics_subscriptions WHERE url = 'https://example.com/work.ics'")
+	if workID <= 2 || parentID <= 3 || childID <= 3 || standupID <= 3 || channelID <= 1 || subscriptionID <= 1 {
+		t.Errorf("merged rows reuse taken ids: project %d, todos %d %d %d, channel %d, subscription %d",
+			workID, parentID, childID, standupID, channelID, subscriptionID)
+	}
+
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos WHERE id = ? AND parent_id = ? AND project_id = ?", childID, parentID, workID); n != 1 {
+		t.Error("the merged subtask does not point at the merged parent and project")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM reminders WHERE todo_id = ? AND channel_id = ?", childID, channelID); n != 1 {
+		t.Error("the merged reminder does not point at the merged todo and channel")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM reminders WHERE todo_id = 1 AND channel_id IS NULL"); n != 1 {
+		t.Error("the existing reminder was changed")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM ics_subscriptions WHERE id = ? AND project_id = ?", subscriptionID, workID); n != 1 {
+		t.Error("the merged subscription does not point at the merged project")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM ics_subscription_items WHERE subscription_id = ? AND todo_id = ?", subscriptionID, standupID); n != 1 {
+		t.Error("the merged subscription item does not point at the merged todo")
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM api_tokens"); n != 2 {
+		t.Errorf("%d API tokens, want 2", n)
+	}
+	checkRestoredSecrets(t, channelID, subscriptionID)
+}
+
+func TestBackupRestoreRefusesOtherSecretKey(t *testing.T) {
+	useSecretKey(t, "backup test key")
+	openTestDatabase(t)
+	seedBackupData(t)
+	body := takeBackup(t)
+
+	openTestDatabase(t)
+	useSecretKey(t, "another key")
+	if w := restoreBackup(t, "replace", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("restore status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if n := queryInt(t, "SELECT COUNT(*) FROM todos"); n != 0 {
+		t.Errorf("%d todos restored from a refused backup", n)
+	}
+}
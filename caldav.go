@@ -0,0 +1,1299 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"todo-app/ical"
+)
+
+// CalDAV layout:
+//
+//	/dav/                        principal
+//	/dav/projects/               calendar home
+//	/dav/projects/{id}/          one VTODO calendar per project
+//	/dav/projects/{id}/{name}    one todo
+const (
+	davPrefix   = "/dav/"
+	davHomePath = "/dav/projects/"
+
+	davMaxBody = 1 << 20
+
+	calDAVNamespace         = "urn:ietf:params:xml:ns:caldav"
+	calendarServerNamespace = "http://calendarserver.org/ns/"
+	appleICalNamespace      = "http://apple.com/ns/ical/"
+
+	davSyncTokenPrefix = "urn:todo-app:sync:"
+
+	// How long deleted todos are reported to clients that sync
+	davTombstoneRetention = 30 * 24 * time.Hour
+)
+
+var davPrefixes = map[string]string{
+	"DAV:":                  "d",
+	calDAVNamespace:         "c",
+	calendarServerNamespace: "cs",
+	appleICalNamespace:      "ical",
+}
+
+// requireDAVAuth accepts an API token as the Basic auth password (the user
+// name is ignored), which is what phone CalDAV clients can send.
+func requireDAVAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+
+		ok, err := validateAPIToken(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="todo-app"`)
+			http.Error(w, "Invalid or missing API token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// wellKnownCalDAVHandler points clients doing service discovery at the principal.
+func wellKnownCalDAVHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, davHref(davPrefix), http.StatusMovedPermanently)
+}
+
+type davResourceKind int
+
+const (
+	davPrincipal davResourceKind = iota
+	davHome
+	davCalendar
+	davObject
+)
+
+// davResource is what a /dav/ path points at.
+type davResource struct {
+	kind      davResourceKind
+	projectID int
+	name      string
+}
+
+func parseDAVPath(path string) (davResource, bool) {
+	rest := strings.Trim(strings.TrimPrefix(path, davPrefix), "/")
+	if rest == "" {
+		return davResource{kind: davPrincipal}, true
+	}
+
+	parts := strings.Split(rest, "/")
+	if parts[0] != "projects" || len(parts) > 3 {
+		return davResource{}, false
+	}
+	if len(parts) == 1 {
+		return davResource{kind: davHome}, true
+	}
+
+	projectID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return davResource{}, false
+	}
+	if len(parts) == 2 {
+		return davResource{kind: davCalendar, projectID: projectID}, true
+	}
+
+	name, err := url.PathUnescape(parts[2])
+	if err != nil || name == "" {
+		return davResource{}, false
+	}
+	return davResource{kind: davObject, projectID: projectID, name: name}, true
+}
+
+// davHref is the href of a /dav/ path, under the base path the app is
+// served under.
+func davHref(path string) string {
+	return config.basePath + path
+}
+
+func davCalendarHref(projectID int) string {
+	return davHref(fmt.Sprintf("%s%d/", davHomePath, projectID))
+}
+
+func davObjectHref(projectID int, name string) string {
+	return davCalendarHref(projectID) + url.PathEscape(name)
+}
+
+func davHandler(w http.ResponseWriter, r *http.Request) {
+	res, ok := parseDAVPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, REPORT")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if res.kind == davCalendar || res.kind == davObject {
+		if exists, err := projectExists(res.projectID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !exists {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		// Todos made in the app get their UID now, so the ETags handed
+		// out below do not change on the next request
+		if err := assignMissingUIDs(res.projectID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		davPropfind(w, r, res)
+	case "PROPPATCH":
+		davProppatch(w, r, res)
+	case "REPORT":
+		davReport(w, r, res)
+	case http.MethodGet, http.MethodHead:
+		davGet(w, r, res)
+	case http.MethodPut:
+		davPut(w, r, res)
+	case http.MethodDelete:
+		davDelete(w, r, res)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func projectExists(projectID int) (bool, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM projects WHERE id = ?", projectID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// assignMissingUIDs gives every todo of a project a UID, since CalDAV
+// clients identify todos by it.
+func assignMissingUIDs(projectID int) error {
+	rows, err := db.Query("SELECT id FROM todos WHERE project_id = ? AND (uid IS NULL OR uid = '')", projectID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := ensureTodoUID(&Todo{ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// davTodo is a todo with its CalDAV resource name and ETag.
+type davTodo struct {
+	Todo
+	name string
+	etag string
+}
+
+func (t davTodo) calendarData() string {
+	var ics icsWriter
+	ics.line("BEGIN", "VCALENDAR")
+	ics.line("VERSION", "2.0")
+	ics.line("PRODID", icsProductID)
+	ics.writeVTODO(t.Todo, t.UID, t.CreatedAt)
+	ics.line("END", "VCALENDAR")
+	return string(ics.bytes())
+}
+
+// The resource name and the latest change, which serves as the ETag
+const davTodoColumns = `t.id, t.title, t.completed, t.created_at, t.completed_at, datetime(t.due_date), t.all_day,
+	t.recurrence_interval, t.recurrence_unit, t.project_id, t.position, COALESCE(t.uid, ''), t.priority,
+	t.notes, COALESCE((SELECT p.uid FROM todos p WHERE p.id = t.parent_id), ''),
+	COALESCE(t.dav_name, 'todo-' || t.id || '.ics'),
+	COALESCE((SELECT MAX(c.id) FROM dav_changes c WHERE c.todo_id = t.id), 0)`
+
+func queryDAVTodos(where string, args ...interface{}) ([]davTodo, error) {
+	rows, err := db.Query("SELECT "+davTodoColumns+" FROM todos t WHERE "+where+" ORDER BY t.position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := make([]davTodo, 0)
+	for rows.Next() {
+		var todo davTodo
+		var dueDateStr sql.NullString
+		var changeID int
+		if err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.Completed,
+			&todo.CreatedAt,
+			&todo.CompletedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.ProjectID,
+			&todo.Position,
+			&todo.UID,
+			&todo.Priority,
+			&todo.Notes,
+			&todo.ParentUID,
+			&todo.name,
+			&changeID,
+		); err != nil {
+			return nil, err
+		}
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+		}
+		todo.etag = fmt.Sprintf(`"%d"`, changeID)
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+func findDAVTodo(projectID int, name string) (*davTodo, error) {
+	todos, err := queryDAVTodos("t.project_id = ? AND COALESCE(t.dav_name, 'todo-' || t.id || '.ics') = ?", projectID, name)
+	if err != nil || len(todos) == 0 {
+		return nil, err
+	}
+	return &todos[0], nil
+}
+
+// davSyncToken is the latest change in a project; it doubles as the ctag.
+// It is never below the project's sync floor, which is also returned.
+func davSyncToken(projectID int) (string, int, int, error) {
+	var changeID, floor int
+	err := db.QueryRow(`
+		SELECT COALESCE((SELECT MAX(id) FROM dav_changes WHERE project_id = ?), 0),
+		       COALESCE((SELECT change_id FROM dav_sync_floors WHERE project_id = ?), 0)
+	`, projectID, projectID).Scan(&changeID, &floor)
+	changeID = max(changeID, floor)
+	return fmt.Sprintf("%s%d", davSyncTokenPrefix, changeID), changeID, floor, err
+}
+
+// pruneDAVChanges drops the tombstones of todos deleted longer ago than
+// davTombstoneRetention, and raises the sync floor of their projects. Only
+// the latest change of each resource is kept, so tombstones are all that
+// would otherwise pile up.
+func pruneDAVChanges() error {
+	cutoff := time.Now().UTC().Add(-davTombstoneRetention).Format("2006-01-02 15:04:05")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO dav_sync_floors (project_id, change_id)
+		SELECT project_id, MAX(id) FROM dav_changes WHERE deleted AND changed_at < ? GROUP BY project_id
+		ON CONFLICT(project_id) DO UPDATE SET change_id = MAX(change_id, excluded.change_id)
+	`, cutoff)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM dav_changes WHERE deleted AND changed_at < ?", cutoff)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// davRequest holds what the handlers need from a PROPFIND, PROPPATCH or
+// REPORT body.
+type davRequest struct {
+	root       xml.Name
+	props      []xml.Name
+	allProp    bool
+	setValues  map[xml.Name]string
+	hrefs      []string
+	syncToken  string
+	compFilter []string
+}
+
+func parseDAVRequest(r *http.Request) (davRequest, error) {
+	req := davRequest{setValues: make(map[xml.Name]string)}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, davMaxBody))
+	if err != nil {
+		return req, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		req.allProp = true
+		return req, nil
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var stack []xml.Name
+	var text strings.Builder
+	inSet := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return req, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				req.root = t.Name
+			}
+			parent := xml.Name{}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+
+			switch {
+			case parent == (xml.Name{Space: "DAV:", Local: "prop"}):
+				req.props = append(req.props, t.Name)
+			case t.Name == xml.Name{Space: "DAV:", Local: "allprop"}, t.Name == xml.Name{Space: "DAV:", Local: "propname"}:
+				req.allProp = true
+			case t.Name == xml.Name{Space: "DAV:", Local: "set"}:
+				inSet = true
+			case t.Name == xml.Name{Space: calDAVNamespace, Local: "comp-filter"}:
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "name" {
+						req.compFilter = append(req.compFilter, strings.ToUpper(attr.Value))
+					}
+				}
+			}
+			stack = append(stack, t.Name)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			value := strings.TrimSpace(text.String())
+			switch {
+			case t.Name == xml.Name{Space: "DAV:", Local: "href"} && len(stack) == 1:
+				req.hrefs = append(req.hrefs, value)
+			case t.Name == xml.Name{Space: "DAV:", Local: "sync-token"}:
+				req.syncToken = value
+			case t.Name == xml.Name{Space: "DAV:", Local: "set"}:
+				inSet = false
+			case inSet && len(stack) > 0 && stack[len(stack)-1] == (xml.Name{Space: "DAV:", Local: "prop"}):
+				req.setValues[t.Name] = value
+			}
+			text.Reset()
+		}
+	}
+	return req, nil
+}
+
+// davResponse is one <response> of a multistatus: the properties found, and
+// the ones that are not (404) or could not be set (403).
+type davResponse struct {
+	href      string
+	status    int
+	found     []string
+	missing   []xml.Name
+	forbidden []xml.Name
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// davElement renders <name>inner</name> using the multistatus prefixes, or
+// an inline namespace declaration for unknown namespaces.
+func davElement(name xml.Name, inner string) string {
+	tag := name.Local
+	attrs := ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		attrs = fmt.Sprintf(` xmlns="%s"`, xmlEscape(name.Space))
+	}
+	if inner == "" {
+		return "<" + tag + attrs + "/>"
+	}
+	return "<" + tag + attrs + ">" + inner + "</" + tag + ">"
+}
+
+func davPropstat(b *strings.Builder, props []string, status int) {
+	b.WriteString("<d:propstat><d:prop>")
+	for _, prop := range props {
+		b.WriteString(prop)
+	}
+	b.WriteString("</d:prop>")
+	fmt.Fprintf(b, "<d:status>HTTP/1.1 %d %s</d:status>", status, http.StatusText(status))
+	b.WriteString("</d:propstat>")
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse, syncToken string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<d:multistatus xmlns:d="DAV:"`)
+	for _, space := range []string{calDAVNamespace, calendarServerNamespace, appleICalNamespace} {
+		fmt.Fprintf(&b, ` xmlns:%s="%s"`, davPrefixes[space], space)
+	}
+	b.WriteString(">")
+
+	for _, response := range responses {
+		b.WriteString("<d:response>")
+		b.WriteString("<d:href>" + xmlEscape(response.href) + "</d:href>")
+		if response.status != 0 {
+			fmt.Fprintf(&b, "<d:status>HTTP/1.1 %d %s</d:status>", response.status, http.StatusText(response.status))
+		} else {
+			if len(response.found) > 0 {
+				davPropstat(&b, response.found, http.StatusOK)
+			}
+			if len(response.forbidden) > 0 {
+				var forbidden []string
+				for _, name := range response.forbidden {
+					forbidden = append(forbidden, davElement(name, ""))
+				}
+				davPropstat(&b, forbidden, http.StatusForbidden)
+			}
+			if len(response.missing) > 0 {
+				var missing []string
+				for _, name := range response.missing {
+					missing = append(missing, davElement(name, ""))
+				}
+				davPropstat(&b, missing, http.StatusNotFound)
+			}
+		}
+		b.WriteString("</d:response>")
+	}
+
+	if syncToken != "" {
+		b.WriteString("<d:sync-token>" + xmlEscape(syncToken) + "</d:sync-token>")
+	}
+	b.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+func davName(space, local string) xml.Name {
+	return xml.Name{Space: space, Local: local}
+}
+
+var (
+	davResourceType        = davName("DAV:", "resourcetype")
+	davDisplayName         = davName("DAV:", "displayname")
+	davCurrentUserPrinc    = davName("DAV:", "current-user-principal")
+	davPrincipalURL        = davName("DAV:", "principal-URL")
+	davOwner               = davName("DAV:", "owner")
+	davPrivilegeSet        = davName("DAV:", "current-user-privilege-set")
+	davSupportedReportSet  = davName("DAV:", "supported-report-set")
+	davSyncTokenProp       = davName("DAV:", "sync-token")
+	davGetETag             = davName("DAV:", "getetag")
+	davGetContentType      = davName("DAV:", "getcontenttype")
+	davCalendarHomeSet     = davName(calDAVNamespace, "calendar-home-set")
+	davSupportedComponents = davName(calDAVNamespace, "supported-calendar-component-set")
+	davCalendarData        = davName(calDAVNamespace, "calendar-data")
+	davGetCTag             = davName(calendarServerNamespace, "getctag")
+	davCalendarOrder       = davName(appleICalNamespace, "calendar-order")
+)
+
+// Properties listed for allprop requests, per kind of resource
+var davAllProps = map[davResourceKind][]xml.Name{
+	davPrincipal: {davResourceType, davDisplayName, davCurrentUserPrinc, davPrincipalURL, davCalendarHomeSet},
+	davHome:      {davResourceType, davDisplayName, davCurrentUserPrinc},
+	davCalendar:  {davResourceType, davDisplayName, davCurrentUserPrinc, davSupportedComponents, davGetCTag, davSyncTokenProp, davCalendarOrder},
+	davObject:    {davResourceType, davGetETag, davGetContentType},
+}
+
+// davContext caches what property rendering needs for one resource.
+type davContext struct {
+	res       davResource
+	project   Project
+	syncToken string
+	todo      *davTodo
+}
+
+func (c davContext) href() string {
+	switch c.res.kind {
+	case davHome:
+		return davHref(davHomePath)
+	case davCalendar:
+		return davCalendarHref(c.res.projectID)
+	case davObject:
+		return davObjectHref(c.res.projectID, c.res.name)
+	default:
+		return davHref(davPrefix)
+	}
+}
+
+// propValue renders one property, reporting false when the resource does
+// not have it.
+func (c davContext) propValue(name xml.Name) (string, bool) {
+	principalHref := "<d:href>" + davHref(davPrefix) + "</d:href>"
+
+	switch name {
+	case davCurrentUserPrinc:
+		return principalHref, true
+	case davPrivilegeSet:
+		var privileges strings.Builder
+		for _, privilege := range []string{"read", "write", "write-properties", "write-content", "bind", "unbind", "read-current-user-privilege-set"} {
+			privileges.WriteString("<d:privilege><d:" + privilege + "/></d:privilege>")
+		}
+		return privileges.String(), true
+	}
+
+	switch c.res.kind {
+	case davPrincipal:
+		switch name {
+		case davResourceType:
+			return "<d:collection/><d:principal/>", true
+		case davDisplayName:
+			return "Todo App", true
+		case davPrincipalURL:
+			return principalHref, true
+		case davCalendarHomeSet:
+			return "<d:href>" + davHref(davHomePath) + "</d:href>", true
+		}
+	case davHome:
+		switch name {
+		case davResourceType:
+			return "<d:collection/>", true
+		case davDisplayName:
+			return "Projects", true
+		}
+	case davCalendar:
+		switch name {
+		case davResourceType:
+			return "<d:collection/><c:calendar/>", true
+		case davDisplayName:
+			return xmlEscape(c.project.Title), true
+		case davOwner:
+			return principalHref, true
+		case davSupportedComponents:
+			return `<c:comp name="VTODO"/>`, true
+		case davSupportedReportSet:
+			var reports strings.Builder
+			for _, report := range []string{"c:calendar-query", "c:calendar-multiget", "d:sync-collection"} {
+				reports.WriteString("<d:supported-report><d:report><" + report + "/></d:report></d:supported-report>")
+			}
+			return reports.String(), true
+		case davGetCTag, davSyncTokenProp:
+			return xmlEscape(c.syncToken), true
+		case davCalendarOrder:
+			return strconv.Itoa(c.project.Position), true
+		}
+	case davObject:
+		if c.todo == nil {
+			return "", false
+		}
+		switch name {
+		case davResourceType:
+			return "", true
+		case davGetETag:
+			return xmlEscape(c.todo.etag), true
+		case davGetContentType:
+			return "text/calendar; charset=utf-8; component=VTODO", true
+		case davCalendarData:
+			return xmlEscape(c.todo.calendarData()), true
+		}
+	}
+	return "", false
+}
+
+func (c davContext) response(req davRequest) davResponse {
+	response := davResponse{href: c.href()}
+	props := req.props
+	if req.allProp {
+		props = davAllProps[c.res.kind]
+	}
+	for _, name := range props {
+		if value, ok := c.propValue(name); ok {
+			response.found = append(response.found, davElement(name, value))
+		} else {
+			response.missing = append(response.missing, name)
+		}
+	}
+	return response
+}
+
+func loadProject(projectID int) (Project, error) {
+	var project Project
+	err := db.QueryRow("SELECT id, title, position, created_at FROM projects WHERE id = ?", projectID).
+		Scan(&project.ID, &project.Title, &project.Position, &project.CreatedAt)
+	return project, err
+}
+
+func calendarContext(project Project) (davContext, error) {
+	syncToken, _, _, err := davSyncToken(project.ID)
+	return davContext{
+		res:       davResource{kind: davCalendar, projectID: project.ID},
+		project:   project,
+		syncToken: syncToken,
+	}, err
+}
+
+func objectContext(todo davTodo) davContext {
+	return davContext{
+		res:  davResource{kind: davObject, projectID: todo.ProjectID, name: todo.name},
+		todo: &todo,
+	}
+}
+
+func davPropfind(w http.ResponseWriter, r *http.Request, res davResource) {
+	req, err := parseDAVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	depth := r.Header.Get("Depth")
+
+	var responses []davResponse
+	switch res.kind {
+	case davPrincipal:
+		responses = append(responses, davContext{res: res}.response(req))
+	case davHome:
+		responses = append(responses, davContext{res: res}.response(req))
+		if depth != "0" {
+			rows, err := db.Query("SELECT id FROM projects ORDER BY position")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var ids []int
+			for rows.Next() {
+				var id int
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				ids = append(ids, id)
+			}
+			rows.Close()
+
+			for _, id := range ids {
+				if err := assignMissingUIDs(id); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				project, err := loadProject(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				ctx, err := calendarContext(project)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				responses = append(responses, ctx.response(req))
+			}
+		}
+	case davCalendar:
+		project, err := loadProject(res.projectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx, err := calendarContext(project)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responses = append(responses, ctx.response(req))
+
+		if depth != "0" {
+			todos, err := queryDAVTodos("t.project_id = ?", res.projectID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, todo := range todos {
+				responses = append(responses, objectContext(todo).response(req))
+			}
+		}
+	case davObject:
+		todo, err := findDAVTodo(res.projectID, res.name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if todo == nil {
+			http.NotFound(w, r)
+			return
+		}
+		responses = append(responses, objectContext(*todo).response(req))
+	}
+
+	writeMultistatus(w, responses, "")
+}
+
+// davProppatch lets clients rename a project or change its order. Other
+// properties are refused.
+func davProppatch(w http.ResponseWriter, r *http.Request, res davResource) {
+	if res.kind != davCalendar {
+		http.Error(w, "Properties can only be changed on project calendars", http.StatusForbidden)
+		return
+	}
+	req, err := parseDAVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := davResponse{href: davCalendarHref(res.projectID)}
+	for _, name := range req.props {
+		value, isSet := req.setValues[name]
+		switch {
+		case name == davDisplayName && isSet && value != "":
+			if _, err := db.Exec("UPDATE projects SET title = ? WHERE id = ?", value, res.projectID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.found = append(response.found, davElement(name, ""))
+		case name == davCalendarOrder && isSet:
+			position, err := strconv.Atoi(value)
+			if err != nil {
+				response.forbidden = append(response.forbidden, name)
+				continue
+			}
+			if _, err := db.Exec("UPDATE projects SET position = ? WHERE id = ?", position, res.projectID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.found = append(response.found, davElement(name, ""))
+		default:
+			response.forbidden = append(response.forbidden, name)
+		}
+	}
+
+	writeMultistatus(w, []davResponse{response}, "")
+}
+
+func davReport(w http.ResponseWriter, r *http.Request, res davResource) {
+	if res.kind != davCalendar {
+		http.Error(w, "Reports are only supported on project calendars", http.StatusForbidden)
+		return
+	}
+	req, err := parseDAVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.root {
+	case davName(calDAVNamespace, "calendar-query"):
+		// Only VTODO is stored; time ranges and other filters are not
+		// applied, which RFC 4791 allows since clients filter again
+		for _, component := range req.compFilter {
+			if component != "VCALENDAR" && component != "VTODO" {
+				writeMultistatus(w, nil, "")
+				return
+			}
+		}
+		todos, err := queryDAVTodos("t.project_id = ?", res.projectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responses := make([]davResponse, 0, len(todos))
+		for _, todo := range todos {
+			responses = append(responses, objectContext(todo).response(req))
+		}
+		writeMultistatus(w, responses, "")
+
+	case davName(calDAVNamespace, "calendar-multiget"):
+		responses := make([]davResponse, 0, len(req.hrefs))
+		for _, href := range req.hrefs {
+			target, ok := parseDAVPath(hrefPath(href))
+			if !ok || target.kind != davObject || target.projectID != res.projectID {
+				responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+				continue
+			}
+			todo, err := findDAVTodo(target.projectID, target.name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if todo == nil {
+				responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+				continue
+			}
+			responses = append(responses, objectContext(*todo).response(req))
+		}
+		writeMultistatus(w, responses, "")
+
+	case davName("DAV:", "sync-collection"):
+		davSyncCollection(w, req, res.projectID)
+
+	default:
+		http.Error(w, "Unsupported report", http.StatusForbidden)
+	}
+}
+
+// hrefPath accepts both absolute URLs and paths in multiget hrefs, and
+// takes off the base path the app is served under.
+func hrefPath(href string) string {
+	if u, err := url.Parse(href); err == nil {
+		href = u.EscapedPath()
+	}
+	return strings.TrimPrefix(href, config.basePath)
+}
+
+// davSyncCollection reports todos changed or deleted since the client's
+// sync token, or every todo for an initial sync (RFC 6578).
+func davSyncCollection(w http.ResponseWriter, req davRequest, projectID int) {
+	syncToken, latest, floor, err := davSyncToken(projectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.syncToken == "" {
+		todos, err := queryDAVTodos("t.project_id = ?", projectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responses := make([]davResponse, 0, len(todos))
+		for _, todo := range todos {
+			responses = append(responses, objectContext(todo).response(req))
+		}
+		writeMultistatus(w, responses, syncToken)
+		return
+	}
+
+	// Clients with a token from before the pruned tombstones sync again
+	since, err := strconv.Atoi(strings.TrimPrefix(req.syncToken, davSyncTokenPrefix))
+	if err != nil || !strings.HasPrefix(req.syncToken, davSyncTokenPrefix) || since > latest || since < floor {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`)
+		return
+	}
+
+	// Only the latest change of each resource name is kept
+	rows, err := db.Query("SELECT todo_id, name, deleted FROM dav_changes WHERE project_id = ? AND id > ? ORDER BY id", projectID, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type change struct {
+		todoID  int
+		name    string
+		deleted bool
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.todoID, &c.name, &c.deleted); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+
+	responses := make([]davResponse, 0, len(changes))
+	for _, c := range changes {
+		href := davObjectHref(projectID, c.name)
+		if c.deleted {
+			responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+			continue
+		}
+		todo, err := findDAVTodo(projectID, c.name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if todo == nil {
+			responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+			continue
+		}
+		responses = append(responses, objectContext(*todo).response(req))
+	}
+	writeMultistatus(w, responses, syncToken)
+}
+
+func davGet(w http.ResponseWriter, r *http.Request, res davResource) {
+	if res.kind != davObject {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	todo, err := findDAVTodo(res.projectID, res.name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if todo == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", todo.etag)
+	io.WriteString(w, todo.calendarData())
+}
+
+// checkDAVPreconditions applies If-Match and If-None-Match to a PUT or
+// DELETE, so clients do not overwrite changes they have not seen.
+func checkDAVPreconditions(w http.ResponseWriter, r *http.Request, existing *davTodo) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if existing == nil || (ifMatch != "*" && ifMatch != existing.etag) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && existing != nil {
+		if ifNoneMatch == "*" || ifNoneMatch == existing.etag {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+// davTodoFields is what a VTODO maps to in the todos table.
+type davTodoFields struct {
+	uid                string
+	title              string
+	completed          bool
+	completedAt        *time.Time
+	dueDate            *time.Time
+	allDay             bool
+	recurrenceInterval *int
+	recurrenceUnit     *string
+	position           *int
+	priority           int
+	notes              string
+	parentUID          string
+}
+
+// recurrenceFromRule maps an RRULE to the recurrence columns. Parts the app
+// cannot represent (BYDAY, COUNT, ...) are dropped.
+func recurrenceFromRule(value string) (*int, *string) {
+	rule, err := ical.ParseRecurrenceRule(value)
+	if err != nil {
+		return nil, nil
+	}
+	var unit string
+	switch rule.Freq {
+	case "DAILY":
+		unit = "days"
+	case "WEEKLY":
+		unit = "weeks"
+	case "MONTHLY":
+		unit = "months"
+	case "YEARLY":
+		unit = "years"
+	default:
+		return nil, nil
+	}
+	interval := rule.Interval
+	return &interval, &unit
+}
+
+// todoFieldsFromVTODO maps a VTODO onto todo fields. Floating times are read
+// in loc.
+func todoFieldsFromVTODO(vtodo *ical.Component, loc *time.Location) davTodoFields {
+	fields := davTodoFields{
+		uid:   vtodo.Text("UID"),
+		title: strings.TrimSpace(vtodo.Text("SUMMARY")),
+	}
+	if fields.title == "" {
+		fields.title = "Untitled"
+	}
+
+	status := strings.ToUpper(vtodo.Text("STATUS"))
+	fields.completed = status == "COMPLETED" || vtodo.Text("PERCENT-COMPLETE") == "100" ||
+		(vtodo.Prop("COMPLETED") != nil && status != "NEEDS-ACTION" && status != "IN-PROCESS")
+	if completed := vtodo.Prop("COMPLETED"); fields.completed && completed != nil {
+		if t, _, err := completed.DateTime(loc); err == nil {
+			t = t.UTC()
+			fields.completedAt = &t
+		}
+	}
+
+	if due := vtodo.Prop("DUE"); due != nil {
+		if t, allDay, err := due.DateTime(loc); err == nil {
+			if allDay {
+				t = allDayDueDate(t)
+			}
+			t = t.UTC()
+			fields.dueDate = &t
+			fields.allDay = allDay
+		}
+	}
+
+	if rrule := vtodo.Prop("RRULE"); rrule != nil {
+		fields.recurrenceInterval, fields.recurrenceUnit = recurrenceFromRule(rrule.Value)
+	}
+
+	if priority, err := strconv.Atoi(strings.TrimSpace(vtodo.Text("PRIORITY"))); err == nil && priority >= 0 && priority <= 9 {
+		fields.priority = priority
+	}
+
+	if order := vtodo.Prop("X-APPLE-SORT-ORDER"); order != nil {
+		if position, err := strconv.Atoi(strings.TrimSpace(order.Value)); err == nil {
+			fields.position = &position
+		}
+	}
+
+	fields.notes = strings.TrimSpace(vtodo.Text("DESCRIPTION"))
+
+	// RELATED-TO points at the parent unless RELTYPE says otherwise
+	for _, related := range vtodo.Props("RELATED-TO") {
+		if reltype := strings.ToUpper(related.Param("RELTYPE")); reltype == "" || reltype == "PARENT" {
+			fields.parentUID = strings.TrimSpace(related.Value)
+			break
+		}
+	}
+	return fields
+}
+
+// findVTODO returns the master VTODO of a calendar object. Overrides of
+// single occurrences (RECURRENCE-ID) are ignored.
+func findVTODO(components []*ical.Component) *ical.Component {
+	for _, calendar := range components {
+		for _, vtodo := range calendar.Components("VTODO") {
+			if vtodo.Prop("RECURRENCE-ID") == nil {
+				return vtodo
+			}
+		}
+	}
+	return nil
+}
+
+func dbDateTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func davPut(w http.ResponseWriter, r *http.Request, res davResource) {
+	if res.kind != davObject {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	components, err := ical.Parse(io.LimitReader(r.Body, davMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid calendar data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	vtodo := findVTODO(components)
+	if vtodo == nil {
+		http.Error(w, "Only VTODO components are supported", http.StatusForbidden)
+		return
+	}
+	fields := todoFieldsFromVTODO(vtodo, time.Local)
+	if fields.uid == "" {
+		http.Error(w, "VTODO without UID", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := findDAVTodo(res.projectID, res.name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkDAVPreconditions(w, r, existing) {
+		return
+	}
+
+	// A UID names one resource per task list (RFC 4791 no-uid-conflict), so
+	// a client that sends a todo again under another name is turned away
+	// rather than creating a copy
+	excludeID := 0
+	if existing != nil {
+		excludeID = existing.ID
+	}
+	var conflict string
+	err = db.QueryRow(
+		"SELECT COALESCE(dav_name, 'todo-' || id || '.ics') FROM todos WHERE project_id = ? AND uid = ? AND id != ? LIMIT 1",
+		res.projectID, fields.uid, excludeID,
+	).Scan(&conflict)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<d:error xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><c:no-uid-conflict><d:href>`+
+			xmlEscape(davObjectHref(res.projectID, conflict))+`</d:href></c:no-uid-conflict></d:error>`)
+		return
+	} else if err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Parents are looked up in the same task list
+	var parentID *int
+	if fields.parentUID != "" && fields.parentUID != fields.uid {
+		var id int
+		err := tx.QueryRow("SELECT id FROM todos WHERE uid = ? AND project_id = ?", fields.parentUID, res.projectID).Scan(&id)
+		if err == nil {
+			parentID = &id
+		} else if err != sql.ErrNoRows {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	var todoID int64
+	if existing == nil {
+		// New todos go to the bottom of the project, like imported ones
+		position := fields.position
+		if position == nil {
+			var next int
+			if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE project_id = ?", res.projectID).Scan(&next); err != nil {
+				tx.Rollback()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			position = &next
+		}
+		completedAt := fields.completedAt
+		if fields.completed && completedAt == nil {
+			now := time.Now().UTC()
+			completedAt = &now
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO todos (title, completed, completed_at, due_date, all_day, recurrence_interval, recurrence_unit, project_id, position, uid, dav_name, priority, notes, parent_id)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			fields.title, fields.completed, dbDateTime(completedAt), dbDateTime(fields.dueDate), fields.allDay,
+			fields.recurrenceInterval, fields.recurrenceUnit, res.projectID, *position, fields.uid, res.name, fields.priority,
+			fields.notes, parentID,
+		)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		todoID, err = result.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		status = http.StatusNoContent
+		todoID = int64(existing.ID)
+
+		completedAt := fields.completedAt
+		if fields.completed && completedAt == nil {
+			completedAt = existing.CompletedAt
+			if completedAt == nil {
+				now := time.Now().UTC()
+				completedAt = &now
+			}
+		}
+		if !fields.completed {
+			completedAt = nil
+		}
+		position := existing.Position
+		if fields.position != nil {
+			position = *fields.position
+		}
+
+		_, err := tx.Exec(
+			`UPDATE todos SET title = ?, completed = ?, completed_at = ?, due_date = ?, all_day = ?, recurrence_interval = ?,
+			 recurrence_unit = ?, position = ?, uid = ?, priority = ?, notes = ?, parent_id = ? WHERE id = ?`,
+			fields.title, fields.completed, dbDateTime(completedAt), dbDateTime(fields.dueDate), fields.allDay,
+			fields.recurrenceInterval, fields.recurrenceUnit, position, fields.uid, fields.priority,
+			fields.notes, parentID, existing.ID,
+		)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Offset reminders follow the due date, so they fire again once it moves
+		if dbDateTime(existing.DueDate) != dbDateTime(fields.dueDate) {
+			if _, err := tx.Exec("UPDATE reminders SET sent_at = NULL WHERE todo_id = ? AND offset_minutes IS NOT NULL", existing.ID); err != nil {
+				tx.Rollback()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Completing a recurring todo adds its next occurrence, as in the app
+		if fields.completed && !existing.Completed && fields.recurrenceInterval != nil && fields.recurrenceUnit != nil {
+			if err := createNextOccurrence(tx, existing.ID, fields.dueDate, *fields.recurrenceInterval, *fields.recurrenceUnit); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to create next recurring todo: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	todos, err := queryDAVTodos("t.id = ?", todoID)
+	if err == nil && len(todos) == 1 {
+		w.Header().Set("ETag", todos[0].etag)
+	}
+	w.WriteHeader(status)
+}
+
+func davDelete(w http.ResponseWriter, r *http.Request, res davResource) {
+	if res.kind != davObject {
+		http.Error(w, "Projects cannot be deleted through CalDAV", http.StatusForbidden)
+		return
+	}
+
+	existing, err := findDAVTodo(res.projectID, res.name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkDAVPreconditions(w, r, existing) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM todos WHERE id = ?", existing.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
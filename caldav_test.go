@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const davTestCalendar = "/dav/projects/1/"
+
+func davRequestTo(t *testing.T, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	davHandler(w, r)
+	return w
+}
+
+func vtodoBody(uid, extra string) string {
+	return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VTODO\r\nUID:" + uid + "\r\nSUMMARY:Water the plants\r\n" +
+		extra + "END:VTODO\r\nEND:VCALENDAR\r\n"
+}
+
+func putVTODO(t *testing.T, name, uid, extra string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	return davRequestTo(t, http.MethodPut, davTestCalendar+name, vtodoBody(uid, extra), header)
+}
+
+func TestDAVPutPreconditions(t *testing.T) {
+	openTestDatabase(t)
+
+	created := putVTODO(t, "plants.ics", "plants", "", map[string]string{"If-None-Match": "*"})
+	if created.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d: %s", created.Code, http.StatusCreated, created.Body)
+	}
+	etag := created.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("create returned no ETag")
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"create over existing", map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"If-None-Match current etag", map[string]string{"If-None-Match": etag}, http.StatusPreconditionFailed},
+		{"If-Match stale etag", map[string]string{"If-Match": `"stale"`}, http.StatusPreconditionFailed},
+		{"If-Match current etag", map[string]string{"If-Match": etag}, http.StatusNoContent},
+		// The update above changed the ETag
+		{"If-Match etag before update", map[string]string{"If-Match": etag}, http.StatusPreconditionFailed},
+		{"If-Match any", map[string]string{"If-Match": "*"}, http.StatusNoContent},
+		{"unconditional", nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each write changes the notes, and with them the ETag
+			w := putVTODO(t, "plants.ics", "plants", "DESCRIPTION:"+tt.name+"\r\n", tt.header)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	if w := putVTODO(t, "new.ics", "new", "", map[string]string{"If-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match on a missing todo: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	current := davRequestTo(t, http.MethodGet, davTestCalendar+"plants.ics", "", nil).Header().Get("ETag")
+	if w := davRequestTo(t, http.MethodDelete, davTestCalendar+"plants.ics", "", map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with stale etag: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := davRequestTo(t, http.MethodDelete, davTestCalendar+"plants.ics", "", map[string]string{"If-Match": current}); w.Code != http.StatusNoContent {
+		t.Errorf("delete with current etag: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestDAVPutUIDConflict(t *testing.T) {
+	openTestDatabase(t)
+
+	if w := putVTODO(t, "first.ics", "shared-uid", "", nil); w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+
+	w := putVTODO(t, "second.ics", "shared-uid", "", nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "no-uid-conflict") || !strings.Contains(body, davTestCalendar+"first.ics") {
+		t.Errorf("conflict body does not name the existing resource: %s", body)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos WHERE uid = 'shared-uid'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d todos with the UID, want 1", count)
+	}
+
+	// The same resource may be written again with its own UID
+	if w := putVTODO(t, "first.ics", "shared-uid", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("update status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+var syncTokenPattern = regexp.MustCompile(`<d:sync-token>([^<]+)</d:sync-token>`)
+
+// syncCollection runs a sync-collection report and returns the status, the
+// new sync token and the body.
+func syncCollection(t *testing.T, token string) (int, string, string) {
+	t.Helper()
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:sync-collection xmlns:d="DAV:"><d:sync-token>` + token + `</d:sync-token><d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`
+	w := davRequestTo(t, "REPORT", davTestCalendar, body, nil)
+	newToken := ""
+	if m := syncTokenPattern.FindStringSubmatch(w.Body.String()); m != nil {
+		newToken = m[1]
+	}
+	return w.Code, newToken, w.Body.String()
+}
+
+func TestDAVSyncCollectionAfterDelete(t *testing.T) {
+	openTestDatabase(t)
+
+	for _, name := range []string{"keep", "gone"} {
+		if w := putVTODO(t, name+".ics", name, "", nil); w.Code != http.StatusCreated {
+			t.Fatalf("create %s: status = %d: %s", name, w.Code, w.Body)
+		}
+	}
+
+	status, token, body := syncCollection(t, "")
+	if status != http.StatusMultiStatus || token == "" {
+		t.Fatalf("initial sync: status = %d, token %q: %s", status, token, body)
+	}
+	if !strings.Contains(body, "keep.ics") || !strings.Contains(body, "gone.ics") {
+		t.Fatalf("initial sync does not list both todos: %s", body)
+	}
+
+	if w := davRequestTo(t, http.MethodDelete, davTestCalendar+"gone.ics", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d", w.Code)
+	}
+
+	status, next, body := syncCollection(t, token)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("delta sync: status = %d: %s", status, body)
+	}
+	if next == token {
+		t.Error("sync token did not change after a delete")
+	}
+	if strings.Contains(body, "keep.ics") {
+		t.Errorf("delta lists an unchanged todo: %s", body)
+	}
+	if !strings.Contains(body, "gone.ics") || !strings.Contains(body, "404") {
+		t.Errorf("delta does not report the deleted todo as gone: %s", body)
+	}
+
+	status, _, body = syncCollection(t, next)
+	if status != http.StatusMultiStatus || strings.Contains(body, ".ics") {
+		t.Errorf("sync with the latest token: status = %d, want no changes: %s", status, body)
+	}
+
+	if status, _, _ := syncCollection(t, davSyncTokenPrefix+"999999"); status != http.StatusForbidden {
+		t.Errorf("sync with an unknown token: status = %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestDAVCompleteRecurringTodo(t *testing.T) {
+	openTestDatabase(t)
+
+	due := time.Now().UTC().AddDate(0, 0, 1).Truncate(time.Second)
+	rule := "DUE:" + due.Format("20060102T150405Z") + "\r\nRRULE:FREQ=WEEKLY;INTERVAL=1\r\n"
+	if w := putVTODO(t, "weekly.ics", "weekly", rule, nil); w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+
+	completed := rule + "STATUS:COMPLETED\r\nCOMPLETED:" + time.Now().UTC().Format("20060102T150405Z") + "\r\n"
+	if w := putVTODO(t, "weekly.ics", "weekly", completed, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("complete status = %d: %s", w.Code, w.Body)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos WHERE completed = 0").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d open occurrences, want 1", count)
+	}
+	var nextDue time.Time
+	if err := db.QueryRow("SELECT due_date FROM todos WHERE completed = 0").Scan(&nextDue); err != nil {
+		t.Fatal(err)
+	}
+	if want := due.AddDate(0, 0, 7); !nextDue.Equal(want) {
+		t.Errorf("next occurrence due %v, want %v", nextDue, want)
+	}
+
+	// Sending the completed todo again does not add another occurrence
+	if w := putVTODO(t, "weekly.ics", "weekly", completed, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("repeat status = %d", w.Code)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos WHERE completed = 0").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d open occurrences after repeating the completion, want 1", count)
+	}
+}
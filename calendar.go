@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const icsProductID = "-//BeringLogic//todo-app//EN"
+
+// icsWriter builds iCalendar text with CRLF line endings, folding content
+// lines longer than 75 octets as RFC 5545 requires.
+type icsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *icsWriter) line(name, value string) {
+	content := name + ":" + value
+	for len(content) > 75 {
+		cut := 75
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		w.buf.WriteString(content[:cut])
+		w.buf.WriteString("\r\n ")
+		content = content[cut:]
+	}
+	w.buf.WriteString(content)
+	w.buf.WriteString("\r\n")
+}
+
+func (w *icsWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// icsEscapeText escapes a TEXT property value.
+func icsEscapeText(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, ";", "\\;")
+	s = strings.ReplaceAll(s, ",", "\\,")
+	s = strings.ReplaceAll(s, "\r\n", "\\n")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	return s
+}
+
+func icsDateTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsRecurrenceRule maps the todo recurrence columns to an RRULE value, or
+// returns "" when the todo does not repeat.
+func icsRecurrenceRule(interval *int, unit *string) string {
+	if interval == nil || unit == nil || *interval <= 0 {
+		return ""
+	}
+
+	var freq string
+	switch strings.ToLower(*unit) {
+	case "day", "days":
+		freq = "DAILY"
+	case "week", "weeks":
+		freq = "WEEKLY"
+	case "month", "months":
+		freq = "MONTHLY"
+	case "year", "years":
+		freq = "YEARLY"
+	default:
+		return ""
+	}
+
+	if *interval == 1 {
+		return "FREQ=" + freq
+	}
+	return fmt.Sprintf("FREQ=%s;INTERVAL=%d", freq, *interval)
+}
+
+// dateProperty writes a DATE property for an all-day due date, which is
+// stored as midnight UTC, and a DATE-TIME property otherwise.
+func (w *icsWriter) dateProperty(name string, t time.Time, allDay bool) {
+	if allDay {
+		w.line(name+";VALUE=DATE", t.UTC().Format("20060102"))
+	} else {
+		w.line(name, icsDateTime(t))
+	}
+}
+
+func generateUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b) + "@todo-app", nil
+}
+
+// ensureTodoUID gives a todo a UID the first time it is exported, so
+// calendar clients see the same item on every refresh.
+func ensureTodoUID(todo *Todo) error {
+	if todo.UID != "" {
+		return nil
+	}
+	uid, err := generateUID()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE todos SET uid = ? WHERE id = ? AND (uid IS NULL OR uid = '')", uid, todo.ID); err != nil {
+		return err
+	}
+	todo.UID = uid
+	return nil
+}
+
+// writeVTODO writes a todo as a VTODO component.
+func (w *icsWriter) writeVTODO(todo Todo, uid string, stamp time.Time) {
+	w.line("BEGIN", "VTODO")
+	w.line("UID", uid)
+	w.line("DTSTAMP", icsDateTime(stamp))
+	w.line("CREATED", icsDateTime(todo.CreatedAt))
+	w.line("SUMMARY", icsEscapeText(todo.Title))
+	if todo.Notes != "" {
+		w.line("DESCRIPTION", icsEscapeText(todo.Notes))
+	}
+	if todo.ParentUID != "" {
+		w.line("RELATED-TO", todo.ParentUID)
+	}
+	if todo.DueDate != nil {
+		w.dateProperty("DUE", *todo.DueDate, todo.AllDay)
+	}
+	if rrule := icsRecurrenceRule(todo.RecurrenceInterval, todo.RecurrenceUnit); rrule != "" {
+		w.line("RRULE", rrule)
+	}
+	if todo.Priority > 0 {
+		w.line("PRIORITY", strconv.Itoa(todo.Priority))
+	}
+	if todo.Completed {
+		w.line("STATUS", "COMPLETED")
+		if todo.CompletedAt != nil {
+			w.line("COMPLETED", icsDateTime(*todo.CompletedAt))
+		}
+		w.line("PERCENT-COMPLETE", "100")
+	} else {
+		w.line("STATUS", "NEEDS-ACTION")
+	}
+	w.line("END", "VTODO")
+}
+
+// writeVEVENT writes a todo with a due date as a VEVENT at its due time, or
+// as an all-day event when it has no time of day.
+func (w *icsWriter) writeVEVENT(todo Todo, uid string, stamp time.Time) {
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", uid)
+	w.line("DTSTAMP", icsDateTime(stamp))
+	w.line("CREATED", icsDateTime(todo.CreatedAt))
+	w.line("SUMMARY", icsEscapeText(todo.Title))
+	if todo.Notes != "" {
+		w.line("DESCRIPTION", icsEscapeText(todo.Notes))
+	}
+	w.dateProperty("DTSTART", *todo.DueDate, todo.AllDay)
+	if rrule := icsRecurrenceRule(todo.RecurrenceInterval, todo.RecurrenceUnit); rrule != "" {
+		w.line("RRULE", rrule)
+	}
+	w.line("TRANSP", "TRANSPARENT")
+	w.line("END", "VEVENT")
+}
+
+// findProjectForCalendar looks a project up by id or, failing that, by
+// case-insensitive title.
+func findProjectForCalendar(ref string) (Project, error) {
+	var project Project
+	if id, err := strconv.Atoi(ref); err == nil {
+		err := db.QueryRow("SELECT id, title FROM projects WHERE id = ?", id).Scan(&project.ID, &project.Title)
+		if err != sql.ErrNoRows {
+			return project, err
+		}
+	}
+	err := db.QueryRow("SELECT id, title FROM projects WHERE title = ? COLLATE NOCASE", ref).Scan(&project.ID, &project.Title)
+	return project, err
+}
+
+// calendarHandler serves /calendar/{project|all}.ics. The "type" query
+// parameter selects "event" (default), "todo" or "both" components, and
+// "completed=true" includes completed todos.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	ref, ok := strings.CutSuffix(r.PathValue("file"), ".ics")
+	if !ok || ref == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	componentType := r.URL.Query().Get("type")
+	if componentType == "" {
+		componentType = "event"
+	}
+	if componentType != "event" && componentType != "todo" && componentType != "both" {
+		http.Error(w, "type must be event, todo or both", http.StatusBadRequest)
+		return
+	}
+	includeCompleted := r.URL.Query().Get("completed") == "true"
+
+	query := `
+		SELECT t.id, t.title, t.completed, t.created_at, t.completed_at, datetime(t.due_date), t.all_day,
+		       t.recurrence_interval, t.recurrence_unit, t.project_id, t.position, COALESCE(t.uid, ''), t.priority,
+		       t.notes, COALESCE((SELECT p.uid FROM todos p WHERE p.id = t.parent_id), '')
+		FROM todos t
+		WHERE t.due_date IS NOT NULL`
+	args := []interface{}{}
+	if !includeCompleted {
+		query += " AND t.completed = 0"
+	}
+
+	calendarName := "Todo App"
+	if ref != "all" {
+		project, err := findProjectForCalendar(ref)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		calendarName = project.Title
+		query += " AND t.project_id = ?"
+		args = append(args, project.ID)
+	}
+	query += " ORDER BY t.project_id, t.position"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var todos []Todo
+	for rows.Next() {
+		var todo Todo
+		var dueDateStr sql.NullString
+		if err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.Completed,
+			&todo.CreatedAt,
+			&todo.CompletedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.ProjectID,
+			&todo.Position,
+			&todo.UID,
+			&todo.Priority,
+			&todo.Notes,
+			&todo.ParentUID,
+		); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil || todo.DueDate == nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+			continue
+		}
+		todos = append(todos, todo)
+	}
+	rows.Close()
+
+	stamp := time.Now().UTC()
+	var ics icsWriter
+	ics.line("BEGIN", "VCALENDAR")
+	ics.line("VERSION", "2.0")
+	ics.line("PRODID", icsProductID)
+	ics.line("CALSCALE", "GREGORIAN")
+	ics.line("X-WR-CALNAME", icsEscapeText(calendarName))
+	for _, todo := range todos {
+		if err := ensureTodoUID(&todo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch componentType {
+		case "event":
+			ics.writeVEVENT(todo, todo.UID, stamp)
+		case "todo":
+			ics.writeVTODO(todo, todo.UID, stamp)
+		case "both":
+			// UIDs must be unique within a calendar, so the event gets its own
+			ics.writeVTODO(todo, todo.UID, stamp)
+			ics.writeVEVENT(todo, "event-"+todo.UID, stamp)
+		}
+	}
+	ics.line("END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", ref+".ics"))
+	w.Write(ics.bytes())
+}
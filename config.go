@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Features that can be turned off with DISABLED_FEATURES or -disable.
+const (
+	featureCalDAV           = "caldav"
+	featureCalendarFeeds    = "calendar_feeds"
+	featureICSSubscriptions = "ics_subscriptions"
+	featureReminders        = "reminders"
+	featurePush             = "push"
+)
+
+var features = []string{featureCalDAV, featureCalendarFeeds, featureICSSubscriptions, featureReminders, featurePush}
+
+// Config is the server's configuration. Settings are read, each overriding
+// the one before, from the defaults, the JSON config file named by -config
+// or CONFIG_FILE, the environment and the command line flags.
+type Config struct {
+	Listen string `json:"listen"`
+	DBPath string `json:"db_path"`
+	// BaseURL is where the app is reached, e.g. https://example.com/todo or
+	// just /todo, when it is served under a path behind a reverse proxy
+	BaseURL  string `json:"base_url,omitempty"`
+	LogLevel string `json:"log_level"`
+	// Refresh interval in minutes new ICS subscriptions start with; each
+	// subscription keeps its own afterwards
+	DefaultIcsRefreshInterval int `json:"default_ics_refresh_interval"`
+	// Time zone of the server, used for all-day dates, the digest and
+	// scheduled snapshots. Empty keeps the system's, or the one TZ names.
+	TimeZone         string         `json:"time_zone,omitempty"`
+	DisabledFeatures []string       `json:"disabled_features,omitempty"`
+	SecretKey        string         `json:"secret_key,omitempty"`
+	VAPIDSubject     string         `json:"vapid_subject,omitempty"`
+	Digest           DigestConfig   `json:"digest"`
+	Snapshots        SnapshotConfig `json:"snapshots"`
+
+	// basePath is the path of BaseURL without a trailing slash, "" at the
+	// root
+	basePath string
+}
+
+// config is the configuration the server was started with.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Listen:                    ":8081",
+		DBPath:                    "./data/todos.db",
+		LogLevel:                  "info",
+		DefaultIcsRefreshInterval: icsDefaultRefreshInterval,
+		VAPIDSubject:              defaultVAPIDSubject,
+		Digest: DigestConfig{
+			SendAt: "07:00",
+			Days:   defaultAgendaDays,
+		},
+		Snapshots: SnapshotConfig{
+			Dir:        "./data/snapshots",
+			KeepDaily:  7,
+			KeepWeekly: 4,
+		},
+	}
+}
+
+// loadConfig reads the configuration for the command line args, and returns
+// the args left after the flags.
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("todo-app", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: todo-app [flags] [snapshot [path]]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON config `file` (CONFIG_FILE)")
+	listen := fs.String("listen", cfg.Listen, "`address` to listen on (LISTEN_ADDR)")
+	dbPath := fs.String("db", cfg.DBPath, "`path` of the SQLite database (DB_PATH)")
+	baseURL := fs.String("base-url", "", "`URL` or path the app is served under (BASE_URL)")
+	logLevel := fs.String("log-level", cfg.LogLevel, "log `level`: debug, info, warn or error (LOG_LEVEL)")
+	defaultIcsRefreshInterval := fs.Int("default-ics-refresh-interval", cfg.DefaultIcsRefreshInterval, "refresh interval in `minutes` new ICS subscriptions start with (DEFAULT_ICS_REFRESH_INTERVAL)")
+	timeZone := fs.String("tz", "", "time `zone` of the server, e.g. Europe/Paris (TIME_ZONE)")
+	disable := fs.String("disable", "", "comma-separated `features` to turn off: "+strings.Join(features, ", ")+" (DISABLED_FEATURES)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return cfg, nil, fmt.Errorf("reading config file %s: %v", *configFile, err)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "db":
+			cfg.DBPath = *dbPath
+		case "base-url":
+			cfg.BaseURL = *baseURL
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "default-ics-refresh-interval":
+			cfg.DefaultIcsRefreshInterval = *defaultIcsRefreshInterval
+		case "tz":
+			cfg.TimeZone = *timeZone
+		case "disable":
+			cfg.DisabledFeatures = splitList(*disable)
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile reads a JSON config file. Settings it leaves out keep their
+// value, and unknown ones are an error so that typos do not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// loadEnv reads the environment variables that are set and not empty.
+func (c *Config) loadEnv() error {
+	stringVars := map[string]*string{
+		"LISTEN_ADDR":   &c.Listen,
+		"DB_PATH":       &c.DBPath,
+		"BASE_URL":      &c.BaseURL,
+		"LOG_LEVEL":     &c.LogLevel,
+		"TIME_ZONE":     &c.TimeZone,
+		"SECRET_KEY":    &c.SecretKey,
+		"VAPID_SUBJECT": &c.VAPIDSubject,
+		"SMTP_HOST":     &c.Digest.SMTP.Host,
+		"SMTP_USERNAME": &c.Digest.SMTP.Username,
+		"SMTP_PASSWORD": &c.Digest.SMTP.Password,
+		"SMTP_FROM":     &c.Digest.SMTP.From,
+		"DIGEST_TIME":   &c.Digest.SendAt,
+		"SNAPSHOT_DIR":  &c.Snapshots.Dir,
+		"SNAPSHOT_TIME": &c.Snapshots.Time,
+	}
+	for name, value := range stringVars {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+
+	intVars := map[string]*int{
+		"DEFAULT_ICS_REFRESH_INTERVAL": &c.DefaultIcsRefreshInterval,
+		"SMTP_PORT":                    &c.Digest.SMTP.Port,
+		"DIGEST_DAYS":                  &c.Digest.Days,
+		"SNAPSHOT_KEEP_DAILY":          &c.Snapshots.KeepDaily,
+		"SNAPSHOT_KEEP_WEEKLY":         &c.Snapshots.KeepWeekly,
+	}
+	for name, value := range intVars {
+		if env := os.Getenv(name); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", name, env, err)
+			}
+			*value = n
+		}
+	}
+
+	if env := os.Getenv("SMTP_TLS"); env != "" {
+		tls, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP_TLS %q: %v", env, err)
+		}
+		c.Digest.SMTP.TLS = tls
+	}
+	if env := os.Getenv("DIGEST_TO"); env != "" {
+		c.Digest.SMTP.To = splitList(env)
+	}
+	if env := os.Getenv("DISABLED_FEATURES"); env != "" {
+		c.DisabledFeatures = splitList(env)
+	}
+	return nil
+}
+
+// validate checks the settings and works out the base path. An invalid
+// setting stops the server from starting rather than being ignored.
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen address must not be empty")
+	}
+	if c.DBPath == "" {
+		return fmt.Errorf("database path must not be empty")
+	}
+
+	c.basePath = ""
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil {
+			return fmt.Errorf("invalid base URL %q: %v", c.BaseURL, err)
+		}
+		if (u.Scheme != "" || u.Host != "") && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+			return fmt.Errorf("invalid base URL %q: must be an http or https URL or a path", c.BaseURL)
+		}
+		if u.Host == "" && !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("invalid base URL %q: a path must start with /", c.BaseURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid base URL %q: must not have a query or fragment", c.BaseURL)
+		}
+		c.basePath = strings.TrimRight(u.Path, "/")
+	}
+
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("invalid log level %q: must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.DefaultIcsRefreshInterval < icsMinRefreshInterval {
+		return fmt.Errorf("default ICS refresh interval must be at least %d minutes", icsMinRefreshInterval)
+	}
+	if c.TimeZone != "" {
+		if _, err := time.LoadLocation(c.TimeZone); err != nil {
+			return fmt.Errorf("invalid time zone %q: %v", c.TimeZone, err)
+		}
+	}
+	for _, feature := range c.DisabledFeatures {
+		if !slices.Contains(features, feature) {
+			return fmt.Errorf("unknown feature %q: must be one of %s", feature, strings.Join(features, ", "))
+		}
+	}
+
+	if c.Digest.enabled() {
+		if _, err := time.Parse("15:04", c.Digest.SendAt); err != nil {
+			return fmt.Errorf("invalid digest time %q: must be HH:MM", c.Digest.SendAt)
+		}
+	}
+	if c.Digest.Days < 0 || c.Digest.Days > maxAgendaDays {
+		return fmt.Errorf("digest days must be from 0 to %d", maxAgendaDays)
+	}
+	if c.Snapshots.Dir == "" {
+		return fmt.Errorf("snapshot directory must not be empty")
+	}
+	if c.Snapshots.enabled() {
+		if _, err := time.Parse("15:04", c.Snapshots.Time); err != nil {
+			return fmt.Errorf("invalid snapshot time %q: must be HH:MM", c.Snapshots.Time)
+		}
+	}
+	if c.Snapshots.KeepDaily < 0 || c.Snapshots.KeepWeekly < 0 {
+		return fmt.Errorf("number of snapshots to keep must not be negative")
+	}
+	if c.Snapshots.enabled() && c.Snapshots.KeepDaily == 0 && c.Snapshots.KeepWeekly == 0 {
+		return fmt.Errorf("scheduled snapshots need daily or weekly snapshots to keep")
+	}
+	return nil
+}
+
+// apply puts the settings that are global to the process into effect.
+func (c Config) apply() {
+	if c.TimeZone != "" {
+		loc, _ := time.LoadLocation(c.TimeZone)
+		time.Local = loc
+	}
+	setLogLevel(logLevels[c.LogLevel])
+}
+
+// enabled reports whether a feature is turned on.
+func (c Config) enabled(feature string) bool {
+	return !slices.Contains(c.DisabledFeatures, feature)
+}
+
+// appURL is the absolute URL of the app, or "" when BaseURL is not one.
+func (c Config) appURL() string {
+	if !strings.HasPrefix(c.BaseURL, "http://") && !strings.HasPrefix(c.BaseURL, "https://") {
+		return ""
+	}
+	return strings.TrimRight(c.BaseURL, "/") + "/"
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Default number of days, after today, listed as upcoming in the agenda
+const defaultAgendaDays = 7
+
+// The most days ahead an agenda lists, which keeps its query bounded
+const maxAgendaDays = 366
+
+type AgendaProject struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	Overdue  []Todo `json:"overdue"`
+	DueToday []Todo `json:"due_today"`
+	Upcoming []Todo `json:"upcoming"`
+}
+
+type Agenda struct {
+	Date         string          `json:"date"`
+	TimeZone     string          `json:"time_zone"`
+	UpcomingDays int             `json:"upcoming_days"`
+	GeneratedAt  time.Time       `json:"generated_at"`
+	Projects     []AgendaProject `json:"projects"`
+	// AppURL links the digest email to the app when the base URL is known
+	AppURL   string `json:"-"`
+	location *time.Location
+}
+
+func (a Agenda) empty() bool {
+	return len(a.Projects) == 0
+}
+
+// buildAgenda groups incomplete todos with a due date by project into
+// overdue, due today and upcoming, using day boundaries in loc.
+func buildAgenda(now time.Time, loc *time.Location, upcomingDays int) (Agenda, error) {
+	now = now.In(loc)
+	startOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	startOfTomorrow := startOfToday.AddDate(0, 0, 1)
+	endOfUpcoming := startOfTomorrow.AddDate(0, 0, upcomingDays)
+
+	agenda := Agenda{
+		Date:         startOfToday.Format("2006-01-02"),
+		TimeZone:     loc.String(),
+		UpcomingDays: upcomingDays,
+		GeneratedAt:  now.UTC(),
+		Projects:     make([]AgendaProject, 0),
+		location:     loc,
+	}
+
+	rows, err := db.Query(`
+		SELECT t.id, t.title, t.created_at, datetime(t.due_date), t.all_day, t.recurrence_interval, t.recurrence_unit,
+		       t.position, p.id, p.title
+		FROM todos t
+		JOIN projects p ON p.id = t.project_id
+		WHERE t.completed = 0 AND t.due_date IS NOT NULL
+		ORDER BY p.position, t.due_date, t.position
+	`)
+	if err != nil {
+		return agenda, err
+	}
+	defer rows.Close()
+
+	projectIndex := make(map[int]int)
+	for rows.Next() {
+		var todo Todo
+		var dueDateStr sql.NullString
+		var projectTitle string
+		if err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.CreatedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.Position,
+			&todo.ProjectID,
+			&projectTitle,
+		); err != nil {
+			return agenda, err
+		}
+
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil || todo.DueDate == nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+			continue
+		}
+		// All-day todos are due at the start of their date in loc
+		due := *todo.DueDate
+		if todo.AllDay {
+			due = time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, loc)
+		}
+		if !due.Before(endOfUpcoming) {
+			continue
+		}
+
+		index, ok := projectIndex[todo.ProjectID]
+		if !ok {
+			index = len(agenda.Projects)
+			projectIndex[todo.ProjectID] = index
+			agenda.Projects = append(agenda.Projects, AgendaProject{
+				ID:       todo.ProjectID,
+				Title:    projectTitle,
+				Overdue:  make([]Todo, 0),
+				DueToday: make([]Todo, 0),
+				Upcoming: make([]Todo, 0),
+			})
+		}
+
+		project := &agenda.Projects[index]
+		switch {
+		case due.Before(startOfToday):
+			project.Overdue = append(project.Overdue, todo)
+		case due.Before(startOfTomorrow):
+			project.DueToday = append(project.DueToday, todo)
+		default:
+			project.Upcoming = append(project.Upcoming, todo)
+		}
+	}
+
+	return agenda, rows.Err()
+}
+
+// formatDue renders a todo's due date in the agenda's time zone, or only
+// its date when it is all-day.
+func (a Agenda) formatDue(todo Todo) string {
+	if todo.DueDate == nil {
+		return ""
+	}
+	if todo.AllDay {
+		return todo.DueDate.UTC().Format("Mon Jan 2")
+	}
+	return todo.DueDate.In(a.location).Format("Mon Jan 2 15:04")
+}
+
+var agendaTemplateFuncs = map[string]interface{}{
+	"due": func(a Agenda, todo Todo) string { return a.formatDue(todo) },
+}
+
+var agendaTextTemplate = template.Must(template.New("agenda").Funcs(agendaTemplateFuncs).Parse(
+	`Agenda for {{.Date}}
+{{if not .Projects}}
+Nothing is overdue or due soon.
+{{end}}{{$agenda := .}}{{range .Projects}}
+== {{.Title}} ==
+{{if .Overdue}}
+Overdue:
+{{range .Overdue}}  [ ] {{.Title}} ({{due $agenda .}})
+{{end}}{{end}}{{if .DueToday}}
+Due today:
+{{range .DueToday}}  [ ] {{.Title}} ({{due $agenda .}})
+{{end}}{{end}}{{if .Upcoming}}
+Upcoming:
+{{range .Upcoming}}  [ ] {{.Title}} ({{due $agenda .}})
+{{end}}{{end}}{{end}}{{if .AppURL}}
+Open Todo App: {{.AppURL}}
+{{end}}`))
+
+var agendaHTMLTemplate = htmltemplate.Must(htmltemplate.New("agenda").Funcs(agendaTemplateFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Agenda for {{.Date}}</title>
+</head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; color: #4c4f69;">
+<h1 style="font-size: 1.4em;">Agenda for {{.Date}}</h1>
+{{if not .Projects}}<p>Nothing is overdue or due soon.</p>{{end}}
+{{$agenda := .}}{{range .Projects}}
+<h2 style="font-size: 1.2em; border-bottom: 1px solid #81839d;">{{.Title}}</h2>
+{{if .Overdue}}<h3 style="font-size: 1em; color: #d20f39;">Overdue</h3>
+<ul>{{range .Overdue}}<li>{{.Title}} <small style="color: #d20f39;">{{due $agenda .}}</small></li>{{end}}</ul>{{end}}
+{{if .DueToday}}<h3 style="font-size: 1em; color: #df8e1d;">Due today</h3>
+<ul>{{range .DueToday}}<li>{{.Title}} <small style="color: #df8e1d;">{{due $agenda .}}</small></li>{{end}}</ul>{{end}}
+{{if .Upcoming}}<h3 style="font-size: 1em;">Upcoming</h3>
+<ul>{{range .Upcoming}}<li>{{.Title}} <small>{{due $agenda .}}</small></li>{{end}}</ul>{{end}}
+{{end}}
+{{if .AppURL}}<p><a href="{{.AppURL}}">Open Todo App</a></p>{{end}}
+</body>
+</html>
+`))
+
+func renderAgendaText(agenda Agenda) (string, error) {
+	var buf bytes.Buffer
+	err := agendaTextTemplate.Execute(&buf, agenda)
+	return buf.String(), err
+}
+
+func renderAgendaHTML(agenda Agenda) (string, error) {
+	var buf bytes.Buffer
+	err := agendaHTMLTemplate.Execute(&buf, agenda)
+	return buf.String(), err
+}
+
+// agendaFromRequest builds the agenda for the "tz" and "days" query
+// parameters, defaulting to the server's time zone and a week ahead.
+func agendaFromRequest(r *http.Request) (Agenda, int, error) {
+	loc := time.Local
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return Agenda{}, http.StatusBadRequest, err
+		}
+	}
+
+	days := defaultAgendaDays
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		var err error
+		days, err = strconv.Atoi(daysStr)
+		if err != nil || days < 0 || days > maxAgendaDays {
+			return Agenda{}, http.StatusBadRequest, fmt.Errorf("days must be an integer from 0 to %d", maxAgendaDays)
+		}
+	}
+
+	agenda, err := buildAgenda(time.Now(), loc, days)
+	if err != nil {
+		return agenda, http.StatusInternalServerError, err
+	}
+	return agenda, http.StatusOK, nil
+}
+
+// getAgendaHandler previews the digest as JSON (default), HTML or text.
+func getAgendaHandler(w http.ResponseWriter, r *http.Request) {
+	agenda, status, err := agendaFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "html":
+		body, err := renderAgendaHTML(agenda)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(body))
+	case "text":
+		body, err := renderAgendaText(agenda)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agenda)
+	}
+}
+
+// DigestConfig controls the daily agenda email.
+type DigestConfig struct {
+	SMTP SMTPConfig `json:"smtp"`
+	// Time of day the digest is sent, as HH:MM in the server's time zone
+	SendAt string `json:"time"`
+	Days   int    `json:"days"`
+}
+
+func (c DigestConfig) enabled() bool {
+	return c.SMTP.Host != "" && len(c.SMTP.To) > 0
+}
+
+// sendDigest emails the agenda. Nothing is sent when nothing is due, unless
+// force is set.
+func sendDigest(cfg DigestConfig, force bool) error {
+	agenda, err := buildAgenda(time.Now(), time.Local, cfg.Days)
+	if err != nil {
+		return err
+	}
+	if agenda.empty() && !force {
+		return nil
+	}
+	agenda.AppURL = config.appURL()
+
+	textBody, err := renderAgendaText(agenda)
+	if err != nil {
+		return err
+	}
+	htmlBody, err := renderAgendaHTML(agenda)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return sendMail(ctx, cfg.SMTP, "Agenda for "+agenda.Date, textBody, htmlBody)
+}
+
+// nextTimeOfDay returns the next occurrence of the HH:MM time of day.
+func nextTimeOfDay(now time.Time, sendAt string) (time.Time, error) {
+	clock, err := time.Parse("15:04", sendAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// runDigestScheduler sends the digest every day at the configured time.
+func runDigestScheduler(cfg DigestConfig) {
+	for {
+		next, err := nextTimeOfDay(time.Now(), cfg.SendAt)
+		if err != nil {
+			logWarn("Invalid DIGEST_TIME %q, digest disabled: %v", cfg.SendAt, err)
+			return
+		}
+		time.Sleep(time.Until(next))
+
+		if err := sendDigest(cfg, false); err != nil {
+			logError("Error sending agenda digest: %v", err)
+		}
+	}
+}
+
+// sendDigestHandler sends the digest right away, which is handy to check
+// the SMTP settings.
+func sendDigestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := config.Digest
+	if !cfg.enabled() {
+		http.Error(w, "Digest is not configured, set SMTP_HOST and DIGEST_TO", http.StatusBadRequest)
+		return
+	}
+	if err := sendDigest(cfg, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,371 @@
+// Package ical parses iCalendar (RFC 5545) data into a tree of components.
+// Unlike gocal, which only handles VEVENT, it keeps every component and
+// property so callers can read VTODO, VALARM and custom X- properties.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Property is one content line, e.g. DUE;TZID=Europe/Paris:20250101T090000.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Param returns a parameter value, or "" when it is not set.
+func (p *Property) Param(name string) string {
+	if p == nil {
+		return ""
+	}
+	return p.Params[name]
+}
+
+// Text returns the value with TEXT escapes (\n, \, \; \\) resolved.
+func (p *Property) Text() string {
+	if p == nil {
+		return ""
+	}
+	return UnescapeText(p.Value)
+}
+
+// Component is a BEGIN/END block such as VCALENDAR, VTODO or VEVENT.
+type Component struct {
+	Name       string
+	Properties []*Property
+	Children   []*Component
+}
+
+// Prop returns the first property with the given name, or nil.
+func (c *Component) Prop(name string) *Property {
+	for _, prop := range c.Properties {
+		if prop.Name == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+// Props returns every property with the given name.
+func (c *Component) Props(name string) []*Property {
+	var props []*Property
+	for _, prop := range c.Properties {
+		if prop.Name == name {
+			props = append(props, prop)
+		}
+	}
+	return props
+}
+
+// Text returns the unescaped value of the first property with the given
+// name, or "" when it is missing.
+func (c *Component) Text(name string) string {
+	return c.Prop(name).Text()
+}
+
+// Components returns the direct children with the given name.
+func (c *Component) Components(name string) []*Component {
+	var components []*Component
+	for _, child := range c.Children {
+		if child.Name == name {
+			components = append(components, child)
+		}
+	}
+	return components
+}
+
+// Parse reads iCalendar data and returns its top-level components, normally
+// a single VCALENDAR.
+func Parse(r io.Reader) ([]*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []*Component
+	var stack []*Component
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		prop, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			component := &Component{Name: strings.ToUpper(prop.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, component)
+			} else {
+				roots = append(roots, component)
+			}
+			stack = append(stack, component)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", i+1, prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: property %s outside of a component", i+1, prop.Name)
+			}
+			current := stack[len(stack)-1]
+			current.Properties = append(current.Properties, prop)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("missing END:%s", stack[len(stack)-1].Name)
+	}
+	return roots, nil
+}
+
+// unfold joins folded content lines (continuations start with a space or tab).
+func unfold(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseLine splits "NAME;PARAM=VALUE;PARAM="QUOTED":VALUE" into a Property.
+func parseLine(line string) (*Property, error) {
+	prop := &Property{Params: make(map[string]string)}
+
+	// The name ends at the first ';' or ':'
+	end := strings.IndexAny(line, ";:")
+	if end <= 0 {
+		return nil, fmt.Errorf("malformed content line %q", line)
+	}
+	prop.Name = strings.ToUpper(line[:end])
+	rest := line[end:]
+
+	for strings.HasPrefix(rest, ";") {
+		rest = rest[1:]
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed parameter in %q", line)
+		}
+		name := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+
+		// Values run to the next unquoted ';' or ':'
+		var value strings.Builder
+		quoted := false
+		i := 0
+		for ; i < len(rest); i++ {
+			c := rest[i]
+			if c == '"' {
+				quoted = !quoted
+				continue
+			}
+			if !quoted && (c == ';' || c == ':') {
+				break
+			}
+			value.WriteByte(c)
+		}
+		prop.Params[name] = value.String()
+		rest = rest[i:]
+	}
+
+	if !strings.HasPrefix(rest, ":") {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+	prop.Value = rest[1:]
+	return prop, nil
+}
+
+// UnescapeText resolves the escapes allowed in TEXT values.
+func UnescapeText(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// SplitText splits a multi-valued TEXT property (e.g. CATEGORIES) on
+// unescaped commas and unescapes each value.
+func SplitText(s string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == ',' {
+			values = append(values, UnescapeText(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, UnescapeText(s[start:]))
+}
+
+// DateTime parses a DATE or DATE-TIME property. Dates are returned as
+// midnight in loc with allDay set. DATE-TIME values use their TZID when it
+// names a known zone, UTC when they end in Z, and loc otherwise.
+func (p *Property) DateTime(loc *time.Location) (t time.Time, allDay bool, err error) {
+	if p == nil {
+		return time.Time{}, false, fmt.Errorf("missing date")
+	}
+	value := strings.TrimSpace(p.Value)
+
+	if p.Param("VALUE") == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	zone := loc
+	if tzid := p.Param("TZID"); tzid != "" {
+		if tz, err := Location(tzid); err == nil {
+			zone = tz
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, zone)
+	return t, false, err
+}
+
+// windowsZones maps the Windows time zone names that Outlook and Exchange
+// use as TZIDs to IANA names.
+var windowsZones = map[string]string{
+	"Dateline Standard Time":          "Etc/GMT+12",
+	"Hawaiian Standard Time":          "Pacific/Honolulu",
+	"Alaskan Standard Time":           "America/Anchorage",
+	"Pacific Standard Time":           "America/Los_Angeles",
+	"Mountain Standard Time":          "America/Denver",
+	"US Mountain Standard Time":       "America/Phoenix",
+	"Central Standard Time":           "America/Chicago",
+	"Eastern Standard Time":           "America/New_York",
+	"Atlantic Standard Time":          "America/Halifax",
+	"Newfoundland Standard Time":      "America/St_Johns",
+	"E. South America Standard Time":  "America/Sao_Paulo",
+	"Argentina Standard Time":         "America/Buenos_Aires",
+	"GMT Standard Time":               "Europe/London",
+	"Greenwich Standard Time":         "Atlantic/Reykjavik",
+	"W. Europe Standard Time":         "Europe/Berlin",
+	"Romance Standard Time":           "Europe/Paris",
+	"Central Europe Standard Time":    "Europe/Budapest",
+	"Central European Standard Time":  "Europe/Warsaw",
+	"E. Europe Standard Time":         "Europe/Chisinau",
+	"GTB Standard Time":               "Europe/Bucharest",
+	"FLE Standard Time":               "Europe/Kiev",
+	"Russian Standard Time":           "Europe/Moscow",
+	"South Africa Standard Time":      "Africa/Johannesburg",
+	"Israel Standard Time":            "Asia/Jerusalem",
+	"Arabian Standard Time":           "Asia/Dubai",
+	"India Standard Time":             "Asia/Kolkata",
+	"SE Asia Standard Time":           "Asia/Bangkok",
+	"China Standard Time":             "Asia/Shanghai",
+	"Singapore Standard Time":         "Asia/Singapore",
+	"Tokyo Standard Time":             "Asia/Tokyo",
+	"Korea Standard Time":             "Asia/Seoul",
+	"AUS Eastern Standard Time":       "Australia/Sydney",
+	"E. Australia Standard Time":      "Australia/Brisbane",
+	"Cen. Australia Standard Time":    "Australia/Adelaide",
+	"W. Australia Standard Time":      "Australia/Perth",
+	"New Zealand Standard Time":       "Pacific/Auckland",
+	"Canada Central Standard Time":    "America/Regina",
+	"Central America Standard Time":   "America/Guatemala",
+	"Mexico Standard Time":            "America/Mexico_City",
+	"Central Standard Time (Mexico)":  "America/Mexico_City",
+	"SA Pacific Standard Time":        "America/Bogota",
+	"Pacific SA Standard Time":        "America/Santiago",
+	"Turkey Standard Time":            "Europe/Istanbul",
+	"Egypt Standard Time":             "Africa/Cairo",
+	"W. Central Africa Standard Time": "Africa/Lagos",
+}
+
+// Location resolves a TZID. Besides IANA names it accepts Windows names and
+// the prefixed forms some producers use, e.g.
+// "/mozilla.org/20050126_1/Europe/Paris".
+func Location(tzid string) (*time.Location, error) {
+	tzid = strings.Trim(strings.TrimSpace(tzid), `"`)
+	if name, ok := windowsZones[tzid]; ok {
+		return time.LoadLocation(name)
+	}
+	if tzid != "" && tzid != "Local" {
+		if loc, err := time.LoadLocation(tzid); err == nil {
+			return loc, nil
+		}
+	}
+
+	// Drop leading path segments until what is left is a known zone
+	parts := strings.Split(tzid, "/")
+	for i := 1; i < len(parts); i++ {
+		if name := strings.Join(parts[i:], "/"); name != "" && name != "Local" {
+			if loc, err := time.LoadLocation(name); err == nil {
+				return loc, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown time zone %q", tzid)
+}
+
+// Recurrence holds the parts of an RRULE the app can represent.
+type Recurrence struct {
+	Freq     string
+	Interval int
+	Parts    map[string]string
+}
+
+// ParseRecurrenceRule parses an RRULE value such as
+// "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO".
+func ParseRecurrenceRule(value string) (Recurrence, error) {
+	rule := Recurrence{Interval: 1, Parts: make(map[string]string)}
+	for _, part := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		rule.Parts[strings.ToUpper(name)] = val
+	}
+
+	rule.Freq = strings.ToUpper(rule.Parts["FREQ"])
+	if rule.Freq == "" {
+		return rule, fmt.Errorf("RRULE without FREQ")
+	}
+	if interval, ok := rule.Parts["INTERVAL"]; ok {
+		n, err := strconv.Atoi(interval)
+		if err != nil || n <= 0 {
+			return rule, fmt.Errorf("invalid RRULE INTERVAL %q", interval)
+		}
+		rule.Interval = n
+	}
+	return rule, nil
+}
@@ -0,0 +1,147 @@
+package ical
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const calendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VTODO\r\n" +
+	"UID:1@example.com\r\n" +
+	"SUMMARY:Buy milk\\, eggs\\; bread\r\n" +
+	"DESCRIPTION:First line\\nsecond line that is folded\r\n" +
+	"  onto two\r\n" +
+	"DUE;TZID=\"Europe/Paris\":20240110T090000\r\n" +
+	"CATEGORIES:home,errands\\,misc\r\n" +
+	"X-CUSTOM;X-PARAM=a:b:c\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VTODO\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	roots, err := Parse(strings.NewReader(calendar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Name != "VCALENDAR" {
+		t.Fatalf("roots = %v, want one VCALENDAR", roots)
+	}
+	todos := roots[0].Components("VTODO")
+	if len(todos) != 1 {
+		t.Fatalf("got %d VTODOs, want 1", len(todos))
+	}
+	todo := todos[0]
+
+	if got, want := todo.Text("SUMMARY"), "Buy milk, eggs; bread"; got != want {
+		t.Errorf("SUMMARY = %q, want %q", got, want)
+	}
+	if got, want := todo.Text("DESCRIPTION"), "First line\nsecond line that is folded onto two"; got != want {
+		t.Errorf("DESCRIPTION = %q, want %q", got, want)
+	}
+	if got, want := todo.Prop("DUE").Param("TZID"), "Europe/Paris"; got != want {
+		t.Errorf("TZID = %q, want %q", got, want)
+	}
+	if got, want := SplitText(todo.Prop("CATEGORIES").Value), []string{"home", "errands,misc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CATEGORIES = %q, want %q", got, want)
+	}
+	if got := todo.Prop("X-CUSTOM"); got.Value != "b:c" || got.Param("X-PARAM") != "a" {
+		t.Errorf("X-CUSTOM = %+v, want value b:c and X-PARAM a", got)
+	}
+	if alarms := todo.Components("VALARM"); len(alarms) != 1 || alarms[0].Text("TRIGGER") != "-PT15M" {
+		t.Errorf("VALARM = %v, want one with TRIGGER -PT15M", alarms)
+	}
+	if todo.Prop("LOCATION") != nil || todo.Text("LOCATION") != "" {
+		t.Error("missing property should be nil and read as empty")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"unbalanced END":      "BEGIN:VCALENDAR\nEND:VTODO\n",
+		"missing END":         "BEGIN:VCALENDAR\nBEGIN:VTODO\nEND:VTODO\n",
+		"property outside":    "SUMMARY:x\n",
+		"line without value":  "BEGIN:VCALENDAR\nSUMMARY\nEND:VCALENDAR\n",
+		"malformed parameter": "BEGIN:VCALENDAR\nDUE;TZID:20240101\nEND:VCALENDAR\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(input)); err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", input)
+			}
+		})
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		line   string
+		want   string
+		allDay bool
+	}{
+		{"DUE;VALUE=DATE:20240110", "2024-01-10T00:00:00-05:00", true},
+		{"DUE:20240110", "2024-01-10T00:00:00-05:00", true},
+		{"DUE:20240110T090000Z", "2024-01-10T09:00:00Z", false},
+		{"DUE;TZID=Europe/Paris:20240110T090000", "2024-01-10T09:00:00+01:00", false},
+		{"DUE;TZID=W. Europe Standard Time:20240710T090000", "2024-07-10T09:00:00+02:00", false},
+		{"DUE;TZID=/mozilla.org/20050126_1/Europe/Paris:20240110T090000", "2024-01-10T09:00:00+01:00", false},
+		// Floating times and unknown zones are read in the given location
+		{"DUE:20240110T090000", "2024-01-10T09:00:00-05:00", false},
+		{"DUE;TZID=Nowhere/Special:20240110T090000", "2024-01-10T09:00:00-05:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			prop, err := parseLine(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, allDay, err := prop.DateTime(newYork)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Format(time.RFC3339) != tt.want || allDay != tt.allDay {
+				t.Errorf("DateTime = %s, %v, want %s, %v", got.Format(time.RFC3339), allDay, tt.want, tt.allDay)
+			}
+		})
+	}
+
+	var missing *Property
+	if _, _, err := missing.DateTime(time.UTC); err == nil {
+		t.Error("DateTime of a missing property succeeded, want an error")
+	}
+}
+
+func TestParseRecurrenceRule(t *testing.T) {
+	tests := []struct {
+		value    string
+		freq     string
+		interval int
+		wantErr  bool
+	}{
+		{value: "FREQ=DAILY", freq: "DAILY", interval: 1},
+		{value: "FREQ=weekly;INTERVAL=2;BYDAY=MO", freq: "WEEKLY", interval: 2},
+		{value: "INTERVAL=2", wantErr: true},
+		{value: "FREQ=MONTHLY;INTERVAL=0", wantErr: true},
+		{value: "FREQ=MONTHLY;INTERVAL=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			rule, err := ParseRecurrenceRule(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (rule.Freq != tt.freq || rule.Interval != tt.interval) {
+				t.Errorf("rule = %s every %d, want %s every %d", rule.Freq, rule.Interval, tt.freq, tt.interval)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IcsImport is the result of importing a calendar file.
+type IcsImport struct {
+	ProjectID   int    `json:"project_id"`
+	ProjectName string `json:"project_name"`
+	Added       int    `json:"added"`
+	Recurring   int    `json:"recurring"`
+	Completed   int    `json:"completed"`
+	Subtasks    int    `json:"subtasks"`
+	Duplicates  int    `json:"duplicates"`
+	Excluded    int    `json:"excluded"`
+}
+
+// importICSHandler imports an uploaded calendar file (multipart field
+// "file") into a project, read the same way as subscriptions. The
+// "project" field names an existing project by id or title, or a new one;
+// it defaults to the file name. Events and tasks whose UID is already in the
+// project are skipped, so a file can be imported again after it changed.
+func importICSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, icsMaxFeedSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	body, err := io.ReadAll(io.LimitReader(file, icsMaxFeedSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > icsMaxFeedSize {
+		http.Error(w, fmt.Sprintf("calendar is larger than %d MB", icsMaxFeedSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var importRules IcsImportRules
+	if value := r.FormValue("import_rules"); value != "" {
+		if err := json.Unmarshal([]byte(value), &importRules); err != nil {
+			http.Error(w, "import_rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rules, err := importRules.compile()
+	if err != nil {
+		http.Error(w, "import rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feed, err := parseIcsFeed(body, rules, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	projectRef := strings.TrimSpace(r.FormValue("project"))
+	if projectRef == "" {
+		projectRef = strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+	}
+	if projectRef == "" || projectRef == "." {
+		projectRef = "Imported Calendar"
+	}
+
+	result, err := importIcsFeed(feed, projectRef)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// importIcsFeed adds the todos of a parsed calendar file to a project in
+// one transaction. Recurring events become recurring todos due on their next
+// occurrence, since nothing follows the file afterwards.
+func importIcsFeed(feed icsFeed, projectRef string) (IcsImport, error) {
+	result := IcsImport{Excluded: len(feed.excluded)}
+
+	project, lookupErr := findProjectForCalendar(projectRef)
+	if lookupErr != nil && lookupErr != sql.ErrNoRows {
+		return result, lookupErr
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	if lookupErr == sql.ErrNoRows {
+		res, err := tx.Exec(
+			"INSERT INTO projects (title, position) VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM projects))",
+			projectRef,
+		)
+		if err != nil {
+			return result, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return result, err
+		}
+		project = Project{ID: int(id), Title: projectRef}
+	}
+	result.ProjectID = project.ID
+	result.ProjectName = project.Title
+
+	todoIDs := make(map[string]int)
+	rows, err := tx.Query("SELECT uid, id FROM todos WHERE project_id = ? AND uid IS NOT NULL AND uid != ''", project.ID)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var uid string
+		var id int
+		if err := rows.Scan(&uid, &id); err != nil {
+			rows.Close()
+			return result, err
+		}
+		todoIDs[uid] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	var position int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE project_id = ?", project.ID).Scan(&position); err != nil {
+		return result, err
+	}
+
+	// Only new todos are linked to their parent, so that subtasks moved
+	// around since the last import stay where they are
+	added := make(map[string]int)
+	for _, uid := range feed.order {
+		if _, ok := todoIDs[uid]; ok {
+			result.Duplicates++
+			continue
+		}
+		entry := feed.entries[uid]
+		if entry.rrule != "" && entry.recurrenceInterval == nil {
+			entry.recurrenceInterval, entry.recurrenceUnit = recurrenceFromRule(entry.rrule)
+		}
+
+		todoID, err := insertIcsEntry(tx, project.ID, entry, position)
+		if err != nil {
+			return result, err
+		}
+		position++
+		todoIDs[uid] = todoID
+		added[uid] = todoID
+
+		result.Added++
+		if entry.recurrenceInterval != nil {
+			result.Recurring++
+		}
+		if entry.completed {
+			result.Completed++
+		}
+	}
+
+	newTodos := icsFeed{entries: feed.entries}
+	for _, uid := range feed.order {
+		if _, ok := added[uid]; ok {
+			newTodos.order = append(newTodos.order, uid)
+		}
+	}
+	if result.Subtasks, err = linkIcsSubtasks(tx, newTodos, todoIDs); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"todo-app/ical"
+
+	"github.com/apognu/gocal"
+)
+
+// Number of refreshes kept in the history of each subscription
+const icsRefreshHistory = 20
+
+// Subscriptions are paused after this many failed refreshes in a row
+const icsMaxConsecutiveFailures = 5
+
+// Default and shortest refresh intervals, in minutes
+const (
+	icsDefaultRefreshInterval = 60
+	icsMinRefreshInterval     = 5
+)
+
+// Limits on fetching feeds
+const (
+	icsFetchTimeout         = 60 * time.Second
+	icsMaxFeedSize          = 20 << 20
+	icsMaxConcurrentFetches = 4
+	icsFetchUserAgent       = "todo-app (+https://github.com/BeringLogic/todo-app)"
+)
+
+// icsHTTPClient fetches feeds. Its transport asks for gzip and decompresses
+// responses itself.
+var icsHTTPClient = &http.Client{
+	Timeout:       icsFetchTimeout,
+	CheckRedirect: icsCheckRedirect,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          icsMaxConcurrentFetches,
+	},
+}
+
+// icsCredentialHeadersKey is the request context key holding the names of
+// the headers set from a subscription's credentials.
+type icsCredentialHeadersKey struct{}
+
+// icsCheckRedirect keeps credentials to the host they were given for. Go
+// only drops Authorization and cookies when a redirect leaves the domain,
+// and copies every other header along.
+func icsCheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		names, _ := req.Context().Value(icsCredentialHeadersKey{}).([]string)
+		for _, name := range names {
+			req.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+// Feeds are fetched concurrently, but applied one at a time so refreshes
+// don't compete for the database.
+var icsApplyMu sync.Mutex
+
+// icsSubscriptionLocks holds a mutex per subscription id, so a manual
+// refresh or an edit waits for a scheduled refresh of the same subscription.
+var icsSubscriptionLocks sync.Map
+
+func lockIcsSubscription(id int) (unlock func()) {
+	lock, _ := icsSubscriptionLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// Policies for events that change upstream after their todo was edited locally
+const (
+	icsLocalEditKeep      = "keep"
+	icsLocalEditOverwrite = "overwrite"
+)
+
+// Policies for events removed from the feed or cancelled
+const (
+	icsRemovedDelete   = "delete"
+	icsRemovedComplete = "complete"
+)
+
+func validateIcsPolicies(localEditPolicy, removedPolicy string) error {
+	if localEditPolicy != icsLocalEditKeep && localEditPolicy != icsLocalEditOverwrite {
+		return fmt.Errorf("local_edit_policy must be %q or %q", icsLocalEditKeep, icsLocalEditOverwrite)
+	}
+	if removedPolicy != icsRemovedDelete && removedPolicy != icsRemovedComplete {
+		return fmt.Errorf("removed_policy must be %q or %q", icsRemovedDelete, icsRemovedComplete)
+	}
+	return nil
+}
+
+type IcsRefreshChange struct {
+	TodoID  *int   `json:"todo_id,omitempty"`
+	UID     string `json:"uid"`
+	Action  string `json:"action"`
+	Details string `json:"details,omitempty"`
+}
+
+// IcsRefresh records the outcome of one refresh of a subscription.
+type IcsRefresh struct {
+	ID             int                `json:"id"`
+	SubscriptionID int                `json:"subscription_id"`
+	RefreshedAt    time.Time          `json:"refreshed_at"`
+	Added          int                `json:"added"`
+	Updated        int                `json:"updated"`
+	Removed        int                `json:"removed"`
+	HTTPStatus     *int               `json:"http_status,omitempty"`
+	Error          *string            `json:"error,omitempty"`
+	Changes        []IcsRefreshChange `json:"changes"`
+}
+
+func (r *IcsRefresh) record(todoID int, uid, action, details string) {
+	change := IcsRefreshChange{UID: uid, Action: action, Details: details}
+	if todoID != 0 {
+		change.TodoID = &todoID
+	}
+	r.Changes = append(r.Changes, change)
+}
+
+// refreshDueIcsSubscriptions refreshes the active subscriptions whose next
+// refresh is due. Subscriptions that were never refreshed are due right away.
+func refreshDueIcsSubscriptions() {
+	rows, err := db.Query(`
+		SELECT id, url, project_id, local_edit_policy, removed_policy, refresh_interval_minutes, next_refresh_at,
+		       COALESCE(etag, ''), COALESCE(last_modified, ''), COALESCE(credentials, ''), COALESCE(import_rules, '')
+		FROM ics_subscriptions
+		WHERE NOT paused`)
+	if err != nil {
+		logError("Error getting ICS subscriptions: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var subscriptions []IcsSubscription
+	for rows.Next() {
+		var sub IcsSubscription
+		var importRules string
+		if err := rows.Scan(
+			&sub.ID, &sub.URL, &sub.ProjectID, &sub.LocalEditPolicy, &sub.RemovedPolicy, &sub.RefreshIntervalMinutes, &sub.NextRefreshAt,
+			&sub.ETag, &sub.LastModified, &sub.EncryptedCredentials, &importRules,
+		); err != nil {
+			logError("Error scanning ICS subscription: %v", err)
+			continue
+		}
+		if sub.ImportRules, err = parseIcsImportRules(importRules); err != nil {
+			logError("Error reading import rules of ICS subscription %d: %v", sub.ID, err)
+			continue
+		}
+		if sub.NextRefreshAt == nil || !sub.NextRefreshAt.After(now) {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, icsMaxConcurrentFetches)
+	for _, sub := range subscriptions {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			runIcsRefresh(sub)
+		}()
+	}
+	wg.Wait()
+}
+
+// refreshIcsSubscriptionByID refreshes one subscription now, paused or not.
+func refreshIcsSubscriptionByID(id int) (IcsRefresh, error) {
+	var sub IcsSubscription
+	var importRules string
+	err := db.QueryRow(`
+		SELECT id, url, project_id, local_edit_policy, removed_policy, refresh_interval_minutes,
+		       COALESCE(etag, ''), COALESCE(last_modified, ''), COALESCE(credentials, ''), COALESCE(import_rules, '')
+		FROM ics_subscriptions
+		WHERE id = ?`, id,
+	).Scan(
+		&sub.ID, &sub.URL, &sub.ProjectID, &sub.LocalEditPolicy, &sub.RemovedPolicy, &sub.RefreshIntervalMinutes,
+		&sub.ETag, &sub.LastModified, &sub.EncryptedCredentials, &importRules,
+	)
+	if err != nil {
+		return IcsRefresh{}, err
+	}
+	if sub.ImportRules, err = parseIcsImportRules(importRules); err != nil {
+		return IcsRefresh{}, err
+	}
+	return runIcsRefresh(sub), nil
+}
+
+// runIcsRefresh refreshes a subscription, records the outcome and schedules
+// its next refresh.
+func runIcsRefresh(sub IcsSubscription) IcsRefresh {
+	unlock := lockIcsSubscription(sub.ID)
+	defer unlock()
+
+	refresh, err := refreshIcsSubscription(sub)
+
+	icsApplyMu.Lock()
+	defer icsApplyMu.Unlock()
+
+	if err != nil {
+		logError("Error refreshing ICS feed from %s: %v", sub.URL, err)
+		message := err.Error()
+		refresh.Error = &message
+	}
+	if err := saveIcsRefresh(&refresh); err != nil {
+		logError("Error saving refresh of ICS subscription %d: %v", sub.ID, err)
+	}
+	if err := updateIcsSubscriptionStatus(sub, refresh); err != nil {
+		logError("Error updating status of ICS subscription %d: %v", sub.ID, err)
+	}
+	return refresh
+}
+
+// nextIcsRefresh is one interval from now, plus up to a tenth of it so that
+// feeds added together do not keep being fetched together.
+func nextIcsRefresh(intervalMinutes int) time.Time {
+	interval := time.Duration(intervalMinutes) * time.Minute
+	jitter := time.Duration(rand.Int64N(int64(interval/10) + 1))
+	return time.Now().UTC().Add(interval + jitter)
+}
+
+func validateIcsRefreshInterval(minutes int) error {
+	if minutes < icsMinRefreshInterval {
+		return fmt.Errorf("refresh_interval_minutes must be at least %d", icsMinRefreshInterval)
+	}
+	return nil
+}
+
+// updateIcsSubscriptionStatus records the outcome of a refresh on the
+// subscription and schedules the next one. A success resumes a paused
+// subscription; it is paused once it has failed too many times in a row.
+func updateIcsSubscriptionStatus(sub IcsSubscription, refresh IcsRefresh) error {
+	next := nextIcsRefresh(sub.RefreshIntervalMinutes)
+	if refresh.Error == nil {
+		_, err := db.Exec(`
+			UPDATE ics_subscriptions
+			SET last_attempt_at = ?, last_success_at = ?, last_updated_at = ?, last_http_status = ?, last_error = NULL,
+			    last_added_count = ?, last_updated_count = ?, last_removed_count = ?, consecutive_failures = 0,
+			    paused = FALSE, next_refresh_at = ?
+			WHERE id = ?`,
+			refresh.RefreshedAt, refresh.RefreshedAt, refresh.RefreshedAt, refresh.HTTPStatus,
+			refresh.Added, refresh.Updated, refresh.Removed, next, sub.ID,
+		)
+		return err
+	}
+
+	var failures int
+	err := db.QueryRow(`
+		UPDATE ics_subscriptions
+		SET last_attempt_at = ?, last_http_status = ?, last_error = ?, consecutive_failures = consecutive_failures + 1,
+		    paused = paused OR consecutive_failures + 1 >= ?, next_refresh_at = ?
+		WHERE id = ?
+		RETURNING consecutive_failures`,
+		refresh.RefreshedAt, refresh.HTTPStatus, refresh.Error, icsMaxConsecutiveFailures, next, sub.ID,
+	).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if failures == icsMaxConsecutiveFailures {
+		logWarn("Paused ICS subscription %d (%s) after %d failed refreshes", sub.ID, sub.URL, failures)
+	}
+	return nil
+}
+
+// resumeIcsSubscriptionHandler unpauses a subscription and refreshes it.
+func resumeIcsSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE ics_subscriptions SET paused = FALSE, consecutive_failures = 0 WHERE id = ?", subscriptionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	go refreshIcsSubscriptionByID(subscriptionID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshIcsSubscriptionHandler refreshes a subscription right away and
+// returns the outcome of the refresh.
+func refreshIcsSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	refresh, err := refreshIcsSubscriptionByID(subscriptionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refresh)
+}
+
+// normalizeIcsURL turns webcal:// links, which calendar apps hand out for
+// subscriptions, into the HTTP URLs they stand for.
+func normalizeIcsURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	switch strings.ToLower(scheme) {
+	case "webcal", "webcals":
+		return "https://" + rest
+	}
+	return rawURL
+}
+
+// IcsCredentials authenticate requests for a protected feed. They are only
+// ever accepted from clients, never sent back.
+type IcsCredentials struct {
+	Username    string            `json:"username,omitempty"`
+	Password    string            `json:"password,omitempty"`
+	BearerToken string            `json:"bearer_token,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+func (c IcsCredentials) empty() bool {
+	return c.Username == "" && c.Password == "" && c.BearerToken == "" && len(c.Headers) == 0
+}
+
+func (c IcsCredentials) validate() error {
+	if (c.Username != "" || c.Password != "") && c.BearerToken != "" {
+		return fmt.Errorf("use either username and password or bearer_token, not both")
+	}
+	for name := range c.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Length", "If-None-Match", "If-Modified-Since":
+			return fmt.Errorf("header %s cannot be set", name)
+		}
+	}
+	return nil
+}
+
+// apply returns req with the credentials set, and the names of the headers
+// they use recorded for icsCheckRedirect.
+func (c IcsCredentials) apply(req *http.Request) *http.Request {
+	var names []string
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+		names = append(names, name)
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+		names = append(names, "Authorization")
+	} else if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+		names = append(names, "Authorization")
+	}
+	return req.WithContext(context.WithValue(req.Context(), icsCredentialHeadersKey{}, names))
+}
+
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// encryptIcsCredentials returns the value stored in the credentials column,
+// or nil when there are none.
+func encryptIcsCredentials(credentials *IcsCredentials) (*string, error) {
+	if credentials == nil || credentials.empty() {
+		return nil, nil
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypted, nil
+}
+
+func decryptIcsCredentials(encrypted string) (IcsCredentials, error) {
+	var credentials IcsCredentials
+	plaintext, err := decryptSecret(encrypted)
+	if err != nil {
+		return credentials, fmt.Errorf("credentials: %v", err)
+	}
+	err = json.Unmarshal(plaintext, &credentials)
+	return credentials, err
+}
+
+// refreshIcsSubscription downloads a feed and applies it to the
+// subscription's project. The feed is not parsed again when the server says
+// it has not changed since the last refresh.
+func refreshIcsSubscription(sub IcsSubscription) (IcsRefresh, error) {
+	refresh := IcsRefresh{SubscriptionID: sub.ID, RefreshedAt: time.Now().UTC(), Changes: make([]IcsRefreshChange, 0)}
+
+	req, err := http.NewRequest(http.MethodGet, normalizeIcsURL(sub.URL), nil)
+	if err != nil {
+		return refresh, err
+	}
+	req.Header.Set("User-Agent", icsFetchUserAgent)
+	req.Header.Set("Accept", "text/calendar, */*;q=0.5")
+	if sub.ETag != "" {
+		req.Header.Set("If-None-Match", sub.ETag)
+	}
+	if sub.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sub.LastModified)
+	}
+	if sub.EncryptedCredentials != "" {
+		credentials, err := decryptIcsCredentials(sub.EncryptedCredentials)
+		if err != nil {
+			return refresh, err
+		}
+		req = credentials.apply(req)
+	}
+
+	resp, err := icsHTTPClient.Do(req)
+	if err != nil {
+		return refresh, err
+	}
+	defer resp.Body.Close()
+
+	refresh.HTTPStatus = &resp.StatusCode
+	if resp.StatusCode == http.StatusNotModified {
+		return refresh, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return refresh, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Read one byte past the limit to tell a full feed from a cut one
+	body, err := io.ReadAll(io.LimitReader(resp.Body, icsMaxFeedSize+1))
+	if err != nil {
+		return refresh, err
+	}
+	if len(body) > icsMaxFeedSize {
+		return refresh, fmt.Errorf("feed is larger than %d MB", icsMaxFeedSize>>20)
+	}
+
+	icsApplyMu.Lock()
+	defer icsApplyMu.Unlock()
+
+	if err := applyIcsFeed(sub, body, &refresh); err != nil {
+		return refresh, err
+	}
+
+	// Only remember validators once the feed they describe has been applied
+	if _, err := db.Exec(
+		"UPDATE ics_subscriptions SET etag = NULLIF(?, ''), last_modified = NULLIF(?, '') WHERE id = ?",
+		resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), sub.ID,
+	); err != nil {
+		logError("Error saving cache validators of ICS subscription %d: %v", sub.ID, err)
+	}
+	return refresh, nil
+}
+
+func init() {
+	// Resolve TZIDs like the ical package, so that Windows and prefixed names
+	// do not fall back to UTC
+	gocal.SetTZMapper(ical.Location)
+}
+
+// icsEventDueDate turns an event start into a due date, and tells whether
+// the event is all-day. All-day events keep their date, as midnight UTC.
+// Times with a TZID are already in that zone; floating times are read in
+// the calendar's zone when the feed names one.
+func icsEventDueDate(event gocal.Event, floating *time.Location) (*time.Time, bool) {
+	if event.Start == nil {
+		return nil, false
+	}
+	if icsEventAllDay(event) {
+		due := allDayDueDate(*event.Start)
+		return &due, true
+	}
+
+	start := *event.Start
+	value := strings.TrimSpace(event.RawStart.Value)
+	if floating != nil && event.RawStart.Params["TZID"] == "" && !strings.HasSuffix(value, "Z") {
+		// gocal reads floating times in the server's zone
+		local := start.In(time.Local)
+		start = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, floating)
+	}
+	due := start.UTC()
+	return &due, false
+}
+
+// icsFeedLocation returns the zone named by the calendar's X-WR-TIMEZONE,
+// or nil when there is none.
+func icsFeedLocation(components []*ical.Component) *time.Location {
+	for _, calendar := range components {
+		if tzid := calendar.Text("X-WR-TIMEZONE"); tzid != "" {
+			if loc, err := ical.Location(tzid); err == nil {
+				return loc
+			}
+		}
+	}
+	return nil
+}
+
+// formatDueDate is the form due dates are compared in: what SQLite's
+// datetime() returns, or "" for no due date.
+func formatDueDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// icsFeedUIDs lists every event and task UID in a feed, whatever its date,
+// and whether the event or task as a whole is cancelled. It tells items that
+// left the feed apart from events outside the import window.
+func icsFeedUIDs(components []*ical.Component) map[string]bool {
+	uids := make(map[string]bool)
+	for _, calendar := range components {
+		for _, component := range calendar.Children {
+			if component.Name != "VEVENT" && component.Name != "VTODO" {
+				continue
+			}
+			uid := component.Text("UID")
+			if uid == "" {
+				continue
+			}
+			if component.Prop("RECURRENCE-ID") != nil {
+				// A cancelled occurrence does not cancel the series
+				if _, seen := uids[uid]; !seen {
+					uids[uid] = false
+				}
+				continue
+			}
+			uids[uid] = strings.EqualFold(component.Text("STATUS"), "CANCELLED")
+		}
+	}
+	return uids
+}
+
+// icsEntry is what an event or a task of a feed becomes.
+type icsEntry struct {
+	uid                string
+	title              string
+	due                string
+	allDay             bool
+	notes              string
+	priority           int
+	completed          bool
+	completedAt        *time.Time
+	recurrenceInterval *int
+	recurrenceUnit     *string
+	parentUID          string
+	// RRULE of a recurring event. Subscriptions follow its occurrences
+	// instead of making the todo recurring.
+	rrule string
+}
+
+func icsEventEntry(event gocal.Event, rules *compiledIcsImportRules, floating *time.Location) icsEntry {
+	dueDate, allDay := icsEventDueDate(event, floating)
+	return icsEntry{
+		uid:      event.Uid,
+		title:    rules.title(event),
+		due:      formatDueDate(dueDate),
+		allDay:   allDay,
+		priority: rules.Priority,
+	}
+}
+
+// icsTaskEntry maps a VTODO like CalDAV does. Its own priority wins over the
+// one of the import rules.
+func icsTaskEntry(fields davTodoFields, event gocal.Event, rules *compiledIcsImportRules) icsEntry {
+	entry := icsEntry{
+		uid:                fields.uid,
+		title:              rules.title(event),
+		due:                formatDueDate(fields.dueDate),
+		allDay:             fields.allDay,
+		notes:              fields.notes,
+		priority:           fields.priority,
+		completed:          fields.completed,
+		completedAt:        fields.completedAt,
+		recurrenceInterval: fields.recurrenceInterval,
+		recurrenceUnit:     fields.recurrenceUnit,
+		parentUID:          fields.parentUID,
+	}
+	if entry.priority == 0 {
+		entry.priority = rules.Priority
+	}
+	return entry
+}
+
+// icsTaskEvent presents a task to the import rules, which are written for
+// events: the due date stands in for the start.
+func icsTaskEvent(vtodo *ical.Component, fields davTodoFields) gocal.Event {
+	event := gocal.Event{
+		Uid:         fields.uid,
+		Summary:     fields.title,
+		Description: fields.notes,
+		Start:       fields.dueDate,
+	}
+	for _, categories := range vtodo.Props("CATEGORIES") {
+		event.Categories = append(event.Categories, ical.SplitText(categories.Value)...)
+	}
+	if due := vtodo.Prop("DUE"); due != nil {
+		event.RawStart = gocal.RawDate{Params: due.Params, Value: due.Value}
+	}
+	return event
+}
+
+// icsFeed is what the events and tasks of a feed become, in feed order.
+type icsFeed struct {
+	// Every UID in the feed, and whether it is cancelled
+	uids     map[string]bool
+	entries  map[string]icsEntry
+	order    []string
+	excluded map[string]bool
+}
+
+// parseIcsFeed maps a feed's events and tasks to todos. Recurring events
+// share a UID, and their todo follows the next occurrence in the import
+// window; tasks are not limited to the window.
+func parseIcsFeed(body []byte, rules *compiledIcsImportRules, now time.Time) (icsFeed, error) {
+	components, err := ical.Parse(bytes.NewReader(body))
+	if err != nil {
+		return icsFeed{}, fmt.Errorf("invalid calendar: %v", err)
+	}
+	feed := icsFeed{
+		uids:     icsFeedUIDs(components),
+		entries:  make(map[string]icsEntry),
+		excluded: make(map[string]bool),
+	}
+	floating := icsFeedLocation(components)
+
+	eventRules := make(map[string]string)
+	for _, calendar := range components {
+		for _, event := range calendar.Components("VEVENT") {
+			if event.Prop("RECURRENCE-ID") == nil && event.Prop("RRULE") != nil {
+				eventRules[event.Text("UID")] = event.Prop("RRULE").Value
+			}
+		}
+	}
+
+	start, end := rules.window(now)
+	cal := gocal.NewParser(bytes.NewReader(body))
+	cal.Start = &start
+	cal.End = &end
+	cal.Parse()
+
+	starts := make(map[string]*time.Time)
+	for _, event := range cal.Events {
+		if event.Uid == "" || strings.EqualFold(event.Status, "CANCELLED") {
+			continue
+		}
+		if !rules.matches(event) {
+			feed.excluded[event.Uid] = true
+			continue
+		}
+		current, ok := starts[event.Uid]
+		if !ok {
+			feed.order = append(feed.order, event.Uid)
+		}
+		if !ok || (event.Start != nil && current != nil && event.Start.Before(*current)) {
+			entry := icsEventEntry(event, rules, floating)
+			entry.rrule = eventRules[event.Uid]
+			feed.entries[event.Uid] = entry
+			starts[event.Uid] = event.Start
+		}
+	}
+
+	loc := time.Local
+	if floating != nil {
+		loc = floating
+	}
+	for _, calendar := range components {
+		for _, vtodo := range calendar.Components("VTODO") {
+			if vtodo.Prop("RECURRENCE-ID") != nil || strings.EqualFold(vtodo.Text("STATUS"), "CANCELLED") {
+				continue
+			}
+			fields := todoFieldsFromVTODO(vtodo, loc)
+			if fields.uid == "" {
+				continue
+			}
+			if _, seen := feed.entries[fields.uid]; seen {
+				continue
+			}
+			event := icsTaskEvent(vtodo, fields)
+			if !rules.matches(event) {
+				feed.excluded[fields.uid] = true
+				continue
+			}
+			feed.entries[fields.uid] = icsTaskEntry(fields, event, rules)
+			feed.order = append(feed.order, fields.uid)
+		}
+	}
+	return feed, nil
+}
+
+// insertIcsEntry adds the todo of an event or task at the given position.
+func insertIcsEntry(tx *sql.Tx, projectID int, entry icsEntry, position int) (int, error) {
+	var completedAt *time.Time
+	if entry.completed {
+		completedAt = entry.completedAt
+		if completedAt == nil {
+			now := time.Now().UTC()
+			completedAt = &now
+		}
+	}
+	result, err := tx.Exec(
+		`INSERT INTO todos (title, completed, completed_at, project_id, due_date, all_day, uid, position, priority, notes, recurrence_interval, recurrence_unit)
+		 VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?)`,
+		entry.title, entry.completed, completedAt, projectID, entry.due, entry.allDay, entry.uid, position, entry.priority, entry.notes,
+		entry.recurrenceInterval, entry.recurrenceUnit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("inserting todo for %s: %v", entry.uid, err)
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// linkIcsSubtasks points imported subtasks at their parent, once both have a
+// todo. It returns how many links changed.
+func linkIcsSubtasks(tx *sql.Tx, feed icsFeed, todoIDs map[string]int) (int, error) {
+	linked := 0
+	for _, uid := range feed.order {
+		entry := feed.entries[uid]
+		childID, ok := todoIDs[uid]
+		if !ok || entry.parentUID == "" {
+			continue
+		}
+		parentID, ok := todoIDs[entry.parentUID]
+		if !ok || parentID == childID {
+			continue
+		}
+		result, err := tx.Exec("UPDATE todos SET parent_id = ? WHERE id = ? AND parent_id IS NOT ?", parentID, childID, parentID)
+		if err != nil {
+			return linked, err
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			linked += int(n)
+		}
+	}
+	return linked, nil
+}
+
+// icsSubscriptionItem is an imported event or task and the current state of
+// its todo.
+type icsSubscriptionItem struct {
+	uid            string
+	todoID         int
+	importedTitle  string
+	importedDue    string
+	importedAllDay bool
+	importedNotes  string
+	title          string
+	due            string
+	allDay         bool
+	notes          string
+	completed      bool
+}
+
+// applyIcsFeed diffs a feed against the todos already imported from it:
+// new events and tasks are added, changed ones updated following the local
+// edit policy, and removed or cancelled ones handled following the removed
+// policy.
+func applyIcsFeed(sub IcsSubscription, body []byte, refresh *IcsRefresh) error {
+	rules, err := sub.ImportRules.compile()
+	if err != nil {
+		return fmt.Errorf("import rules: %v", err)
+	}
+	feed, err := parseIcsFeed(body, rules, time.Now())
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	items, err := queryIcsSubscriptionItems(tx, sub.ID)
+	if err != nil {
+		return err
+	}
+
+	todoIDs := make(map[string]int)
+	for _, item := range items {
+		cancelled, inFeed := feed.uids[item.uid]
+		entry, ok := feed.entries[item.uid]
+		var reason string
+		switch {
+		case !inFeed:
+			reason = "event removed from the feed"
+		case cancelled:
+			reason = "event cancelled"
+		case !ok && feed.excluded[item.uid]:
+			// Only when no occurrence in the window matches any more
+			reason = "event excluded by the import rules"
+		}
+		if reason != "" {
+			if err := removeIcsItem(tx, sub, item, reason, refresh); err != nil {
+				return err
+			}
+			continue
+		}
+		todoIDs[item.uid] = item.todoID
+
+		if !ok || item.completed {
+			// Past events, and todos already done, are left alone
+			continue
+		}
+		if err := updateIcsItem(tx, sub, item, entry, refresh); err != nil {
+			return err
+		}
+	}
+
+	var positionCounter int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE project_id = ?", sub.ProjectID).Scan(&positionCounter); err != nil {
+		return err
+	}
+
+	for _, uid := range feed.order {
+		entry := feed.entries[uid]
+		if _, ok := items[uid]; ok || entry.completed {
+			// Tasks done before they were ever imported are not worth adding
+			continue
+		}
+
+		todoID, err := insertIcsEntry(tx, sub.ProjectID, entry, positionCounter)
+		if err != nil {
+			return err
+		}
+		positionCounter++
+		todoIDs[uid] = todoID
+
+		if _, err := tx.Exec(
+			"INSERT INTO ics_subscription_items (subscription_id, uid, todo_id, title, due_date, all_day, notes) VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?)",
+			sub.ID, uid, todoID, entry.title, entry.due, entry.allDay, entry.notes,
+		); err != nil {
+			return err
+		}
+		refresh.Added++
+		refresh.record(todoID, uid, "added", entry.title)
+	}
+
+	// Subtasks follow their parent upstream
+	if _, err := linkIcsSubtasks(tx, feed, todoIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func queryIcsSubscriptionItems(tx *sql.Tx, subscriptionID int) (map[string]icsSubscriptionItem, error) {
+	rows, err := tx.Query(`
+		SELECT i.uid, i.todo_id, i.title, COALESCE(datetime(i.due_date), ''), i.all_day, i.notes,
+		       t.title, COALESCE(datetime(t.due_date), ''), t.all_day, t.notes, t.completed
+		FROM ics_subscription_items i
+		JOIN todos t ON t.id = i.todo_id
+		WHERE i.subscription_id = ?
+	`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make(map[string]icsSubscriptionItem)
+	for rows.Next() {
+		var item icsSubscriptionItem
+		if err := rows.Scan(&item.uid, &item.todoID, &item.importedTitle, &item.importedDue, &item.importedAllDay, &item.importedNotes,
+			&item.title, &item.due, &item.allDay, &item.notes, &item.completed); err != nil {
+			return nil, err
+		}
+		items[item.uid] = item
+	}
+	return items, rows.Err()
+}
+
+// removeIcsItem deletes or completes the todo of an event that left the
+// feed. Todos already completed are only forgotten.
+func removeIcsItem(tx *sql.Tx, sub IcsSubscription, item icsSubscriptionItem, reason string, refresh *IcsRefresh) error {
+	if _, err := tx.Exec("DELETE FROM ics_subscription_items WHERE subscription_id = ? AND uid = ?", sub.ID, item.uid); err != nil {
+		return err
+	}
+	if item.completed {
+		return nil
+	}
+
+	switch sub.RemovedPolicy {
+	case icsRemovedComplete:
+		if _, err := tx.Exec("UPDATE todos SET completed = 1, completed_at = ? WHERE id = ?", time.Now().UTC(), item.todoID); err != nil {
+			return err
+		}
+		refresh.record(item.todoID, item.uid, "completed", reason)
+	default:
+		if _, err := tx.Exec("DELETE FROM todos WHERE id = ?", item.todoID); err != nil {
+			return err
+		}
+		refresh.record(item.todoID, item.uid, "deleted", reason)
+	}
+	refresh.Removed++
+	return nil
+}
+
+// updateIcsItem applies upstream changes to an event's or task's todo. A
+// field that was edited locally is only overwritten when the policy says so,
+// and tasks completed upstream complete their todo.
+func updateIcsItem(tx *sql.Tx, sub IcsSubscription, item icsSubscriptionItem, entry icsEntry, refresh *IcsRefresh) error {
+	if entry.completed {
+		completedAt := entry.completedAt
+		if completedAt == nil {
+			now := time.Now().UTC()
+			completedAt = &now
+		}
+		if _, err := tx.Exec("UPDATE todos SET completed = 1, completed_at = ? WHERE id = ?", completedAt, item.todoID); err != nil {
+			return err
+		}
+		refresh.Updated++
+		refresh.record(item.todoID, item.uid, "completed", "task completed upstream")
+		return nil
+	}
+
+	dueChanged := entry.due != item.importedDue || entry.allDay != item.importedAllDay
+	if entry.title == item.importedTitle && !dueChanged && entry.notes == item.importedNotes {
+		return nil
+	}
+
+	overwrite := sub.LocalEditPolicy == icsLocalEditOverwrite
+	title, due, allDay, notes := item.title, item.due, item.allDay, item.notes
+	var changed, kept []string
+
+	if entry.title != item.importedTitle {
+		if item.title == item.importedTitle || overwrite {
+			changed = append(changed, fmt.Sprintf("title %q → %q", item.title, entry.title))
+			title = entry.title
+		} else {
+			kept = append(kept, fmt.Sprintf("title %q (upstream %q)", item.title, entry.title))
+		}
+	}
+	if dueChanged {
+		current, upstream := describeDue(item.due, item.allDay), describeDue(entry.due, entry.allDay)
+		if (item.due == item.importedDue && item.allDay == item.importedAllDay) || overwrite {
+			changed = append(changed, fmt.Sprintf("due %s → %s", current, upstream))
+			due, allDay = entry.due, entry.allDay
+		} else {
+			kept = append(kept, fmt.Sprintf("due %s (upstream %s)", current, upstream))
+		}
+	}
+	if entry.notes != item.importedNotes {
+		if item.notes == item.importedNotes || overwrite {
+			changed = append(changed, "notes")
+			notes = entry.notes
+		} else {
+			kept = append(kept, "notes")
+		}
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE ics_subscription_items SET title = ?, due_date = NULLIF(?, ''), all_day = ?, notes = ? WHERE subscription_id = ? AND uid = ?",
+		entry.title, entry.due, entry.allDay, entry.notes, sub.ID, item.uid,
+	); err != nil {
+		return err
+	}
+
+	if len(changed) > 0 {
+		if _, err := tx.Exec(
+			"UPDATE todos SET title = ?, due_date = NULLIF(?, ''), all_day = ?, notes = ? WHERE id = ?",
+			title, due, allDay, notes, item.todoID,
+		); err != nil {
+			return err
+		}
+		// Offset reminders follow the due date, so they fire again once it moves
+		if due != item.due {
+			if _, err := tx.Exec("UPDATE reminders SET sent_at = NULL WHERE todo_id = ? AND offset_minutes IS NOT NULL", item.todoID); err != nil {
+				return err
+			}
+		}
+		refresh.Updated++
+		refresh.record(item.todoID, item.uid, "updated", strings.Join(changed, ", "))
+	}
+	if len(kept) > 0 {
+		refresh.record(item.todoID, item.uid, "kept_local_edit", strings.Join(kept, ", "))
+	}
+	return nil
+}
+
+func describeDue(due string, allDay bool) string {
+	if due == "" {
+		return "none"
+	}
+	if allDay {
+		return strings.TrimSuffix(due, " 00:00:00") + " (all day)"
+	}
+	return due
+}
+
+// saveIcsRefresh stores a refresh and its changes, keeping only the most
+// recent ones for the subscription.
+func saveIcsRefresh(refresh *IcsRefresh) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO ics_refreshes (subscription_id, refreshed_at, added, updated, removed, http_status, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		refresh.SubscriptionID, refresh.RefreshedAt, refresh.Added, refresh.Updated, refresh.Removed, refresh.HTTPStatus, refresh.Error,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	refresh.ID = int(id)
+
+	for _, change := range refresh.Changes {
+		if _, err := tx.Exec(
+			"INSERT INTO ics_refresh_changes (refresh_id, todo_id, uid, action, details) VALUES (?, ?, ?, ?, ?)",
+			refresh.ID, change.TodoID, change.UID, change.Action, change.Details,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM ics_refresh_changes WHERE refresh_id IN (
+			SELECT id FROM ics_refreshes WHERE subscription_id = ? ORDER BY id DESC LIMIT -1 OFFSET ?
+		)`, refresh.SubscriptionID, icsRefreshHistory); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM ics_refreshes WHERE id IN (
+			SELECT id FROM ics_refreshes WHERE subscription_id = ? ORDER BY id DESC LIMIT -1 OFFSET ?
+		)`, refresh.SubscriptionID, icsRefreshHistory); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getIcsRefreshesHandler lists the recent refreshes of a subscription, most
+// recent first, with what each one changed.
+func getIcsRefreshesHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, subscription_id, refreshed_at, added, updated, removed, http_status, error FROM ics_refreshes WHERE subscription_id = ? ORDER BY id DESC",
+		subscriptionID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refreshes := make([]IcsRefresh, 0)
+	index := make(map[int]int)
+	for rows.Next() {
+		refresh := IcsRefresh{Changes: make([]IcsRefreshChange, 0)}
+		if err := rows.Scan(&refresh.ID, &refresh.SubscriptionID, &refresh.RefreshedAt, &refresh.Added, &refresh.Updated, &refresh.Removed, &refresh.HTTPStatus, &refresh.Error); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		index[refresh.ID] = len(refreshes)
+		refreshes = append(refreshes, refresh)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT c.refresh_id, c.todo_id, c.uid, c.action, c.details
+		FROM ics_refresh_changes c
+		JOIN ics_refreshes r ON r.id = c.refresh_id
+		WHERE r.subscription_id = ?
+		ORDER BY c.id
+	`, subscriptionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var refreshID int
+		var change IcsRefreshChange
+		if err := rows.Scan(&refreshID, &change.TodoID, &change.UID, &change.Action, &change.Details); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if i, ok := index[refreshID]; ok {
+			refreshes[i].Changes = append(refreshes[i].Changes, change)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refreshes)
+}
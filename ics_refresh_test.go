@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// icsTestEvent is a VEVENT starting the given number of days from now.
+func icsTestEvent(uid, summary string, days int, extra string) string {
+	start := time.Now().UTC().AddDate(0, 0, days).Truncate(time.Hour)
+	return fmt.Sprintf("BEGIN:VEVENT\r\nUID:%s\r\nDTSTAMP:20240101T000000Z\r\nSUMMARY:%s\r\nDTSTART:%s\r\nDTEND:%s\r\n%sEND:VEVENT\r\n",
+		uid, summary, start.Format("20060102T150405Z"), start.Add(time.Hour).Format("20060102T150405Z"), extra)
+}
+
+func icsTestFeed(events ...string) []byte {
+	return []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n")
+}
+
+func newTestIcsSubscription(t *testing.T, url, localEditPolicy, removedPolicy string) IcsSubscription {
+	t.Helper()
+	result, err := db.Exec(
+		"INSERT INTO ics_subscriptions (url, project_id, local_edit_policy, removed_policy) VALUES (?, 1, ?, ?)",
+		url, localEditPolicy, removedPolicy,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return IcsSubscription{ID: int(id), URL: url, ProjectID: 1, LocalEditPolicy: localEditPolicy, RemovedPolicy: removedPolicy}
+}
+
+func applyTestFeed(t *testing.T, sub IcsSubscription, body []byte) IcsRefresh {
+	t.Helper()
+	var refresh IcsRefresh
+	if err := applyIcsFeed(sub, body, &refresh); err != nil {
+		t.Fatal(err)
+	}
+	return refresh
+}
+
+func icsItemTodoID(t *testing.T, sub IcsSubscription, uid string) int {
+	t.Helper()
+	var todoID int
+	if err := db.QueryRow("SELECT todo_id FROM ics_subscription_items WHERE subscription_id = ? AND uid = ?", sub.ID, uid).Scan(&todoID); err != nil {
+		t.Fatalf("item %s: %v", uid, err)
+	}
+	return todoID
+}
+
+func refreshActions(refresh IcsRefresh) []string {
+	var actions []string
+	for _, change := range refresh.Changes {
+		actions = append(actions, change.Action)
+	}
+	return actions
+}
+
+func TestApplyIcsFeedLocalEdits(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		localTitle string
+		localDue   bool
+		upstream   string
+		wantTitle  string
+		// Whether the todo still has the due date set locally
+		wantLocalDue bool
+		wantActions  []string
+	}{
+		{
+			name: "upstream change without local edit", policy: icsLocalEditKeep,
+			upstream: icsTestEvent("e", "Dentist at noon", 2, ""), wantTitle: "Dentist at noon",
+			wantActions: []string{"updated"},
+		},
+		{
+			name: "local title kept", policy: icsLocalEditKeep, localTitle: "My dentist",
+			upstream: icsTestEvent("e", "Dentist at noon", 2, ""), wantTitle: "My dentist",
+			wantActions: []string{"kept_local_edit"},
+		},
+		{
+			name: "local title overwritten", policy: icsLocalEditOverwrite, localTitle: "My dentist",
+			upstream: icsTestEvent("e", "Dentist at noon", 2, ""), wantTitle: "Dentist at noon",
+			wantActions: []string{"updated"},
+		},
+		{
+			name: "local due kept while title follows upstream", policy: icsLocalEditKeep, localDue: true,
+			upstream: icsTestEvent("e", "Dentist at noon", 3, ""), wantTitle: "Dentist at noon", wantLocalDue: true,
+			wantActions: []string{"updated", "kept_local_edit"},
+		},
+		{
+			name: "local due overwritten", policy: icsLocalEditOverwrite, localDue: true,
+			upstream: icsTestEvent("e", "Dentist", 3, ""), wantTitle: "Dentist",
+			wantActions: []string{"updated"},
+		},
+		{
+			name: "unchanged upstream leaves local edits alone", policy: icsLocalEditOverwrite, localTitle: "My dentist",
+			upstream: icsTestEvent("e", "Dentist", 2, ""), wantTitle: "My dentist",
+		},
+	}
+
+	localDue := time.Date(2031, time.March, 4, 9, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDatabase(t)
+			sub := newTestIcsSubscription(t, "https://example.com/feed.ics", tt.policy, icsRemovedDelete)
+
+			refresh := applyTestFeed(t, sub, icsTestFeed(icsTestEvent("e", "Dentist", 2, "")))
+			if refresh.Added != 1 {
+				t.Fatalf("added %d todos, want 1", refresh.Added)
+			}
+			todoID := icsItemTodoID(t, sub, "e")
+			if tt.localTitle != "" {
+				if _, err := db.Exec("UPDATE todos SET title = ? WHERE id = ?", tt.localTitle, todoID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.localDue {
+				if _, err := db.Exec("UPDATE todos SET due_date = ? WHERE id = ?", localDue, todoID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			refresh = applyTestFeed(t, sub, icsTestFeed(tt.upstream))
+			if got := strings.Join(refreshActions(refresh), ","); got != strings.Join(tt.wantActions, ",") {
+				t.Errorf("actions = %q, want %q", got, strings.Join(tt.wantActions, ","))
+			}
+
+			var title string
+			var due time.Time
+			if err := db.QueryRow("SELECT title, due_date FROM todos WHERE id = ?", todoID).Scan(&title, &due); err != nil {
+				t.Fatal(err)
+			}
+			if title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", title, tt.wantTitle)
+			}
+			if got := due.Equal(localDue); got != tt.wantLocalDue {
+				t.Errorf("due = %v, want local due date kept: %v", due, tt.wantLocalDue)
+			}
+		})
+	}
+}
+
+func TestApplyIcsFeedRemovedItems(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		completeFirst bool
+		feed          []byte
+		wantExists    bool
+		wantCompleted bool
+		wantRemoved   int
+	}{
+		{
+			name: "removed and deleted", policy: icsRemovedDelete,
+			feed:        icsTestFeed(icsTestEvent("keep", "Keep", 1, "")),
+			wantRemoved: 1,
+		},
+		{
+			name: "removed and completed", policy: icsRemovedComplete,
+			feed:       icsTestFeed(icsTestEvent("keep", "Keep", 1, "")),
+			wantExists: true, wantCompleted: true, wantRemoved: 1,
+		},
+		{
+			name: "cancelled and deleted", policy: icsRemovedDelete,
+			feed:        icsTestFeed(icsTestEvent("keep", "Keep", 1, ""), icsTestEvent("gone", "Gone", 2, "STATUS:CANCELLED\r\n")),
+			wantRemoved: 1,
+		},
+		{
+			name: "cancelled and completed", policy: icsRemovedComplete,
+			feed:       icsTestFeed(icsTestEvent("keep", "Keep", 1, ""), icsTestEvent("gone", "Gone", 2, "STATUS:CANCELLED\r\n")),
+			wantExists: true, wantCompleted: true, wantRemoved: 1,
+		},
+		{
+			name: "already completed todo is only forgotten", policy: icsRemovedDelete, completeFirst: true,
+			feed:       icsTestFeed(icsTestEvent("keep", "Keep", 1, "")),
+			wantExists: true, wantCompleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDatabase(t)
+			sub := newTestIcsSubscription(t, "https://example.com/feed.ics", icsLocalEditKeep, tt.policy)
+
+			applyTestFeed(t, sub, icsTestFeed(icsTestEvent("keep", "Keep", 1, ""), icsTestEvent("gone", "Gone", 2, "")))
+			todoID := icsItemTodoID(t, sub, "gone")
+			if tt.completeFirst {
+				if _, err := db.Exec("UPDATE todos SET completed = 1 WHERE id = ?", todoID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			refresh := applyTestFeed(t, sub, tt.feed)
+			if refresh.Removed != tt.wantRemoved {
+				t.Errorf("removed = %d, want %d", refresh.Removed, tt.wantRemoved)
+			}
+
+			var completed bool
+			err := db.QueryRow("SELECT completed FROM todos WHERE id = ?", todoID).Scan(&completed)
+			if exists := err == nil; exists != tt.wantExists {
+				t.Fatalf("todo exists = %v, want %v (%v)", exists, tt.wantExists, err)
+			}
+			if tt.wantExists && completed != tt.wantCompleted {
+				t.Errorf("completed = %v, want %v", completed, tt.wantCompleted)
+			}
+
+			var items int
+			if err := db.QueryRow("SELECT COUNT(*) FROM ics_subscription_items WHERE subscription_id = ? AND uid = 'gone'", sub.ID).Scan(&items); err != nil {
+				t.Fatal(err)
+			}
+			if items != 0 {
+				t.Error("the removed event is still tracked")
+			}
+			if id := icsItemTodoID(t, sub, "keep"); id == 0 {
+				t.Error("the event still in the feed lost its todo")
+			}
+		})
+	}
+}
+
+func TestRefreshIcsSubscriptionNotModified(t *testing.T) {
+	openTestDatabase(t)
+
+	body := icsTestFeed(icsTestEvent("e", "Dentist", 2, ""))
+	const etag = `"v1"`
+	var conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "text/calendar")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	sub := newTestIcsSubscription(t, server.URL+"/feed.ics", icsLocalEditKeep, icsRemovedDelete)
+
+	refresh, err := refreshIcsSubscriptionByID(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh.Error != nil || refresh.Added != 1 {
+		t.Fatalf("first refresh: added %d, error %v", refresh.Added, refresh.Error)
+	}
+	todoID := icsItemTodoID(t, sub, "e")
+
+	// A local edit would be overwritten if the feed were applied again
+	if _, err := db.Exec("UPDATE ics_subscriptions SET local_edit_policy = ? WHERE id = ?", icsLocalEditOverwrite, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE todos SET title = 'Mine' WHERE id = ?", todoID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE ics_subscription_items SET title = 'Old' WHERE todo_id = ?", todoID); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err = refreshIcsSubscriptionByID(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conditional != 1 {
+		t.Fatalf("server saw %d conditional requests, want 1", conditional)
+	}
+	if refresh.Error != nil || refresh.HTTPStatus == nil || *refresh.HTTPStatus != http.StatusNotModified {
+		t.Fatalf("second refresh: status %v, error %v", refresh.HTTPStatus, refresh.Error)
+	}
+	if len(refresh.Changes) != 0 {
+		t.Errorf("not modified refresh made changes: %+v", refresh.Changes)
+	}
+
+	var title string
+	if err := db.QueryRow("SELECT title FROM todos WHERE id = ?", todoID).Scan(&title); err != nil {
+		t.Fatal(err)
+	}
+	if title != "Mine" {
+		t.Errorf("title = %q after a not modified refresh, want the local edit", title)
+	}
+}
+
+func TestIcsCredentialsDroppedOnCrossHostRedirect(t *testing.T) {
+	received := make(map[string]http.Header)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received[r.URL.Path] = r.Header.Clone()
+	}))
+	defer other.Close()
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received[r.URL.Path] = r.Header.Clone()
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/feed.ics", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, other.URL+"/feed.ics", http.StatusFound)
+		}
+	}))
+	defer feed.Close()
+
+	credentials := IcsCredentials{BearerToken: "secret", Headers: map[string]string{"X-Api-Key": "key"}}
+	for _, tt := range []struct {
+		path     string
+		wantSent bool
+	}{
+		{"/moved", true},
+		{"/elsewhere", false},
+	} {
+		clear(received)
+		req, err := http.NewRequest(http.MethodGet, feed.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := icsHTTPClient.Do(credentials.apply(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		header, ok := received["/feed.ics"]
+		if !ok {
+			t.Fatalf("%s: redirect was not followed", tt.path)
+		}
+		for _, name := range []string{"Authorization", "X-Api-Key"} {
+			if sent := header.Get(name) != ""; sent != tt.wantSent {
+				t.Errorf("%s: %s sent after the redirect = %v, want %v", tt.path, name, sent, tt.wantSent)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/apognu/gocal"
+)
+
+// IcsImportRules decide which events of a subscription become todos, and
+// what those todos look like. The zero value imports every event.
+type IcsImportRules struct {
+	// Regular expressions matched against the event summary
+	IncludeSummary string `json:"include_summary,omitempty"`
+	ExcludeSummary string `json:"exclude_summary,omitempty"`
+
+	// Events need one of the included categories and none of the excluded
+	IncludeCategories []string `json:"include_categories,omitempty"`
+	ExcludeCategories []string `json:"exclude_categories,omitempty"`
+
+	// Participation status (ACCEPTED, DECLINED, TENTATIVE, NEEDS-ACTION) of
+	// the attendee with this email address
+	AttendeeEmail         string   `json:"attendee_email,omitempty"`
+	IncludeAttendeeStatus []string `json:"include_attendee_status,omitempty"`
+	ExcludeAttendeeStatus []string `json:"exclude_attendee_status,omitempty"`
+
+	// Import window around today. Zero means today for the past, and the end
+	// of the year after next for the future.
+	PastDays   int `json:"past_days,omitempty"`
+	FutureDays int `json:"future_days,omitempty"`
+
+	AllDayOnly bool `json:"all_day_only,omitempty"`
+
+	// Go template for the todo title, e.g. "{{.Summary}} @ {{.Location}}"
+	TitleTemplate string `json:"title_template,omitempty"`
+
+	// Added to the title of every todo as #tags
+	Tags []string `json:"tags,omitempty"`
+
+	// Priority of created todos, 1 (highest) to 9 (lowest) as in iCalendar
+	Priority int `json:"priority,omitempty"`
+}
+
+// icsTitleData is what title templates can refer to.
+type icsTitleData struct {
+	Summary     string
+	Description string
+	Location    string
+	Categories  string
+	Start       time.Time
+}
+
+// compiledIcsImportRules are rules ready to be matched against events.
+type compiledIcsImportRules struct {
+	IcsImportRules
+	includeSummary *regexp.Regexp
+	excludeSummary *regexp.Regexp
+	titleTemplate  *template.Template
+}
+
+func (rules IcsImportRules) compile() (*compiledIcsImportRules, error) {
+	compiled := &compiledIcsImportRules{IcsImportRules: rules}
+	var err error
+	if rules.IncludeSummary != "" {
+		if compiled.includeSummary, err = regexp.Compile(rules.IncludeSummary); err != nil {
+			return nil, fmt.Errorf("include_summary: %v", err)
+		}
+	}
+	if rules.ExcludeSummary != "" {
+		if compiled.excludeSummary, err = regexp.Compile(rules.ExcludeSummary); err != nil {
+			return nil, fmt.Errorf("exclude_summary: %v", err)
+		}
+	}
+	if rules.TitleTemplate != "" {
+		if compiled.titleTemplate, err = template.New("title").Parse(rules.TitleTemplate); err != nil {
+			return nil, fmt.Errorf("title_template: %v", err)
+		}
+		// Catch references to fields that do not exist
+		if err := compiled.titleTemplate.Execute(io.Discard, icsTitleData{}); err != nil {
+			return nil, fmt.Errorf("title_template: %v", err)
+		}
+	}
+	if (len(rules.IncludeAttendeeStatus) > 0 || len(rules.ExcludeAttendeeStatus) > 0) && rules.AttendeeEmail == "" {
+		return nil, fmt.Errorf("attendee_email is required to filter on attendee status")
+	}
+	if rules.PastDays < 0 || rules.FutureDays < 0 {
+		return nil, fmt.Errorf("past_days and future_days cannot be negative")
+	}
+	if rules.Priority < 0 || rules.Priority > 9 {
+		return nil, fmt.Errorf("priority must be between 0 and 9")
+	}
+	for _, tag := range rules.Tags {
+		if tag == "" || strings.ContainsAny(tag, " \t#") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return compiled, nil
+}
+
+// window returns the range of event starts to import.
+func (rules *compiledIcsImportRules) window(now time.Time) (time.Time, time.Time) {
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start := startOfDay.AddDate(0, 0, -rules.PastDays)
+	end := time.Date(now.Year()+2, time.December, 31, 23, 59, 59, 0, time.UTC)
+	if rules.FutureDays > 0 {
+		end = startOfDay.AddDate(0, 0, rules.FutureDays+1)
+	}
+	return start, end
+}
+
+// matches reports whether an event passes the filters.
+func (rules *compiledIcsImportRules) matches(event gocal.Event) bool {
+	if rules.includeSummary != nil && !rules.includeSummary.MatchString(event.Summary) {
+		return false
+	}
+	if rules.excludeSummary != nil && rules.excludeSummary.MatchString(event.Summary) {
+		return false
+	}
+
+	hasCategory := func(names []string) bool {
+		for _, category := range event.Categories {
+			for _, name := range names {
+				if strings.EqualFold(strings.TrimSpace(category), name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(rules.IncludeCategories) > 0 && !hasCategory(rules.IncludeCategories) {
+		return false
+	}
+	if len(rules.ExcludeCategories) > 0 && hasCategory(rules.ExcludeCategories) {
+		return false
+	}
+
+	if rules.AttendeeEmail != "" {
+		status := icsAttendeeStatus(event, rules.AttendeeEmail)
+		matchesStatus := func(statuses []string) bool {
+			return slices.ContainsFunc(statuses, func(s string) bool { return strings.EqualFold(s, status) })
+		}
+		if len(rules.IncludeAttendeeStatus) > 0 && !matchesStatus(rules.IncludeAttendeeStatus) {
+			return false
+		}
+		if len(rules.ExcludeAttendeeStatus) > 0 && matchesStatus(rules.ExcludeAttendeeStatus) {
+			return false
+		}
+	}
+
+	if rules.AllDayOnly && !icsEventAllDay(event) {
+		return false
+	}
+	return true
+}
+
+// icsAttendeeStatus returns the PARTSTAT of an attendee, "" when the email
+// address is not invited, and NEEDS-ACTION (the default) when it is unset.
+func icsAttendeeStatus(event gocal.Event, email string) string {
+	for _, attendee := range event.Attendees {
+		address := strings.TrimPrefix(strings.ToLower(attendee.Value), "mailto:")
+		if strings.EqualFold(address, email) {
+			if attendee.Status == "" {
+				return "NEEDS-ACTION"
+			}
+			return strings.ToUpper(attendee.Status)
+		}
+	}
+	return ""
+}
+
+// icsEventAllDay reports whether an event starts on a date rather than at a
+// time of day.
+func icsEventAllDay(event gocal.Event) bool {
+	return strings.EqualFold(event.RawStart.Params["VALUE"], "DATE") || len(strings.TrimSpace(event.RawStart.Value)) == 8
+}
+
+// title builds the todo title for an event.
+func (rules *compiledIcsImportRules) title(event gocal.Event) string {
+	title := event.Summary
+	if rules.titleTemplate != nil {
+		data := icsTitleData{
+			Summary:     event.Summary,
+			Description: event.Description,
+			Location:    event.Location,
+			Categories:  strings.Join(event.Categories, ", "),
+		}
+		if event.Start != nil {
+			data.Start = *event.Start
+		}
+		var b strings.Builder
+		if err := rules.titleTemplate.Execute(&b, data); err == nil && strings.TrimSpace(b.String()) != "" {
+			title = strings.TrimSpace(b.String())
+		}
+	}
+	for _, tag := range rules.Tags {
+		title += " #" + tag
+	}
+	return title
+}
+
+// parseIcsImportRules reads the import_rules column.
+func parseIcsImportRules(raw string) (IcsImportRules, error) {
+	var rules IcsImportRules
+	if raw == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(raw), &rules)
+	return rules, err
+}
+
+// encodeIcsImportRules returns the value stored in the import_rules column,
+// or nil when the rules import everything unchanged.
+func encodeIcsImportRules(rules IcsImportRules) (*string, error) {
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	if string(encoded) == "{}" {
+		return nil, nil
+	}
+	s := string(encoded)
+	return &s, nil
+}
@@ -0,0 +1,84 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// googleTasksExport is the Tasks.json file of a Google Takeout archive,
+// which has the shape of the Tasks API.
+type googleTasksExport struct {
+	Items []googleTaskList `json:"items"`
+}
+
+type googleTaskList struct {
+	ID    string       `json:"id"`
+	Title string       `json:"title"`
+	Items []googleTask `json:"items"`
+}
+
+type googleTask struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Notes     string `json:"notes"`
+	Status    string `json:"status"`
+	Due       string `json:"due"`
+	Completed string `json:"completed"`
+	Parent    string `json:"parent"`
+	Position  string `json:"position"`
+	Deleted   bool   `json:"deleted"`
+}
+
+func parseGoogleTasks(data []byte, opts Options) ([]List, error) {
+	var export googleTasksExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+	if len(export.Items) == 0 {
+		return nil, fmt.Errorf("no task lists found in the export")
+	}
+
+	lists := make([]List, 0, len(export.Items))
+	for _, taskList := range export.Items {
+		list := List{Title: strings.TrimSpace(taskList.Title)}
+
+		// Positions order siblings, so sorting them all keeps each
+		// subtask list in order too
+		items := taskList.Items
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Position < items[j].Position })
+		for _, item := range items {
+			if item.Deleted {
+				continue
+			}
+			task := Task{
+				ID:     item.ID,
+				Parent: item.Parent,
+				Title:  item.Title,
+				Notes:  item.Notes,
+				Done:   item.Status == "completed",
+			}
+			if item.ID != "" {
+				task.UID = item.ID + "@tasks.google.com"
+			}
+			if item.Due != "" {
+				if due, err := time.Parse(time.RFC3339, item.Due); err != nil {
+					task.Problems = append(task.Problems, fmt.Sprintf("invalid due date %q, imported without one", item.Due))
+				} else {
+					// Google Tasks only keep the date of a due date
+					due = date(due.UTC())
+					task.Due = &due
+					task.AllDay = true
+				}
+			}
+			if completed, err := time.Parse(time.RFC3339, item.Completed); err == nil && task.Done {
+				task.Completed = &completed
+			}
+			list.Tasks = append(list.Tasks, task)
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
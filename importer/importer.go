@@ -0,0 +1,143 @@
+// Package importer reads the exports of other todo apps (Google Tasks,
+// Todoist, Microsoft To Do and Trello) into one model of lists and tasks,
+// so that the app imports them all the same way.
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sources an export can be read from.
+const (
+	GoogleTasks   = "google_tasks"
+	Todoist       = "todoist"
+	TodoistCSV    = "todoist_csv"
+	MicrosoftToDo = "microsoft_todo"
+	Trello        = "trello"
+)
+
+var parsers = map[string]func(data []byte, opts Options) ([]List, error){
+	GoogleTasks:   parseGoogleTasks,
+	Todoist:       parseTodoist,
+	TodoistCSV:    parseTodoistCSV,
+	MicrosoftToDo: parseMicrosoftToDo,
+	Trello:        parseTrello,
+}
+
+// List is a list of tasks, which becomes a project.
+type List struct {
+	Title string
+	// Tasks in the order the source shows them, subtasks included
+	Tasks []Task
+}
+
+// Task is a task, or a checklist item as a subtask of its card or task.
+type Task struct {
+	// ID identifies the task within the export, for Parent to refer to
+	ID     string
+	Parent string
+	// UID is kept on the todo so that importing an export again skips it.
+	// Empty when the source has no stable ids.
+	UID   string
+	Title string
+	Notes string
+	Done  bool
+	// When the task was completed, if the source says
+	Completed *time.Time
+	// All-day due dates are the date at midnight UTC
+	Due                *time.Time
+	AllDay             bool
+	RecurrenceInterval int
+	RecurrenceUnit     string // days, weeks, months or years
+	// 1 (highest) to 9, 0 for none
+	Priority int
+	Labels   []string
+	// Problems are what could not be read; the rest of the task still is
+	Problems []string
+}
+
+// Options are what some sources need besides the export.
+type Options struct {
+	// Location is the time zone of dates and times that have none
+	Location *time.Location
+	// Title names the list of sources that do not name their own, such as
+	// a Todoist CSV file, which holds one project
+	Title string
+}
+
+// Sources returns the names of the sources, sorted.
+func Sources() []string {
+	names := make([]string, 0, len(parsers))
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse reads an export of the given source.
+func Parse(source string, data []byte, opts Options) ([]List, error) {
+	parse, ok := parsers[source]
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q, expected one of %s", source, strings.Join(Sources(), ", "))
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	return parse(data, opts)
+}
+
+// Detect guesses the source of an export from its shape, or returns "".
+func Detect(data []byte) string {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(data, []byte("{")) {
+		header, _, _ := bytes.Cut(data, []byte("\n"))
+		if bytes.HasPrefix(bytes.ToUpper(header), []byte("TYPE,CONTENT")) {
+			return TodoistCSV
+		}
+		return ""
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return ""
+	}
+	has := func(key string) bool {
+		_, ok := keys[key]
+		return ok
+	}
+	switch {
+	case has("cards") && has("lists"):
+		return Trello
+	case has("items") && has("projects"):
+		return Todoist
+	case has("lists") || has("value"):
+		return MicrosoftToDo
+	case has("items"):
+		return GoogleTasks
+	}
+	return ""
+}
+
+// date is a date at midnight UTC, the way all-day due dates are kept.
+func date(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+var nonWordPattern = regexp.MustCompile(`\W+`)
+
+// Tag turns a label into a #tag, which can only hold word characters.
+func Tag(label string) string {
+	name := strings.Trim(nonWordPattern.ReplaceAllString(strings.TrimSpace(label), "_"), "_")
+	if name == "" {
+		return ""
+	}
+	return "#" + name
+}
@@ -0,0 +1,232 @@
+package importer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const googleExport = `{"kind": "tasks#taskLists", "items": [{"id": "L1", "title": " Groceries ", "items": [
+	{"id": "t2", "title": "Eggs", "parent": "t1", "position": "00000000000000000001", "status": "needsAction"},
+	{"id": "t1", "title": "Shop", "notes": "Before noon", "position": "00000000000000000000", "status": "needsAction",
+	 "due": "2024-01-10T00:00:00.000Z"},
+	{"id": "t3", "title": "Old", "position": "00000000000000000002", "status": "completed",
+	 "completed": "2024-01-02T08:00:00.000Z"},
+	{"id": "t4", "title": "Gone", "position": "00000000000000000003", "deleted": true},
+	{"id": "t5", "title": "Odd", "position": "00000000000000000004", "due": "soon"}
+]}]}`
+
+const todoistExport = `{
+	"projects": [{"id": "P2", "name": "Work", "child_order": 2}, {"id": "P1", "name": "Home", "child_order": 1},
+	             {"id": "P3", "name": "Trash", "is_deleted": true}],
+	"sections": [{"id": "S1", "name": "Garden", "project_id": "P1", "section_order": 1}],
+	"items": [
+		{"id": "i1", "project_id": "P1", "content": "Water plants", "priority": 4, "labels": ["outside"], "child_order": 1,
+		 "due": {"date": "2024-01-10", "string": "every 2 weeks", "is_recurring": true}},
+		{"id": "i2", "project_id": "P1", "section_id": "S1", "content": "Mow", "priority": 1, "child_order": 2,
+		 "due": {"date": "2024-01-10T09:00:00Z"}},
+		{"id": "i3", "project_id": "P1", "parent_id": "i1", "content": "Refill can", "checked": true,
+		 "completed_at": "2024-01-05T10:00:00Z", "child_order": 3},
+		{"id": "i4", "project_id": "P2", "content": "Report", "priority": 2, "child_order": 4,
+		 "due": {"date": "2024-01-10T09:00:00", "timezone": "Europe/Paris"}},
+		{"id": "i5", "project_id": "P3", "content": "Deleted project", "child_order": 5}
+	]}`
+
+const todoistCSV = "\xef\xbb\xbfTYPE,CONTENT,DESCRIPTION,PRIORITY,INDENT,AUTHOR,RESPONSIBLE,DATE,DATE_LANG,TIMEZONE\n" +
+	"task,Plan trip @travel,Where to?,4,1,,,2024-03-01,en,UTC\n" +
+	"note,Ask about visas,,,,,,,,\n" +
+	"task,Book flights,,1,2,,,,,\n" +
+	"section,Packing,,,,,,,,\n" +
+	"task,Passport,,1,3,,,someday,en,\n"
+
+const microsoftExport = `{"lists": [{"id": "L1", "displayName": "Tasks", "tasks": [
+	{"id": "m1", "title": "Pay bills", "status": "notStarted", "importance": "high",
+	 "body": {"content": "<p>Gas &amp; power</p>", "contentType": "html"},
+	 "dueDateTime": {"dateTime": "2024-01-10T00:00:00.0000000", "timeZone": "W. Europe Standard Time"},
+	 "categories": ["Money"],
+	 "recurrence": {"pattern": {"type": "absoluteMonthly", "interval": 1}},
+	 "checklistItems": [{"id": "c1", "displayName": "Gas", "isChecked": true, "checkedDateTime": "2024-01-03T10:00:00Z"}]},
+	{"id": "m2", "title": "Gym", "status": "completed", "importance": "low",
+	 "completedDateTime": {"dateTime": "2024-01-04T18:00:00.0000000", "timeZone": "UTC"},
+	 "recurrence": {"pattern": {"type": "weeklyOnWeekdays"}}}
+]}]}`
+
+const trelloExport = `{"name": "Board", "lists": [
+	{"id": "l2", "name": "Done", "pos": 2}, {"id": "l1", "name": "To do", "pos": 1}, {"id": "l3", "name": "Old", "closed": true, "pos": 3}],
+	"cards": [
+		{"id": "c2", "name": "Second", "idList": "l1", "pos": 2, "labels": [{"name": "", "color": "red"}]},
+		{"id": "c1", "name": "First", "desc": "Details", "idList": "l1", "pos": 1, "due": "2024-01-10T09:00:00.000Z",
+		 "labels": [{"name": "Urgent", "color": "red"}]},
+		{"id": "c3", "name": "Shipped", "idList": "l2", "pos": 1, "dueComplete": true, "dateLastActivity": "2024-01-05T10:00:00.000Z"},
+		{"id": "c4", "name": "Archived", "idList": "l1", "closed": true, "pos": 3},
+		{"id": "c5", "name": "In closed list", "idList": "l3", "pos": 1}
+	],
+	"checklists": [{"id": "k1", "idCard": "c1", "pos": 1, "checkItems": [
+		{"id": "x2", "name": "Step two", "state": "incomplete", "pos": 2},
+		{"id": "x1", "name": "Step one", "state": "complete", "pos": 1}]}]}`
+
+func TestDetect(t *testing.T) {
+	tests := map[string]string{
+		googleExport:    GoogleTasks,
+		todoistExport:   Todoist,
+		todoistCSV:      TodoistCSV,
+		microsoftExport: MicrosoftToDo,
+		`{"value": []}`: MicrosoftToDo,
+		trelloExport:    Trello,
+		`{"other": 1}`:  "",
+		"plain text":    "",
+		`{"broken": `:   "",
+	}
+	for data, want := range tests {
+		if got := Detect([]byte(data)); got != want {
+			t.Errorf("Detect(%.30q) = %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestParseUnknownSource(t *testing.T) {
+	if _, err := Parse("wunderlist", []byte("{}"), Options{}); err == nil {
+		t.Error("Parse of an unknown source succeeded, want an error")
+	}
+}
+
+func TestTag(t *testing.T) {
+	tests := map[string]string{
+		"Urgent":        "#Urgent",
+		" home office ": "#home_office",
+		"@errands!":     "#errands",
+		"---":           "",
+	}
+	for label, want := range tests {
+		if got := Tag(label); got != want {
+			t.Errorf("Tag(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestGoogleTasks(t *testing.T) {
+	lists := parse(t, GoogleTasks, googleExport, Options{})
+	want := []List{{Title: "Groceries", Tasks: []Task{
+		{ID: "t1", UID: "t1@tasks.google.com", Title: "Shop", Notes: "Before noon", Due: at("2024-01-10T00:00:00Z"), AllDay: true},
+		{ID: "t2", Parent: "t1", UID: "t2@tasks.google.com", Title: "Eggs"},
+		{ID: "t3", UID: "t3@tasks.google.com", Title: "Old", Done: true, Completed: at("2024-01-02T08:00:00Z")},
+		{ID: "t5", UID: "t5@tasks.google.com", Title: "Odd", Problems: []string{`invalid due date "soon", imported without one`}},
+	}}}
+	compare(t, lists, want)
+}
+
+func TestTodoist(t *testing.T) {
+	lists := parse(t, Todoist, todoistExport, Options{Location: time.UTC})
+	want := []List{
+		{Title: "Home", Tasks: []Task{
+			{ID: "i1", UID: "i1@todoist.com", Title: "Water plants", Priority: 1, Labels: []string{"outside"},
+				Due: at("2024-01-10T00:00:00Z"), AllDay: true, RecurrenceInterval: 2, RecurrenceUnit: "weeks"},
+			{ID: "i3", Parent: "i1", UID: "i3@todoist.com", Title: "Refill can", Done: true, Completed: at("2024-01-05T10:00:00Z")},
+		}},
+		{Title: "Home / Garden", Tasks: []Task{
+			{ID: "i2", UID: "i2@todoist.com", Title: "Mow", Due: at("2024-01-10T09:00:00Z")},
+		}},
+		{Title: "Work", Tasks: []Task{
+			{ID: "i4", UID: "i4@todoist.com", Title: "Report", Priority: 3, Due: at("2024-01-10T08:00:00Z")},
+		}},
+	}
+	compare(t, lists, want)
+}
+
+func TestTodoistCSV(t *testing.T) {
+	lists := parse(t, TodoistCSV, todoistCSV, Options{Location: time.UTC, Title: "Trip"})
+	want := []List{
+		{Title: "Trip", Tasks: []Task{
+			{ID: "line 2", Title: "Plan trip", Notes: "Where to?\n\nAsk about visas", Priority: 1, Labels: []string{"travel"},
+				Due: at("2024-03-01T00:00:00Z"), AllDay: true},
+			{ID: "line 4", Parent: "line 2", Title: "Book flights"},
+		}},
+		{Title: "Trip / Packing", Tasks: []Task{
+			// An indent deeper than the task before it is capped at one level
+			// below it, and a section starts without parents
+			{ID: "line 6", Title: "Passport", Problems: []string{`due date "someday" not understood, imported without one`}},
+		}},
+	}
+	compare(t, lists, want)
+
+	if _, err := Parse(TodoistCSV, []byte("NAME,VALUE\nx,y\n"), Options{}); err == nil {
+		t.Error("Parse of a CSV file without TYPE succeeded, want an error")
+	}
+}
+
+func TestMicrosoftToDo(t *testing.T) {
+	lists := parse(t, MicrosoftToDo, microsoftExport, Options{})
+	want := []List{{Title: "Tasks", Tasks: []Task{
+		{ID: "m1", UID: "m1@todo.microsoft.com", Title: "Pay bills", Notes: "Gas & power", Priority: 1, Labels: []string{"Money"},
+			Due: at("2024-01-10T00:00:00Z"), AllDay: true, RecurrenceInterval: 1, RecurrenceUnit: "months"},
+		{ID: "c1", Parent: "m1", UID: "c1@todo.microsoft.com", Title: "Gas", Done: true, Completed: at("2024-01-03T10:00:00Z")},
+		{ID: "m2", UID: "m2@todo.microsoft.com", Title: "Gym", Done: true, Priority: 9, Completed: at("2024-01-04T18:00:00Z"),
+			Problems: []string{`recurrence "weeklyOnWeekdays" not supported, imported as a one-off`}},
+	}}}
+	compare(t, lists, want)
+}
+
+func TestTrello(t *testing.T) {
+	lists := parse(t, Trello, trelloExport, Options{})
+	want := []List{
+		{Title: "Board / To do", Tasks: []Task{
+			{ID: "c1", UID: "c1@trello.com", Title: "First", Notes: "Details", Labels: []string{"Urgent"}, Due: at("2024-01-10T09:00:00Z")},
+			{ID: "x1", Parent: "c1", UID: "x1@trello.com", Title: "Step one", Done: true},
+			{ID: "x2", Parent: "c1", UID: "x2@trello.com", Title: "Step two"},
+			{ID: "c2", UID: "c2@trello.com", Title: "Second", Labels: []string{"red"}},
+		}},
+		{Title: "Board / Done", Tasks: []Task{
+			{ID: "c3", UID: "c3@trello.com", Title: "Shipped", Done: true, Completed: at("2024-01-05T10:00:00Z")},
+		}},
+	}
+	compare(t, lists, want)
+}
+
+func parse(t *testing.T, source, data string, opts Options) []List {
+	t.Helper()
+	lists, err := Parse(source, []byte(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lists
+}
+
+// compare checks lists against want, comparing times by the instant.
+func compare(t *testing.T, lists, want []List) {
+	t.Helper()
+	if len(lists) != len(want) {
+		t.Fatalf("got %d lists, want %d: %+v", len(lists), len(want), lists)
+	}
+	for i := range want {
+		if lists[i].Title != want[i].Title {
+			t.Errorf("list %d title = %q, want %q", i, lists[i].Title, want[i].Title)
+		}
+		if len(lists[i].Tasks) != len(want[i].Tasks) {
+			t.Errorf("list %q has %d tasks, want %d: %+v", want[i].Title, len(lists[i].Tasks), len(want[i].Tasks), lists[i].Tasks)
+			continue
+		}
+		for j, task := range lists[i].Tasks {
+			if got, want := normalize(task), normalize(want[i].Tasks[j]); !reflect.DeepEqual(got, want) {
+				t.Errorf("list %q task %d =\n%+v\nwant\n%+v", lists[i].Title, j, got, want)
+			}
+		}
+	}
+}
+
+func normalize(task Task) Task {
+	for _, t := range []**time.Time{&task.Due, &task.Completed} {
+		if *t != nil {
+			utc := (*t).UTC()
+			*t = &utc
+		}
+	}
+	return task
+}
+
+func at(value string) *time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"todo-app/ical"
+)
+
+// microsoftToDoExport is an export of Microsoft To Do in the shape of the
+// Microsoft Graph API: the task lists, each with its tasks. A bare list
+// response ({"value": [...]}) is accepted too.
+type microsoftToDoExport struct {
+	Lists []microsoftToDoList `json:"lists"`
+	Value []microsoftToDoList `json:"value"`
+}
+
+type microsoftToDoList struct {
+	ID          string              `json:"id"`
+	DisplayName string              `json:"displayName"`
+	Tasks       []microsoftToDoTask `json:"tasks"`
+}
+
+type microsoftToDoTask struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Status     string `json:"status"`
+	Importance string `json:"importance"`
+	Body       struct {
+		Content     string `json:"content"`
+		ContentType string `json:"contentType"`
+	} `json:"body"`
+	DueDateTime       *microsoftDateTime `json:"dueDateTime"`
+	CompletedDateTime *microsoftDateTime `json:"completedDateTime"`
+	Categories        []string           `json:"categories"`
+	Recurrence        *struct {
+		Pattern struct {
+			Type     string `json:"type"`
+			Interval int    `json:"interval"`
+		} `json:"pattern"`
+	} `json:"recurrence"`
+	ChecklistItems []struct {
+		ID              string `json:"id"`
+		DisplayName     string `json:"displayName"`
+		IsChecked       bool   `json:"isChecked"`
+		CheckedDateTime string `json:"checkedDateTime"`
+	} `json:"checklistItems"`
+}
+
+// microsoftDateTime is a Graph dateTimeTimeZone: a time without an offset,
+// and the (often Windows) name of its time zone.
+type microsoftDateTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+func (d microsoftDateTime) time() (time.Time, error) {
+	loc := time.UTC
+	if d.TimeZone != "" {
+		var err error
+		if loc, err = ical.Location(d.TimeZone); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.ParseInLocation("2006-01-02T15:04:05.9999999", d.DateTime, loc)
+}
+
+var microsoftRecurrenceUnits = map[string]string{
+	"daily":           "days",
+	"weekly":          "weeks",
+	"absoluteMonthly": "months",
+	"relativeMonthly": "months",
+	"absoluteYearly":  "years",
+	"relativeYearly":  "years",
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func parseMicrosoftToDo(data []byte, opts Options) ([]List, error) {
+	var export microsoftToDoExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+	taskLists := append(export.Lists, export.Value...)
+	if len(taskLists) == 0 {
+		return nil, fmt.Errorf("no task lists found in the export")
+	}
+
+	lists := make([]List, 0, len(taskLists))
+	for _, taskList := range taskLists {
+		list := List{Title: strings.TrimSpace(taskList.DisplayName)}
+		for _, item := range taskList.Tasks {
+			task := Task{
+				ID:     item.ID,
+				Title:  item.Title,
+				Notes:  item.Body.Content,
+				Done:   item.Status == "completed",
+				Labels: item.Categories,
+			}
+			if item.ID != "" {
+				task.UID = item.ID + "@todo.microsoft.com"
+			}
+			if strings.EqualFold(item.Body.ContentType, "html") {
+				task.Notes = strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(task.Notes, "")))
+			}
+			switch item.Importance {
+			case "high":
+				task.Priority = 1
+			case "low":
+				task.Priority = 9
+			}
+
+			if item.DueDateTime != nil {
+				// To Do only has due dates, kept as midnight in the list's
+				// time zone
+				if due, err := item.DueDateTime.time(); err != nil {
+					task.Problems = append(task.Problems, fmt.Sprintf("invalid due date %q, imported without one", item.DueDateTime.DateTime))
+				} else {
+					due = date(due)
+					task.Due = &due
+					task.AllDay = true
+				}
+			}
+			if item.CompletedDateTime != nil && task.Done {
+				if completed, err := item.CompletedDateTime.time(); err == nil {
+					task.Completed = &completed
+				}
+			}
+			if item.Recurrence != nil {
+				pattern := item.Recurrence.Pattern
+				if unit, ok := microsoftRecurrenceUnits[pattern.Type]; ok {
+					task.RecurrenceInterval = max(pattern.Interval, 1)
+					task.RecurrenceUnit = unit
+				} else {
+					task.Problems = append(task.Problems, fmt.Sprintf("recurrence %q not supported, imported as a one-off", pattern.Type))
+				}
+			}
+			list.Tasks = append(list.Tasks, task)
+
+			// Steps become subtasks
+			for _, step := range item.ChecklistItems {
+				subtask := Task{
+					ID:     step.ID,
+					Parent: item.ID,
+					Title:  step.DisplayName,
+					Done:   step.IsChecked,
+				}
+				if step.ID != "" {
+					subtask.UID = step.ID + "@todo.microsoft.com"
+				}
+				if checked, err := time.Parse(time.RFC3339, step.CheckedDateTime); err == nil && step.IsChecked {
+					subtask.Completed = &checked
+				}
+				list.Tasks = append(list.Tasks, subtask)
+			}
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
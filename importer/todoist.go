@@ -0,0 +1,283 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"todo-app/quickadd"
+)
+
+// todoistBackup holds the resources of a Todoist Sync API (v9) response,
+// which is what Todoist's JSON exports contain.
+type todoistBackup struct {
+	Projects []todoistProject `json:"projects"`
+	Sections []todoistSection `json:"sections"`
+	Items    []todoistItem    `json:"items"`
+}
+
+type todoistProject struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ChildOrder int    `json:"child_order"`
+	IsDeleted  bool   `json:"is_deleted"`
+}
+
+type todoistSection struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ProjectID    string `json:"project_id"`
+	SectionOrder int    `json:"section_order"`
+	IsDeleted    bool   `json:"is_deleted"`
+}
+
+type todoistItem struct {
+	ID          string      `json:"id"`
+	ProjectID   string      `json:"project_id"`
+	SectionID   string      `json:"section_id"`
+	ParentID    string      `json:"parent_id"`
+	Content     string      `json:"content"`
+	Description string      `json:"description"`
+	Priority    int         `json:"priority"`
+	ChildOrder  int         `json:"child_order"`
+	Checked     bool        `json:"checked"`
+	CompletedAt string      `json:"completed_at"`
+	Labels      []string    `json:"labels"`
+	Due         *todoistDue `json:"due"`
+	IsDeleted   bool        `json:"is_deleted"`
+}
+
+type todoistDue struct {
+	Date        string `json:"date"`
+	Timezone    string `json:"timezone"`
+	String      string `json:"string"`
+	IsRecurring bool   `json:"is_recurring"`
+}
+
+// todoistPriority maps Todoist's priorities, where 4 is p1, the highest,
+// and 1 is none.
+func todoistPriority(priority int) int {
+	if priority < 2 || priority > 4 {
+		return 0
+	}
+	return 5 - priority
+}
+
+// setTodoistRecurrence reads a recurring due date such as "every 2 weeks".
+// Todoist understands more than the app can repeat, e.g. "every weekday".
+func setTodoistRecurrence(task *Task, text string, loc *time.Location) {
+	result := quickadd.Parse(text, time.Now().In(loc))
+	if result.RecurrenceInterval == nil {
+		task.Problems = append(task.Problems, fmt.Sprintf("recurrence %q not understood, imported as a one-off", text))
+		return
+	}
+	task.RecurrenceInterval = *result.RecurrenceInterval
+	task.RecurrenceUnit = strings.TrimSuffix(*result.RecurrenceUnit, "s") + "s"
+}
+
+func parseTodoist(data []byte, opts Options) ([]List, error) {
+	var backup todoistBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, err
+	}
+	if len(backup.Projects) == 0 {
+		return nil, fmt.Errorf("no projects found in the export")
+	}
+
+	sort.SliceStable(backup.Projects, func(i, j int) bool { return backup.Projects[i].ChildOrder < backup.Projects[j].ChildOrder })
+	sort.SliceStable(backup.Sections, func(i, j int) bool { return backup.Sections[i].SectionOrder < backup.Sections[j].SectionOrder })
+	sort.SliceStable(backup.Items, func(i, j int) bool { return backup.Items[i].ChildOrder < backup.Items[j].ChildOrder })
+
+	// A project is a list, and each of its sections a list after it
+	listIndex := make(map[[2]string]int)
+	var lists []List
+	for _, project := range backup.Projects {
+		if project.IsDeleted {
+			continue
+		}
+		listIndex[[2]string{project.ID, ""}] = len(lists)
+		lists = append(lists, List{Title: strings.TrimSpace(project.Name)})
+		for _, section := range backup.Sections {
+			if section.ProjectID != project.ID || section.IsDeleted {
+				continue
+			}
+			listIndex[[2]string{project.ID, section.ID}] = len(lists)
+			lists = append(lists, List{Title: strings.TrimSpace(project.Name) + " / " + strings.TrimSpace(section.Name)})
+		}
+	}
+
+	for _, item := range backup.Items {
+		if item.IsDeleted {
+			continue
+		}
+		i, ok := listIndex[[2]string{item.ProjectID, item.SectionID}]
+		if !ok {
+			// Sections that were removed leave their tasks in the project
+			if i, ok = listIndex[[2]string{item.ProjectID, ""}]; !ok {
+				continue
+			}
+		}
+
+		task := Task{
+			ID:       item.ID,
+			Parent:   item.ParentID,
+			UID:      item.ID + "@todoist.com",
+			Title:    item.Content,
+			Notes:    item.Description,
+			Done:     item.Checked,
+			Priority: todoistPriority(item.Priority),
+			Labels:   item.Labels,
+		}
+		if completed, err := time.Parse(time.RFC3339, item.CompletedAt); err == nil && task.Done {
+			task.Completed = &completed
+		}
+		if item.Due != nil && item.Due.Date != "" {
+			loc := opts.Location
+			if item.Due.Timezone != "" {
+				if tz, err := time.LoadLocation(item.Due.Timezone); err == nil {
+					loc = tz
+				}
+			}
+			if err := setTodoistDue(&task, item.Due.Date, loc); err != nil {
+				task.Problems = append(task.Problems, err.Error())
+			}
+			if item.Due.IsRecurring {
+				setTodoistRecurrence(&task, item.Due.String, loc)
+			}
+		}
+		lists[i].Tasks = append(lists[i].Tasks, task)
+	}
+	return lists, nil
+}
+
+// setTodoistDue reads a due date, which is a date for all-day tasks, a
+// time with a Z for ones fixed to a time zone, or a floating time.
+func setTodoistDue(task *Task, value string, loc *time.Location) error {
+	if due, err := time.Parse("2006-01-02", value); err == nil {
+		task.Due = &due
+		task.AllDay = true
+		return nil
+	}
+	due, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if due, err = time.ParseInLocation("2006-01-02T15:04:05", value, loc); err != nil {
+			return fmt.Errorf("invalid due date %q, imported without one", value)
+		}
+	}
+	due = due.UTC()
+	task.Due = &due
+	return nil
+}
+
+// parseTodoistCSV reads a project exported as a CSV template. Its rows are
+// sections, tasks and notes (comments) on the task before them, and INDENT
+// nests subtasks under the task before them with a smaller indent. Rows
+// have no ids, so importing the file again adds its tasks again.
+func parseTodoistCSV(data []byte, opts Options) ([]List, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("the file is empty")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToUpper(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["TYPE"]; !ok {
+		return nil, fmt.Errorf("not a Todoist CSV file: no TYPE column")
+	}
+	if _, ok := columns["CONTENT"]; !ok {
+		return nil, fmt.Errorf("not a Todoist CSV file: no CONTENT column")
+	}
+
+	title := strings.TrimSpace(opts.Title)
+	if title == "" {
+		title = "Todoist"
+	}
+	lists := []List{{Title: title}}
+	// parents holds the last task at each indent of the current section
+	var parents []string
+	for n, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		list := &lists[len(lists)-1]
+
+		switch strings.ToLower(field("TYPE")) {
+		case "section":
+			lists = append(lists, List{Title: title + " / " + field("CONTENT")})
+			parents = nil
+		case "note":
+			if len(list.Tasks) > 0 && field("CONTENT") != "" {
+				task := &list.Tasks[len(list.Tasks)-1]
+				task.Notes = strings.TrimSpace(task.Notes + "\n\n" + field("CONTENT"))
+			}
+		case "task":
+			task := Task{ID: fmt.Sprintf("line %d", n+2), Notes: field("DESCRIPTION")}
+			priority, _ := strconv.Atoi(field("PRIORITY"))
+			task.Priority = todoistPriority(priority)
+
+			// Labels are written into the content as @label
+			var words []string
+			for _, word := range strings.Fields(field("CONTENT")) {
+				if label, ok := strings.CutPrefix(word, "@"); ok && label != "" {
+					task.Labels = append(task.Labels, label)
+				} else {
+					words = append(words, word)
+				}
+			}
+			task.Title = strings.Join(words, " ")
+
+			indent, _ := strconv.Atoi(field("INDENT"))
+			indent = min(max(indent, 1), len(parents)+1)
+			if indent > 1 {
+				task.Parent = parents[indent-2]
+			}
+			parents = append(parents[:indent-1], task.ID)
+
+			if value := field("DATE"); value != "" {
+				loc := opts.Location
+				if tz, err := time.LoadLocation(field("TIMEZONE")); field("TIMEZONE") != "" && err == nil {
+					loc = tz
+				}
+				setTodoistCSVDate(&task, value, loc)
+			}
+			list.Tasks = append(list.Tasks, task)
+		}
+	}
+	return lists, nil
+}
+
+// setTodoistCSVDate reads the DATE column, which holds the due date as it
+// was typed, e.g. "every monday 9am" or "Jan 5 2025".
+func setTodoistCSVDate(task *Task, value string, loc *time.Location) {
+	result := quickadd.Parse(value, time.Now().In(loc))
+	if result.DueDate == nil && result.RecurrenceInterval == nil {
+		task.Problems = append(task.Problems, fmt.Sprintf("due date %q not understood, imported without one", value))
+		return
+	}
+	if result.DueDate != nil {
+		due := result.DueDate.UTC()
+		if !result.HasTime {
+			due = date(result.DueDate.In(loc))
+			task.AllDay = true
+		}
+		task.Due = &due
+	}
+	if result.RecurrenceInterval != nil {
+		task.RecurrenceInterval = *result.RecurrenceInterval
+		task.RecurrenceUnit = strings.TrimSuffix(*result.RecurrenceUnit, "s") + "s"
+	}
+}
@@ -0,0 +1,134 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trelloBoard is the JSON export of a Trello board (Menu, Print and
+// export, Export as JSON).
+type trelloBoard struct {
+	Name  string `json:"name"`
+	Lists []struct {
+		ID     string  `json:"id"`
+		Name   string  `json:"name"`
+		Closed bool    `json:"closed"`
+		Pos    float64 `json:"pos"`
+	} `json:"lists"`
+	Cards []struct {
+		ID               string  `json:"id"`
+		Name             string  `json:"name"`
+		Desc             string  `json:"desc"`
+		IDList           string  `json:"idList"`
+		Closed           bool    `json:"closed"`
+		Due              string  `json:"due"`
+		DueComplete      bool    `json:"dueComplete"`
+		DateLastActivity string  `json:"dateLastActivity"`
+		Pos              float64 `json:"pos"`
+		Labels           []struct {
+			Name  string `json:"name"`
+			Color string `json:"color"`
+		} `json:"labels"`
+	} `json:"cards"`
+	Checklists []trelloChecklist `json:"checklists"`
+}
+
+type trelloChecklist struct {
+	ID         string  `json:"id"`
+	IDCard     string  `json:"idCard"`
+	Pos        float64 `json:"pos"`
+	CheckItems []struct {
+		ID    string  `json:"id"`
+		Name  string  `json:"name"`
+		State string  `json:"state"`
+		Pos   float64 `json:"pos"`
+		Due   string  `json:"due"`
+	} `json:"checkItems"`
+}
+
+// parseTrello reads a board. Each open list becomes a list named after the
+// board and the list, archived cards and lists are left out, and checklist
+// items become subtasks of their card.
+func parseTrello(data []byte, opts Options) ([]List, error) {
+	var board trelloBoard
+	if err := json.Unmarshal(data, &board); err != nil {
+		return nil, err
+	}
+	if len(board.Lists) == 0 {
+		return nil, fmt.Errorf("no lists found in the board")
+	}
+
+	sort.SliceStable(board.Lists, func(i, j int) bool { return board.Lists[i].Pos < board.Lists[j].Pos })
+	sort.SliceStable(board.Cards, func(i, j int) bool { return board.Cards[i].Pos < board.Cards[j].Pos })
+	sort.SliceStable(board.Checklists, func(i, j int) bool { return board.Checklists[i].Pos < board.Checklists[j].Pos })
+	checklists := make(map[string][]trelloChecklist)
+	for _, checklist := range board.Checklists {
+		sort.SliceStable(checklist.CheckItems, func(i, j int) bool { return checklist.CheckItems[i].Pos < checklist.CheckItems[j].Pos })
+		checklists[checklist.IDCard] = append(checklists[checklist.IDCard], checklist)
+	}
+
+	listIndex := make(map[string]int)
+	var lists []List
+	for _, trelloList := range board.Lists {
+		if trelloList.Closed {
+			continue
+		}
+		listIndex[trelloList.ID] = len(lists)
+		lists = append(lists, List{Title: strings.TrimSpace(board.Name) + " / " + strings.TrimSpace(trelloList.Name)})
+	}
+
+	for _, card := range board.Cards {
+		i, ok := listIndex[card.IDList]
+		if card.Closed || !ok {
+			continue
+		}
+		task := Task{
+			ID:    card.ID,
+			UID:   card.ID + "@trello.com",
+			Title: card.Name,
+			Notes: card.Desc,
+			Done:  card.DueComplete,
+		}
+		for _, label := range card.Labels {
+			if label.Name != "" {
+				task.Labels = append(task.Labels, label.Name)
+			} else if label.Color != "" {
+				task.Labels = append(task.Labels, label.Color)
+			}
+		}
+		if card.Due != "" {
+			if due, err := time.Parse(time.RFC3339, card.Due); err != nil {
+				task.Problems = append(task.Problems, fmt.Sprintf("invalid due date %q, imported without one", card.Due))
+			} else {
+				due = due.UTC()
+				task.Due = &due
+			}
+		}
+		// Trello does not keep when a card was completed
+		if lastActivity, err := time.Parse(time.RFC3339, card.DateLastActivity); err == nil && task.Done {
+			task.Completed = &lastActivity
+		}
+		lists[i].Tasks = append(lists[i].Tasks, task)
+
+		for _, checklist := range checklists[card.ID] {
+			for _, item := range checklist.CheckItems {
+				subtask := Task{
+					ID:     item.ID,
+					Parent: card.ID,
+					UID:    item.ID + "@trello.com",
+					Title:  item.Name,
+					Done:   item.State == "complete",
+				}
+				if due, err := time.Parse(time.RFC3339, item.Due); err == nil {
+					due = due.UTC()
+					subtask.Due = &due
+				}
+				lists[i].Tasks = append(lists[i].Tasks, subtask)
+			}
+		}
+	}
+	return lists, nil
+}
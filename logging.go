@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// debugLogging is set when requests are logged.
+var debugLogging bool
+
+// minLogLevel is the lowest level logged. log.Fatal is always logged.
+var minLogLevel = levelInfo
+
+// setLogLevel drops log messages below level.
+func setLogLevel(level logLevel) {
+	minLogLevel = level
+	debugLogging = level == levelDebug
+}
+
+// logf logs a message at level, which the helpers below name.
+func logf(level logLevel, format string, args ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func logDebug(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func logInfo(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func logWarn(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func logError(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+// statusRecorder remembers the status code a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequests logs every request at the debug level.
+func logRequests(next http.Handler) http.Handler {
+	if !debugLogging {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		logDebug("Debug: %s %s %d %s", r.Method, r.URL.RequestURI(), recorder.status, time.Since(start).Round(time.Millisecond))
+	})
+}
@@ -4,15 +4,19 @@ import (
 	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/apognu/gocal"
+	"todo-app/quickadd"
+
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite3"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
@@ -26,11 +30,16 @@ type Todo struct {
 	CreatedAt          time.Time  `json:"created_at"`
 	CompletedAt        *time.Time `json:"completed_at,omitempty"`
 	DueDate            *time.Time `json:"due_date,omitempty"`
+	AllDay             bool       `json:"all_day,omitempty"`
 	RecurrenceInterval *int       `json:"recurrence_interval,omitempty"`
 	RecurrenceUnit     *string    `json:"recurrence_unit,omitempty"`
 	Position           int        `json:"position"`
 	ProjectID          int        `json:"project_id"`
 	UID                string     `json:"uid,omitempty"`
+	Priority           int        `json:"priority,omitempty"`
+	Notes              string     `json:"notes,omitempty"`
+	ParentID           *int       `json:"parent_id,omitempty"`
+	ParentUID          string     `json:"-"`
 }
 
 type Project struct {
@@ -41,11 +50,32 @@ type Project struct {
 }
 
 type IcsSubscription struct {
-	ID            int        `json:"id"`
-	URL           string     `json:"url"`
-	ProjectID     int        `json:"project_id"`
-	ProjectName   string     `json:"project_name"`
-	LastUpdatedAt *time.Time `json:"last_updated_at"`
+	ID              int        `json:"id"`
+	URL             string     `json:"url"`
+	ProjectID       int        `json:"project_id"`
+	ProjectName     string     `json:"project_name"`
+	LastUpdatedAt   *time.Time `json:"last_updated_at"`
+	LocalEditPolicy string     `json:"local_edit_policy"`
+	RemovedPolicy   string     `json:"removed_policy"`
+
+	RefreshIntervalMinutes int            `json:"refresh_interval_minutes"`
+	NextRefreshAt          *time.Time     `json:"next_refresh_at"`
+	ETag                   string         `json:"-"`
+	LastModified           string         `json:"-"`
+	EncryptedCredentials   string         `json:"-"`
+	HasCredentials         bool           `json:"has_credentials"`
+	ImportRules            IcsImportRules `json:"import_rules"`
+
+	// Outcome of the latest refreshes
+	LastAttemptAt       *time.Time `json:"last_attempt_at"`
+	LastSuccessAt       *time.Time `json:"last_success_at"`
+	LastHTTPStatus      *int       `json:"last_http_status"`
+	LastError           *string    `json:"last_error"`
+	LastAddedCount      int        `json:"last_added_count"`
+	LastUpdatedCount    int        `json:"last_updated_count"`
+	LastRemovedCount    int        `json:"last_removed_count"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Paused              bool       `json:"paused"`
 }
 
 //go:embed migrations/*.sql
@@ -63,29 +93,33 @@ var styleCSS []byte
 //go:embed todo-app.js
 var todoAppJS []byte
 
+//go:embed sw.js
+var serviceWorkerJS []byte
+
 var db *sql.DB
 
-func init() {
-	log.SetFlags(log.LstdFlags)
+// openDatabase opens the database at path, creating its directory and
+// bringing its schema up to date.
+func openDatabase(path string) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
 	var err error
-	db, err = sql.Open("sqlite3", "./data/todos.db")
+	db, err = sql.Open("sqlite3", path)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Enable WAL mode for better concurrent access
 	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
-		log.Fatal("Failed to enable WAL mode:", err)
+		return fmt.Errorf("failed to enable WAL mode: %v", err)
 	}
 
 	// Run migrations
-	if err := runMigrations(); err != nil {
-		log.Fatal(err)
-	}
-
-	if err != nil {
-		log.Fatal(err)
-	}
+	return runMigrations()
 }
 
 func runMigrations() error {
@@ -324,8 +358,9 @@ func deleteProject(w http.ResponseWriter, r *http.Request) {
 func getTodos(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query(`
 		SELECT id, title, completed, created_at, completed_at, 
-		       datetime(due_date) as due_date, 
-		       recurrence_interval, recurrence_unit, project_id, position 
+		       datetime(due_date) as due_date, all_day,
+		       recurrence_interval, recurrence_unit, project_id, position, priority,
+		       notes, parent_id
 		FROM todos 
 		ORDER BY project_id, completed, position
 	`)
@@ -346,10 +381,14 @@ func getTodos(w http.ResponseWriter, r *http.Request) {
 			&todo.CreatedAt,
 			&todo.CompletedAt,
 			&dueDateStr,
+			&todo.AllDay,
 			&todo.RecurrenceInterval,
 			&todo.RecurrenceUnit,
 			&todo.ProjectID,
 			&todo.Position,
+			&todo.Priority,
+			&todo.Notes,
+			&todo.ParentID,
 		); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -365,7 +404,7 @@ func getTodos(w http.ResponseWriter, r *http.Request) {
 				// If that fails, try parsing as database datetime format (YYYY-MM-DD HH:MM:SS)
 				parsedTime, err = time.ParseInLocation("2006-01-02 15:04:05", dueDateStr.String, time.UTC)
 				if err != nil {
-					log.Printf("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+					logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
 					continue
 				}
 			}
@@ -379,27 +418,114 @@ func getTodos(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(todos)
 }
 
+// parseDBDateTime parses a timestamp read back with SQLite's datetime(),
+// which is UTC in "YYYY-MM-DD HH:MM:SS" form. RFC3339 is accepted too.
+func parseDBDateTime(value sql.NullString) (*time.Time, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+
+	parsedTime, err := time.Parse(time.RFC3339, value.String)
+	if err != nil {
+		parsedTime, err = time.ParseInLocation("2006-01-02 15:04:05", value.String, time.UTC)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &parsedTime, nil
+}
+
+// allDayDueDate keeps only the date of an all-day due date, as midnight UTC,
+// so that it is the same day in every time zone.
+func allDayDueDate(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
 func addTodo(w http.ResponseWriter, r *http.Request) {
 	var requestData struct {
 		Title              string  `json:"title"`
 		Completed          bool    `json:"completed"`
 		ProjectID          int     `json:"project_id"`
 		DueDate            *string `json:"due_date,omitempty"`
+		AllDay             bool    `json:"all_day,omitempty"`
 		RecurrenceInterval *int    `json:"recurrence_interval,omitempty"`
 		RecurrenceUnit     *string `json:"recurrence_unit,omitempty"`
+		Priority           int     `json:"priority,omitempty"`
+		Notes              string  `json:"notes,omitempty"`
+		ParentID           *int    `json:"parent_id,omitempty"`
+		// Parse asks the server to extract dates, recurrence, project and tags
+		// from the title, resolving relative dates in TimeZone
+		Parse    bool   `json:"parse,omitempty"`
+		TimeZone string `json:"time_zone,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if requestData.Priority < 0 || requestData.Priority > 9 {
+		http.Error(w, "priority must be between 0 and 9", http.StatusBadRequest)
+		return
+	}
+
+	// Explicit fields in the request win over what the parser found, except
+	// the project: the app always sends the one the todo was typed into, and
+	// an @project in the text moves the todo there, creating it if needed
+	var parsed *quickadd.Result
+	if requestData.Parse {
+		loc := time.Local
+		if requestData.TimeZone != "" {
+			var err error
+			loc, err = time.LoadLocation(requestData.TimeZone)
+			if err != nil {
+				http.Error(w, "invalid time zone: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result := quickadd.Parse(requestData.Title, time.Now().In(loc))
+		parsed = &result
+
+		requestData.Title = result.Title
+		if requestData.DueDate == nil && result.DueDate != nil {
+			// A date without a time of day is all-day, on that date in loc
+			dueDate := result.DueDate.In(loc).Format(time.RFC3339)
+			requestData.DueDate = &dueDate
+			requestData.AllDay = !result.HasTime
+		}
+		if requestData.RecurrenceInterval == nil && requestData.RecurrenceUnit == nil {
+			requestData.RecurrenceInterval = result.RecurrenceInterval
+			requestData.RecurrenceUnit = result.RecurrenceUnit
+		}
+	}
 
-	// Shift all existing todos in the same project down by 1 position
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if parsed != nil && parsed.Project != "" {
+		projectID, err := newProjectResolver(tx).id(parsed.Project)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestData.ProjectID = projectID
+	}
+	if requestData.ParentID != nil && *requestData.ParentID == 0 {
+		requestData.ParentID = nil
+	}
+	if requestData.ParentID != nil {
+		if status, err := checkTodoParent(tx, 0, *requestData.ParentID, requestData.ProjectID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	// Shift all existing todos in the same project down by 1 position
 	_, err = tx.Exec("UPDATE todos SET position = position + 1 WHERE project_id = ?", requestData.ProjectID)
 	if err != nil {
 		tx.Rollback()
@@ -416,10 +542,14 @@ func addTodo(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid date format, expected RFC3339 format (e.g., 2023-01-02T15:04:05Z)", http.StatusBadRequest)
 			return
 		}
+		if requestData.AllDay {
+			parsedTime = allDayDueDate(parsedTime)
+		}
 		// Ensure it's in UTC
 		parsedTime = parsedTime.UTC()
 		dueDate = &parsedTime
 	}
+	allDay := requestData.AllDay && dueDate != nil
 
 	var dueDateInterface interface{}
 	if dueDate != nil {
@@ -427,13 +557,17 @@ func addTodo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result, err := tx.Exec(
-		"INSERT INTO todos (title, completed, project_id, due_date, recurrence_interval, recurrence_unit, position) VALUES (?, ?, ?, datetime(?, 'utc'), ?, ?, 0)",
+		"INSERT INTO todos (title, completed, project_id, due_date, all_day, recurrence_interval, recurrence_unit, priority, notes, parent_id, position) VALUES (?, ?, ?, datetime(?, 'utc'), ?, ?, ?, ?, ?, ?, 0)",
 		requestData.Title,
 		requestData.Completed,
 		requestData.ProjectID,
 		dueDateInterface,
+		allDay,
 		requestData.RecurrenceInterval,
 		requestData.RecurrenceUnit,
+		requestData.Priority,
+		requestData.Notes,
+		requestData.ParentID,
 	)
 	if err != nil {
 		tx.Rollback()
@@ -460,13 +594,20 @@ func addTodo(w http.ResponseWriter, r *http.Request) {
 		Completed:          requestData.Completed,
 		ProjectID:          requestData.ProjectID,
 		DueDate:            dueDate,
+		AllDay:             allDay,
 		RecurrenceInterval: requestData.RecurrenceInterval,
 		RecurrenceUnit:     requestData.RecurrenceUnit,
 		Position:           0,
+		Priority:           requestData.Priority,
+		Notes:              requestData.Notes,
+		ParentID:           requestData.ParentID,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(createdTodo)
+	json.NewEncoder(w).Encode(struct {
+		Todo
+		Parsed *quickadd.Result `json:"parsed,omitempty"`
+	}{createdTodo, parsed})
 }
 
 func updateTodo(w http.ResponseWriter, r *http.Request) {
@@ -484,9 +625,14 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 		Completed          bool    `json:"completed"`
 		ProjectID          int     `json:"project_id"`
 		DueDate            *string `json:"due_date,omitempty"`
+		AllDay             *bool   `json:"all_day,omitempty"`
 		RecurrenceInterval *int    `json:"recurrence_interval,omitempty"`
 		RecurrenceUnit     *string `json:"recurrence_unit,omitempty"`
 		Position           int     `json:"position,omitempty"`
+		Priority           *int    `json:"priority,omitempty"`
+		Notes              *string `json:"notes,omitempty"`
+		// 0 makes a subtask a top-level todo again
+		ParentID *int `json:"parent_id,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
@@ -498,22 +644,37 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ID is required", http.StatusBadRequest)
 		return
 	}
+	if requestData.Priority != nil && (*requestData.Priority < 0 || *requestData.Priority > 9) {
+		http.Error(w, "priority must be between 0 and 9", http.StatusBadRequest)
+		return
+	}
+	if requestData.ParentID != nil && *requestData.ParentID == requestData.ID {
+		http.Error(w, "a todo cannot be its own parent", http.StatusBadRequest)
+		return
+	}
 
 	// Get the current todo to preserve position and project ID if not provided
 	var currentTodo struct {
 		Position  int
 		ProjectID int
 		DueDate   sql.NullString
+		AllDay    bool
 	}
 
-	err := db.QueryRow("SELECT position, project_id, datetime(due_date) as due_date FROM todos WHERE id = ?", requestData.ID).
-		Scan(&currentTodo.Position, &currentTodo.ProjectID, &currentTodo.DueDate)
+	err := db.QueryRow("SELECT position, project_id, datetime(due_date) as due_date, all_day FROM todos WHERE id = ?", requestData.ID).
+		Scan(&currentTodo.Position, &currentTodo.ProjectID, &currentTodo.DueDate, &currentTodo.AllDay)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// All-day stays as it is unless the request says otherwise
+	allDay := currentTodo.AllDay
+	if requestData.AllDay != nil {
+		allDay = *requestData.AllDay
+	}
+
 	// Parse the due date if provided (expecting UTC timestamp from frontend)
 	var dueDate *time.Time
 	if requestData.DueDate != nil {
@@ -527,6 +688,9 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "invalid date format, expected RFC3339 format (e.g., 2023-01-02T15:04:05Z)", http.StatusBadRequest)
 				return
 			}
+			if allDay {
+				parsedTime = allDayDueDate(parsedTime)
+			}
 			// Ensure it's in UTC
 			parsedTime = parsedTime.UTC()
 			dueDate = &parsedTime
@@ -542,6 +706,8 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 		dueDate = &parsedTime
 	}
 
+	allDay = allDay && dueDate != nil
+
 	// Use current project ID and position if not provided in the request
 	projectID := requestData.ProjectID
 	if projectID == 0 {
@@ -566,6 +732,14 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if requestData.ParentID != nil && *requestData.ParentID != 0 {
+		if status, err := checkTodoParent(tx, requestData.ID, *requestData.ParentID, projectID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
 	// Determine if completed status is changing and handle position logic
 	var newPosition int
 	if requestData.Completed && !currentTodoIsCompleted(requestData.ID) {
@@ -615,11 +789,12 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 
 	// Update the todo in the database
 	_, err = tx.Exec(
-		"UPDATE todos SET title = ?, completed = ?, project_id = ?, due_date = datetime(?, 'utc'), recurrence_interval = ?, recurrence_unit = ?, position = ? WHERE id = ?",
+		"UPDATE todos SET title = ?, completed = ?, project_id = ?, due_date = datetime(?, 'utc'), all_day = ?, recurrence_interval = ?, recurrence_unit = ?, position = ? WHERE id = ?",
 		requestData.Title,
 		requestData.Completed,
 		projectID,
 		dueDateInterface,
+		allDay,
 		requestData.RecurrenceInterval,
 		requestData.RecurrenceUnit,
 		newPosition,
@@ -631,95 +806,184 @@ func updateTodo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If a recurring todo is being completed, generate the next occurrence
-	// The next occurrence will keep the same time-of-day as the original due date.
-	if requestData.Completed && !currentTodoIsCompleted(requestData.ID) && requestData.RecurrenceInterval != nil && requestData.RecurrenceUnit != nil {
-		var baseDue time.Time
-		if dueDate != nil {
-			baseDue = *dueDate
-		} else {
-			baseDue = time.Now().UTC()
+	// Priority, notes and parent are only changed when the request carries them
+	if requestData.Priority != nil {
+		if _, err := tx.Exec("UPDATE todos SET priority = ? WHERE id = ?", *requestData.Priority, requestData.ID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		// Calculate the next due date, preserving the time of day
-		var nextDue time.Time
-		switch strings.ToLower(*requestData.RecurrenceUnit) {
-		case "day", "days":
-			nextDue = baseDue.AddDate(0, 0, *requestData.RecurrenceInterval)
-		case "week", "weeks":
-			nextDue = baseDue.AddDate(0, 0, 7*(*requestData.RecurrenceInterval))
-		case "month", "months":
-			nextDue = baseDue.AddDate(0, *requestData.RecurrenceInterval, 0)
-		case "year", "years":
-			nextDue = baseDue.AddDate(*requestData.RecurrenceInterval, 0, 0)
-		default:
-			// Unknown unit, skip recurrence
-			nextDue = time.Time{}
-		}
-
-		// Ensure the next due date is >= today
-		if !nextDue.IsZero() {
-			now := time.Now().UTC()
-			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-
-			// Keep advancing the date until it's >= today
-			for nextDue.Before(today) {
-				switch strings.ToLower(*requestData.RecurrenceUnit) {
-				case "day", "days":
-					nextDue = nextDue.AddDate(0, 0, *requestData.RecurrenceInterval)
-				case "week", "weeks":
-					nextDue = nextDue.AddDate(0, 0, 7*(*requestData.RecurrenceInterval))
-				case "month", "months":
-					nextDue = nextDue.AddDate(0, *requestData.RecurrenceInterval, 0)
-				case "year", "years":
-					nextDue = nextDue.AddDate(*requestData.RecurrenceInterval, 0, 0)
-				}
-			}
+	}
+	if requestData.Notes != nil {
+		if _, err := tx.Exec("UPDATE todos SET notes = ? WHERE id = ?", *requestData.Notes, requestData.ID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if requestData.ParentID != nil {
+		if _, err := tx.Exec("UPDATE todos SET parent_id = NULLIF(?, 0) WHERE id = ?", *requestData.ParentID, requestData.ID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
 
-		// Explicitly preserve hour, minute, second, nanosecond from baseDue (already preserved by AddDate, but this is robust)
-		if !nextDue.IsZero() {
-			nextDue = time.Date(
-				nextDue.Year(), nextDue.Month(), nextDue.Day(),
-				baseDue.Hour(), baseDue.Minute(), baseDue.Second(), baseDue.Nanosecond(),
-				time.UTC,
-			)
-			_, err := tx.Exec(
-				"INSERT INTO todos (title, completed, created_at, due_date, recurrence_interval, recurrence_unit, project_id, position) VALUES (?, 0, datetime('now', 'utc'), datetime(?, 'utc'), ?, ?, ?, 0)",
-				requestData.Title,
-				nextDue.Format(time.RFC3339),
-				requestData.RecurrenceInterval,
-				requestData.RecurrenceUnit,
-				projectID,
-			)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to create next recurring todo: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Offset reminders follow the due date, so they fire again once it moves
+	var previousDue, newDue string
+	if currentTodo.DueDate.Valid {
+		previousDue = currentTodo.DueDate.String
+	}
+	if dueDate != nil {
+		newDue = dueDate.UTC().Format("2006-01-02 15:04:05")
+	}
+	if previousDue != newDue {
+		_, err = tx.Exec("UPDATE reminders SET sent_at = NULL WHERE todo_id = ? AND offset_minutes IS NOT NULL", requestData.ID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+
+	// If a recurring todo is being completed, generate the next occurrence
+	if requestData.Completed && !currentTodoIsCompleted(requestData.ID) && requestData.RecurrenceInterval != nil && requestData.RecurrenceUnit != nil {
+		if err := createNextOccurrence(tx, requestData.ID, dueDate, *requestData.RecurrenceInterval, *requestData.RecurrenceUnit); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to create next recurring todo: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// Return the updated todo
+	// Priority, notes and parent are read back, since the request may have left them out
 	updatedTodo := Todo{
 		ID:                 requestData.ID,
 		Title:              requestData.Title,
 		Completed:          requestData.Completed,
 		ProjectID:          projectID,
 		DueDate:            dueDate,
+		AllDay:             allDay,
 		RecurrenceInterval: requestData.RecurrenceInterval,
 		RecurrenceUnit:     requestData.RecurrenceUnit,
 		Position:           newPosition,
 	}
+	var parentID sql.NullInt64
+	if err := tx.QueryRow("SELECT priority, notes, parent_id FROM todos WHERE id = ?", requestData.ID).
+		Scan(&updatedTodo.Priority, &updatedTodo.Notes, &parentID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		updatedTodo.ParentID = &id
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(updatedTodo)
 }
 
+// checkTodoParent makes sure parentID can be the parent of todoID, or of a
+// new todo when todoID is 0, in projectID. When it cannot, it returns the
+// status to answer with.
+func checkTodoParent(tx *sql.Tx, todoID, parentID, projectID int) (int, error) {
+	var parentProjectID int
+	var ancestor sql.NullInt64
+	err := tx.QueryRow("SELECT project_id, parent_id FROM todos WHERE id = ?", parentID).Scan(&parentProjectID, &ancestor)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, fmt.Errorf("parent todo %d not found", parentID)
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if parentProjectID != projectID {
+		return http.StatusBadRequest, errors.New("a subtask must be in the same project as its parent")
+	}
+
+	// Walk up the ancestors, so a todo never ends up below its own subtasks
+	seen := map[int64]bool{int64(parentID): true}
+	for todoID != 0 && ancestor.Valid && !seen[ancestor.Int64] {
+		if ancestor.Int64 == int64(todoID) {
+			return http.StatusBadRequest, errors.New("a todo cannot be a subtask of its own subtask")
+		}
+		seen[ancestor.Int64] = true
+		err := tx.QueryRow("SELECT parent_id FROM todos WHERE id = ?", ancestor.Int64).Scan(&ancestor)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return 0, nil
+}
+
+// createNextOccurrence adds the next occurrence of a recurring todo that was
+// just completed, with its reminders carried forward. It is due one interval
+// after dueDate, or after now for todos without one, and never before today.
+// The time of day is kept. Todos with an unknown unit do not recur.
+func createNextOccurrence(tx *sql.Tx, todoID int, dueDate *time.Time, interval int, unit string) error {
+	var baseDue time.Time
+	if dueDate != nil {
+		baseDue = dueDate.UTC()
+	} else {
+		baseDue = time.Now().UTC()
+	}
+
+	advance := func(t time.Time) time.Time {
+		switch strings.ToLower(unit) {
+		case "day", "days":
+			return t.AddDate(0, 0, interval)
+		case "week", "weeks":
+			return t.AddDate(0, 0, 7*interval)
+		case "month", "months":
+			return t.AddDate(0, interval, 0)
+		case "year", "years":
+			return t.AddDate(interval, 0, 0)
+		}
+		return time.Time{}
+	}
+
+	nextDue := advance(baseDue)
+	if nextDue.IsZero() || interval <= 0 {
+		return nil
+	}
+
+	// Keep advancing the date until it's >= today
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for nextDue.Before(today) {
+		nextDue = advance(nextDue)
+	}
+	nextDue = time.Date(
+		nextDue.Year(), nextDue.Month(), nextDue.Day(),
+		baseDue.Hour(), baseDue.Minute(), baseDue.Second(), baseDue.Nanosecond(),
+		time.UTC,
+	)
+
+	result, err := tx.Exec(
+		`INSERT INTO todos (title, completed, created_at, due_date, all_day, recurrence_interval, recurrence_unit, project_id, position, priority, notes, parent_id)
+		 SELECT title, 0, datetime('now', 'utc'), datetime(?, 'utc'), all_day, recurrence_interval, recurrence_unit, project_id, 0, priority, notes, parent_id
+		 FROM todos WHERE id = ?`,
+		nextDue.Format(time.RFC3339),
+		todoID,
+	)
+	if err != nil {
+		return err
+	}
+	nextID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := carryForwardReminders(tx, todoID, int(nextID), nextDue.Sub(baseDue)); err != nil {
+		return fmt.Errorf("carrying reminders forward: %v", err)
+	}
+	return nil
+}
+
 func deleteTodo(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -788,26 +1052,105 @@ func reorderProjects(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	log.SetFlags(log.LstdFlags)
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error in configuration: %v", err)
+	}
+	config = cfg
+	config.apply()
+
+	if err := openDatabase(config.DBPath); err != nil {
+		log.Fatalf("Error opening database %s: %v", config.DBPath, err)
+	}
+
+	if len(args) > 0 {
+		if args[0] != "snapshot" {
+			log.Fatalf("Error: unknown command %q", args[0])
+		}
+		if err := runSnapshotCommand(args[1:]); err != nil {
+			log.Fatalf("Error taking snapshot: %v", err)
+		}
+		return
+	}
+
 	// Create a new HTTP server
 	server := &http.Server{
-		Addr:    ":8081",
-		Handler: createRouter(),
+		Addr:    config.Listen,
+		Handler: logRequests(withBasePath(config.basePath, createRouter())),
+	}
+
+	// Refresh ICS feeds as they come due
+	if config.enabled(featureICSSubscriptions) {
+		go func() {
+			for {
+				time.Sleep(1 * time.Minute)
+				refreshDueIcsSubscriptions()
+			}
+		}()
 	}
 
-	// Periodically refresh ICS feeds
+	// Send reminders and due-date push notifications as they come due
 	go func() {
 		for {
+			time.Sleep(1 * time.Minute)
+			if config.enabled(featureReminders) {
+				sendDueReminders()
+			}
+			if config.enabled(featurePush) {
+				sendDueNotifications()
+			}
+		}
+	}()
+
+	// Forget deleted todos once CalDAV clients have had time to sync them
+	go func() {
+		for {
+			if err := pruneDAVChanges(); err != nil {
+				logError("Error pruning CalDAV changes: %v", err)
+			}
 			time.Sleep(1 * time.Hour)
-			refreshIcsFeeds()
 		}
 	}()
 
-	log.Println("Server running on port 8081")
+	// Email the daily agenda when SMTP is configured
+	if config.Digest.enabled() {
+		go runDigestScheduler(config.Digest)
+	}
+
+	// Take and rotate snapshots when a snapshot time is set
+	if config.Snapshots.enabled() {
+		go runSnapshotScheduler(config.Snapshots)
+	}
+
+	logInfo("Server listening on %s", config.Listen)
 	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+		log.Fatalf("Error running server: %v", err)
 	}
 }
 
+// withBasePath serves next under prefix, for when a reverse proxy passes on
+// requests for a path such as /todo/ as they are.
+func withBasePath(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
 func createRouter() http.Handler {
 	mux := http.NewServeMux()
 
@@ -829,6 +1172,13 @@ func createRouter() http.Handler {
 		w.Write(todoAppJS)
 	})
 
+	// Serve the service worker from the root so it controls the whole app
+	mux.HandleFunc("/sw.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(serviceWorkerJS)
+	})
+
 	// Serve embedded index.html at root
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Only serve index.html for root path or non-file paths
@@ -864,6 +1214,21 @@ func createRouter() http.Handler {
 		}
 	})
 
+	mux.HandleFunc("/api/projects/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		exportAllProjectsHandler(w, r)
+	})
+	mux.HandleFunc("/api/projects/{id}/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		exportProjectHandler(w, r)
+	})
+
 	mux.HandleFunc("/api/todos", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -888,97 +1253,340 @@ func createRouter() http.Handler {
 		}
 	})
 
-	mux.HandleFunc("/api/subscribe_ics", subscribeToICSHandler)
-	mux.HandleFunc("/api/ics_subscriptions", getICSSubscriptionsHandler)
-	mux.HandleFunc("/api/cancel_ics_subscription", cancelICSSubscriptionHandler)
-
-	return mux
-}
-
-func getICSSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-		SELECT s.id, s.url, s.project_id, p.title, s.last_updated_at
-		FROM ics_subscriptions s
-		JOIN projects p ON s.project_id = p.id
-	`)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	subscriptions := make([]IcsSubscription, 0)
-	for rows.Next() {
-		var sub IcsSubscription
-		if err := rows.Scan(&sub.ID, &sub.URL, &sub.ProjectID, &sub.ProjectName, &sub.LastUpdatedAt); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	mux.HandleFunc("/api/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		subscriptions = append(subscriptions, sub)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(subscriptions)
-}
-
-func cancelICSSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	if id == "" {
-		http.Error(w, "ID is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the project_id before deleting the subscription
-	var projectID int
-	err := db.QueryRow("SELECT project_id FROM ics_subscriptions WHERE id = ?", id).Scan(&projectID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Subscription not found", http.StatusNotFound)
+		backupHandler(w, r)
+	})
+	mux.HandleFunc("/api/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Delete the subscription
-	stmt, err := db.Prepare("DELETE FROM ics_subscriptions WHERE id = ?")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer stmt.Close()
+		restoreHandler(w, r)
+	})
 
-	if _, err := stmt.Exec(id); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	mux.HandleFunc("/api/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getSnapshotsHandler(w, r)
+		case http.MethodPost:
+			createSnapshotHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/snapshots/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		downloadSnapshotHandler(w, r)
+	})
+
+	mux.HandleFunc("/api/import_ics", importICSHandler)
+	mux.HandleFunc("/api/export_todo_txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		exportTodoTxtHandler(w, r)
+	})
+	mux.HandleFunc("/api/import_todo_txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importTodoTxtHandler(w, r)
+	})
+	mux.HandleFunc("/api/export_taskwarrior", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		exportTaskwarriorHandler(w, r)
+	})
+	mux.HandleFunc("/api/import_taskwarrior", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importTaskwarriorHandler(w, r)
+	})
+	mux.HandleFunc("/api/import_tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importTasksHandler(w, r)
+	})
+	mux.HandleFunc("/api/import_google_tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importGoogleTasksHandler(w, r)
+	})
 
-	// Delete todos associated with the project
-	stmt, err = db.Prepare("DELETE FROM todos WHERE project_id = ?")
+	if config.enabled(featureICSSubscriptions) {
+		mux.HandleFunc("/api/subscribe_ics", subscribeToICSHandler)
+		mux.HandleFunc("/api/ics_subscriptions", getICSSubscriptionsHandler)
+		mux.HandleFunc("/api/cancel_ics_subscription", cancelICSSubscriptionHandler)
+		mux.HandleFunc("/api/ics_subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			updateIcsSubscriptionHandler(w, r)
+		})
+		mux.HandleFunc("/api/ics_subscriptions/{id}/refreshes", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			getIcsRefreshesHandler(w, r)
+		})
+
+		mux.HandleFunc("/api/ics_subscriptions/{id}/refresh", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			refreshIcsSubscriptionHandler(w, r)
+		})
+
+		mux.HandleFunc("/api/ics_subscriptions/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			resumeIcsSubscriptionHandler(w, r)
+		})
+	}
+
+	if config.enabled(featureCalendarFeeds) {
+		// Calendar feeds are fetched by calendar apps, which pass the token in the URL
+		mux.HandleFunc("/calendar/{file}", requireAPIToken(calendarHandler))
+	}
+
+	if config.enabled(featureCalDAV) {
+		// CalDAV clients authenticate with an API token as the password
+		mux.HandleFunc("/.well-known/caldav", wellKnownCalDAVHandler)
+		mux.HandleFunc("/dav/", requireDAVAuth(davHandler))
+	}
+
+	mux.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getAPITokens(w, r)
+		case http.MethodPost:
+			addAPIToken(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deleteAPIToken(w, r)
+	})
+
+	mux.HandleFunc("/api/quick_add", requireAPIToken(quickAddHandler))
+
+	if config.enabled(featureReminders) {
+		mux.HandleFunc("/api/reminders", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				getReminders(w, r)
+			case http.MethodPost:
+				addReminder(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+		mux.HandleFunc("/api/reminders/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			deleteReminder(w, r)
+		})
+	}
+
+	mux.HandleFunc("/api/agenda", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		getAgendaHandler(w, r)
+	})
+	mux.HandleFunc("/api/agenda/send", sendDigestHandler)
+
+	if config.enabled(featurePush) {
+		mux.HandleFunc("/api/push/vapid_public_key", getVAPIDPublicKeyHandler)
+		mux.HandleFunc("/api/push_subscriptions", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				getPushSubscriptions(w, r)
+			case http.MethodPost:
+				addPushSubscription(w, r)
+			case http.MethodDelete:
+				deletePushSubscription(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+	}
+
+	mux.HandleFunc("/api/notification_channels", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getNotificationChannels(w, r)
+		case http.MethodPost:
+			addNotificationChannel(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/notification_channels/{id}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			updateNotificationChannel(w, r)
+		case http.MethodDelete:
+			deleteNotificationChannel(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/notification_channels/{id}/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		testNotificationChannel(w, r)
+	})
+
+	return mux
+}
+
+// queryIcsSubscriptions lists subscriptions with their status. The where
+// clause may refer to the subscription as s.
+func queryIcsSubscriptions(where string, args ...interface{}) ([]IcsSubscription, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.url, s.project_id, p.title, s.last_updated_at, s.local_edit_policy, s.removed_policy,
+		       s.refresh_interval_minutes, s.next_refresh_at, s.credentials IS NOT NULL, COALESCE(s.import_rules, ''),
+		       s.last_attempt_at, s.last_success_at, s.last_http_status, s.last_error,
+		       s.last_added_count, s.last_updated_count, s.last_removed_count, s.consecutive_failures, s.paused
+		FROM ics_subscriptions s
+		JOIN projects p ON s.project_id = p.id
+		`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make([]IcsSubscription, 0)
+	for rows.Next() {
+		var sub IcsSubscription
+		var importRules string
+		if err := rows.Scan(
+			&sub.ID, &sub.URL, &sub.ProjectID, &sub.ProjectName, &sub.LastUpdatedAt, &sub.LocalEditPolicy, &sub.RemovedPolicy,
+			&sub.RefreshIntervalMinutes, &sub.NextRefreshAt, &sub.HasCredentials, &importRules,
+			&sub.LastAttemptAt, &sub.LastSuccessAt, &sub.LastHTTPStatus, &sub.LastError,
+			&sub.LastAddedCount, &sub.LastUpdatedCount, &sub.LastRemovedCount, &sub.ConsecutiveFailures, &sub.Paused,
+		); err != nil {
+			return nil, err
+		}
+		if sub.ImportRules, err = parseIcsImportRules(importRules); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, rows.Err()
+}
+
+func getICSSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := queryIcsSubscriptions("")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
 
-	if _, err := stmt.Exec(projectID); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// cancelICSSubscriptionHandler deletes a subscription. By default its project
+// and todos go with it; mode=detach keeps them as ordinary todos.
+func cancelICSSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "delete" && mode != "detach" {
+		http.Error(w, "mode must be delete or detach", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete the project
-	stmt, err = db.Prepare("DELETE FROM projects WHERE id = ?")
+	// Get the project_id before deleting the subscription
+	var projectID int
+	err = tx.QueryRow("SELECT project_id FROM ics_subscriptions WHERE id = ?", id).Scan(&projectID)
 	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
 
-	if _, err := stmt.Exec(projectID); err != nil {
+	// Only the todos imported from the feed go; todos added to the project
+	// by hand stay, along with the project itself
+	if mode != "detach" {
+		if _, err := tx.Exec("DELETE FROM todos WHERE id IN (SELECT todo_id FROM ics_subscription_items WHERE subscription_id = ?)", id); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The trigger on ics_subscriptions forgets which todos came from the feed
+	if _, err := tx.Exec("DELETE FROM ics_subscriptions WHERE id = ?", id); err != nil {
+		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if mode != "detach" {
+		_, err := tx.Exec(`
+			DELETE FROM projects WHERE id = ?
+			AND NOT EXISTS (SELECT 1 FROM todos WHERE project_id = ?)
+			AND NOT EXISTS (SELECT 1 FROM ics_subscriptions WHERE project_id = ?)
+		`, projectID, projectID, projectID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -1027,177 +1635,298 @@ func reorderTodos(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func subscribeToICSHandler(w http.ResponseWriter, r *http.Request) {
-	var requestData struct {
-		URL         string `json:"url"`
-		ProjectName string `json:"project_name"`
+// updateIcsSubscriptionHandler changes a subscription's URL, project or
+// options. Fields left out of the request are kept. Todos already imported
+// move to the new project, and a new URL is fetched right away.
+func updateIcsSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
 	}
 
+	var requestData struct {
+		URL             *string         `json:"url"`
+		ProjectID       *int            `json:"project_id"`
+		ProjectName     *string         `json:"project_name"`
+		LocalEditPolicy *string         `json:"local_edit_policy"`
+		RemovedPolicy   *string         `json:"removed_policy"`
+		RefreshInterval *int            `json:"refresh_interval_minutes"`
+		Credentials     *IcsCredentials `json:"credentials"`
+		ImportRules     *IcsImportRules `json:"import_rules"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Check if the user is already subscribed to this feed
-	var existingSubscriptionID int
-	err := db.QueryRow("SELECT id FROM ics_subscriptions WHERE url = ?", requestData.URL).Scan(&existingSubscriptionID)
-	if err != nil && err != sql.ErrNoRows {
+	unlock := lockIcsSubscription(id)
+	defer unlock()
+
+	var sub IcsSubscription
+	err = db.QueryRow("SELECT url, project_id, local_edit_policy, removed_policy, refresh_interval_minutes FROM ics_subscriptions WHERE id = ?", id).
+		Scan(&sub.URL, &sub.ProjectID, &sub.LocalEditPolicy, &sub.RemovedPolicy, &sub.RefreshIntervalMinutes)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if existingSubscriptionID != 0 {
-		http.Error(w, "You are already subscribed to this ICS feed", http.StatusConflict)
+
+	if requestData.LocalEditPolicy != nil {
+		sub.LocalEditPolicy = *requestData.LocalEditPolicy
+	}
+	if requestData.RemovedPolicy != nil {
+		sub.RemovedPolicy = *requestData.RemovedPolicy
+	}
+	if err := validateIcsPolicies(sub.LocalEditPolicy, sub.RemovedPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Find or create the project
-	var projectID int
-	err = db.QueryRow("SELECT id FROM projects WHERE title = ?", requestData.ProjectName).Scan(&projectID)
-	if err == sql.ErrNoRows {
-		// Create the project if it doesn't exist
-		stmt, err := db.Prepare("INSERT INTO projects (title, position) VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM projects))")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if requestData.RefreshInterval != nil {
+		if err := validateIcsRefreshInterval(*requestData.RefreshInterval); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer stmt.Close()
-
-		result, err := stmt.Exec(requestData.ProjectName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		sub.RefreshIntervalMinutes = *requestData.RefreshInterval
+	}
+	if requestData.Credentials != nil {
+		if err := requestData.Credentials.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if requestData.ImportRules != nil {
+		if _, err := requestData.ImportRules.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		id, err := result.LastInsertId()
-		if err != nil {
+	urlChanged := false
+	if requestData.URL != nil {
+		url := normalizeIcsURL(*requestData.URL)
+		if url == "" {
+			http.Error(w, "URL is required", http.StatusBadRequest)
+			return
+		}
+		var existingSubscriptionID int
+		err := db.QueryRow("SELECT id FROM ics_subscriptions WHERE url = ? AND id != ?", url, id).Scan(&existingSubscriptionID)
+		if err != nil && err != sql.ErrNoRows {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		projectID = int(id)
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if existingSubscriptionID != 0 {
+			http.Error(w, "You are already subscribed to this ICS feed", http.StatusConflict)
+			return
+		}
+		urlChanged = url != sub.URL
+		sub.URL = url
 	}
 
-	stmt, err := db.Prepare("INSERT INTO ics_subscriptions (url, project_id) VALUES (?, ?)")
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	if _, err := stmt.Exec(requestData.URL, projectID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	projectID := sub.ProjectID
+	if requestData.ProjectID != nil {
+		exists, err := projectExists(*requestData.ProjectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Project not found", http.StatusBadRequest)
+			return
+		}
+		projectID = *requestData.ProjectID
+	} else if requestData.ProjectName != nil && *requestData.ProjectName != "" {
+		// Created with the rest of the change, so a failed update leaves no
+		// empty project behind
+		projectID, err = newProjectResolver(tx).id(*requestData.ProjectName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	go refreshIcsFeeds()
-
-	w.WriteHeader(http.StatusCreated)
-}
-
-func refreshIcsFeeds() {
-	rows, err := db.Query("SELECT id, url, project_id FROM ics_subscriptions")
-	if err != nil {
-		log.Printf("Error getting ICS subscriptions: %v", err)
+	if _, err := tx.Exec(
+		"UPDATE ics_subscriptions SET url = ?, project_id = ?, local_edit_policy = ?, removed_policy = ?, refresh_interval_minutes = ? WHERE id = ?",
+		sub.URL, projectID, sub.LocalEditPolicy, sub.RemovedPolicy, sub.RefreshIntervalMinutes, id,
+	); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var subscriptions []IcsSubscription
-	for rows.Next() {
-		var sub IcsSubscription
-		if err := rows.Scan(&sub.ID, &sub.URL, &sub.ProjectID); err != nil {
-			log.Printf("Error scanning ICS subscription: %v", err)
-			continue
+	if requestData.Credentials != nil {
+		credentials, err := encryptIcsCredentials(requestData.Credentials)
+		if err != nil {
+			http.Error(w, err.Error(), secretErrorStatus(err))
+			return
+		}
+		if _, err := tx.Exec("UPDATE ics_subscriptions SET credentials = ? WHERE id = ?", credentials, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		subscriptions = append(subscriptions, sub)
 	}
-	rows.Close()
 
-	for _, sub := range subscriptions {
-		var maxPosition int
-		err := db.QueryRow("SELECT COALESCE(MAX(position), 0) FROM todos WHERE project_id = ?", sub.ProjectID).Scan(&maxPosition)
+	if requestData.ImportRules != nil {
+		importRules, err := encodeIcsImportRules(*requestData.ImportRules)
 		if err != nil {
-			log.Printf("Error getting max position for project %d: %v", sub.ProjectID, err)
-			continue
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("UPDATE ics_subscriptions SET import_rules = ? WHERE id = ?", importRules, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		positionCounter := maxPosition + 1
+	}
 
-		resp, err := http.Get(sub.URL)
-		if err != nil {
-			log.Printf("Error fetching ICS feed from %s: %v", sub.URL, err)
-			continue
+	// Anything that changes what the feed turns into is applied right away
+	refreshNow := urlChanged || requestData.Credentials != nil || requestData.ImportRules != nil
+	if refreshNow {
+		// Cache validators belong to the old URL, the feed may look different
+		// with other credentials, and new rules need the feed parsed again
+		if _, err := tx.Exec(
+			"UPDATE ics_subscriptions SET etag = NULL, last_modified = NULL, next_refresh_at = NULL, consecutive_failures = 0, paused = FALSE WHERE id = ?",
+			id,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		defer resp.Body.Close()
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Printf("Error fetching ICS feed from %s: status code %d, body: %s", sub.URL, resp.StatusCode, string(body))
-			continue
+	if projectID != sub.ProjectID {
+		// Imported todos follow the subscription, after the todos already there
+		if _, err := tx.Exec(`
+			UPDATE todos
+			SET project_id = ?, position = position + (SELECT COALESCE(MAX(position), 0) FROM todos WHERE project_id = ?)
+			WHERE id IN (SELECT todo_id FROM ics_subscription_items WHERE subscription_id = ?)`,
+			projectID, projectID, id,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
 
-		now := time.Now()
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		endOfYear := time.Date(now.Year()+2, time.December, 31, 23, 59, 59, 0, time.UTC)
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		cal := gocal.NewParser(resp.Body)
-		cal.Start = &startOfDay
-		cal.End = &endOfYear
-		cal.Parse()
+	if refreshNow {
+		go refreshIcsSubscriptionByID(id)
+	}
 
-		for _, event := range cal.Events {
-			var existingTodoID int
-			err := db.QueryRow("SELECT id FROM todos WHERE uid = ?", event.Uid).Scan(&existingTodoID)
-			if err != nil && err != sql.ErrNoRows {
-				log.Printf("Error checking for existing todo with UID %s: %v", event.Uid, err)
-				continue
-			}
+	subscriptions, err := queryIcsSubscriptions("WHERE s.id = ?", id)
+	if err != nil || len(subscriptions) == 0 {
+		http.Error(w, fmt.Sprintf("reading updated subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions[0])
+}
 
-			if existingTodoID == 0 {
-				var dueDate *time.Time
-				if event.Start != nil {
-					// Heuristic to check for all-day events: time is exactly midnight.
-					if event.Start.Hour() == 0 && event.Start.Minute() == 0 && event.Start.Second() == 0 {
-						// For all-day events, create a new time in local time using the event's date, then convert to UTC.
-						year, month, day := event.Start.Date()
-						localTime := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
-						utcTime := localTime.UTC()
-						dueDate = &utcTime
-					} else {
-						// For timed events, just convert to UTC
-						utcTime := event.Start.UTC()
-						dueDate = &utcTime
-					}
-				}
+func subscribeToICSHandler(w http.ResponseWriter, r *http.Request) {
+	requestData := struct {
+		URL             string          `json:"url"`
+		ProjectName     string          `json:"project_name"`
+		LocalEditPolicy string          `json:"local_edit_policy"`
+		RemovedPolicy   string          `json:"removed_policy"`
+		RefreshInterval int             `json:"refresh_interval_minutes"`
+		Credentials     *IcsCredentials `json:"credentials"`
+		ImportRules     IcsImportRules  `json:"import_rules"`
+	}{
+		LocalEditPolicy: icsLocalEditKeep,
+		RemovedPolicy:   icsRemovedDelete,
+		RefreshInterval: config.DefaultIcsRefreshInterval,
+	}
 
-				// Todo doesn't exist, so create it
-				_, err := db.Exec(
-					"INSERT INTO todos (title, completed, project_id, due_date, uid, position) VALUES (?, 0, ?, ?, ?, ?)",
-					event.Summary,
-					sub.ProjectID,
-					dueDate,
-					event.Uid,
-					positionCounter,
-				)
-				if err != nil {
-					log.Printf("Error inserting new todo with UID %s: %v", event.Uid, err)
-				} else {
-					positionCounter++
-				}
-			}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateIcsPolicies(requestData.LocalEditPolicy, requestData.RemovedPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateIcsRefreshInterval(requestData.RefreshInterval); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestData.Credentials != nil {
+		if err := requestData.Credentials.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+	}
+	if _, err := requestData.ImportRules.compile(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requestData.URL = normalizeIcsURL(requestData.URL)
 
-		// Update the last_updated_at timestamp
-		stmt, err := db.Prepare("UPDATE ics_subscriptions SET last_updated_at = ? WHERE id = ?")
-		if err != nil {
-			log.Printf("Error preparing statement: %v", err)
-			continue
-		}
+	// Check if the user is already subscribed to this feed
+	var existingSubscriptionID int
+	err := db.QueryRow("SELECT id FROM ics_subscriptions WHERE url = ?", requestData.URL).Scan(&existingSubscriptionID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existingSubscriptionID != 0 {
+		http.Error(w, "You are already subscribed to this ICS feed", http.StatusConflict)
+		return
+	}
 
-		if _, err := stmt.Exec(time.Now(), sub.ID); err != nil {
-			log.Printf("Error updating last_updated_at: %v", err)
-		}
-		stmt.Close()
+	credentials, err := encryptIcsCredentials(requestData.Credentials)
+	if err != nil {
+		http.Error(w, err.Error(), secretErrorStatus(err))
+		return
 	}
+	importRules, err := encodeIcsImportRules(requestData.ImportRules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The project is created with the subscription, so a failed insert
+	// leaves no empty project behind
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	projectID, err := newProjectResolver(tx).id(requestData.ProjectName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO ics_subscriptions (url, project_id, local_edit_policy, removed_policy, refresh_interval_minutes, credentials, import_rules) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		requestData.URL, projectID, requestData.LocalEditPolicy, requestData.RemovedPolicy, requestData.RefreshInterval, credentials, importRules,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	subscriptionID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go refreshIcsSubscriptionByID(int(subscriptionID))
+
+	w.WriteHeader(http.StatusCreated)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// openTestDatabase points the global db at a fresh, fully migrated database
+// in a temporary directory.
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	if err := openDatabase(filepath.Join(t.TempDir(), "todos.db")); err != nil {
+		t.Fatal(err)
+	}
+	opened := db
+	t.Cleanup(func() { opened.Close() })
+}
+
+func TestUpdateTodoParent(t *testing.T) {
+	openTestDatabase(t)
+
+	// 2 is a subtask of 1, 3 is in another project and 4 has notes and a priority
+	for _, stmt := range []string{
+		"INSERT INTO projects (id, title, position) VALUES (2, 'Other', 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (1, 'Parent', 1, 0)",
+		"INSERT INTO todos (id, title, project_id, position, parent_id) VALUES (2, 'Child', 1, 1, 1)",
+		"INSERT INTO todos (id, title, project_id, position) VALUES (3, 'Elsewhere', 2, 0)",
+		"INSERT INTO todos (id, title, project_id, position, notes, priority) VALUES (4, 'Loose', 1, 2, 'Some notes', 3)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		id         int
+		parentID   int
+		want       int
+		wantParent int
+	}{
+		{"own parent", 1, 1, http.StatusBadRequest, 0},
+		{"below its own subtask", 1, 2, http.StatusBadRequest, 0},
+		{"missing parent", 4, 99, http.StatusNotFound, 0},
+		{"parent in another project", 4, 3, http.StatusBadRequest, 0},
+		{"valid parent", 4, 2, http.StatusOK, 2},
+		{"below a subtask of a subtask", 1, 4, http.StatusBadRequest, 0},
+		{"made top-level", 4, 0, http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"id": ` + strconv.Itoa(tt.id) + `, "title": "Todo", "parent_id": ` + strconv.Itoa(tt.parentID) + `}`
+			w := httptest.NewRecorder()
+			updateTodo(w, httptest.NewRequest(http.MethodPut, "/api/todos", strings.NewReader(body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var todo Todo
+			if err := json.NewDecoder(w.Body).Decode(&todo); err != nil {
+				t.Fatal(err)
+			}
+			parent := 0
+			if todo.ParentID != nil {
+				parent = *todo.ParentID
+			}
+			if parent != tt.wantParent {
+				t.Errorf("parent_id = %d, want %d", parent, tt.wantParent)
+			}
+			// Left out of the request, so they are kept and returned as stored
+			if todo.Notes != "Some notes" || todo.Priority != 3 {
+				t.Errorf("notes %q and priority %d, want the stored ones", todo.Notes, todo.Priority)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS delete_reminders_with_todo;
+DROP INDEX IF EXISTS idx_reminders_sent_at;
+DROP INDEX IF EXISTS idx_reminders_todo_id;
+DROP TABLE reminders;
+DROP TABLE notification_channels;
@@ -0,0 +1,35 @@
+-- Where notifications are delivered (webhook, email, ntfy). Passwords and
+-- tokens of a channel's config are kept apart in secrets, encrypted with the
+-- secret key.
+CREATE TABLE notification_channels (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL,
+    config TEXT NOT NULL DEFAULT '{}',
+    secrets TEXT,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A reminder fires at remind_at, or offset_minutes before the todo's due date.
+-- A NULL channel_id notifies every enabled channel.
+CREATE TABLE reminders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    todo_id INTEGER NOT NULL,
+    remind_at TIMESTAMP,
+    offset_minutes INTEGER,
+    channel_id INTEGER,
+    sent_at TIMESTAMP,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(todo_id) REFERENCES todos(id),
+    FOREIGN KEY(channel_id) REFERENCES notification_channels(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reminders_todo_id ON reminders (todo_id);
+CREATE INDEX IF NOT EXISTS idx_reminders_sent_at ON reminders (sent_at);
+
+-- Foreign keys are not enforced, so clean up reminders of deleted todos here
+CREATE TRIGGER delete_reminders_with_todo AFTER DELETE ON todos
+BEGIN
+    DELETE FROM reminders WHERE todo_id = OLD.id;
+END;
@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS dav_todo_deleted;
+DROP TRIGGER IF EXISTS dav_todo_updated;
+DROP TRIGGER IF EXISTS dav_todo_inserted;
+DROP TRIGGER IF EXISTS compact_dav_changes;
+DROP TABLE dav_sync_floors;
+DROP INDEX IF EXISTS idx_dav_changes_name;
+DROP INDEX IF EXISTS idx_dav_changes_todo_id;
+DROP INDEX IF EXISTS idx_dav_changes_project_id;
+DROP TABLE dav_changes;
+ALTER TABLE todos DROP COLUMN dav_name;
@@ -0,0 +1,71 @@
+-- Resource name a CalDAV client chose when it created the todo. Todos
+-- created elsewhere are served as "todo-<id>.ics".
+ALTER TABLE todos ADD COLUMN dav_name TEXT;
+
+-- The latest change of each todo, used for CalDAV ETags, collection tags and
+-- sync-collection reports. Rows marked deleted are tombstones; changed_at
+-- dates them so they can be dropped once clients have had time to sync.
+CREATE TABLE dav_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    todo_id INTEGER NOT NULL,
+    project_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_dav_changes_project_id ON dav_changes (project_id, id);
+CREATE INDEX IF NOT EXISTS idx_dav_changes_todo_id ON dav_changes (todo_id, id);
+CREATE INDEX IF NOT EXISTS idx_dav_changes_name ON dav_changes (project_id, name, id);
+
+-- The newest pruned tombstone of each project. Sync tokens from before it
+-- may miss deletions, so clients holding one sync again from scratch.
+CREATE TABLE dav_sync_floors (
+    project_id INTEGER PRIMARY KEY,
+    change_id INTEGER NOT NULL
+);
+
+INSERT INTO dav_changes (todo_id, project_id, name)
+SELECT id, project_id, 'todo-' || id || '.ics' FROM todos ORDER BY id;
+
+-- Only the latest change of each resource name is kept, which is all a
+-- sync-collection report needs
+CREATE TRIGGER compact_dav_changes AFTER INSERT ON dav_changes
+BEGIN
+    DELETE FROM dav_changes WHERE project_id = NEW.project_id AND name = NEW.name AND id < NEW.id;
+END;
+
+CREATE TRIGGER dav_todo_inserted AFTER INSERT ON todos
+BEGIN
+    INSERT INTO dav_changes (todo_id, project_id, name)
+    VALUES (NEW.id, NEW.project_id, COALESCE(NEW.dav_name, 'todo-' || NEW.id || '.ics'));
+END;
+
+-- Only changes to what the VTODO holds count. Adding or completing a todo
+-- shifts the position of the others, which would otherwise change them all.
+-- A todo moved to another project, or renamed, disappears from where it was.
+CREATE TRIGGER dav_todo_updated AFTER UPDATE ON todos
+WHEN OLD.title IS NOT NEW.title
+    OR OLD.completed IS NOT NEW.completed
+    OR OLD.completed_at IS NOT NEW.completed_at
+    OR OLD.created_at IS NOT NEW.created_at
+    OR OLD.due_date IS NOT NEW.due_date
+    OR OLD.recurrence_interval IS NOT NEW.recurrence_interval
+    OR OLD.recurrence_unit IS NOT NEW.recurrence_unit
+    OR OLD.uid IS NOT NEW.uid
+    OR OLD.project_id IS NOT NEW.project_id
+    OR OLD.dav_name IS NOT NEW.dav_name
+BEGIN
+    INSERT INTO dav_changes (todo_id, project_id, name, deleted)
+    SELECT OLD.id, OLD.project_id, COALESCE(OLD.dav_name, 'todo-' || OLD.id || '.ics'), TRUE
+    WHERE OLD.project_id IS NOT NEW.project_id OR OLD.dav_name IS NOT NEW.dav_name;
+
+    INSERT INTO dav_changes (todo_id, project_id, name)
+    VALUES (NEW.id, NEW.project_id, COALESCE(NEW.dav_name, 'todo-' || NEW.id || '.ics'));
+END;
+
+CREATE TRIGGER dav_todo_deleted AFTER DELETE ON todos
+BEGIN
+    INSERT INTO dav_changes (todo_id, project_id, name, deleted)
+    VALUES (OLD.id, OLD.project_id, COALESCE(OLD.dav_name, 'todo-' || OLD.id || '.ics'), TRUE);
+END;
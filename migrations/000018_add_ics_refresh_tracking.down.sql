@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS delete_ics_history_with_subscription;
+DROP TRIGGER IF EXISTS delete_ics_items_with_todo;
+DROP INDEX IF EXISTS idx_ics_refresh_changes_refresh_id;
+DROP TABLE ics_refresh_changes;
+DROP INDEX IF EXISTS idx_ics_refreshes_subscription_id;
+DROP TABLE ics_refreshes;
+DROP INDEX IF EXISTS idx_ics_subscription_items_todo_id;
+DROP TABLE ics_subscription_items;
+ALTER TABLE ics_subscriptions DROP COLUMN removed_policy;
+ALTER TABLE ics_subscriptions DROP COLUMN local_edit_policy;
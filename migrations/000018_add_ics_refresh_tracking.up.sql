@@ -0,0 +1,63 @@
+-- What to do when an event changes upstream after the todo was edited
+-- locally ('keep' or 'overwrite'), and when it is removed or cancelled
+-- ('delete' or 'complete')
+ALTER TABLE ics_subscriptions ADD COLUMN local_edit_policy TEXT NOT NULL DEFAULT 'keep';
+ALTER TABLE ics_subscriptions ADD COLUMN removed_policy TEXT NOT NULL DEFAULT 'delete';
+
+-- The todo created for each event of a feed, with the title and due date
+-- last imported, to tell upstream changes from local edits
+CREATE TABLE ics_subscription_items (
+    subscription_id INTEGER NOT NULL,
+    uid TEXT NOT NULL,
+    todo_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    due_date TIMESTAMP,
+    PRIMARY KEY (subscription_id, uid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ics_subscription_items_todo_id ON ics_subscription_items (todo_id);
+
+-- Todos imported before this migration are assumed unedited. UIDs the app
+-- generated itself belong to local todos.
+INSERT OR IGNORE INTO ics_subscription_items (subscription_id, uid, todo_id, title, due_date)
+SELECT s.id, t.uid, t.id, t.title, datetime(t.due_date)
+FROM todos t
+JOIN ics_subscriptions s ON s.project_id = t.project_id
+WHERE t.uid IS NOT NULL AND t.uid != '' AND t.uid NOT LIKE '%@todo-app' AND t.dav_name IS NULL;
+
+-- One row per refresh, and what it changed
+CREATE TABLE ics_refreshes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id INTEGER NOT NULL,
+    refreshed_at TIMESTAMP NOT NULL,
+    added INTEGER NOT NULL DEFAULT 0,
+    updated INTEGER NOT NULL DEFAULT 0,
+    removed INTEGER NOT NULL DEFAULT 0,
+    error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_ics_refreshes_subscription_id ON ics_refreshes (subscription_id, id);
+
+CREATE TABLE ics_refresh_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    refresh_id INTEGER NOT NULL,
+    todo_id INTEGER,
+    uid TEXT NOT NULL,
+    action TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_ics_refresh_changes_refresh_id ON ics_refresh_changes (refresh_id);
+
+-- Foreign keys are not enforced, so clean up here
+CREATE TRIGGER delete_ics_items_with_todo AFTER DELETE ON todos
+BEGIN
+    DELETE FROM ics_subscription_items WHERE todo_id = OLD.id;
+END;
+
+CREATE TRIGGER delete_ics_history_with_subscription AFTER DELETE ON ics_subscriptions
+BEGIN
+    DELETE FROM ics_subscription_items WHERE subscription_id = OLD.id;
+    DELETE FROM ics_refresh_changes WHERE refresh_id IN (SELECT id FROM ics_refreshes WHERE subscription_id = OLD.id);
+    DELETE FROM ics_refreshes WHERE subscription_id = OLD.id;
+END;
@@ -0,0 +1,10 @@
+ALTER TABLE ics_refreshes DROP COLUMN http_status;
+ALTER TABLE ics_subscriptions DROP COLUMN paused;
+ALTER TABLE ics_subscriptions DROP COLUMN consecutive_failures;
+ALTER TABLE ics_subscriptions DROP COLUMN last_removed_count;
+ALTER TABLE ics_subscriptions DROP COLUMN last_updated_count;
+ALTER TABLE ics_subscriptions DROP COLUMN last_added_count;
+ALTER TABLE ics_subscriptions DROP COLUMN last_error;
+ALTER TABLE ics_subscriptions DROP COLUMN last_http_status;
+ALTER TABLE ics_subscriptions DROP COLUMN last_success_at;
+ALTER TABLE ics_subscriptions DROP COLUMN last_attempt_at;
@@ -0,0 +1,14 @@
+-- Outcome of the most recent refresh attempts of each subscription
+ALTER TABLE ics_subscriptions ADD COLUMN last_attempt_at TIMESTAMP;
+ALTER TABLE ics_subscriptions ADD COLUMN last_success_at TIMESTAMP;
+ALTER TABLE ics_subscriptions ADD COLUMN last_http_status INTEGER;
+ALTER TABLE ics_subscriptions ADD COLUMN last_error TEXT;
+ALTER TABLE ics_subscriptions ADD COLUMN last_added_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ics_subscriptions ADD COLUMN last_updated_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ics_subscriptions ADD COLUMN last_removed_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ics_subscriptions ADD COLUMN consecutive_failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ics_subscriptions ADD COLUMN paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE ics_subscriptions SET last_attempt_at = last_updated_at, last_success_at = last_updated_at;
+
+ALTER TABLE ics_refreshes ADD COLUMN http_status INTEGER;
@@ -0,0 +1,2 @@
+ALTER TABLE ics_subscriptions DROP COLUMN next_refresh_at;
+ALTER TABLE ics_subscriptions DROP COLUMN refresh_interval_minutes;
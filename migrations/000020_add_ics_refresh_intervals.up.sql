@@ -0,0 +1,3 @@
+-- How often each subscription is refreshed, and when it is next due
+ALTER TABLE ics_subscriptions ADD COLUMN refresh_interval_minutes INTEGER NOT NULL DEFAULT 60;
+ALTER TABLE ics_subscriptions ADD COLUMN next_refresh_at TIMESTAMP;
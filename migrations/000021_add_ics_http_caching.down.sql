@@ -0,0 +1,2 @@
+ALTER TABLE ics_subscriptions DROP COLUMN last_modified;
+ALTER TABLE ics_subscriptions DROP COLUMN etag;
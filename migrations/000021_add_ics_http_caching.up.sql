@@ -0,0 +1,3 @@
+-- Validators from the last full response, sent back in conditional requests
+ALTER TABLE ics_subscriptions ADD COLUMN etag TEXT;
+ALTER TABLE ics_subscriptions ADD COLUMN last_modified TEXT;
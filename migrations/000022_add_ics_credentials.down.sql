@@ -0,0 +1 @@
+ALTER TABLE ics_subscriptions DROP COLUMN credentials;
@@ -0,0 +1,3 @@
+-- Basic auth, bearer token and extra headers for protected feeds, as JSON
+-- encrypted with the server's secret key
+ALTER TABLE ics_subscriptions ADD COLUMN credentials TEXT;
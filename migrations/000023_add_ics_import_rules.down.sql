@@ -0,0 +1,23 @@
+DROP TRIGGER IF EXISTS dav_todo_updated;
+CREATE TRIGGER dav_todo_updated AFTER UPDATE ON todos
+WHEN OLD.title IS NOT NEW.title
+    OR OLD.completed IS NOT NEW.completed
+    OR OLD.completed_at IS NOT NEW.completed_at
+    OR OLD.created_at IS NOT NEW.created_at
+    OR OLD.due_date IS NOT NEW.due_date
+    OR OLD.recurrence_interval IS NOT NEW.recurrence_interval
+    OR OLD.recurrence_unit IS NOT NEW.recurrence_unit
+    OR OLD.uid IS NOT NEW.uid
+    OR OLD.project_id IS NOT NEW.project_id
+    OR OLD.dav_name IS NOT NEW.dav_name
+BEGIN
+    INSERT INTO dav_changes (todo_id, project_id, name, deleted)
+    SELECT OLD.id, OLD.project_id, COALESCE(OLD.dav_name, 'todo-' || OLD.id || '.ics'), TRUE
+    WHERE OLD.project_id IS NOT NEW.project_id OR OLD.dav_name IS NOT NEW.dav_name;
+
+    INSERT INTO dav_changes (todo_id, project_id, name)
+    VALUES (NEW.id, NEW.project_id, COALESCE(NEW.dav_name, 'todo-' || NEW.id || '.ics'));
+END;
+
+ALTER TABLE todos DROP COLUMN priority;
+ALTER TABLE ics_subscriptions DROP COLUMN import_rules;
@@ -0,0 +1,42 @@
+-- Free-form notes, e.g. the description of an imported task
+ALTER TABLE todos ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+
+-- The todo a subtask belongs to
+ALTER TABLE todos ADD COLUMN parent_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_todos_parent_id ON todos (parent_id);
+
+-- Foreign keys are not enforced, so subtasks of deleted todos become top-level here
+CREATE TRIGGER detach_subtasks_of_deleted_todo AFTER DELETE ON todos
+BEGIN
+    UPDATE todos SET parent_id = NULL WHERE parent_id = OLD.id;
+END;
+
+-- Notes of the task when it was last imported
+ALTER TABLE ics_subscription_items ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+
+-- The VTODOs served over CalDAV hold the notes and parent, so changing them is a change
+DROP TRIGGER IF EXISTS dav_todo_updated;
+CREATE TRIGGER dav_todo_updated AFTER UPDATE ON todos
+WHEN OLD.title IS NOT NEW.title
+    OR OLD.completed IS NOT NEW.completed
+    OR OLD.completed_at IS NOT NEW.completed_at
+    OR OLD.created_at IS NOT NEW.created_at
+    OR OLD.due_date IS NOT NEW.due_date
+    OR OLD.all_day IS NOT NEW.all_day
+    OR OLD.recurrence_interval IS NOT NEW.recurrence_interval
+    OR OLD.recurrence_unit IS NOT NEW.recurrence_unit
+    OR OLD.uid IS NOT NEW.uid
+    OR OLD.priority IS NOT NEW.priority
+    OR OLD.notes IS NOT NEW.notes
+    OR OLD.parent_id IS NOT NEW.parent_id
+    OR OLD.project_id IS NOT NEW.project_id
+    OR OLD.dav_name IS NOT NEW.dav_name
+BEGIN
+    INSERT INTO dav_changes (todo_id, project_id, name, deleted)
+    SELECT OLD.id, OLD.project_id, COALESCE(OLD.dav_name, 'todo-' || OLD.id || '.ics'), TRUE
+    WHERE OLD.project_id IS NOT NEW.project_id OR OLD.dav_name IS NOT NEW.dav_name;
+
+    INSERT INTO dav_changes (todo_id, project_id, name)
+    VALUES (NEW.id, NEW.project_id, COALESCE(NEW.dav_name, 'todo-' || NEW.id || '.ics'));
+END;
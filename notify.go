@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Notification is a message about a todo sent through a notification channel.
+type Notification struct {
+	Event     string     `json:"event"`
+	Title     string     `json:"title"`
+	Message   string     `json:"message"`
+	TodoID    int        `json:"todo_id,omitempty"`
+	ProjectID int        `json:"project_id,omitempty"`
+	DueDate   *time.Time `json:"due_date,omitempty"`
+	AllDay    bool       `json:"all_day,omitempty"`
+}
+
+// Notifier delivers notifications to one destination.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// notifierFactories builds a Notifier from a channel's JSON config. New
+// channel types register here.
+var notifierFactories = map[string]func(config json.RawMessage) (Notifier, error){
+	"webhook": newWebhookNotifier,
+	"email":   newEmailNotifier,
+	"ntfy":    newNtfyNotifier,
+	"webpush": newWebPushNotifier,
+}
+
+// channelSecretFields are the config fields of each channel type that hold
+// credentials. They are stored encrypted in the secrets column, and the API
+// only tells whether they are set, as has_<field>.
+var channelSecretFields = map[string][]string{
+	"webhook": {"headers"},
+	"ntfy":    {"token"},
+	"email":   {"password"},
+}
+
+const selectNotificationChannels = "SELECT id, name, type, config, secrets, enabled, created_at FROM notification_channels"
+
+type NotificationChannel struct {
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Config    json.RawMessage `json:"config"`
+	Enabled   bool            `json:"enabled"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (c NotificationChannel) notifier() (Notifier, error) {
+	factory, ok := notifierFactories[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown notification channel type %q", c.Type)
+	}
+	return factory(c.Config)
+}
+
+// configFields reads a channel config as a JSON object.
+func configFields(config json.RawMessage) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(config) == 0 || string(config) == "null" {
+		return fields, nil
+	}
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	return fields, nil
+}
+
+// splitSecrets returns the config without its secret fields, and the secret
+// fields that are set.
+func (c NotificationChannel) splitSecrets() (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	fields, err := configFields(c.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]json.RawMessage)
+	for _, name := range channelSecretFields[c.Type] {
+		if value, ok := fields[name]; ok && string(value) != "null" && string(value) != `""` {
+			secrets[name] = value
+		}
+		delete(fields, name)
+		delete(fields, "has_"+name)
+	}
+	return fields, secrets, nil
+}
+
+// storedConfig returns the values stored in the config and secrets columns.
+// secrets is nil when none are set.
+func (c NotificationChannel) storedConfig() (string, *string, error) {
+	fields, secrets, err := c.splitSecrets()
+	if err != nil {
+		return "", nil, err
+	}
+	config, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(secrets) == 0 {
+		return string(config), nil, nil
+	}
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return "", nil, err
+	}
+	encrypted, err := encryptSecret(plaintext)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(config), &encrypted, nil
+}
+
+// redacted returns the channel as the API shows it, with has_<field> in place
+// of each secret field.
+func (c NotificationChannel) redacted() (NotificationChannel, error) {
+	fields, secrets, err := c.splitSecrets()
+	if err != nil {
+		return c, err
+	}
+	for _, name := range channelSecretFields[c.Type] {
+		_, ok := secrets[name]
+		fields["has_"+name] = json.RawMessage(strconv.FormatBool(ok))
+	}
+	c.Config, err = json.Marshal(fields)
+	return c, err
+}
+
+// keepSecrets copies the secret fields an update leaves out from the stored
+// channel, as clients never get them to send back. Setting a field to null or
+// "" clears it.
+func (c *NotificationChannel) keepSecrets(stored NotificationChannel) error {
+	if c.Type != stored.Type {
+		return nil
+	}
+	fields, err := configFields(c.Config)
+	if err != nil {
+		return err
+	}
+	storedFields, err := configFields(stored.Config)
+	if err != nil {
+		return err
+	}
+	for _, name := range channelSecretFields[c.Type] {
+		if _, ok := fields[name]; !ok && storedFields[name] != nil {
+			fields[name] = storedFields[name]
+		}
+	}
+	c.Config, err = json.Marshal(fields)
+	return err
+}
+
+var notificationClient = &http.Client{Timeout: 30 * time.Second}
+
+// postNotification sends a request and treats any non-2xx status as an error.
+func postNotification(ctx context.Context, req *http.Request) error {
+	resp, err := notificationClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status code %d, body: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification as JSON.
+type webhookNotifier struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func newWebhookNotifier(config json.RawMessage) (Notifier, error) {
+	var n webhookNotifier
+	if err := json.Unmarshal(config, &n); err != nil {
+		return nil, err
+	}
+	if n.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	return &n, nil
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.Headers {
+		req.Header.Set(key, value)
+	}
+	return postNotification(ctx, req)
+}
+
+// ntfyNotifier publishes to an ntfy-style topic URL, with the message as the
+// body and the title in a header.
+type ntfyNotifier struct {
+	URL      string `json:"url"`
+	Token    string `json:"token,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+func newNtfyNotifier(config json.RawMessage) (Notifier, error) {
+	var n ntfyNotifier
+	if err := json.Unmarshal(config, &n); err != nil {
+		return nil, err
+	}
+	if n.URL == "" {
+		return nil, fmt.Errorf("ntfy topic url is required")
+	}
+	return &n, nil
+}
+
+func (n *ntfyNotifier) Notify(ctx context.Context, notification Notification) error {
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader([]byte(notification.Message)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notification.Title)
+	req.Header.Set("Tags", "bell")
+	if n.Priority != "" {
+		req.Header.Set("Priority", n.Priority)
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return postNotification(ctx, req)
+}
+
+// emailNotifier sends a plain-text email through SMTP.
+type emailNotifier struct {
+	SMTPConfig
+}
+
+func newEmailNotifier(config json.RawMessage) (Notifier, error) {
+	var n emailNotifier
+	if err := json.Unmarshal(config, &n.SMTPConfig); err != nil {
+		return nil, err
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, notification Notification) error {
+	return sendMail(ctx, n.SMTPConfig, notification.Title, notification.Message, "")
+}
+
+// notifyChannels sends a notification to one channel, or to every enabled
+// channel when channelID is nil. It returns the first error encountered.
+func notifyChannels(channelID *int, notification Notification) error {
+	query := selectNotificationChannels + " WHERE enabled = 1"
+	args := []interface{}{}
+	if channelID != nil {
+		query += " AND id = ?"
+		args = append(args, *channelID)
+	}
+
+	channels, err := queryNotificationChannels(query, args...)
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return fmt.Errorf("no enabled notification channel")
+	}
+
+	var firstErr error
+	for _, channel := range channels {
+		if err := sendToChannel(channel, notification); err != nil {
+			logError("Error sending notification through channel %q: %v", channel.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func sendToChannel(channel NotificationChannel, notification Notification) error {
+	notifier, err := channel.notifier()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return notifier.Notify(ctx, notification)
+}
+
+func queryNotificationChannels(query string, args ...interface{}) ([]NotificationChannel, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := make([]NotificationChannel, 0)
+	for rows.Next() {
+		var channel NotificationChannel
+		var config string
+		var secrets sql.NullString
+		if err := rows.Scan(&channel.ID, &channel.Name, &channel.Type, &config, &secrets, &channel.Enabled, &channel.CreatedAt); err != nil {
+			return nil, err
+		}
+		channel.Config = json.RawMessage(config)
+		if secrets.Valid {
+			if err := channel.addSecrets(secrets.String); err != nil {
+				return nil, fmt.Errorf("channel %q: %v", channel.Name, err)
+			}
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+// addSecrets decrypts the secrets column into the channel's config.
+func (c *NotificationChannel) addSecrets(encrypted string) error {
+	plaintext, err := decryptSecret(encrypted)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]json.RawMessage
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return err
+	}
+	fields, err := configFields(c.Config)
+	if err != nil {
+		return err
+	}
+	for name, value := range secrets {
+		fields[name] = value
+	}
+	c.Config, err = json.Marshal(fields)
+	return err
+}
+
+func getNotificationChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := queryNotificationChannels(selectNotificationChannels + " ORDER BY id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, channel := range channels {
+		if channels[i], err = channel.redacted(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+// decodeNotificationChannel reads a channel from the request.
+func decodeNotificationChannel(r *http.Request) (NotificationChannel, error) {
+	channel := NotificationChannel{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		return channel, err
+	}
+	if channel.Name == "" {
+		channel.Name = channel.Type
+	}
+	if len(channel.Config) == 0 {
+		channel.Config = json.RawMessage("{}")
+	}
+	return channel, nil
+}
+
+func addNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel, err := decodeNotificationChannel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := channel.notifier(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, secrets, err := channel.storedConfig()
+	if err != nil {
+		http.Error(w, err.Error(), secretErrorStatus(err))
+		return
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO notification_channels (name, type, config, secrets, enabled) VALUES (?, ?, ?, ?, ?)",
+		channel.Name, channel.Type, config, secrets, channel.Enabled,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	channel.ID = int(id)
+	channel.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if channel, err = channel.redacted(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(channel)
+}
+
+func updateNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	channel, err := decodeNotificationChannel(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stored, err := queryNotificationChannels(selectNotificationChannels+" WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(stored) == 0 {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	if err := channel.keepSecrets(stored[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := channel.notifier(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, secrets, err := channel.storedConfig()
+	if err != nil {
+		http.Error(w, err.Error(), secretErrorStatus(err))
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE notification_channels SET name = ?, type = ?, config = ?, secrets = ?, enabled = ? WHERE id = ?",
+		channel.Name, channel.Type, config, secrets, channel.Enabled, id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if rowsAffected == 0 {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	channel.ID = id
+	channel.CreatedAt = stored[0].CreatedAt
+	if channel, err = channel.redacted(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+func deleteNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Reminders bound to this channel fall back to all channels
+	if _, err := tx.Exec("UPDATE reminders SET channel_id = NULL WHERE channel_id = ?", id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM notification_channels WHERE id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		tx.Rollback()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// testNotificationChannel sends a sample notification so settings can be
+// checked without waiting for a reminder.
+func testNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	channels, err := queryNotificationChannels(selectNotificationChannels+" WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(channels) == 0 {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	err = sendToChannel(channels[0], Notification{
+		Event:   "test",
+		Title:   "Todo App test notification",
+		Message: "This channel is set up correctly.",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// projectExportOptions are the query parameters of a project export.
+type projectExportOptions struct {
+	format string
+	loc    *time.Location
+	// "true" (the default) includes completed todos, "false" leaves them
+	// out and "only" leaves out the others
+	completed string
+	// Completed todos are only included when completed in [from, to)
+	from, to *time.Time
+}
+
+func projectExportOptionsFromRequest(r *http.Request) (projectExportOptions, error) {
+	query := r.URL.Query()
+	opts := projectExportOptions{format: query.Get("format"), loc: time.Local, completed: query.Get("completed")}
+	if opts.format == "" {
+		opts.format = "md"
+	}
+	if opts.format != "md" && opts.format != "csv" {
+		return opts, fmt.Errorf("format must be md or csv")
+	}
+	if opts.completed == "" {
+		opts.completed = "true"
+	}
+	if opts.completed != "true" && opts.completed != "false" && opts.completed != "only" {
+		return opts, fmt.Errorf("completed must be true, false or only")
+	}
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return opts, err
+		}
+		opts.loc = loc
+	}
+
+	// Both ends are dates in the export's time zone, and both are included
+	if value := query.Get("completed_from"); value != "" {
+		from, err := time.ParseInLocation("2006-01-02", value, opts.loc)
+		if err != nil {
+			return opts, fmt.Errorf("completed_from: %v", err)
+		}
+		opts.from = &from
+	}
+	if value := query.Get("completed_to"); value != "" {
+		to, err := time.ParseInLocation("2006-01-02", value, opts.loc)
+		if err != nil {
+			return opts, fmt.Errorf("completed_to: %v", err)
+		}
+		to = to.AddDate(0, 0, 1)
+		opts.to = &to
+	}
+	return opts, nil
+}
+
+// exportProjectHandler serves /api/projects/{id}/export.
+func exportProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	exportProjects(w, r, &id)
+}
+
+// exportAllProjectsHandler serves /api/projects/export.
+func exportAllProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	exportProjects(w, r, nil)
+}
+
+// exportProjects renders the todos of one project, or of all of them, as a
+// Markdown checklist (format=md) or as CSV with every todo column
+// (format=csv).
+func exportProjects(w http.ResponseWriter, r *http.Request, projectID *int) {
+	opts, err := projectExportOptionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	projectQuery := "SELECT id, title, position, created_at FROM projects"
+	args := []interface{}{}
+	if projectID != nil {
+		projectQuery += " WHERE id = ?"
+		args = append(args, *projectID)
+	}
+	rows, err := db.Query(projectQuery+" ORDER BY position, id", args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var projects []Project
+	for rows.Next() {
+		var project Project
+		if err := rows.Scan(&project.ID, &project.Title, &project.Position, &project.CreatedAt); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		projects = append(projects, project)
+	}
+	rows.Close()
+	if projectID != nil && len(projects) == 0 {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	todos, err := queryExportTodos(projectID, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := "todos"
+	if projectID != nil {
+		name = projects[0].Title
+	}
+	switch opts.format {
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".md"))
+		w.Write([]byte(renderProjectsMarkdown(projects, todos, opts.loc)))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+		if err := writeTodosCSV(w, projects, todos, opts.loc); err != nil {
+			logError("Error writing CSV export: %v", err)
+		}
+	}
+}
+
+// queryExportTodos returns the todos to export, in the order the app shows
+// them: open todos first, then by position.
+func queryExportTodos(projectID *int, opts projectExportOptions) ([]Todo, error) {
+	query := `
+		SELECT id, title, completed, created_at, completed_at, datetime(due_date), all_day,
+		       recurrence_interval, recurrence_unit, project_id, position, COALESCE(uid, ''), priority,
+		       notes, parent_id
+		FROM todos
+		WHERE 1 = 1`
+	args := []interface{}{}
+	if projectID != nil {
+		query += " AND project_id = ?"
+		args = append(args, *projectID)
+	}
+	switch opts.completed {
+	case "false":
+		query += " AND completed = 0"
+	case "only":
+		query += " AND completed = 1"
+	}
+	if opts.from != nil {
+		query += " AND (completed = 0 OR datetime(completed_at) >= ?)"
+		args = append(args, formatDueDate(opts.from))
+	}
+	if opts.to != nil {
+		query += " AND (completed = 0 OR datetime(completed_at) < ?)"
+		args = append(args, formatDueDate(opts.to))
+	}
+	query += " ORDER BY project_id, completed, position, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var todos []Todo
+	for rows.Next() {
+		var todo Todo
+		var dueDateStr sql.NullString
+		if err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.Completed,
+			&todo.CreatedAt,
+			&todo.CompletedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.ProjectID,
+			&todo.Position,
+			&todo.UID,
+			&todo.Priority,
+			&todo.Notes,
+			&todo.ParentID,
+		); err != nil {
+			return nil, err
+		}
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+// describeRecurrence turns the recurrence columns into e.g. "every 2 weeks",
+// or "" when the todo does not repeat.
+func describeRecurrence(interval *int, unit *string) string {
+	if interval == nil || unit == nil || *interval <= 0 {
+		return ""
+	}
+	singular := strings.TrimSuffix(strings.ToLower(*unit), "s")
+	if *interval == 1 {
+		return "every " + singular
+	}
+	return fmt.Sprintf("every %d %ss", *interval, singular)
+}
+
+// exportDueDate formats a due date for people: a date for all-day todos,
+// and a date and time in loc otherwise.
+func exportDueDate(todo Todo, loc *time.Location) string {
+	if todo.AllDay {
+		return todo.DueDate.UTC().Format("2006-01-02")
+	}
+	return todo.DueDate.In(loc).Format("2006-01-02 15:04")
+}
+
+// renderProjectsMarkdown renders each project as a heading and its todos as
+// a checklist, with subtasks nested under their parent and notes below the
+// todo.
+func renderProjectsMarkdown(projects []Project, todos []Todo, loc *time.Location) string {
+	projectOf := make(map[int]int)
+	for _, todo := range todos {
+		projectOf[todo.ID] = todo.ProjectID
+	}
+	children := make(map[int][]Todo)
+	topLevel := make(map[int][]Todo)
+	for _, todo := range todos {
+		// Subtasks whose parent is left out, or elsewhere, stay at the top
+		nested := false
+		if todo.ParentID != nil && *todo.ParentID != todo.ID {
+			parentProject, ok := projectOf[*todo.ParentID]
+			nested = ok && parentProject == todo.ProjectID
+		}
+		if nested {
+			children[*todo.ParentID] = append(children[*todo.ParentID], todo)
+		} else {
+			topLevel[todo.ProjectID] = append(topLevel[todo.ProjectID], todo)
+		}
+	}
+
+	var out strings.Builder
+	written := make(map[int]bool)
+	var writeTodo func(todo Todo, depth int)
+	writeTodo = func(todo Todo, depth int) {
+		if written[todo.ID] {
+			return
+		}
+		written[todo.ID] = true
+
+		indent := strings.Repeat("  ", depth)
+		box := "[ ]"
+		if todo.Completed {
+			box = "[x]"
+		}
+		var details []string
+		if todo.DueDate != nil {
+			details = append(details, "due "+exportDueDate(todo, loc))
+		}
+		if recurrence := describeRecurrence(todo.RecurrenceInterval, todo.RecurrenceUnit); recurrence != "" {
+			details = append(details, recurrence)
+		}
+		if todo.Completed && todo.CompletedAt != nil {
+			details = append(details, "completed "+todo.CompletedAt.In(loc).Format("2006-01-02"))
+		}
+		line := fmt.Sprintf("%s- %s %s", indent, box, todo.Title)
+		if len(details) > 0 {
+			line += " (" + strings.Join(details, ", ") + ")"
+		}
+		out.WriteString(line + "\n")
+
+		for _, note := range strings.Split(strings.TrimSpace(todo.Notes), "\n") {
+			if note = strings.TrimRight(note, " \r"); note != "" {
+				out.WriteString(indent + "  " + note + "\n")
+			}
+		}
+		for _, child := range children[todo.ID] {
+			writeTodo(child, depth+1)
+		}
+	}
+
+	for i, project := range projects {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString("# " + project.Title + "\n\n")
+		if len(topLevel[project.ID]) == 0 {
+			out.WriteString("_No todos_\n")
+			continue
+		}
+		for _, todo := range topLevel[project.ID] {
+			writeTodo(todo, 0)
+		}
+	}
+	return out.String()
+}
+
+// writeTodosCSV writes a row per todo with every column. Times are RFC 3339
+// in loc, and all-day due dates are plain dates.
+func writeTodosCSV(w http.ResponseWriter, projects []Project, todos []Todo, loc *time.Location) error {
+	projectTitles := make(map[int]string)
+	for _, project := range projects {
+		projectTitles[project.ID] = project.Title
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.In(loc).Format(time.RFC3339)
+	}
+	formatInt := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"id", "title", "completed", "created_at", "completed_at", "due_date", "all_day",
+		"recurrence_interval", "recurrence_unit", "position", "project_id", "project", "uid",
+		"priority", "notes", "parent_id",
+	})
+	for _, todo := range todos {
+		dueDate := ""
+		if todo.DueDate != nil {
+			if todo.AllDay {
+				dueDate = todo.DueDate.UTC().Format("2006-01-02")
+			} else {
+				dueDate = formatTime(todo.DueDate)
+			}
+		}
+		recurrenceUnit := ""
+		if todo.RecurrenceUnit != nil {
+			recurrenceUnit = *todo.RecurrenceUnit
+		}
+		out.Write([]string{
+			strconv.Itoa(todo.ID),
+			todo.Title,
+			strconv.FormatBool(todo.Completed),
+			formatTime(&todo.CreatedAt),
+			formatTime(todo.CompletedAt),
+			dueDate,
+			strconv.FormatBool(todo.AllDay),
+			formatInt(todo.RecurrenceInterval),
+			recurrenceUnit,
+			strconv.Itoa(todo.Position),
+			strconv.Itoa(todo.ProjectID),
+			projectTitles[todo.ProjectID],
+			todo.UID,
+			strconv.Itoa(todo.Priority),
+			todo.Notes,
+			formatInt(todo.ParentID),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
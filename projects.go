@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// projectResolver finds projects by title within a transaction, creating the
+// ones that do not exist yet at the end of the project list. Titles match
+// without regard to case, and each is looked up once.
+type projectResolver struct {
+	tx        *sql.Tx
+	ids       map[string]int
+	positions map[int]int
+	// Titles of the projects created, in order
+	created []string
+}
+
+func newProjectResolver(tx *sql.Tx) *projectResolver {
+	return &projectResolver{
+		tx:        tx,
+		ids:       make(map[string]int),
+		positions: make(map[int]int),
+		created:   make([]string, 0),
+	}
+}
+
+// id returns the id of the project with the given title.
+func (p *projectResolver) id(title string) (int, error) {
+	return p.resolve(title, "title = ? COLLATE NOCASE", title)
+}
+
+// name returns the id of the project with the given todo.txt +project
+// name, a title with underscores for spaces.
+func (p *projectResolver) name(name string) (int, error) {
+	return p.resolve(strings.ReplaceAll(name, "_", " "), "REPLACE(TRIM(title), ' ', '_') = ? COLLATE NOCASE", name)
+}
+
+// resolve returns the oldest project matching where, or creates one with
+// the given title when none does. Results are cached by lowercased title.
+func (p *projectResolver) resolve(title, where string, args ...interface{}) (int, error) {
+	key := strings.ToLower(title)
+	if id, ok := p.ids[key]; ok {
+		return id, nil
+	}
+
+	var id int
+	err := p.tx.QueryRow("SELECT id FROM projects WHERE "+where+" ORDER BY id LIMIT 1", args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		res, err := p.tx.Exec("INSERT INTO projects (title, position) VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM projects))", title)
+		if err != nil {
+			return 0, err
+		}
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(lastID)
+		p.created = append(p.created, title)
+	} else if err != nil {
+		return 0, err
+	}
+	p.ids[key] = id
+	return id, nil
+}
+
+// position returns the next free position at the end of a project.
+func (p *projectResolver) position(projectID int) (int, error) {
+	position, ok := p.positions[projectID]
+	if !ok {
+		if err := p.tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE project_id = ?", projectID).Scan(&position); err != nil {
+			return 0, err
+		}
+	}
+	p.positions[projectID] = position + 1
+	return position, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjectResolver(t *testing.T) {
+	openTestDatabase(t)
+	execAll(t,
+		"INSERT INTO projects (id, title, position) VALUES (2, 'Home Office', 1)",
+		"INSERT INTO projects (id, title, position) VALUES (3, 'home office', 2)",
+		"INSERT INTO todos (title, project_id, position) VALUES ('Desk', 2, 4)",
+	)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	projects := newProjectResolver(tx)
+
+	tests := []struct {
+		name string
+		find func(string) (int, error)
+		ref  string
+		want int
+	}{
+		{"title, oldest of two", projects.id, "HOME OFFICE", 2},
+		{"todo.txt name", projects.name, "home_office", 2},
+		{"missing title", projects.id, "Garden", 4},
+		{"missing title again", projects.id, "garden", 4},
+		{"missing todo.txt name", projects.name, "Side_Project", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id, err := tt.find(tt.ref); err != nil || id != tt.want {
+				t.Errorf("project = %d, %v, want %d", id, err, tt.want)
+			}
+		})
+	}
+	if want := []string{"Garden", "Side Project"}; !reflect.DeepEqual(projects.created, want) {
+		t.Errorf("created %q, want %q", projects.created, want)
+	}
+
+	for _, want := range []int{5, 6} {
+		if position, err := projects.position(2); err != nil || position != want {
+			t.Errorf("position = %d, %v, want %d", position, err, want)
+		}
+	}
+}
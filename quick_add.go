@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"todo-app/quickadd"
+)
+
+// Maximum size of a quick-add request body
+const quickAddMaxBody = 64 * 1024
+
+// errProjectNotFound is returned for a project id that does not exist.
+var errProjectNotFound = errors.New("project not found")
+
+// resolveProjectReference accepts either a project id or a project title.
+// Unknown titles are created, but an id has to exist: a typo in a script
+// should not create a project named after a number.
+func resolveProjectReference(projects *projectResolver, ref string) (int, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return 1, nil
+	}
+
+	if id, err := strconv.Atoi(ref); err == nil {
+		var projectID int
+		err := projects.tx.QueryRow("SELECT id FROM projects WHERE id = ?", id).Scan(&projectID)
+		if err == sql.ErrNoRows {
+			return 0, errProjectNotFound
+		}
+		return projectID, err
+	}
+
+	return projects.id(ref)
+}
+
+// insertTodoAtTop adds a todo at the top of its project, like the UI does.
+func insertTodoAtTop(tx *sql.Tx, todo *Todo) error {
+	if _, err := tx.Exec("UPDATE todos SET position = position + 1 WHERE project_id = ?", todo.ProjectID); err != nil {
+		return err
+	}
+
+	var dueDateInterface interface{}
+	if todo.DueDate != nil {
+		dueDateInterface = todo.DueDate.Format(time.RFC3339)
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO todos (title, completed, project_id, due_date, all_day, recurrence_interval, recurrence_unit, position) VALUES (?, 0, ?, datetime(?, 'utc'), ?, ?, ?, 0)",
+		todo.Title,
+		todo.ProjectID,
+		dueDateInterface,
+		todo.AllDay,
+		todo.RecurrenceInterval,
+		todo.RecurrenceUnit,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	todo.ID = int(id)
+	todo.Position = 0
+	todo.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+// mergeValues overlays form values on top of the query string values.
+func mergeValues(base url.Values, overlay map[string][]string) url.Values {
+	merged := url.Values{}
+	for key, values := range base {
+		merged[key] = values
+	}
+	for key, values := range overlay {
+		merged[key] = values
+	}
+	return merged
+}
+
+// quickAddHandler creates a todo from a plain-text or form-encoded body. It is
+// meant for scripts and shortcuts, so it is authenticated with an API token.
+//
+//	curl -H "Authorization: Bearer $TOKEN" --data-binary "Buy milk #groceries due:tomorrow" \
+//	     "http://localhost:8081/api/quick_add?project=Shopping"
+func quickAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, quickAddMaxBody)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fields can come from the query string or a form body. A body without a
+	// text field is taken verbatim, because curl --data sends plain text as a
+	// form by default.
+	text := string(body)
+	fields := r.URL.Query()
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(text); err == nil && (form.Has("text") || form.Has("title")) {
+			fields = mergeValues(fields, form)
+			text = ""
+		}
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(quickAddMaxBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields = mergeValues(fields, form.Value)
+		text = ""
+	}
+	if text == "" {
+		text = fields.Get("text")
+		if text == "" {
+			text = fields.Get("title")
+		}
+	}
+	projectRef := fields.Get("project")
+	due := fields.Get("due")
+	extraTags := fields.Get("tags")
+
+	// Explicit fields are folded into the text so they go through the same parser
+	for _, tag := range strings.FieldsFunc(extraTags, func(r rune) bool { return r == ',' || r == ' ' }) {
+		text += " #" + strings.TrimPrefix(tag, "#")
+	}
+	now := time.Now()
+	if due != "" {
+		if check := quickadd.Parse("due:"+due, now); check.DueDate == nil || check.Title != "" {
+			http.Error(w, fmt.Sprintf("invalid due date %q", due), http.StatusBadRequest)
+			return
+		}
+		text += " due:" + due
+	}
+
+	// The text is read like a todo typed with parsing on, in the server's time zone
+	parsed := quickadd.Parse(text, now)
+	if parsed.Title == "" {
+		http.Error(w, "Todo text is required", http.StatusBadRequest)
+		return
+	}
+	if projectRef == "" {
+		projectRef = parsed.Project
+	}
+
+	// The project is created with the todo, so a failed insert leaves no
+	// empty project behind
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	projectID, err := resolveProjectReference(newProjectResolver(tx), projectRef)
+	if errors.Is(err, errProjectNotFound) {
+		http.Error(w, fmt.Sprintf("Project %s not found", projectRef), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	todo := Todo{
+		Title:              parsed.Title,
+		ProjectID:          projectID,
+		DueDate:            parsed.DueDate,
+		RecurrenceInterval: parsed.RecurrenceInterval,
+		RecurrenceUnit:     parsed.RecurrenceUnit,
+	}
+	if todo.DueDate != nil && !parsed.HasTime {
+		// A date without a time of day is all-day, on that date locally
+		dueDate := allDayDueDate(todo.DueDate.In(time.Local))
+		todo.DueDate = &dueDate
+		todo.AllDay = true
+	}
+	if err := insertTodoAtTop(tx, &todo); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Todo
+		Tags []string `json:"tags"`
+	}{todo, parsed.Tags})
+}
@@ -0,0 +1,527 @@
+// Package quickadd extracts due dates, times, recurrence, projects and tags
+// from free-form todo text such as
+// "Pay rent every month on the 1st #finance tomorrow 9am".
+package quickadd
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Match describes one phrase the parser understood.
+type Match struct {
+	Kind string `json:"kind"` // date, time, recurrence, project or tag
+	Text string `json:"text"`
+}
+
+// Result is what Parse understood from the input. Everything except tags is
+// removed from the title; tags stay because the UI renders them inline.
+type Result struct {
+	Title              string     `json:"title"`
+	DueDate            *time.Time `json:"due_date,omitempty"`
+	HasTime            bool       `json:"has_time"`
+	RecurrenceInterval *int       `json:"recurrence_interval,omitempty"`
+	RecurrenceUnit     *string    `json:"recurrence_unit,omitempty"`
+	Project            string     `json:"project,omitempty"`
+	Tags               []string   `json:"tags"`
+	Matches            []Match    `json:"matches"`
+}
+
+const (
+	weekdayNames = `(sunday|monday|tuesday|wednesday|thursday|friday|saturday)`
+	monthNames   = `(jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sep(?:t(?:ember)?)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)`
+	numberWords  = `(\d+|a|an|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)`
+	ordinal      = `(\d{1,2})(?:st|nd|rd|th)`
+	units        = `(day|week|month|year)s?`
+)
+
+var (
+	projectPattern = regexp.MustCompile(`(?:^|\s)@(?:"([^"]+)"|(\S+))`)
+	tagPattern     = regexp.MustCompile(`(?:^|\s)#(\w+)`)
+
+	everyUnitPattern    = regexp.MustCompile(`(?i)\bevery\s+(?:(other)\s+|` + numberWords + `\s+)?` + units + `\b(?:\s+on\s+(?:the\s+` + ordinal + `|` + weekdayNames + `s?)\b)?`)
+	everyWeekdayPattern = regexp.MustCompile(`(?i)\bevery\s+` + weekdayNames + `s?\b`)
+	everyOrdinalPattern = regexp.MustCompile(`(?i)\bevery\s+` + ordinal + `\b`)
+	adverbPattern       = regexp.MustCompile(`(?i)\b(daily|weekly|fortnightly|monthly|yearly|annually)\b`)
+
+	dueMarkerPattern        = regexp.MustCompile(`(?i)(?:^|\s)due:(\S+)`)
+	isoDatePattern          = regexp.MustCompile(`(?i)\b(?:on\s+)?(\d{4})-(\d{1,2})-(\d{1,2})(?:T(\d{1,2}):(\d{2}))?\b`)
+	monthDayPattern         = regexp.MustCompile(`(?i)\b(?:(?:on|by|due)\s+)?` + monthNames + `\.?\s+(\d{1,2})(?:st|nd|rd|th)?(?:,?\s+(\d{4}))?\b`)
+	dayMonthPattern         = regexp.MustCompile(`(?i)\b(?:(?:on|by|due)\s+)?(?:the\s+)?(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?` + monthNames + `(?:,?\s+(\d{4}))?\b`)
+	dayAfterTomorrowPattern = regexp.MustCompile(`(?i)\b(?:the\s+)?day\s+after\s+tomorrow\b`)
+	relativeDayPattern      = regexp.MustCompile(`(?i)\b(today|tonight|tomorrow|tmrw)\b`)
+	inDurationPattern       = regexp.MustCompile(`(?i)\bin\s+` + numberWords + `\s+(minute|hour|day|week|month|year)s?\b`)
+	nextUnitPattern         = regexp.MustCompile(`(?i)\bnext\s+(week|month|year)\b`)
+	weekdayPattern          = regexp.MustCompile(`(?i)\b(?:(?:on|by|due)\s+)?(?:next\s+|this\s+)?` + weekdayNames + `\b`)
+	ordinalDayPattern       = regexp.MustCompile(`(?i)\b(?:on\s+)?the\s+` + ordinal + `\b`)
+	amPmPattern             = regexp.MustCompile(`(?i)\b(?:at\s+)?(\d{1,2})(?::(\d{2}))?\s*(am|pm)\b`)
+	clockPattern            = regexp.MustCompile(`(?i)\b(?:at\s+)?([01]?\d|2[0-3]):([0-5]\d)\b`)
+	atHourPattern           = regexp.MustCompile(`(?i)\bat\s+([01]?\d|2[0-3])\b`)
+	namedTimePattern        = regexp.MustCompile(`(?i)\b(?:at\s+)?(noon|midday|midnight)\b`)
+	triggerPattern          = regexp.MustCompile(`(?i)^(?:on|by|due|next|this)\s`)
+	trailingPattern         = regexp.MustCompile(`(?i)^(?:\s*(?:#\w+|(?:at\s+)?\d{1,2}(?::\d{2})?\s*(?:am|pm)?|(?:at\s+)?(?:noon|midday|midnight)))*\s*[.!]?\s*$`)
+	whitespacePattern       = regexp.MustCompile(`[ \t]+`)
+	spaceAroundNewPattern   = regexp.MustCompile(` ?\n ?`)
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+var numbers = map[string]int{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+}
+
+type date struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+type parser struct {
+	text   string
+	now    time.Time
+	result Result
+	// after is the text following the match take is considering
+	after string
+
+	date   *date
+	anchor *date // first occurrence implied by the recurrence, used when no date is given
+	hour   int
+	minute int
+	// set when a phrase like "tonight" implies a time without stating one
+	defaultHour *int
+	hasTime     bool
+}
+
+// Parse extracts what it can from input. Relative phrases are resolved
+// against now, and the due date is computed in now's location before being
+// converted to UTC.
+func Parse(input string, now time.Time) Result {
+	p := &parser{text: input, now: now}
+	p.result.Tags = make([]string, 0)
+	p.result.Matches = make([]Match, 0)
+
+	p.parseProject()
+	p.parseTags()
+	p.parseRecurrence()
+	p.parseDate()
+	p.parseTime()
+
+	p.result.Title = strings.TrimSpace(spaceAroundNewPattern.ReplaceAllString(whitespacePattern.ReplaceAllString(p.text, " "), "\n"))
+	p.result.DueDate = p.dueDate()
+	p.result.HasTime = p.hasTime
+	return p.result
+}
+
+// take removes the first match of re from the text that accept agrees with.
+func (p *parser) take(re *regexp.Regexp, kind string, accept func(groups []string) bool) bool {
+	for _, loc := range re.FindAllStringSubmatchIndex(p.text, -1) {
+		groups := make([]string, len(loc)/2)
+		for i := range groups {
+			if loc[2*i] >= 0 {
+				groups[i] = p.text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		p.after = p.text[loc[1]:]
+		if !accept(groups) {
+			continue
+		}
+
+		p.result.Matches = append(p.result.Matches, Match{Kind: kind, Text: strings.TrimSpace(groups[0])})
+		p.text = p.text[:loc[0]] + " " + p.text[loc[1]:]
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseProject() {
+	p.take(projectPattern, "project", func(g []string) bool {
+		p.result.Project = g[1]
+		if p.result.Project == "" {
+			p.result.Project = g[2]
+		}
+		return true
+	})
+}
+
+func (p *parser) parseTags() {
+	for _, match := range tagPattern.FindAllStringSubmatch(p.text, -1) {
+		p.result.Tags = append(p.result.Tags, match[1])
+		p.result.Matches = append(p.result.Matches, Match{Kind: "tag", Text: "#" + match[1]})
+	}
+}
+
+func (p *parser) setRecurrence(interval int, unit string) {
+	p.result.RecurrenceInterval = &interval
+	p.result.RecurrenceUnit = &unit
+}
+
+func (p *parser) parseRecurrence() {
+	if p.take(everyUnitPattern, "recurrence", func(g []string) bool {
+		interval := 1
+		if g[1] != "" {
+			interval = 2
+		} else if g[2] != "" {
+			interval = parseNumber(g[2])
+		}
+		if interval <= 0 {
+			return false
+		}
+		p.setRecurrence(interval, strings.ToLower(g[3]))
+		if g[4] != "" {
+			p.anchor = p.nextDayOfMonth(atoi(g[4]))
+		} else if g[5] != "" {
+			p.anchor = p.nextWeekday(weekdays[strings.ToLower(g[5])], true)
+		}
+		return true
+	}) {
+		return
+	}
+
+	if p.take(everyWeekdayPattern, "recurrence", func(g []string) bool {
+		p.setRecurrence(1, "week")
+		p.anchor = p.nextWeekday(weekdays[strings.ToLower(g[1])], true)
+		return true
+	}) {
+		return
+	}
+
+	if p.take(everyOrdinalPattern, "recurrence", func(g []string) bool {
+		p.anchor = p.nextDayOfMonth(atoi(g[1]))
+		if p.anchor == nil {
+			return false
+		}
+		p.setRecurrence(1, "month")
+		return true
+	}) {
+		return
+	}
+
+	p.take(adverbPattern, "recurrence", func(g []string) bool {
+		switch strings.ToLower(g[1]) {
+		case "daily":
+			p.setRecurrence(1, "day")
+		case "weekly":
+			p.setRecurrence(1, "week")
+		case "fortnightly":
+			p.setRecurrence(2, "week")
+		case "monthly":
+			p.setRecurrence(1, "month")
+		default:
+			p.setRecurrence(1, "year")
+		}
+		return true
+	})
+}
+
+func (p *parser) parseDate() {
+	today := date{p.now.Year(), p.now.Month(), p.now.Day()}
+
+	attempts := []struct {
+		re     *regexp.Regexp
+		accept func(g []string) bool
+	}{
+		// A todo.txt style "due:" marker takes a date phrase or an RFC 3339
+		// timestamp as one word
+		{dueMarkerPattern, func(g []string) bool {
+			if t, err := time.Parse(time.RFC3339, g[1]); err == nil {
+				t = t.In(p.now.Location())
+				p.date = &date{t.Year(), t.Month(), t.Day()}
+				p.setTime(t.Hour(), t.Minute())
+				return true
+			}
+			value := Parse(g[1], p.now)
+			if value.Title != "" || value.DueDate == nil {
+				return false
+			}
+			t := value.DueDate.In(p.now.Location())
+			p.date = &date{t.Year(), t.Month(), t.Day()}
+			if value.HasTime {
+				p.setTime(t.Hour(), t.Minute())
+			}
+			return true
+		}},
+		{isoDatePattern, func(g []string) bool {
+			d := date{atoi(g[1]), time.Month(atoi(g[2])), atoi(g[3])}
+			if !d.valid() {
+				return false
+			}
+			p.date = &d
+			if g[4] != "" {
+				p.setTime(atoi(g[4]), atoi(g[5]))
+			}
+			return true
+		}},
+		{monthDayPattern, func(g []string) bool {
+			return (g[3] != "" || p.meantAsDate(g[0])) && p.setMonthDay(parseMonth(g[1]), atoi(g[2]), g[3])
+		}},
+		{dayMonthPattern, func(g []string) bool {
+			return (g[3] != "" || p.meantAsDate(g[0])) && p.setMonthDay(parseMonth(g[2]), atoi(g[1]), g[3])
+		}},
+		{dayAfterTomorrowPattern, func(g []string) bool {
+			d := today.add(0, 0, 2)
+			p.date = &d
+			return true
+		}},
+		{relativeDayPattern, func(g []string) bool {
+			d := today
+			switch strings.ToLower(g[1]) {
+			case "tomorrow", "tmrw":
+				d = today.add(0, 0, 1)
+			case "tonight":
+				hour := 20
+				p.defaultHour = &hour
+			}
+			p.date = &d
+			return true
+		}},
+		{inDurationPattern, func(g []string) bool {
+			n := parseNumber(g[1])
+			if n <= 0 {
+				return false
+			}
+			switch strings.ToLower(g[2]) {
+			case "minute", "hour":
+				unit := time.Minute
+				if strings.EqualFold(g[2], "hour") {
+					unit = time.Hour
+				}
+				t := p.now.Add(time.Duration(n) * unit)
+				d := date{t.Year(), t.Month(), t.Day()}
+				p.date = &d
+				p.setTime(t.Hour(), t.Minute())
+			case "day":
+				d := today.add(0, 0, n)
+				p.date = &d
+			case "week":
+				d := today.add(0, 0, 7*n)
+				p.date = &d
+			case "month":
+				d := today.add(0, n, 0)
+				p.date = &d
+			default:
+				d := today.add(n, 0, 0)
+				p.date = &d
+			}
+			return true
+		}},
+		{nextUnitPattern, func(g []string) bool {
+			var d date
+			switch strings.ToLower(g[1]) {
+			case "week":
+				d = *p.nextWeekday(time.Monday, false)
+			case "month":
+				d = date{p.now.Year(), p.now.Month() + 1, 1}.normalize()
+			default:
+				d = date{p.now.Year() + 1, time.January, 1}
+			}
+			p.date = &d
+			return true
+		}},
+		{weekdayPattern, func(g []string) bool {
+			if !p.meantAsDate(g[0]) {
+				return false
+			}
+			p.date = p.nextWeekday(weekdays[strings.ToLower(g[1])], false)
+			return true
+		}},
+		{ordinalDayPattern, func(g []string) bool {
+			p.date = p.nextDayOfMonth(atoi(g[1]))
+			return p.date != nil
+		}},
+	}
+
+	for _, attempt := range attempts {
+		if p.take(attempt.re, "date", attempt.accept) {
+			return
+		}
+	}
+}
+
+func (p *parser) parseTime() {
+	if p.hasTime {
+		return
+	}
+
+	if p.take(amPmPattern, "time", func(g []string) bool {
+		hour, minute := atoi(g[1]), atoi(g[2])
+		if hour < 1 || hour > 12 || minute > 59 {
+			return false
+		}
+		hour %= 12
+		if strings.EqualFold(g[3], "pm") {
+			hour += 12
+		}
+		p.setTime(hour, minute)
+		return true
+	}) {
+		return
+	}
+
+	if p.take(clockPattern, "time", func(g []string) bool {
+		p.setTime(atoi(g[1]), atoi(g[2]))
+		return true
+	}) {
+		return
+	}
+
+	if p.take(namedTimePattern, "time", func(g []string) bool {
+		if strings.EqualFold(g[1], "midnight") {
+			p.setTime(0, 0)
+		} else {
+			p.setTime(12, 0)
+		}
+		return true
+	}) {
+		return
+	}
+
+	p.take(atHourPattern, "time", func(g []string) bool {
+		p.setTime(atoi(g[1]), 0)
+		return true
+	})
+}
+
+// meantAsDate tells whether a weekday or month name, which is just as often
+// part of the title ("Prepare monday meeting notes", "the may report"), is
+// meant as the due date: it follows a word such as "on" or "by", or ends
+// the title, with nothing but a time or tags after it.
+func (p *parser) meantAsDate(match string) bool {
+	return triggerPattern.MatchString(match) || trailingPattern.MatchString(p.after)
+}
+
+func (p *parser) setTime(hour, minute int) {
+	p.hour, p.minute, p.hasTime = hour, minute, true
+}
+
+// dueDate combines the date and time that were found. A time on its own means
+// the next time that clock time comes around.
+func (p *parser) dueDate() *time.Time {
+	d := p.date
+	if d == nil {
+		d = p.anchor
+	}
+
+	hour, minute := p.hour, p.minute
+	if !p.hasTime && p.defaultHour != nil {
+		hour, minute = *p.defaultHour, 0
+		p.hasTime = true
+	}
+
+	if d == nil {
+		if !p.hasTime {
+			return nil
+		}
+		today := date{p.now.Year(), p.now.Month(), p.now.Day()}
+		d = &today
+		if !d.at(hour, minute, p.now.Location()).After(p.now) {
+			tomorrow := today.add(0, 0, 1)
+			d = &tomorrow
+		}
+	}
+
+	if !p.hasTime {
+		hour, minute = 0, 0
+	}
+	due := d.at(hour, minute, p.now.Location()).UTC()
+	return &due
+}
+
+// setMonthDay resolves "March 5" to its next occurrence unless a year is given.
+func (p *parser) setMonthDay(month time.Month, day int, year string) bool {
+	d := date{p.now.Year(), month, day}
+	if year != "" {
+		d.year = atoi(year)
+	}
+	if month == 0 || !d.valid() {
+		return false
+	}
+	if year == "" && d.before(date{p.now.Year(), p.now.Month(), p.now.Day()}) {
+		d.year++
+	}
+	p.date = &d
+	return true
+}
+
+// nextWeekday returns the next given weekday, optionally counting today.
+func (p *parser) nextWeekday(weekday time.Weekday, includeToday bool) *date {
+	days := (int(weekday) - int(p.now.Weekday()) + 7) % 7
+	if days == 0 && !includeToday {
+		days = 7
+	}
+	d := date{p.now.Year(), p.now.Month(), p.now.Day()}.add(0, 0, days)
+	return &d
+}
+
+// nextDayOfMonth returns the next date with the given day of month, today
+// included, skipping months that are too short.
+func (p *parser) nextDayOfMonth(day int) *date {
+	if day < 1 || day > 31 {
+		return nil
+	}
+	for i := 0; i < 12; i++ {
+		d := date{p.now.Year(), p.now.Month() + time.Month(i), 1}.normalize()
+		d.day = day
+		if d.valid() && !d.before(date{p.now.Year(), p.now.Month(), p.now.Day()}) {
+			return &d
+		}
+	}
+	return nil
+}
+
+func (d date) at(hour, minute int, loc *time.Location) time.Time {
+	return time.Date(d.year, d.month, d.day, hour, minute, 0, 0, loc)
+}
+
+func (d date) add(years, months, days int) date {
+	t := time.Date(d.year, d.month, d.day, 12, 0, 0, 0, time.UTC).AddDate(years, months, days)
+	return date{t.Year(), t.Month(), t.Day()}
+}
+
+func (d date) normalize() date {
+	return d.add(0, 0, 0)
+}
+
+func (d date) valid() bool {
+	return d.month >= time.January && d.month <= time.December && d.day >= 1 && d.normalize() == d
+}
+
+func (d date) before(other date) bool {
+	if d.year != other.year {
+		return d.year < other.year
+	}
+	if d.month != other.month {
+		return d.month < other.month
+	}
+	return d.day < other.day
+}
+
+func parseMonth(name string) time.Month {
+	prefix := strings.ToLower(name)
+	if len(prefix) > 3 {
+		prefix = prefix[:3]
+	}
+	for m := time.January; m <= time.December; m++ {
+		if strings.ToLower(m.String()[:3]) == prefix {
+			return m
+		}
+	}
+	return 0
+}
+
+func parseNumber(s string) int {
+	if n, ok := numbers[strings.ToLower(s)]; ok {
+		return n
+	}
+	return atoi(s)
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
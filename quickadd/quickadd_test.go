@@ -0,0 +1,111 @@
+package quickadd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// now is a Wednesday morning.
+var now = time.Date(2024, time.January, 10, 10, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		title    string
+		due      string // RFC 3339, "" for none
+		hasTime  bool
+		interval int
+		unit     string
+		project  string
+		tags     []string
+	}{
+		{
+			input:    "Pay rent every month on the 1st #finance tomorrow 9am",
+			title:    "Pay rent #finance",
+			due:      "2024-01-11T09:00:00Z",
+			hasTime:  true,
+			interval: 1,
+			unit:     "month",
+			tags:     []string{"finance"},
+		},
+		{input: "Buy milk", title: "Buy milk"},
+		{input: "Call mom tomorrow", title: "Call mom", due: "2024-01-11T00:00:00Z"},
+		{input: "Call mom @Family today at 5pm", title: "Call mom", due: "2024-01-10T17:00:00Z", hasTime: true, project: "Family"},
+		{input: `Plan trip @"Summer Holiday"`, title: "Plan trip", project: "Summer Holiday"},
+		{input: "Dentist on friday", title: "Dentist", due: "2024-01-12T00:00:00Z"},
+		{input: "Call the bank friday 9am", title: "Call the bank", due: "2024-01-12T09:00:00Z", hasTime: true},
+		{input: "Standup next monday at 09:30", title: "Standup", due: "2024-01-15T09:30:00Z", hasTime: true},
+		{input: "Submit report by March 5th #work", title: "Submit report #work", due: "2024-03-05T00:00:00Z", tags: []string{"work"}},
+		{input: "Renew passport 3 jan", title: "Renew passport", due: "2025-01-03T00:00:00Z"},
+		{input: "Conference may 3, 2024 in Lisbon", title: "Conference in Lisbon", due: "2024-05-03T00:00:00Z"},
+		{input: "Release 2024-02-29T14:00", title: "Release", due: "2024-02-29T14:00:00Z", hasTime: true},
+		{input: "Water plants every 3 days", title: "Water plants", interval: 3, unit: "day"},
+		{input: "Team lunch every friday", title: "Team lunch", due: "2024-01-12T00:00:00Z", interval: 1, unit: "week"},
+		{input: "Backups weekly", title: "Backups", interval: 1, unit: "week"},
+		{input: "Follow up in 2 weeks", title: "Follow up", due: "2024-01-24T00:00:00Z"},
+		{input: "Take out the trash tonight", title: "Take out the trash", due: "2024-01-10T20:00:00Z", hasTime: true},
+		{input: "Pay the invoice on the 20th", title: "Pay the invoice", due: "2024-01-20T00:00:00Z"},
+		{input: "Buy milk #groceries due:tomorrow", title: "Buy milk #groceries", due: "2024-01-11T00:00:00Z", tags: []string{"groceries"}},
+		{input: "Call the plumber due:2024-06-01T09:00", title: "Call the plumber", due: "2024-06-01T09:00:00Z", hasTime: true},
+		{input: "Ship it due:2024-06-01T09:00:00+02:00", title: "Ship it", due: "2024-06-01T07:00:00Z", hasTime: true},
+		{input: "Plan the garden due:someday", title: "Plan the garden due:someday"},
+
+		// Weekday and month names that are part of the title
+		{input: "Prepare monday meeting notes", title: "Prepare monday meeting notes"},
+		{input: "Read chapter 3 of may report", title: "Read chapter 3 of may report"},
+		{input: "Prepare monday notes on friday", title: "Prepare monday notes", due: "2024-01-12T00:00:00Z"},
+		{input: "Review march 5 budget draft", title: "Review march 5 budget draft"},
+		{input: "Write up sunday league results #sport", title: "Write up sunday league results #sport", tags: []string{"sport"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got := Parse(tt.input, now)
+			if got.Title != tt.title {
+				t.Errorf("title = %q, want %q", got.Title, tt.title)
+			}
+
+			due := ""
+			if got.DueDate != nil {
+				due = got.DueDate.Format(time.RFC3339)
+			}
+			if due != tt.due {
+				t.Errorf("due = %q, want %q", due, tt.due)
+			}
+			if got.HasTime != tt.hasTime {
+				t.Errorf("has_time = %v, want %v", got.HasTime, tt.hasTime)
+			}
+
+			interval, unit := 0, ""
+			if got.RecurrenceInterval != nil {
+				interval, unit = *got.RecurrenceInterval, *got.RecurrenceUnit
+			}
+			if interval != tt.interval || unit != tt.unit {
+				t.Errorf("recurrence = %d %s, want %d %s", interval, unit, tt.interval, tt.unit)
+			}
+
+			if got.Project != tt.project {
+				t.Errorf("project = %q, want %q", got.Project, tt.project)
+			}
+			tags := tt.tags
+			if tags == nil {
+				tags = []string{}
+			}
+			if !reflect.DeepEqual(got.Tags, tags) {
+				t.Errorf("tags = %v, want %v", got.Tags, tags)
+			}
+		})
+	}
+}
+
+func TestParseUsesLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	got := Parse("Call mom tomorrow 9am", now.In(loc))
+	if want := "2024-01-11T14:00:00Z"; got.DueDate == nil || got.DueDate.Format(time.RFC3339) != want {
+		t.Errorf("due = %v, want %s", got.DueDate, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type Reminder struct {
+	ID            int        `json:"id"`
+	TodoID        int        `json:"todo_id"`
+	RemindAt      *time.Time `json:"remind_at,omitempty"`
+	OffsetMinutes *int       `json:"offset_minutes,omitempty"`
+	ChannelID     *int       `json:"channel_id,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func getReminders(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT id, todo_id, remind_at, offset_minutes, channel_id, sent_at, created_at FROM reminders"
+	args := []interface{}{}
+	if todoID := r.URL.Query().Get("todo_id"); todoID != "" {
+		query += " WHERE todo_id = ?"
+		args = append(args, todoID)
+	}
+	query += " ORDER BY todo_id, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reminders := make([]Reminder, 0)
+	for rows.Next() {
+		var reminder Reminder
+		if err := rows.Scan(
+			&reminder.ID,
+			&reminder.TodoID,
+			&reminder.RemindAt,
+			&reminder.OffsetMinutes,
+			&reminder.ChannelID,
+			&reminder.SentAt,
+			&reminder.CreatedAt,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reminders = append(reminders, reminder)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminders)
+}
+
+func addReminder(w http.ResponseWriter, r *http.Request) {
+	var reminder Reminder
+	if err := json.NewDecoder(r.Body).Decode(&reminder); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if (reminder.RemindAt == nil) == (reminder.OffsetMinutes == nil) {
+		http.Error(w, "Exactly one of remind_at and offset_minutes is required", http.StatusBadRequest)
+		return
+	}
+	if reminder.OffsetMinutes != nil && *reminder.OffsetMinutes < 0 {
+		http.Error(w, "offset_minutes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var todoID int
+	err := db.QueryRow("SELECT id FROM todos WHERE id = ?", reminder.TodoID).Scan(&todoID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Todo not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if reminder.RemindAt != nil {
+		remindAt := reminder.RemindAt.UTC()
+		reminder.RemindAt = &remindAt
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO reminders (todo_id, remind_at, offset_minutes, channel_id) VALUES (?, ?, ?, ?)",
+		reminder.TodoID, reminder.RemindAt, reminder.OffsetMinutes, reminder.ChannelID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reminder.ID = int(id)
+	reminder.SentAt = nil
+	reminder.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reminder)
+}
+
+func deleteReminder(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM reminders WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if rowsAffected == 0 {
+		http.Error(w, "Reminder not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// carryForwardReminders copies the reminders of a completed recurring todo to
+// its next occurrence. Absolute reminders move by the same amount as the due
+// date; offset reminders already follow it.
+func carryForwardReminders(tx *sql.Tx, fromTodoID, toTodoID int, shift time.Duration) error {
+	rows, err := tx.Query("SELECT remind_at, offset_minutes, channel_id FROM reminders WHERE todo_id = ?", fromTodoID)
+	if err != nil {
+		return err
+	}
+
+	var reminders []Reminder
+	for rows.Next() {
+		var reminder Reminder
+		if err := rows.Scan(&reminder.RemindAt, &reminder.OffsetMinutes, &reminder.ChannelID); err != nil {
+			rows.Close()
+			return err
+		}
+		reminders = append(reminders, reminder)
+	}
+	rows.Close()
+
+	for _, reminder := range reminders {
+		if reminder.RemindAt != nil {
+			shifted := reminder.RemindAt.Add(shift).UTC()
+			reminder.RemindAt = &shifted
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO reminders (todo_id, remind_at, offset_minutes, channel_id) VALUES (?, ?, ?, ?)",
+			toTodoID, reminder.RemindAt, reminder.OffsetMinutes, reminder.ChannelID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDueReminders notifies about every unsent reminder whose time has come.
+// Reminders of completed todos, and offset reminders of todos without a due
+// date, never fire.
+func sendDueReminders() {
+	rows, err := db.Query(`
+		SELECT r.id, r.todo_id, r.remind_at, r.offset_minutes, r.channel_id,
+		       t.title, t.project_id, datetime(t.due_date), t.all_day
+		FROM reminders r
+		JOIN todos t ON t.id = r.todo_id
+		WHERE r.sent_at IS NULL AND t.completed = 0
+	`)
+	if err != nil {
+		logError("Error getting reminders: %v", err)
+		return
+	}
+
+	type dueReminder struct {
+		Reminder
+		notification Notification
+	}
+
+	now := time.Now().UTC()
+	var due []dueReminder
+	for rows.Next() {
+		var reminder dueReminder
+		var dueDateStr sql.NullString
+		if err := rows.Scan(
+			&reminder.ID,
+			&reminder.TodoID,
+			&reminder.RemindAt,
+			&reminder.OffsetMinutes,
+			&reminder.ChannelID,
+			&reminder.notification.Title,
+			&reminder.notification.ProjectID,
+			&dueDateStr,
+			&reminder.notification.AllDay,
+		); err != nil {
+			logError("Error scanning reminder: %v", err)
+			continue
+		}
+
+		dueDate, err := parseDBDateTime(dueDateStr)
+		if err != nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+		}
+
+		var fireAt time.Time
+		if reminder.RemindAt != nil {
+			fireAt = *reminder.RemindAt
+		} else if dueDate != nil {
+			fireAt = dueDate.Add(-time.Duration(*reminder.OffsetMinutes) * time.Minute)
+		} else {
+			continue
+		}
+		if fireAt.After(now) {
+			continue
+		}
+
+		reminder.notification.Event = "reminder"
+		reminder.notification.TodoID = reminder.TodoID
+		reminder.notification.DueDate = dueDate
+		reminder.notification.Message = reminderMessage(dueDate, reminder.notification.AllDay)
+		due = append(due, reminder)
+	}
+	rows.Close()
+
+	for _, reminder := range due {
+		// Mark the reminder as sent first so a failing channel doesn't
+		// produce the same notification every minute.
+		if _, err := db.Exec("UPDATE reminders SET sent_at = ? WHERE id = ?", now, reminder.ID); err != nil {
+			logError("Error marking reminder %d as sent: %v", reminder.ID, err)
+			continue
+		}
+		if err := notifyChannels(reminder.ChannelID, reminder.notification); err != nil {
+			logError("Error sending reminder %d for todo %d: %v", reminder.ID, reminder.TodoID, err)
+		}
+	}
+}
+
+func reminderMessage(dueDate *time.Time, allDay bool) string {
+	if dueDate == nil {
+		return "Reminder"
+	}
+	if allDay {
+		return fmt.Sprintf("Due %s", dueDate.UTC().Format("Mon Jan 2"))
+	}
+	return fmt.Sprintf("Due %s", dueDate.In(time.Local).Format("Mon Jan 2 15:04"))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// errNoSecretKey is returned when credentials are to be stored but SECRET_KEY
+// is not set. The key is never kept in the database, as anyone who can read
+// the database could then read the credentials too.
+var errNoSecretKey = errors.New("SECRET_KEY must be set to store credentials")
+
+var (
+	secretKeyOnce sync.Once
+	secretKeyAEAD cipher.AEAD
+	secretKeyErr  error
+)
+
+// secretAEAD returns the AES-256-GCM cipher secrets are stored with, keyed
+// with a hash of SECRET_KEY.
+func secretAEAD() (cipher.AEAD, error) {
+	secretKeyOnce.Do(func() {
+		passphrase := config.SecretKey
+		if passphrase == "" {
+			secretKeyErr = errNoSecretKey
+			return
+		}
+		key := sha256.Sum256([]byte(passphrase))
+		secretKeyAEAD, secretKeyErr = newSecretAEAD(key[:])
+	})
+	return secretKeyAEAD, secretKeyErr
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretErrorStatus is the status to answer a failure to store a secret
+// with: a missing SECRET_KEY is the client's to fix.
+func secretErrorStatus(err error) int {
+	if errors.Is(err, errNoSecretKey) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// encryptSecret seals plaintext with a random nonce and returns it base64
+// encoded, nonce first.
+func encryptSecret(plaintext []byte) (string, error) {
+	aead, err := secretAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func decryptSecret(encoded string) ([]byte, error) {
+	aead, err := secretAEAD()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openSecret(aead, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt secret, was SECRET_KEY changed? %v", err)
+	}
+	return plaintext, nil
+}
+
+// openSecret decrypts a value sealed by encryptSecret with the given cipher.
+func openSecret(aead cipher.AEAD, encoded string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted secret is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
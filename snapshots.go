@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotPrefix     = "todos-"
+	snapshotTimeFormat = "20060102T150405Z"
+
+	snapshotDaily  = "daily"
+	snapshotWeekly = "weekly"
+	snapshotManual = "manual"
+)
+
+// snapshotMu keeps two snapshots from being written at the same time.
+var snapshotMu sync.Mutex
+
+// SnapshotConfig controls where snapshots are written and which scheduled
+// ones are kept.
+type SnapshotConfig struct {
+	Dir string `json:"dir"`
+	// Time of day scheduled snapshots are taken, as HH:MM in the server's
+	// time zone. Empty disables them.
+	Time       string `json:"time,omitempty"`
+	KeepDaily  int    `json:"keep_daily"`
+	KeepWeekly int    `json:"keep_weekly"`
+}
+
+func (c SnapshotConfig) enabled() bool {
+	return c.Time != ""
+}
+
+// Snapshot is a copy of the database file.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// parseSnapshotName reads the time and kind out of a snapshot file name,
+// e.g. todos-20240105T030000Z-daily.db.
+func parseSnapshotName(name string) (Snapshot, bool) {
+	rest, ok := strings.CutPrefix(name, snapshotPrefix)
+	if !ok {
+		return Snapshot{}, false
+	}
+	rest, ok = strings.CutSuffix(rest, ".db")
+	if !ok {
+		return Snapshot{}, false
+	}
+	stamp, kind, ok := strings.Cut(rest, "-")
+	if !ok || (kind != snapshotDaily && kind != snapshotWeekly && kind != snapshotManual) {
+		return Snapshot{}, false
+	}
+	createdAt, err := time.Parse(snapshotTimeFormat, stamp)
+	if err != nil {
+		return Snapshot{}, false
+	}
+	return Snapshot{Name: name, Kind: kind, CreatedAt: createdAt}, true
+}
+
+// listSnapshots returns the snapshots in dir, newest first.
+func listSnapshots(dir string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Snapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0)
+	for _, entry := range entries {
+		snapshot, ok := parseSnapshotName(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			snapshot.Size = info.Size()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// writeSnapshot copies the database to path with VACUUM INTO, which reads
+// it in one transaction and so, unlike copying the file while WAL is on,
+// always gives a consistent copy. The copy is then checked with
+// PRAGMA integrity_check, and removed if it fails.
+func writeSnapshot(path string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("writing snapshot: %v", err)
+	}
+	if err := checkSnapshotIntegrity(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func checkSnapshotIntegrity(path string) error {
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	rows, err := snapshot.Query("PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("checking snapshot: %v", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("snapshot failed the integrity check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// createSnapshot writes a snapshot of the given kind to dir.
+func createSnapshot(dir, kind string, now time.Time) (Snapshot, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Snapshot{}, err
+	}
+	createdAt := now.UTC().Truncate(time.Second)
+	name := snapshotPrefix + createdAt.Format(snapshotTimeFormat) + "-" + kind + ".db"
+	path := filepath.Join(dir, name)
+	if err := writeSnapshot(path); err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{Name: name, Kind: kind, CreatedAt: createdAt}
+	if info, err := os.Stat(path); err == nil {
+		snapshot.Size = info.Size()
+	}
+	return snapshot, nil
+}
+
+// scheduledSnapshotKind makes a scheduled snapshot weekly when there is no
+// weekly one from the last seven days, and daily otherwise. Snapshots are
+// only daily when no weekly ones are kept, or rotation would remove each one
+// right away.
+func scheduledSnapshotKind(snapshots []Snapshot, now time.Time, keepWeekly int) string {
+	if keepWeekly == 0 {
+		return snapshotDaily
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Kind == snapshotWeekly {
+			// Allow for the scheduler waking up a little early
+			if now.Sub(snapshot.CreatedAt) < 7*24*time.Hour-time.Hour {
+				return snapshotDaily
+			}
+			break
+		}
+	}
+	return snapshotWeekly
+}
+
+// rotateSnapshots removes the daily and weekly snapshots beyond the ones to
+// keep. Manual snapshots are never removed.
+func rotateSnapshots(cfg SnapshotConfig) error {
+	snapshots, err := listSnapshots(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	kept := map[string]int{}
+	keep := map[string]int{snapshotDaily: cfg.KeepDaily, snapshotWeekly: cfg.KeepWeekly}
+	for _, snapshot := range snapshots {
+		if snapshot.Kind == snapshotManual {
+			continue
+		}
+		if kept[snapshot.Kind] < keep[snapshot.Kind] {
+			kept[snapshot.Kind]++
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.Dir, snapshot.Name)); err != nil {
+			return err
+		}
+		logInfo("Removed old snapshot %s", snapshot.Name)
+	}
+	return nil
+}
+
+// runSnapshotScheduler takes a snapshot every day at the configured time.
+func runSnapshotScheduler(cfg SnapshotConfig) {
+	for {
+		next, err := nextTimeOfDay(time.Now(), cfg.Time)
+		if err != nil {
+			logWarn("Invalid SNAPSHOT_TIME %q, scheduled snapshots disabled: %v", cfg.Time, err)
+			return
+		}
+		time.Sleep(time.Until(next))
+
+		now := time.Now()
+		snapshots, err := listSnapshots(cfg.Dir)
+		if err != nil {
+			logError("Error listing snapshots: %v", err)
+			continue
+		}
+		snapshot, err := createSnapshot(cfg.Dir, scheduledSnapshotKind(snapshots, now, cfg.KeepWeekly), now)
+		if err != nil {
+			logError("Error taking snapshot: %v", err)
+			continue
+		}
+		logInfo("Took snapshot %s", snapshot.Name)
+
+		if err := rotateSnapshots(cfg); err != nil {
+			logError("Error removing old snapshots: %v", err)
+		}
+	}
+}
+
+// runSnapshotCommand implements "todo-app snapshot [path]": it writes a
+// snapshot to path, or as a manual snapshot to SNAPSHOT_DIR.
+func runSnapshotCommand(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: todo-app snapshot [path]")
+	}
+	if len(args) == 1 {
+		if err := writeSnapshot(args[0]); err != nil {
+			return err
+		}
+		fmt.Println(args[0])
+		return nil
+	}
+
+	cfg := config.Snapshots
+	snapshot, err := createSnapshot(cfg.Dir, snapshotManual, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Join(cfg.Dir, snapshot.Name))
+	return nil
+}
+
+func getSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := listSnapshots(config.Snapshots.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// createSnapshotHandler takes a manual snapshot right away.
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := createSnapshot(config.Snapshots.Dir, snapshotManual, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// downloadSnapshotHandler serves a snapshot file.
+func downloadSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filepath.Join(config.Snapshots.Dir, name))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduledSnapshotKind(t *testing.T) {
+	weeklyAt := time.Date(2024, time.January, 1, 3, 0, 0, 0, time.UTC)
+	snapshots := []Snapshot{
+		{Kind: snapshotDaily, CreatedAt: weeklyAt.AddDate(0, 0, 1)},
+		{Kind: snapshotManual, CreatedAt: weeklyAt.Add(time.Hour)},
+		{Kind: snapshotWeekly, CreatedAt: weeklyAt},
+	}
+
+	tests := []struct {
+		name       string
+		snapshots  []Snapshot
+		now        time.Time
+		keepWeekly int
+		want       string
+	}{
+		{"first snapshot", nil, weeklyAt, 4, snapshotWeekly},
+		{"only daily and manual ones", snapshots[:2], weeklyAt.AddDate(0, 0, 2), 4, snapshotWeekly},
+		{"weekly one from yesterday", snapshots, weeklyAt.AddDate(0, 0, 1), 4, snapshotDaily},
+		{"weekly one from six days ago", snapshots, weeklyAt.AddDate(0, 0, 6), 4, snapshotDaily},
+		{"a week later", snapshots, weeklyAt.AddDate(0, 0, 7), 4, snapshotWeekly},
+		{"a week later, woken up early", snapshots, weeklyAt.AddDate(0, 0, 7).Add(-30 * time.Minute), 4, snapshotWeekly},
+		{"no weekly ones kept", nil, weeklyAt, 0, snapshotDaily},
+		{"no weekly ones kept, a week later", snapshots, weeklyAt.AddDate(0, 0, 7), 0, snapshotDaily},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scheduledSnapshotKind(tt.snapshots, tt.now, tt.keepWeekly); got != tt.want {
+				t.Errorf("kind = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRotateSnapshots runs the scheduler's steps for 60 days of snapshots,
+// as empty files, and checks which are left.
+func TestRotateSnapshots(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		keepDaily  int
+		keepWeekly int
+		// Days since the first snapshot, by kind, newest first
+		wantDaily  []int
+		wantWeekly []int
+	}{
+		{keepDaily: 7, keepWeekly: 4, wantDaily: []int{59, 58, 57, 55, 54, 53, 52}, wantWeekly: []int{56, 49, 42, 35}},
+		{keepDaily: 3, keepWeekly: 1, wantDaily: []int{59, 58, 57}, wantWeekly: []int{56}},
+		{keepDaily: 7, keepWeekly: 0, wantDaily: []int{59, 58, 57, 56, 55, 54, 53}},
+		{keepDaily: 0, keepWeekly: 4, wantWeekly: []int{56, 49, 42, 35}},
+		{keepDaily: 0, keepWeekly: 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("daily %d weekly %d", tt.keepDaily, tt.keepWeekly), func(t *testing.T) {
+			cfg := SnapshotConfig{Dir: t.TempDir(), KeepDaily: tt.keepDaily, KeepWeekly: tt.keepWeekly}
+
+			manual := snapshotPrefix + start.Add(-time.Hour).Format(snapshotTimeFormat) + "-" + snapshotManual + ".db"
+			if err := os.WriteFile(filepath.Join(cfg.Dir, manual), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			for day := 0; day < 60; day++ {
+				// The scheduler wakes up at a slightly different time each day
+				now := start.AddDate(0, 0, day).Add(time.Duration(day%3-1) * time.Minute)
+				snapshots, err := listSnapshots(cfg.Dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				kind := scheduledSnapshotKind(snapshots, now, cfg.KeepWeekly)
+				name := snapshotPrefix + now.Format(snapshotTimeFormat) + "-" + kind + ".db"
+				if err := os.WriteFile(filepath.Join(cfg.Dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := rotateSnapshots(cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snapshots, err := listSnapshots(cfg.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			days := map[string][]int{}
+			for _, snapshot := range snapshots {
+				day := int(snapshot.CreatedAt.Add(time.Hour).Sub(start) / (24 * time.Hour))
+				days[snapshot.Kind] = append(days[snapshot.Kind], day)
+			}
+			if !reflect.DeepEqual(days[snapshotDaily], tt.wantDaily) {
+				t.Errorf("daily snapshots from days %v, want %v", days[snapshotDaily], tt.wantDaily)
+			}
+			if !reflect.DeepEqual(days[snapshotWeekly], tt.wantWeekly) {
+				t.Errorf("weekly snapshots from days %v, want %v", days[snapshotWeekly], tt.wantWeekly)
+			}
+			if len(days[snapshotManual]) != 1 {
+				t.Error("the manual snapshot was removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Service worker for Todo App: shows Web Push notifications for reminders
+// and due todos, and focuses the app when one is clicked.
+
+self.addEventListener("install", () => {
+  self.skipWaiting();
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener("push", (event) => {
+  let data = {};
+  try {
+    data = event.data ? event.data.json() : {};
+  } catch (error) {
+    data = { title: "Todo App", message: event.data.text() };
+  }
+
+  const title = data.title || "Todo App";
+  const options = {
+    body: data.message || "",
+    icon: "favicon.svg",
+    badge: "favicon.svg",
+    tag: data.todo_id ? `todo-${data.todo_id}-${data.event}` : undefined,
+    data: data,
+  };
+
+  event.waitUntil(self.registration.showNotification(title, options));
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+
+  event.waitUntil(
+    self.clients
+      .matchAll({ type: "window", includeUncontrolled: true })
+      .then((windowClients) => {
+        for (const client of windowClients) {
+          if ("focus" in client) {
+            return client.focus();
+          }
+        }
+        return self.clients.openWindow(self.registration.scope);
+      }),
+  );
+});
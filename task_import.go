@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"todo-app/importer"
+)
+
+const taskImportMaxSize = 20 << 20
+
+// TaskImport is the result, or with dry_run the preview, of importing the
+// export of another todo app.
+type TaskImport struct {
+	Source     string              `json:"source"`
+	DryRun     bool                `json:"dry_run"`
+	Projects   []TaskImportProject `json:"projects"`
+	Added      int                 `json:"added"`
+	Completed  int                 `json:"completed"`
+	Subtasks   int                 `json:"subtasks"`
+	Duplicates int                 `json:"duplicates"`
+	Errors     []ImportItemError   `json:"errors"`
+}
+
+// TaskImportProject is the project a list went to. New projects have no id
+// in a dry run.
+type TaskImportProject struct {
+	ID         int    `json:"id,omitempty"`
+	Title      string `json:"title"`
+	Created    bool   `json:"created"`
+	Added      int    `json:"added"`
+	Duplicates int    `json:"duplicates"`
+}
+
+// ImportItemError is an item an import skipped or could not fully import.
+type ImportItemError struct {
+	Line  int    `json:"line,omitempty"`
+	List  string `json:"list,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title,omitempty"`
+	Error string `json:"error"`
+}
+
+// importTasksHandler imports the export of another todo app in one
+// transaction. "source" names the app (see importer.Sources) and is guessed
+// from the file when left out. Each list goes to the project with its title,
+// created if needed, and tasks keep their notes, due date, recurrence,
+// completion, priority, labels (as #tags), subtasks and order. With
+// "dry_run=true" nothing is saved and the response previews what would be
+// imported. "tz" is the time zone of times without one, and "title" names
+// the project of a Todoist CSV file.
+func importTasksHandler(w http.ResponseWriter, r *http.Request) {
+	importTasks(w, r, r.URL.Query().Get("source"))
+}
+
+// importGoogleTasksHandler imports the Tasks.json of a Google Takeout
+// archive, as importTasksHandler does with source=google_tasks.
+func importGoogleTasksHandler(w http.ResponseWriter, r *http.Request) {
+	importTasks(w, r, importer.GoogleTasks)
+}
+
+func importTasks(w http.ResponseWriter, r *http.Request, source string) {
+	query := r.URL.Query()
+	opts := importer.Options{Location: time.Local, Title: query.Get("title")}
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Location = loc
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, taskImportMaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if source == "" {
+		if source = importer.Detect(data); source == "" {
+			http.Error(w, "Could not tell which app the file was exported from, set source to one of "+
+				strings.Join(importer.Sources(), ", "), http.StatusBadRequest)
+			return
+		}
+	}
+	lists, err := importer.Parse(source, data, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := importLists(source, lists, query.Get("dry_run") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func importLists(source string, lists []importer.List, dryRun bool) (TaskImport, error) {
+	result := TaskImport{
+		Source:   source,
+		DryRun:   dryRun,
+		Projects: make([]TaskImportProject, 0),
+		Errors:   make([]ImportItemError, 0),
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	projects := newProjectResolver(tx)
+	for _, list := range lists {
+		if err := importList(tx, projects, list, &result); err != nil {
+			return result, err
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	return result, tx.Commit()
+}
+
+// importList adds the tasks of one list, parents before their subtasks and
+// siblings in the list's order.
+func importList(tx *sql.Tx, projects *projectResolver, list importer.List, result *TaskImport) error {
+	title := strings.TrimSpace(list.Title)
+	if title == "" {
+		title = "Untitled Project"
+	}
+	itemError := func(task importer.Task, format string, args ...interface{}) {
+		result.Errors = append(result.Errors, ImportItemError{
+			List:  title,
+			ID:    task.ID,
+			Title: task.Title,
+			Error: fmt.Sprintf(format, args...),
+		})
+	}
+
+	tasks := make(map[string]importer.Task)
+	children := make(map[string][]importer.Task)
+	for _, task := range list.Tasks {
+		if strings.TrimSpace(task.Title) == "" {
+			itemError(task, "task has no title, skipped")
+			continue
+		}
+		for _, problem := range task.Problems {
+			itemError(task, "%s", problem)
+		}
+		if task.ID != "" {
+			tasks[task.ID] = task
+		}
+	}
+	for _, task := range list.Tasks {
+		if _, ok := tasks[task.ID]; !ok {
+			if strings.TrimSpace(task.Title) != "" {
+				// Tasks without an id are kept, they just cannot be parents
+				children[""] = append(children[""], task)
+			}
+			continue
+		}
+		parent := task.Parent
+		if _, ok := tasks[parent]; parent != "" && !ok {
+			itemError(task, "parent task %s not found, imported at the top level", parent)
+			parent = ""
+		}
+		children[parent] = append(children[parent], task)
+	}
+	if len(children[""]) == 0 {
+		return nil
+	}
+
+	project := TaskImportProject{Title: title}
+	created := len(projects.created)
+	id, err := projects.id(title)
+	if err != nil {
+		return err
+	}
+	project.ID = id
+	project.Created = len(projects.created) > created
+
+	var position int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM todos WHERE project_id = ?", project.ID).Scan(&position); err != nil {
+		return err
+	}
+
+	visited := make(map[string]bool)
+	var insert func(task importer.Task, parentID *int) error
+	insert = func(task importer.Task, parentID *int) error {
+		if task.ID != "" {
+			// A task listed twice would otherwise bring its subtasks twice
+			if visited[task.ID] {
+				itemError(task, "task %s is listed more than once, skipped", task.ID)
+				return nil
+			}
+			visited[task.ID] = true
+		}
+
+		// Tasks imported before are found wherever they went since
+		var todoID, todoProjectID int
+		var todoProject string
+		err := sql.ErrNoRows
+		if task.UID != "" {
+			err = tx.QueryRow(
+				"SELECT t.id, t.project_id, COALESCE(p.title, '') FROM todos t LEFT JOIN projects p ON p.id = t.project_id WHERE t.uid = ? ORDER BY t.id LIMIT 1",
+				task.UID,
+			).Scan(&todoID, &todoProjectID, &todoProject)
+		}
+		switch {
+		case err == nil:
+			project.Duplicates++
+			result.Duplicates++
+			if todoProjectID != project.ID {
+				itemError(task, "already imported into project %q, skipped", todoProject)
+				// Subtasks stay in this project, so they cannot hang below it
+				todoID = 0
+			}
+		case err != sql.ErrNoRows:
+			return err
+		default:
+			var completedAt *time.Time
+			if task.Done {
+				now := time.Now().UTC()
+				completedAt = &now
+				if task.Completed != nil {
+					completed := task.Completed.UTC()
+					completedAt = &completed
+				}
+			}
+			var recurrenceInterval *int
+			var recurrenceUnit *string
+			if task.RecurrenceInterval > 0 && task.RecurrenceUnit != "" {
+				recurrenceInterval, recurrenceUnit = &task.RecurrenceInterval, &task.RecurrenceUnit
+			}
+			priority := task.Priority
+			if priority < 0 || priority > 9 {
+				priority = 0
+			}
+
+			res, err := tx.Exec(
+				`INSERT INTO todos (title, completed, completed_at, project_id, due_date, all_day, recurrence_interval, recurrence_unit, uid, position, priority, notes, parent_id)
+				 VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?)`,
+				importTitle(task), task.Done, completedAt, project.ID, formatDueDate(task.Due), task.Due != nil && task.AllDay,
+				recurrenceInterval, recurrenceUnit, task.UID, position, priority, task.Notes, parentID,
+			)
+			if err != nil {
+				return fmt.Errorf("inserting task %s: %v", task.ID, err)
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			todoID = int(id)
+			position++
+
+			project.Added++
+			result.Added++
+			if task.Done {
+				result.Completed++
+			}
+			if parentID != nil {
+				result.Subtasks++
+			}
+		}
+
+		if task.ID == "" {
+			return nil
+		}
+		var childParentID *int
+		if todoID != 0 {
+			childParentID = &todoID
+		}
+		for _, child := range children[task.ID] {
+			if err := insert(child, childParentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, task := range children[""] {
+		if err := insert(task, nil); err != nil {
+			return err
+		}
+	}
+
+	// Whatever is left is only reachable through a parent cycle
+	for _, task := range list.Tasks {
+		if _, ok := tasks[task.ID]; ok && !visited[task.ID] {
+			itemError(task, "task is part of a parent cycle, skipped")
+		}
+	}
+
+	if result.DryRun && project.Created {
+		project.ID = 0
+	}
+	result.Projects = append(result.Projects, project)
+	return nil
+}
+
+// importTitle is the title of an imported task, with its labels as #tags
+// the way quick add writes them.
+func importTitle(task importer.Task) string {
+	words := []string{strings.TrimSpace(task.Title)}
+	for _, label := range task.Labels {
+		if tag := importer.Tag(label); tag != "" && !strings.Contains(" "+words[0]+" ", " "+tag+" ") {
+			words = append(words, tag)
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"todo-app/importer"
+	"todo-app/taskwarrior"
+)
+
+const taskwarriorMaxSize = 20 << 20
+
+var tagWordPattern = regexp.MustCompile(`^#(\w+)$`)
+
+// taskwarriorUUID is the uuid a todo has in Taskwarrior, which only takes
+// UUIDs. Todos imported from Taskwarrior keep theirs as their UID, the app's
+// own UIDs (32 random hex digits) are written as a UUID, and other UIDs get
+// a name-based UUID, so that a todo always has the same uuid.
+func taskwarriorUUID(uid string) string {
+	if taskwarrior.IsUUID(uid) {
+		return strings.ToLower(uid)
+	}
+	if digits, ok := strings.CutSuffix(uid, "@todo-app"); ok {
+		if b, err := hex.DecodeString(digits); err == nil && len(b) == 16 {
+			return formatUUID(b)
+		}
+	}
+	sum := sha1.Sum([]byte(uid))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return formatUUID(sum[:16])
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// taskwarriorPriority maps a priority onto H, M and L the way the app shows
+// them: 1 to 4 are high, 5 medium and 6 to 9 low.
+func taskwarriorPriority(priority int) string {
+	switch {
+	case priority >= 1 && priority <= 4:
+		return "H"
+	case priority == 5:
+		return "M"
+	case priority >= 6 && priority <= 9:
+		return "L"
+	}
+	return ""
+}
+
+func priorityFromTaskwarrior(priority string) int {
+	switch strings.ToUpper(priority) {
+	case "H":
+		return 1
+	case "M":
+		return 5
+	case "L":
+		return 9
+	}
+	return 0
+}
+
+// taskwarriorTask converts a todo. #tags in the title become tags, an open
+// recurring todo becomes a recurring task, which Taskwarrior makes pending
+// instances of, and an all-day due date is midnight in loc.
+func taskwarriorTask(todo Todo, projectTitle string, loc *time.Location) taskwarrior.Task {
+	task := taskwarrior.Task{
+		UUID:     taskwarriorUUID(todo.UID),
+		Status:   taskwarrior.Pending,
+		Project:  projectTitle,
+		Entry:    taskwarrior.FormatTime(todo.CreatedAt),
+		Priority: taskwarriorPriority(todo.Priority),
+	}
+
+	var words []string
+	for _, word := range strings.Fields(todo.Title) {
+		if m := tagWordPattern.FindStringSubmatch(word); m != nil {
+			task.Tags = append(task.Tags, m[1])
+		} else {
+			words = append(words, word)
+		}
+	}
+	task.Description = strings.Join(words, " ")
+	if task.Description == "" {
+		task.Description = todo.Title
+	}
+
+	if todo.DueDate != nil {
+		due := *todo.DueDate
+		if todo.AllDay {
+			due = todoTxtDate(due.UTC(), loc)
+		}
+		task.Due = taskwarrior.FormatTime(due)
+	}
+	if todo.Completed {
+		task.Status = taskwarrior.Completed
+		if todo.CompletedAt != nil {
+			task.End = taskwarrior.FormatTime(*todo.CompletedAt)
+		}
+	} else if todo.RecurrenceInterval != nil && todo.RecurrenceUnit != nil && todo.DueDate != nil {
+		// Taskwarrior only repeats tasks with a due date
+		if recur := taskwarrior.Recur(*todo.RecurrenceInterval, *todo.RecurrenceUnit); recur != "" {
+			task.Status = taskwarrior.Recurring
+			task.Recur = recur
+		}
+	}
+	return task
+}
+
+// exportTaskwarriorHandler writes todos as the JSON of "task export", all
+// of them or those of the "project" query parameter (id or title).
+// "completed=false" leaves done todos out. Todos without a UID get one, so
+// that they keep their uuid from one export to the next.
+func exportTaskwarriorHandler(w http.ResponseWriter, r *http.Request) {
+	loc := time.Local
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := `
+		SELECT t.id, t.title, t.completed, t.created_at, t.completed_at, datetime(t.due_date), t.all_day,
+		       t.recurrence_interval, t.recurrence_unit, t.priority, COALESCE(t.uid, ''), p.title
+		FROM todos t
+		JOIN projects p ON p.id = t.project_id
+		WHERE 1 = 1`
+	args := []interface{}{}
+	if ref := r.URL.Query().Get("project"); ref != "" {
+		project, err := findProjectForCalendar(ref)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		query += " AND t.project_id = ?"
+		args = append(args, project.ID)
+	}
+	if r.URL.Query().Get("completed") == "false" {
+		query += " AND t.completed = 0"
+	}
+	query += " ORDER BY p.position, p.id, t.position, t.id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var todos []Todo
+	var projectTitles []string
+	for rows.Next() {
+		var todo Todo
+		var dueDateStr sql.NullString
+		var projectTitle string
+		if err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.Completed,
+			&todo.CreatedAt,
+			&todo.CompletedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.Priority,
+			&todo.UID,
+			&projectTitle,
+		); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+		}
+		todos = append(todos, todo)
+		projectTitles = append(projectTitles, projectTitle)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Like "task export", one task per line
+	var out strings.Builder
+	out.WriteString("[\n")
+	for i := range todos {
+		if err := ensureTodoUID(&todos[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		line, err := json.Marshal(taskwarriorTask(todos[i], projectTitles[i], loc))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out.Write(line)
+		if i < len(todos)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("]\n")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="taskwarrior.json"`)
+	io.WriteString(w, out.String())
+}
+
+// TaskwarriorImport is the result of a Taskwarrior import.
+type TaskwarriorImport struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	// Deleted tasks, and instances of recurring tasks in the export
+	Skipped         int               `json:"skipped"`
+	CreatedProjects []string          `json:"created_projects"`
+	Errors          []ImportItemError `json:"errors"`
+}
+
+// importTaskwarriorHandler imports the JSON of "task export" in one
+// transaction. A task whose uuid is the UID of a todo, or the uuid the todo
+// is exported with, updates that todo, so importing again does not add
+// duplicates; other tasks are added with their uuid as their UID. Tasks go to
+// the project with their project's title, found or created, and otherwise
+// to the "project" query parameter (id or title, the default project when
+// absent). Deleted tasks are skipped. A recurring task is imported once,
+// due when its next pending instance is, and the instances are skipped.
+// Tags become #tags in the title, and a due time of midnight in "tz" an
+// all-day due date.
+func importTaskwarriorHandler(w http.ResponseWriter, r *http.Request) {
+	loc := time.Local
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, taskwarriorMaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tasks, err := taskwarrior.Parse(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defaultProject := Project{ID: 1}
+	if ref := r.URL.Query().Get("project"); ref != "" {
+		if defaultProject, err = findProjectForCalendar(ref); err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The todos tasks may already be, by uuid. Todos from calendar
+	// subscriptions are left to their feed.
+	existing := make(map[string]int)
+	subscribed := make(map[string]bool)
+	rows, err := tx.Query(`SELECT id, uid, EXISTS (SELECT 1 FROM ics_subscription_items i WHERE i.todo_id = todos.id)
+		FROM todos WHERE uid IS NOT NULL AND uid != ''`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id int
+		var uid string
+		var fromFeed bool
+		if err := rows.Scan(&id, &uid, &fromFeed); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		existing[taskwarriorUUID(uid)] = id
+		if fromFeed {
+			subscribed[taskwarriorUUID(uid)] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Recurring tasks take the due date of their next instance
+	nextDue := make(map[string]time.Time)
+	recurring := make(map[string]bool)
+	for _, task := range tasks {
+		if task.Status == taskwarrior.Recurring {
+			recurring[strings.ToLower(task.UUID)] = true
+		}
+	}
+	for _, task := range tasks {
+		parent := strings.ToLower(task.Parent)
+		if !recurring[parent] || (task.Status != taskwarrior.Pending && task.Status != taskwarrior.Waiting) {
+			continue
+		}
+		if due, err := taskwarrior.ParseTime(task.Due); err == nil {
+			if next, ok := nextDue[parent]; !ok || due.Before(next) {
+				nextDue[parent] = due
+			}
+		}
+	}
+
+	result := TaskwarriorImport{CreatedProjects: make([]string, 0), Errors: make([]ImportItemError, 0)}
+	projects := newProjectResolver(tx)
+	now := time.Now().UTC()
+
+	for _, task := range tasks {
+		if task.Status == taskwarrior.Deleted || recurring[strings.ToLower(task.Parent)] {
+			result.Skipped++
+			continue
+		}
+		taskError := func(format string, args ...interface{}) {
+			result.Errors = append(result.Errors, ImportItemError{
+				ID:    task.UUID,
+				Title: task.Description,
+				Error: fmt.Sprintf(format, args...),
+			})
+		}
+
+		todo := Todo{
+			Title:     importTitle(importer.Task{Title: task.Description, Labels: task.Tags}),
+			Completed: task.Status == taskwarrior.Completed,
+			Priority:  priorityFromTaskwarrior(task.Priority),
+			CreatedAt: now,
+		}
+		if strings.TrimSpace(task.Description) == "" {
+			taskError("task has no description, skipped")
+			continue
+		}
+		uid := ""
+		if taskwarrior.IsUUID(task.UUID) {
+			uid = strings.ToLower(task.UUID)
+		} else {
+			taskError("invalid uuid %q, imported without one", task.UUID)
+		}
+		if subscribed[uid] && uid != "" {
+			taskError("todo comes from a calendar subscription, skipped")
+			continue
+		}
+
+		if entry, err := taskwarrior.ParseTime(task.Entry); err == nil {
+			todo.CreatedAt = entry.UTC()
+		}
+		if todo.Completed {
+			completedAt := now
+			if end, err := taskwarrior.ParseTime(task.End); err == nil {
+				completedAt = end.UTC()
+			}
+			todo.CompletedAt = &completedAt
+		}
+		if task.Due != "" {
+			due, err := taskwarrior.ParseTime(task.Due)
+			if next, ok := nextDue[uid]; ok {
+				due, err = next, nil
+			}
+			if err != nil {
+				taskError("invalid due date %q, imported without one", task.Due)
+			} else {
+				// Taskwarrior has no all-day tasks, dates are due at midnight
+				if local := due.In(loc); local.Hour() == 0 && local.Minute() == 0 && local.Second() == 0 {
+					due = allDayDueDate(local)
+					todo.AllDay = true
+				}
+				due = due.UTC()
+				todo.DueDate = &due
+			}
+		}
+		if task.Recur != "" && !todo.Completed {
+			if interval, unit, ok := taskwarrior.ParseRecur(task.Recur); ok {
+				todo.RecurrenceInterval = &interval
+				todo.RecurrenceUnit = &unit
+			} else {
+				taskError("recurrence %q not supported, imported as a one-off", task.Recur)
+			}
+		}
+
+		projectID := 0
+		if task.Project != "" {
+			if projectID, err = projects.id(task.Project); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if id, ok := existing[uid]; ok && uid != "" {
+			// Todos stay where they are unless the task names another project
+			var currentProjectID, position int
+			if err := tx.QueryRow("SELECT project_id, position FROM todos WHERE id = ?", id).Scan(&currentProjectID, &position); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if projectID == 0 {
+				projectID = currentProjectID
+			} else if projectID != currentProjectID {
+				if position, err = projects.position(projectID); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if _, err := tx.Exec(
+				`UPDATE todos SET title = ?, completed = ?, completed_at = ?, project_id = ?, position = ?, due_date = NULLIF(?, ''),
+				 all_day = ?, recurrence_interval = ?, recurrence_unit = ?, priority = ? WHERE id = ?`,
+				todo.Title, todo.Completed, todo.CompletedAt, projectID, position, formatDueDate(todo.DueDate),
+				todo.AllDay, todo.RecurrenceInterval, todo.RecurrenceUnit, todo.Priority, id,
+			); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Updated++
+			continue
+		}
+
+		if projectID == 0 {
+			projectID = defaultProject.ID
+		}
+		position, err := projects.position(projectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res, err := tx.Exec(
+			`INSERT INTO todos (title, completed, created_at, completed_at, project_id, due_date, all_day, recurrence_interval, recurrence_unit, priority, uid, position)
+			 VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+			todo.Title, todo.Completed, todo.CreatedAt.Format("2006-01-02 15:04:05"), todo.CompletedAt, projectID,
+			formatDueDate(todo.DueDate), todo.AllDay, todo.RecurrenceInterval, todo.RecurrenceUnit, todo.Priority, uid, position,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if uid != "" {
+			// A task listed twice updates the todo the first one added
+			if id, err := res.LastInsertId(); err == nil {
+				existing[uid] = int(id)
+			}
+		}
+		result.Added++
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.CreatedProjects = append(result.CreatedProjects, projects.created...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,162 @@
+// Package taskwarrior reads and writes the JSON of Taskwarrior's
+// "task export" and "task import", e.g.
+// {"uuid":"…","description":"Call Mom","status":"pending","due":"20240110T000000Z"}.
+package taskwarrior
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of a task. A recurring task is the template Taskwarrior creates
+// pending instances of, which name it as their parent.
+const (
+	Pending   = "pending"
+	Waiting   = "waiting"
+	Completed = "completed"
+	Deleted   = "deleted"
+	Recurring = "recurring"
+)
+
+const timeLayout = "20060102T150405Z"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Task is a task with the attributes the app has a use for. Times are kept
+// as written, see ParseTime.
+type Task struct {
+	UUID        string   `json:"uuid"`
+	Description string   `json:"description"`
+	Status      string   `json:"status"`
+	Project     string   `json:"project,omitempty"`
+	Entry       string   `json:"entry,omitempty"`
+	Modified    string   `json:"modified,omitempty"`
+	Due         string   `json:"due,omitempty"`
+	End         string   `json:"end,omitempty"`
+	Recur       string   `json:"recur,omitempty"`
+	Parent      string   `json:"parent,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Priority    string   `json:"priority,omitempty"` // H, M or L
+}
+
+// Parse reads an export, which is a JSON array or, from older versions,
+// one JSON object per line.
+func Parse(data []byte) ([]Task, error) {
+	data = bytes.TrimSpace(data)
+	var tasks []Task
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			return nil, err
+		}
+		return tasks, nil
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(bytes.TrimSpace(line), []byte(","))
+		if len(line) == 0 {
+			continue
+		}
+		var task Task
+		if err := json.Unmarshal(line, &task); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// ParseTime reads a time such as 20240110T093000Z. RFC 3339 times are
+// accepted too.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(timeLayout, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// FormatTime writes a time the way Taskwarrior does, in UTC.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// IsUUID reports whether s is a UUID, which every task is identified by.
+func IsUUID(s string) bool {
+	return uuidPattern.MatchString(s)
+}
+
+var (
+	recurPattern    = regexp.MustCompile(`^(\d*)\s*([a-z]+)$`)
+	isoRecurPattern = regexp.MustCompile(`^P(\d+)([DWMY])$`)
+)
+
+var recurNames = map[string]struct {
+	interval int
+	unit     string
+}{
+	"daily":      {1, "days"},
+	"weekly":     {1, "weeks"},
+	"biweekly":   {2, "weeks"},
+	"fortnight":  {2, "weeks"},
+	"monthly":    {1, "months"},
+	"bimonthly":  {2, "months"},
+	"quarterly":  {3, "months"},
+	"semiannual": {6, "months"},
+	"yearly":     {1, "years"},
+	"annual":     {1, "years"},
+	"biannual":   {2, "years"},
+	"biyearly":   {2, "years"},
+}
+
+var recurUnits = map[string]string{
+	"d": "days", "day": "days", "days": "days",
+	"w": "weeks", "wk": "weeks", "wks": "weeks", "week": "weeks", "weeks": "weeks",
+	"mo": "months", "mos": "months", "mth": "months", "mths": "months", "month": "months", "months": "months",
+	"q": "quarters", "qtr": "quarters", "qtrs": "quarters", "quarter": "quarters", "quarters": "quarters",
+	"y": "years", "yr": "years", "yrs": "years", "year": "years", "years": "years",
+}
+
+// ParseRecur reads a recurrence such as "weekly", "2d", "3mo" or "P1Y" into
+// an interval of days, weeks, months or years. Recurrences the app cannot
+// repeat, such as "weekdays" or hours, are not ok.
+func ParseRecur(value string) (interval int, unit string, ok bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if named, ok := recurNames[value]; ok {
+		return named.interval, named.unit, true
+	}
+	if m := isoRecurPattern.FindStringSubmatch(strings.ToUpper(value)); m != nil {
+		interval, _ = strconv.Atoi(m[1])
+		unit = map[string]string{"D": "days", "W": "weeks", "M": "months", "Y": "years"}[m[2]]
+		return interval, unit, interval > 0
+	}
+	m := recurPattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, "", false
+	}
+	interval = 1
+	if m[1] != "" {
+		interval, _ = strconv.Atoi(m[1])
+	}
+	unit, ok = recurUnits[m[2]]
+	if unit == "quarters" {
+		interval, unit = interval*3, "months"
+	}
+	return interval, unit, ok && interval > 0
+}
+
+// Recur writes an interval of days, weeks, months or years as a recurrence.
+func Recur(interval int, unit string) string {
+	suffix := map[string]string{"days": "d", "weeks": "w", "months": "mo", "years": "y"}
+	named := map[string]string{"days": "daily", "weeks": "weekly", "months": "monthly", "years": "yearly"}
+	unit = strings.TrimSuffix(strings.ToLower(unit), "s") + "s"
+	if _, ok := suffix[unit]; !ok || interval <= 0 {
+		return ""
+	}
+	if interval == 1 {
+		return named[unit]
+	}
+	return strconv.Itoa(interval) + suffix[unit]
+}
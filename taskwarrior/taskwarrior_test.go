@@ -0,0 +1,139 @@
+package taskwarrior
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	want := []Task{
+		{UUID: "6fa3a1d6-0b5a-4bde-9c5b-7f1d4f4d2f10", Description: "Call Mom", Status: Pending, Due: "20240110T000000Z", Tags: []string{"family"}},
+		{UUID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", Description: "Pay rent", Status: Recurring, Recur: "monthly", Priority: "H"},
+	}
+
+	array := `[
+		{"uuid":"6fa3a1d6-0b5a-4bde-9c5b-7f1d4f4d2f10","description":"Call Mom","status":"pending","due":"20240110T000000Z","tags":["family"],"urgency":3.2},
+		{"uuid":"0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","description":"Pay rent","status":"recurring","recur":"monthly","priority":"H"}
+	]`
+	// Older versions write one object per line, with trailing commas
+	lines := `
+		{"uuid":"6fa3a1d6-0b5a-4bde-9c5b-7f1d4f4d2f10","description":"Call Mom","status":"pending","due":"20240110T000000Z","tags":["family"]},
+
+		{"uuid":"0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","description":"Pay rent","status":"recurring","recur":"monthly","priority":"H"}
+	`
+	for name, data := range map[string]string{"array": array, "lines": lines} {
+		t.Run(name, func(t *testing.T) {
+			tasks, err := Parse([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tasks, want) {
+				t.Errorf("Parse() =\n%+v\nwant\n%+v", tasks, want)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte("{\"uuid\":\"x\"}\nnot json\n")); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Parse() error = %v, want one for line 2", err)
+	}
+}
+
+func TestTime(t *testing.T) {
+	want := time.Date(2024, time.January, 10, 9, 30, 0, 0, time.UTC)
+	for _, value := range []string{"20240110T093000Z", "2024-01-10T10:30:00+01:00"} {
+		got, err := ParseTime(value)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := ParseTime("tomorrow"); err == nil {
+		t.Error("ParseTime(tomorrow) succeeded, want an error")
+	}
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	if got := FormatTime(want.In(paris)); got != "20240110T093000Z" {
+		t.Errorf("FormatTime() = %q, want 20240110T093000Z", got)
+	}
+}
+
+func TestIsUUID(t *testing.T) {
+	tests := map[string]bool{
+		"6fa3a1d6-0b5a-4bde-9c5b-7f1d4f4d2f10": true,
+		"6FA3A1D6-0B5A-4BDE-9C5B-7F1D4F4D2F10": true,
+		"6fa3a1d60b5a4bde9c5b7f1d4f4d2f10":     false,
+		"6fa3a1d6-0b5a-4bde-9c5b-7f1d4f4d2f1":  false,
+		"":                                     false,
+	}
+	for s, want := range tests {
+		if got := IsUUID(s); got != want {
+			t.Errorf("IsUUID(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestParseRecur(t *testing.T) {
+	tests := []struct {
+		value    string
+		interval int
+		unit     string
+		ok       bool
+	}{
+		{"daily", 1, "days", true},
+		{"Weekly", 1, "weeks", true},
+		{"biweekly", 2, "weeks", true},
+		{"quarterly", 3, "months", true},
+		{"annual", 1, "years", true},
+		{"2d", 2, "days", true},
+		{"3 wks", 3, "weeks", true},
+		{"mo", 1, "months", true},
+		{"2q", 6, "months", true},
+		{"P1Y", 1, "years", true},
+		{"p2w", 2, "weeks", true},
+		{"weekdays", 0, "", false},
+		{"4h", 0, "", false},
+		{"0d", 0, "", false},
+		{"P0D", 0, "", false},
+		{"", 0, "", false},
+	}
+	for _, tt := range tests {
+		interval, unit, ok := ParseRecur(tt.value)
+		if ok != tt.ok || ok && (interval != tt.interval || unit != tt.unit) {
+			t.Errorf("ParseRecur(%q) = %d, %q, %v, want %d, %q, %v", tt.value, interval, unit, ok, tt.interval, tt.unit, tt.ok)
+		}
+	}
+}
+
+func TestRecur(t *testing.T) {
+	tests := []struct {
+		interval int
+		unit     string
+		want     string
+		// unit ParseRecur reads the recurrence back as
+		back string
+	}{
+		{1, "days", "daily", "days"},
+		{1, "week", "weekly", "weeks"},
+		{2, "weeks", "2w", "weeks"},
+		{3, "Months", "3mo", "months"},
+		{1, "years", "yearly", "years"},
+		{0, "days", "", ""},
+		{1, "hours", "", ""},
+	}
+	for _, tt := range tests {
+		got := Recur(tt.interval, tt.unit)
+		if got != tt.want {
+			t.Errorf("Recur(%d, %q) = %q, want %q", tt.interval, tt.unit, got, tt.want)
+		}
+		if got == "" {
+			continue
+		}
+		if interval, unit, ok := ParseRecur(got); !ok || interval != tt.interval || unit != tt.back {
+			t.Errorf("ParseRecur(%q) = %d, %q, %v, want %d, %q", got, interval, unit, ok, tt.interval, tt.back)
+		}
+	}
+}
@@ -1,111 +1,3 @@
-// Lightweight .ics parser to extract VEVENT SUMMARY and DTSTART
-/**
- * Parse raw ICS text and return array of {summary, date}
- * Only supports DTSTART in formats YYYYMMDD, YYYYMMDDThhmmss, or ...Z
- */
-function parseICS(text) {
-  // Unfold lines (RFC 5545 3.1) – remove CRLF followed by space / tab
-  text = text.replace(/\r?\n[ \t]/g, "");
-  const lines = text.split(/\r?\n/);
-  const events = [];
-  let current = null;
-  for (const line of lines) {
-    if (line.startsWith("BEGIN:VEVENT")) {
-      current = { summary: null, date: null, rrule: null, isAllDay: false };
-    } else if (line.startsWith("END:VEVENT")) {
-      if (current) events.push(current);
-      current = null;
-    } else if (current) {
-      if (line.startsWith("SUMMARY:")) {
-        current.summary = line.substring(8).trim();
-      } else if (line.startsWith("DTSTART")) {
-        const [, value] = line.split(":");
-        if (!value) continue;
-        let date = null;
-        const v = value.trim();
-        if (/^\d{8}T\d{6}Z$/.test(v)) {
-          date = new Date(v);
-          current.isAllDay = false;
-        } else if (/^\d{8}T\d{6}$/.test(v)) {
-          const y = v.slice(0, 4),
-            m = v.slice(4, 6),
-            d = v.slice(6, 8);
-          const H = v.slice(9, 11),
-            M = v.slice(11, 13),
-            S = v.slice(13, 15);
-          date = new Date(
-            Number(y),
-            Number(m) - 1,
-            Number(d),
-            Number(H),
-            Number(M),
-            Number(S),
-          );
-          current.isAllDay = false;
-        } else if (/^\d{8}$/.test(v)) {
-          const y = v.slice(0, 4),
-            m = v.slice(4, 6),
-            d = v.slice(6, 8);
-          date = new Date(Number(y), Number(m) - 1, Number(d));
-          current.isAllDay = true;
-        }
-        current.date = date;
-      } else if (line.startsWith("RRULE:")) {
-        current.rrule = line.substring(6).trim();
-      }
-    }
-  }
-
-  const now = new Date();
-  const today = new Date(now.getFullYear(), now.getMonth(), now.getDate());
-
-  // Filter events and map RRULE to recurrence fields
-  return events
-    .filter((ev) => {
-      // Always keep events that have a recurrence rule.
-      if (ev.rrule) return true;
-      // If there's no date, keep it (it might be a timeless task).
-      if (!ev.date) return true;
-
-      if (ev.isAllDay) {
-        // For all-day events, keep it if its date is today or in the future.
-        return ev.date >= today;
-      } else {
-        // For timed events, only keep it if the date is not in the past.
-        if (ev.summary.startsWith("Lucie")) console.log(ev, ev.date >= now);
-        return ev.date >= now;
-      }
-    })
-    .map((ev) => {
-      if (ev.rrule) {
-        const parts = Object.fromEntries(
-          ev.rrule.split(";").map((p) => p.split("=")),
-        );
-        const freq = (parts.FREQ || "").toUpperCase();
-        const interval = parseInt(parts.INTERVAL || "1", 10);
-        let unit = null;
-        switch (freq) {
-          case "DAILY":
-            unit = "day";
-            break;
-          case "WEEKLY":
-            unit = "week";
-            break;
-          case "MONTHLY":
-            unit = "month";
-            break;
-          case "YEARLY":
-            unit = "year";
-            break;
-        }
-        if (unit) {
-          ev.recurrenceInterval = interval;
-          ev.recurrenceUnit = unit;
-        }
-      }
-      return ev;
-    });
-}
 // Utility: format date as strict RFC3339 (no ms, always ends in Z)
 //
 function toRFC3339NoMillis(date) {
@@ -126,6 +18,14 @@ function toRFC3339NoMillis(date) {
   );
 }
 
+// Due date of a todo as a local Date. All-day todos are stored as midnight
+// UTC, so their date is read in UTC to avoid moving to another day.
+function localDueDate(todo) {
+  const d = new Date(todo.due_date);
+  if (!todo.all_day) return d;
+  return new Date(d.getUTCFullYear(), d.getUTCMonth(), d.getUTCDate());
+}
+
 async function subscribeToICS() {
   const url = prompt("Enter the URL of the ICS calendar to subscribe to:");
   if (!url) return;
@@ -136,7 +36,7 @@ async function subscribeToICS() {
   if (!projectName) return;
 
   try {
-    const response = await fetch("/api/subscribe_ics", {
+    const response = await fetch("api/subscribe_ics", {
       method: "POST",
       headers: { "Content-Type": "application/json" },
       body: JSON.stringify({ url: url, project_name: projectName }),
@@ -157,6 +57,90 @@ async function subscribeToICS() {
   }
 }
 
+async function createAPIToken() {
+  const name = prompt("Enter a name for the new API token (e.g. phone shortcut):");
+  if (!name) return;
+
+  try {
+    const response = await fetch("api/tokens", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ name: name }),
+    });
+
+    if (!response.ok) {
+      const errorText = await response.text();
+      throw new Error(errorText || "Failed to create API token");
+    }
+
+    const token = await response.json();
+    prompt(
+      "Copy your API token now, it will not be shown again:",
+      token.token,
+    );
+  } catch (error) {
+    console.error("Error creating API token:", error);
+    alert("Failed to create API token. " + error.message);
+  }
+}
+
+/**
+ * Convert a base64url VAPID key to the Uint8Array PushManager expects.
+ * @param {string} base64String
+ */
+function urlBase64ToUint8Array(base64String) {
+  const padding = "=".repeat((4 - (base64String.length % 4)) % 4);
+  const base64 = (base64String + padding).replace(/-/g, "+").replace(/_/g, "/");
+  const raw = atob(base64);
+  return Uint8Array.from(raw, (c) => c.charCodeAt(0));
+}
+
+async function enablePushNotifications() {
+  if (!("serviceWorker" in navigator) || !("PushManager" in window)) {
+    alert("This browser does not support push notifications.");
+    return;
+  }
+
+  try {
+    const permission = await Notification.requestPermission();
+    if (permission !== "granted") {
+      alert("Notifications were not allowed.");
+      return;
+    }
+
+    const registration = await navigator.serviceWorker.register("sw.js");
+    await navigator.serviceWorker.ready;
+
+    let subscription = await registration.pushManager.getSubscription();
+    if (!subscription) {
+      const keyResponse = await fetch("api/push/vapid_public_key");
+      if (!keyResponse.ok) {
+        throw new Error("Failed to get the server's push key");
+      }
+      const { public_key } = await keyResponse.json();
+      subscription = await registration.pushManager.subscribe({
+        userVisibleOnly: true,
+        applicationServerKey: urlBase64ToUint8Array(public_key),
+      });
+    }
+
+    const response = await fetch("api/push_subscriptions", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(subscription),
+    });
+    if (!response.ok) {
+      const errorText = await response.text();
+      throw new Error(errorText || "Failed to register for notifications");
+    }
+
+    showToast("Notifications enabled for this browser");
+  } catch (error) {
+    console.error("Error enabling push notifications:", error);
+    alert("Failed to enable notifications. " + error.message);
+  }
+}
+
 /**
  * Build a read-only project group that lists todos due in the next 6 days.
  * @param {Array} todos – the todos that are due soon
@@ -240,7 +224,7 @@ async function saveProjectEdit() {
 
   if (newTitle) {
     try {
-      const response = await fetch(`/api/projects/${element.dataset.id}`, {
+      const response = await fetch(`api/projects/${element.dataset.id}`, {
         method: "PUT",
         headers: {
           "Content-Type": "application/json",
@@ -286,7 +270,7 @@ async function deleteProject(id) {
     // Remove the expanded state from localStorage first
     localStorage.removeItem("completedExpanded_" + id);
 
-    const response = await fetch(`/api/projects/${id}`, {
+    const response = await fetch(`api/projects/${id}`, {
       method: "DELETE",
     });
     if (!response.ok) {
@@ -312,6 +296,13 @@ document.addEventListener("click", function (e) {
 
 // Menu toggle and dropdown handlers will be initialized after DOM is loaded
 document.addEventListener("DOMContentLoaded", function () {
+  // Keep the service worker registered so push notifications keep arriving
+  if ("serviceWorker" in navigator && window.Notification?.permission === "granted") {
+    navigator.serviceWorker.register("sw.js").catch((error) => {
+      console.error("Error registering service worker:", error);
+    });
+  }
+
   // Toggle dropdown menu
   document.addEventListener("click", function (e) {
     const menuButton = document.getElementById("menuToggle");
@@ -347,7 +338,7 @@ document.addEventListener("click", async function (e) {
   // Don't do anything if clicking on time or date inputs
   if (
     e.target.closest(
-      ".todo-time-input, .todo-date-input, .recurrence-count, .recurrence-unit",
+      ".todo-time-input, .todo-date-input, .recurrence-count, .recurrence-unit, .reminder-offset",
     )
   ) {
     e.stopPropagation();
@@ -386,7 +377,7 @@ document.addEventListener("click", async function (e) {
           !menu.contains(e.target) &&
           e.target !== menuBtn &&
           !e.target.closest(
-            ".todo-time-input, .todo-date-input, .recurrence-count, .recurrence-unit",
+            ".todo-time-input, .todo-date-input, .recurrence-count, .recurrence-unit, .reminder-offset",
           )
         ) {
           menu.style.display = "none";
@@ -429,10 +420,13 @@ document.addEventListener("click", async function (e) {
       const countEl = li.querySelector(".recurrence-count");
       const unitEl = li.querySelector(".recurrence-unit");
 
-      // Combine date and time inputs using strict RFC3339 formatting
+      // Combine date and time inputs using strict RFC3339 formatting. A date
+      // without a time is all-day.
       let dueDate = null;
+      let allDay;
       if (dateInput && dateInput.value === "") {
         dueDate = "";
+        allDay = false;
       } else if (timeInput?.value && (!dateInput || !dateInput.value)) {
         const now = new Date();
         const [hours, minutes] = timeInput.value.split(":").map(Number);
@@ -446,6 +440,10 @@ document.addEventListener("click", async function (e) {
           0,
         );
         dueDate = toRFC3339NoMillis(localDate);
+        allDay = false;
+      } else if (dateInput?.value && !timeInput?.value) {
+        dueDate = `${dateInput.value}T00:00:00Z`;
+        allDay = true;
       } else if (dateInput?.value) {
         const dateParts = dateInput.value.split("-");
         const localDate = new Date(
@@ -453,13 +451,10 @@ document.addEventListener("click", async function (e) {
           parseInt(dateParts[1]) - 1,
           parseInt(dateParts[2]),
         );
-        if (timeInput?.value) {
-          const [hours, minutes] = timeInput.value.split(":").map(Number);
-          localDate.setHours(hours, minutes, 0, 0);
-        } else {
-          localDate.setHours(0, 0, 0, 0);
-        }
+        const [hours, minutes] = timeInput.value.split(":").map(Number);
+        localDate.setHours(hours, minutes, 0, 0);
         dueDate = toRFC3339NoMillis(localDate);
+        allDay = false;
       } else if (dateInput?.dataset.due && !dateInput.value) {
         dueDate = dateInput.dataset.due;
         if (dueDate && !dueDate.endsWith("Z")) {
@@ -475,6 +470,7 @@ document.addEventListener("click", async function (e) {
         title: titleEl ? titleEl.textContent : "",
         completed: checkbox ? checkbox.checked : false,
         due_date: dueDate,
+        all_day: allDay,
         recurrence_interval:
           countEl && countEl.value ? Number(countEl.value) : null,
         recurrence_unit: unitEl && unitEl.value ? unitEl.value : null,
@@ -482,12 +478,24 @@ document.addEventListener("click", async function (e) {
       };
 
       try {
-        const response = await fetch("/api/todo", {
+        const response = await fetch("api/todo", {
           method: "PUT",
           headers: { "Content-Type": "application/json" },
           body: JSON.stringify(outgoingPayload),
         });
         if (!response.ok) throw new Error("Failed to update todo");
+        const reminderEl = li.querySelector(".reminder-offset");
+        if (reminderEl && reminderEl.value !== "") {
+          const reminderResponse = await fetch("api/reminders", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({
+              todo_id: Number(todoId),
+              offset_minutes: Number(reminderEl.value),
+            }),
+          });
+          if (!reminderResponse.ok) throw new Error("Failed to add reminder");
+        }
         // Close menu after successful save
         const menu = li.querySelector(".todo-menu");
         if (menu) menu.style.display = "none";
@@ -691,7 +699,7 @@ document.addEventListener("drop", async function (e) {
       .filter((id) => !isNaN(parseInt(id)))
       .map((id) => parseInt(id));
     try {
-      await fetch("/api/projects/reorder", {
+      await fetch("api/projects/reorder", {
         method: "PUT",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify(ids),
@@ -748,21 +756,22 @@ document.addEventListener("drop", async function (e) {
     const dateInput = itemEl ? itemEl.querySelector(".todo-date-input") : null;
     const timeInput = itemEl ? itemEl.querySelector(".todo-time-input") : null;
     let dueDate = null;
-    if (dateInput?.value) {
+    let allDay;
+    if (dateInput?.value && !timeInput?.value) {
+      // A date without a time is all-day
+      dueDate = `${dateInput.value}T00:00:00Z`;
+      allDay = true;
+    } else if (dateInput?.value) {
       // Create a date object from the input values
       const [year, month, day] = dateInput.value.split("-").map(Number);
       let date = new Date();
       date.setFullYear(year, month - 1, day);
 
-      // Set time if provided
-      if (timeInput?.value) {
-        const [hours, minutes] = timeInput.value.split(":").map(Number);
-        date.setHours(hours, minutes, 0, 0);
-      } else {
-        date.setHours(0, 0, 0, 0);
-      }
+      const [hours, minutes] = timeInput.value.split(":").map(Number);
+      date.setHours(hours, minutes, 0, 0);
 
       dueDate = toRFC3339NoMillis(date);
+      allDay = false;
     } else if (dateInput?.dataset.due) {
       // If we have a due date from dataset, ensure it's in the correct format
       const date = new Date(dateInput.dataset.due);
@@ -777,7 +786,7 @@ document.addEventListener("drop", async function (e) {
     const recInt = countEl && countEl.value ? Number(countEl.value) : null;
     const recUnitVal = unitEl && unitEl.value ? unitEl.value : null;
 
-    const response = await fetch("/api/todo", {
+    const response = await fetch("api/todo", {
       method: "PUT",
       headers: { "Content-Type": "application/json" },
       body: JSON.stringify({
@@ -786,6 +795,7 @@ document.addEventListener("drop", async function (e) {
         completed: targetCompleted,
         project_id: targetProject,
         due_date: dueDate,
+        all_day: allDay,
         recurrence_interval: recInt,
         recurrence_unit: recUnitVal,
       }),
@@ -824,7 +834,7 @@ document.addEventListener("drop", async function (e) {
     );
 
     // Persist the new order in the backend
-    const reorderPromise = fetch("/api/todos/reorder", {
+    const reorderPromise = fetch("api/todos/reorder", {
       method: "PUT",
       headers: { "Content-Type": "application/json" },
       body: JSON.stringify(ids),
@@ -845,7 +855,7 @@ document.addEventListener("drop", async function (e) {
 
 async function addProject() {
   try {
-    const response = await fetch("/api/projects", {
+    const response = await fetch("api/projects", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
@@ -890,301 +900,112 @@ async function addProject() {
   }
 }
 
-async function importGoogleTasks(exportJson) {
-  if (!exportJson) throw new Error("No data to import");
+// importTasks imports the export of another todo app. Without a source the
+// server tells it from the file; title names the project of a Todoist CSV
+// file.
+async function importTasks(exportText, { source = "", title = "", heading = "Import" } = {}) {
+  if (!exportText) throw new Error("No data to import");
+
+  // The server imports everything in one transaction; a dry run first shows
+  // what it would do
+  const post = async (dryRun) => {
+    const params = new URLSearchParams({
+      tz: Intl.DateTimeFormat().resolvedOptions().timeZone,
+    });
+    if (source) params.set("source", source);
+    if (title) params.set("title", title);
+    if (dryRun) params.set("dry_run", "true");
+    const resp = await fetch(`api/import_tasks?${params}`, {
+      method: "POST",
+      body: exportText,
+    });
+    if (!resp.ok) throw new Error(await resp.text());
+    return resp.json();
+  };
+
+  const preview = await post(true);
+  if (preview.added === 0 && preview.errors.length === 0) {
+    if (preview.duplicates > 0) {
+      alert("All tasks in the export were already imported.");
+      return false;
+    }
+    throw new Error("No tasks found in the export");
+  }
+
+  let question = `Import ${preview.added} task(s) into ${preview.projects.length} project(s)?`;
+  if (preview.duplicates > 0) {
+    question += `\n${preview.duplicates} already imported task(s) will be skipped.`;
+  }
+  if (preview.errors.length > 0) {
+    question += `\n${preview.errors.length} task(s) have problems, see the details after the import.`;
+  }
+  if (!confirm(question)) return false;
+
+  const result = await post(false);
 
-  // Create and show modal
   const modal = document.createElement("div");
   modal.className = "import-modal";
   modal.innerHTML = `
                 <div class="import-modal-content">
                     <div class="import-modal-header">
-                        <h3 class="import-modal-title">Importing Google Tasks</h3>
-                        <button class="import-close-btn" disabled>&times;</button>
+                        <h3 class="import-modal-title"></h3>
+                        <button class="import-close-btn">&times;</button>
                     </div>
-                    
+
                     <div class="progress-section">
                         <h4>Projects</h4>
-                        <div class="progress-bar-container">
-                            <div class="progress-bar" id="project-progress"></div>
-                        </div>
                         <div class="progress-stats">
-                            <span id="project-stats">0/0 projects</span>
-                            <span id="project-status">Starting import...</span>
+                            <span id="project-stats"></span>
+                            <span id="project-status">Completed</span>
                         </div>
                         <div class="progress-details" id="project-details"></div>
                     </div>
-                    
-
                 </div>
             `;
   document.body.appendChild(modal);
-
-  // Show modal with animation
+  modal.querySelector(".import-modal-title").textContent = heading;
   setTimeout(() => modal.classList.add("visible"), 10);
 
-  // Helper function to update progress
-  const updateProgress = (
-    current,
-    total,
-    status,
-    isComplete = false,
-    isError = false,
-  ) => {
-    const progressBar = document.getElementById("project-progress");
-    const statsEl = document.getElementById("project-stats");
-    const statusEl = document.getElementById("project-status");
-
-    if (progressBar) {
-      const progress = total > 0 ? Math.round((current / total) * 100) : 0;
-      progressBar.style.width = `${progress}%`;
-
-      if (isComplete) {
-        progressBar.classList.add("complete");
-        statusEl.textContent = "Completed";
-      } else if (isError) {
-        progressBar.classList.add("error");
-      }
-    }
-
-    if (statsEl) {
-      statsEl.textContent = `${current}/${total} project${total !== 1 ? "s" : ""}`;
-    }
-
-    if (statusEl && status) {
-      statusEl.textContent = status;
-    }
-  };
-
-  // Helper function to log errors
-  const logError = (error) => {
-    console.error(error);
-    const detailsEl = document.getElementById("project-details");
-    if (!detailsEl) return;
+  modal.querySelector("#project-stats").textContent =
+    `${result.added} task(s) imported, ${result.duplicates} skipped`;
 
+  const details = modal.querySelector("#project-details");
+  const addItem = (className, icon, text, stats) => {
     const entry = document.createElement("div");
-    entry.className = "progress-item error";
+    entry.className = `progress-item ${className}`;
     entry.innerHTML = `
-                    <span class="progress-item-icon">✗</span>
-                    <span class="progress-item-text">${error}</span>
+                    <span class="progress-item-icon"></span>
+                    <span class="progress-item-text"></span>
+                    <span class="progress-item-stats"></span>
                 `;
-    detailsEl.appendChild(entry);
-    detailsEl.scrollTop = detailsEl.scrollHeight;
+    entry.querySelector(".progress-item-icon").textContent = icon;
+    entry.querySelector(".progress-item-text").textContent = text;
+    entry.querySelector(".progress-item-stats").textContent = stats || "";
+    details.appendChild(entry);
   };
-
-  try {
-    // Handle Google Tasks API export format
-    const taskLists = exportJson.items || [];
-    if (taskLists.length === 0) {
-      throw new Error("No task lists found in the export");
-    }
-
-    let totalTasks = 0;
-    let importedTasks = 0;
-    let importedProjects = 0;
-
-    // First count all tasks and create project entries
-    for (const list of taskLists) {
-      const tasks = (list.items || []).filter((t) => t.title);
-      totalTasks += tasks.length;
-
-      if (tasks.length > 0) {
-        const projectEntry = document.createElement("div");
-        projectEntry.className = "progress-item progress-item-pending";
-        projectEntry.innerHTML = `
-                            <span class="progress-item-icon">⏳</span>
-                            <span class="progress-item-text">${list.title || "Untitled Project"}</span>
-                            <span class="progress-item-stats">0/${tasks.length} tasks</span>
-                        `;
-        document.getElementById("project-details").appendChild(projectEntry);
-      }
-    }
-
-    if (totalTasks === 0) {
-      throw new Error("No tasks found in the export");
-    }
-
-    // Update project progress
-    updateProgress(0, taskLists.length, "Starting project import...");
-
-    // Process each project
-    for (let i = 0; i < taskLists.length; i++) {
-      const list = taskLists[i];
-      const title = list.title || "Untitled Project";
-      const tasks = (list.items || []).filter((t) => t.title);
-
-      if (tasks.length === 0) continue;
-
-      // Update project status
-      const projectEntries = document.querySelectorAll(
-        "#project-details .progress-item",
-      );
-      const currentProjectEl = projectEntries[importedProjects];
-
-      if (currentProjectEl) {
-        currentProjectEl.innerHTML = `
-                            <span class="progress-item-icon">🔄</span>
-                            <span class="progress-item-text">${title}</span>
-                            <span class="progress-item-stats">0/${tasks.length} tasks</span>
-                        `;
-      }
-      currentProjectEl.scrollIntoView({ behavior: "smooth" });
-
-      updateProgress(
-        importedProjects,
-        taskLists.length,
-        `Importing project: ${title}...`,
-      );
-
-      try {
-        // Create project
-        const createResp = await fetch("/api/projects", {
-          method: "POST",
-          headers: { "Content-Type": "application/json" },
-          body: JSON.stringify({ title }),
-        });
-
-        if (!createResp.ok) {
-          throw new Error(
-            `Failed to create project: ${await createResp.text()}`,
-          );
-        }
-
-        const project = await createResp.json();
-
-        // Update project entry
-        if (currentProjectEl) {
-          currentProjectEl.innerHTML = `
-                                <span class="progress-item-icon">✓</span>
-                                <span class="progress-item-text">${title}</span>
-                                <span class="progress-item-stats">0/${tasks.length} tasks</span>
-                            `;
-        }
-
-        // Process tasks for this project
-        for (let j = 0; j < tasks.length; j++) {
-          const task = tasks[j];
-
-          try {
-            const todo = {
-              title: task.title || "",
-              completed: task.status === "completed" || !!task.completed,
-              project_id: project.id,
-              due_date: task.due
-                ? new Date(task.due).toISOString().split("T")[0]
-                : null,
-            };
-
-            const taskResp = await fetch("/api/todo", {
-              method: "POST",
-              headers: { "Content-Type": "application/json" },
-              body: JSON.stringify(todo),
-            });
-
-            if (!taskResp.ok) {
-              throw new Error(
-                `Failed to import task: ${await taskResp.text()}`,
-              );
-            }
-
-            importedTasks++;
-
-            // Update project task count in the UI
-            if (currentProjectEl) {
-              const taskCount = currentProjectEl.querySelector(
-                ".progress-item-stats",
-              );
-              if (taskCount) {
-                taskCount.textContent = `(${j + 1}/${tasks.length} tasks)`;
-              }
-
-              // Update the main status with current progress
-              updateProgress(
-                importedProjects,
-                taskLists.length,
-                `Importing ${title} (${j + 1}/${tasks.length} tasks)...`,
-              );
-            }
-          } catch (taskError) {
-            logError(
-              `Error importing task: ${task.title} - ${taskError.message}`,
-            );
-          }
-        }
-
-        importedProjects++;
-        updateProgress(
-          importedProjects,
-          taskLists.length,
-          "Project import in progress...",
-        );
-      } catch (projectError) {
-        console.error(`Error importing project ${title}:`, projectError);
-
-        if (currentProjectEl) {
-          currentProjectEl.innerHTML = `
-                                <span class="progress-item-icon">✗</span>
-                                <span class="progress-item-text">${title} - ${projectError.message}</span>
-                            `;
-          currentProjectEl.classList.add("error");
-        }
-
-        // Skip to next project
-        importedProjects++;
-        continue;
-      }
-    }
-
-    // Update final status
-    updateProgress(
-      importedProjects,
-      taskLists.length,
-      "All projects imported",
-      true,
+  for (const project of result.projects) {
+    addItem(
+      "complete",
+      "✓",
+      project.created ? project.title : `${project.title} (existing)`,
+      `${project.added} task(s)`,
     );
-
-    // Enable close button
-    const closeBtn = modal.querySelector(".import-close-btn");
-    if (closeBtn) {
-      closeBtn.disabled = false;
-      closeBtn.onclick = () => {
-        modal.classList.remove("visible");
-        setTimeout(() => {
-          document.body.removeChild(modal);
-          loadTodosByProject(); // Refresh the UI
-        }, 300);
-      };
-    }
-  } catch (error) {
-    console.error("Import failed:", error);
-
-    // Update UI with error
-    const statusEl = document.getElementById("project-status");
-    if (statusEl) {
-      statusEl.textContent = `Error: ${error.message}`;
-      statusEl.style.color = "#f44336";
-    }
-
-    // Enable close button on error
-    const closeBtn = modal.querySelector(".import-close-btn");
-    if (closeBtn) {
-      closeBtn.disabled = false;
-      closeBtn.onclick = () => {
-        modal.classList.remove("visible");
-        setTimeout(() => {
-          document.body.removeChild(modal);
-        }, 300);
-      };
-    }
-
-    throw error; // Re-throw to be caught by the caller
   }
+  for (const error of result.errors) {
+    addItem("error", "✗", `${error.list}: ${error.title || error.id} - ${error.error}`);
+  }
+
+  modal.querySelector(".import-close-btn").onclick = () => {
+    modal.classList.remove("visible");
+    setTimeout(() => document.body.removeChild(modal), 300);
+  };
+  return true;
 }
 
 async function loadTodosByProject() {
   try {
     // Fetch all projects first
-    const projectsResp = await fetch("/api/projects");
+    const projectsResp = await fetch("api/projects");
     if (!projectsResp.ok) {
       throw new Error("Failed to fetch projects");
     }
@@ -1198,14 +1019,25 @@ async function loadTodosByProject() {
     }
 
     // Fetch all todos
-    const todosResponse = await fetch("/api/todos");
+    const todosResponse = await fetch("api/todos");
     if (!todosResponse.ok) {
       throw new Error("Failed to fetch todos");
     }
     const todos = await todosResponse.json();
 
+    // Attach reminders so each todo can show how many it has
+    const remindersResponse = await fetch("api/reminders");
+    if (remindersResponse.ok) {
+      const reminders = await remindersResponse.json();
+      for (const todo of todos) {
+        todo.reminders = reminders.filter(
+          (reminder) => reminder.todo_id === todo.id && !reminder.sent_at,
+        );
+      }
+    }
+
     // Get projects
-    const projectsResponse = await fetch("/api/projects");
+    const projectsResponse = await fetch("api/projects");
     const projects = await projectsResponse.json();
 
     const projectsContainer = document.querySelector(".projects-container");
@@ -1217,14 +1049,14 @@ async function loadTodosByProject() {
     thisWeek.setDate(today.getDate() + 6);
     const upcomingTodos = todos.filter((todo) => {
       if (!todo.due_date) return false;
-      const due = new Date(todo.due_date);
+      const due = localDueDate(todo);
       return due <= thisWeek;
     });
 
     // Sort by due_date in ascending order
     upcomingTodos.sort((a, b) => {
       if (a.due_date && b.due_date) {
-        return new Date(a.due_date) - new Date(b.due_date);
+        return localDueDate(a) - localDueDate(b);
       }
       return 0;
     });
@@ -1289,7 +1121,7 @@ async function loadProject(project, filteredTodos) {
 
     filteredTodos.forEach((todo) => {
       const li = document.createElement("li");
-      li.className = `todo-item ${todo.completed ? "completed" : ""}`;
+      li.className = `todo-item ${todo.completed ? "completed" : ""} ${todo.parent_id ? "subtask" : ""}`;
       li.setAttribute("draggable", "true");
       li.dataset.id = todo.id;
       li.dataset.projectId = project.id;
@@ -1299,7 +1131,7 @@ async function loadProject(project, filteredTodos) {
       let recurrenceHtml = "";
       if (todo.due_date) {
         // Parse RFC3339 UTC string and convert to local time
-        const utcDate = new Date(todo.due_date);
+        const utcDate = localDueDate(todo);
         const pad = (n) => String(n).padStart(2, "0");
         const localYear = utcDate.getFullYear();
         const localMonth = pad(utcDate.getMonth() + 1);
@@ -1319,18 +1151,44 @@ async function loadProject(project, filteredTodos) {
         } else if (datePart < todayLocal && !todo.completed) {
           dueDateClass = "overdue";
         }
-        dueDateHtml = `<div class="due-date ${dueDateClass}"><i class="nf nf-md-calendar"></i> ${datePart} <i class="nf nf-fa-clock"></i> ${timeStr}</div>`;
+        const reminderHtml = todo.reminders?.length
+          ? ` <i class="nf nf-md-bell"></i> ${todo.reminders.length}`
+          : "";
+        const timeHtml = todo.all_day
+          ? ""
+          : ` <i class="nf nf-fa-clock"></i> ${timeStr}`;
+        dueDateHtml = `<div class="due-date ${dueDateClass}"><i class="nf nf-md-calendar"></i> ${datePart}${timeHtml}${reminderHtml}</div>`;
         if (todo.recurrence_interval && todo.recurrence_unit) {
           recurrenceHtml = `<div class="recurrence-info ${dueDateClass}"><i class="nf nf-md-refresh"></i> Every ${todo.recurrence_interval} ${todo.recurrence_unit}(s)</div>`;
         }
       }
 
+      // iCalendar priorities: 1-4 high, 5 medium, 6-9 low
+      let priorityHtml = "";
+      if (todo.priority) {
+        const level =
+          todo.priority < 5 ? "high" : todo.priority === 5 ? "medium" : "low";
+        priorityHtml = `<div class="priority-info priority-${level}"><i class="nf nf-md-flag"></i> ${level[0].toUpperCase() + level.slice(1)} priority</div>`;
+      }
+
+      // Notes often come from imported tasks, so they are escaped
+      let notesHtml = "";
+      if (todo.notes) {
+        const escaped = todo.notes
+          .replace(/&/g, "&amp;")
+          .replace(/</g, "&lt;")
+          .replace(/>/g, "&gt;");
+        notesHtml = `<pre class="todo-notes">${linkify(escaped)}</pre>`;
+      }
+
       li.innerHTML = `
                             <input class="todo-checkbox" type="checkbox" onchange="toggleTodo(${todo.id})" ${todo.completed ? "checked" : ""}>
                              <div class="todo-content">
                                  <pre class="todo-text" data-id="${todo.id}" role="button">${linkify(hashtagify(todo.title))}</pre>
                                  ${dueDateHtml}
                                  ${recurrenceHtml}
+                                 ${priorityHtml}
+                                 ${notesHtml}
                              </div>
                             <button class="todo-menu-btn" data-id="${todo.id}">⋮</button>
                             <div class="todo-menu">
@@ -1339,7 +1197,7 @@ async function loadProject(project, filteredTodos) {
                                         <span>Date</span>
                                         <input type="date" class="todo-date-input" data-id="${todo.id}" data-due="${todo.due_date || ""}" value="${(() => {
                                           if (!todo.due_date) return "";
-                                          const d = new Date(todo.due_date);
+                                          const d = localDueDate(todo);
                                           return (
                                             d.getFullYear() +
                                             "-" +
@@ -1355,7 +1213,7 @@ async function loadProject(project, filteredTodos) {
                                     <div style="display:flex; align-items:center; gap:8px;">
                                         <span>Time</span>
                                         <input type="time" class="todo-time-input" data-id="${todo.id}" value="${(() => {
-                                          if (!todo.due_date) return "";
+                                          if (!todo.due_date || todo.all_day) return "";
                                           const d = new Date(todo.due_date);
                                           return (
                                             String(d.getHours()).padStart(
@@ -1381,6 +1239,16 @@ async function loadProject(project, filteredTodos) {
                                         <option value="year" ${todo.recurrence_unit === "year" ? "selected" : ""}>year(s)</option>
                                     </select>
                                 </div>
+                                <div class="todo-menu-item" style="display:flex; align-items:center; gap:8px;">
+                                    <span>Remind</span>
+                                    <select class="reminder-offset" data-id="${todo.id}">
+                                        <option value="">add reminder…</option>
+                                        <option value="0">at due time</option>
+                                        <option value="15">15 minutes before</option>
+                                        <option value="60">1 hour before</option>
+                                        <option value="1440">1 day before</option>
+                                    </select>
+                                </div>
                                 <div class="todo-menu-item" role="button" data-action="save" data-id="${todo.id}">Save</div>
                                 <div class="todo-menu-item" role="button" data-action="cancel">Cancel</div>
                                 <div class="todo-menu-item" role="button" data-action="delete" data-id="${todo.id}">Delete</div>
@@ -1490,54 +1358,13 @@ async function loadProject(project, filteredTodos) {
 // Export database handler
 document
   .getElementById("exportDatabase")
-  .addEventListener("click", async function () {
-    try {
-      // Get all projects, todos, and subscriptions in parallel
-      const [todosRes, projectsRes, subscriptionsRes] = await Promise.all([
-        fetch("/api/todos"),
-        fetch("/api/projects"),
-        fetch("/api/ics_subscriptions"),
-      ]);
-
-      if (!todosRes.ok) throw new Error("Failed to fetch todos");
-      if (!projectsRes.ok) throw new Error("Failed to fetch projects");
-      if (!subscriptionsRes.ok)
-        throw new Error("Failed to fetch subscriptions");
-
-      let todos = await todosRes.json();
-      let projects = await projectsRes.json();
-      let subscriptions = await subscriptionsRes.json();
-
-      // Filter out the special 'thisweek' project and its todos
-      projects = projects.filter((p) => p.id !== "thisweek");
-      const projectIds = new Set(projects.map((p) => p.id));
-      todos = todos.filter((todo) => projectIds.has(todo.project_id));
-
-      // Combine data
-      const exportData = {
-        version: 1,
-        exportedAt: new Date().toISOString(),
-        projects: projects,
-        todos: todos,
-        subscriptions: subscriptions,
-      };
-
-      // Create a blob and download link
-      const blob = new Blob([JSON.stringify(exportData, null, 2)], {
-        type: "application/json",
-      });
-      const url = URL.createObjectURL(blob);
-      const a = document.createElement("a");
-      a.href = url;
-      a.download = `todo-export-${new Date().toISOString()}.json`;
-      document.body.appendChild(a);
-      a.click();
-      document.body.removeChild(a);
-      URL.revokeObjectURL(url);
-    } catch (error) {
-      console.error("Export failed:", error);
-      alert("Failed to export database. Check console for details.");
-    }
+  .addEventListener("click", function () {
+    // The server sends the backup as a download
+    const a = document.createElement("a");
+    a.href = "api/backup";
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
   });
 
 // Import database handler
@@ -1555,136 +1382,35 @@ document
     if (!file) return;
 
     try {
-      const data = JSON.parse(await file.text());
-
-      // Validate the import data
-      if (!data.version || !data.projects || !data.todos) {
-        throw new Error("Invalid import file format");
+      const text = await file.text();
+      const backup = JSON.parse(text);
+      if (backup.format !== "todo-app-backup" || !backup.tables) {
+        throw new Error("Not a backup made by Export Database");
       }
 
-      // Confirm with user before proceeding with import
+      const count = (table) => (backup.tables[table]?.rows || []).length;
       if (
         !confirm(
-          `WARNING: This will DELETE ALL existing projects and todos, then import ${data.projects.length} projects and ${data.todos.length} todos. This action cannot be undone. Continue?`,
+          `WARNING: This will REPLACE ALL existing projects, todos and subscriptions with the ${count("projects")} projects and ${count("todos")} todos of the backup. This action cannot be undone. Continue?`,
         )
       ) {
         return;
       }
 
-      // Delete all existing todos and projects
-      try {
-        const projects = await fetch("/api/projects").then((res) =>
-          res.ok ? res.json() : [],
-        );
-        for (const project of projects) {
-          await fetch(`/api/projects/${project.id}`, {
-            method: "DELETE",
-          });
-        }
-        const subscriptions = await fetch("/api/ics_subscriptions").then(
-          (res) => (res.ok ? res.json() : []),
-        );
-        for (const sub of subscriptions) {
-          await fetch(`/api/cancel_ics_subscription?id=${sub.id}`, {
-            method: "DELETE",
-          });
-        }
-      } catch (err) {
-        console.error("Failed to clear existing data:", err);
-        throw new Error("Failed to clear existing data");
-      }
-
-      // Import projects first (excluding any special projects)
-      const projectsToImport = data.projects.filter((p) => p.id !== "thisweek");
-
-      for (const project of projectsToImport) {
-        try {
-          // Create new project with only the necessary fields
-          const projectData = {
-            title: project.title,
-            position: project.position || 0,
-          };
-
-          await fetch("/api/projects", {
-            method: "POST",
-            headers: { "Content-Type": "application/json" },
-            body: JSON.stringify(projectData),
-          });
-        } catch (err) {
-          console.error(`Failed to import project ${project.id}:`, err);
-        }
-      }
-
-      // Get the newly created projects to map old IDs to new ones
-      const newProjects = await fetch("/api/projects").then((res) =>
-        res.ok ? res.json() : [],
-      );
-      const projectIdMap = {};
-
-      // Create a mapping from old project IDs to new ones
-      for (const oldProject of projectsToImport) {
-        const newProject = newProjects.find(
-          (p) =>
-            p.title === oldProject.title &&
-            p.position === (oldProject.position || 0),
-        );
-        if (newProject) {
-          projectIdMap[oldProject.id] = newProject.id;
-        }
-      }
-
-      // Then import todos (only those that belong to imported projects)
-      const todosToImport = data.todos.filter(
-        (todo) => projectIdMap[todo.project_id] !== undefined,
-      );
-
-      for (const todo of todosToImport) {
-        try {
-          // Prepare todo data with all required fields
-          const todoData = {
-            title: todo.title || "",
-            completed: !!todo.completed,
-            project_id: projectIdMap[todo.project_id] || 1, // Use the mapped project ID
-            due_date: todo.due_date || null,
-            recurrence_interval: todo.recurrence_interval || null,
-            recurrence_unit: todo.recurrence_unit || null,
-            position: todo.position || 0,
-          };
-
-          // Create new todo
-          await fetch("/api/todo", {
-            method: "POST",
-            headers: { "Content-Type": "application/json" },
-            body: JSON.stringify(todoData),
-          });
-        } catch (err) {
-          console.error(`Failed to import todo ${todo.id}:`, err);
-        }
-      }
-
-      // Import subscriptions
-      if (data.subscriptions) {
-        for (const sub of data.subscriptions) {
-          try {
-            await fetch("/api/subscribe_ics", {
-              method: "POST",
-              headers: { "Content-Type": "application/json" },
-              body: JSON.stringify({
-                url: sub.url,
-                project_name: sub.project_name,
-              }),
-            });
-          } catch (err) {
-            console.error(`Failed to import subscription ${sub.url}:`, err);
-          }
-        }
-      }
+      // The server checks the backup and restores it in one transaction, so
+      // a failed restore leaves the data as it was
+      const resp = await fetch("api/restore?mode=replace", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: text,
+      });
+      if (!resp.ok) throw new Error(await resp.text());
 
       alert("Import completed successfully! Refreshing the page...");
       window.location.reload();
     } catch (error) {
       console.error("Import failed:", error);
-      alert("Failed to import database. Check console for details.");
+      alert("Failed to import database: " + (error.message || "Unknown error"));
     } finally {
       // Reset the file input
       e.target.value = "";
@@ -1699,11 +1425,15 @@ document
     if (!file) return;
     try {
       const text = await file.text();
-      const data = JSON.parse(text);
 
-      await importGoogleTasks(data);
-      alert("Import completed");
-      await loadTodosByProject();
+      if (
+        await importTasks(text, {
+          source: "google_tasks",
+          heading: "Google Tasks Import",
+        })
+      ) {
+        await loadTodosByProject();
+      }
     } catch (err) {
       console.error("Import error:", err, "Stack:", err.stack);
       alert("Import failed: " + (err.message || "Unknown error"));
@@ -1712,6 +1442,28 @@ document
     }
   });
 
+// Import Todoist, Microsoft To Do and Trello handler
+document
+  .getElementById("importTasksFile")
+  .addEventListener("change", async function (e) {
+    const file = e.target.files[0];
+    if (!file) return;
+    try {
+      const text = await file.text();
+
+      // A Todoist CSV file holds one project, named after the file
+      const title = file.name.replace(/\.[^.]+$/, "");
+      if (await importTasks(text, { title, heading: "Task Import" })) {
+        await loadTodosByProject();
+      }
+    } catch (err) {
+      console.error("Import error:", err);
+      alert("Import failed: " + (err.message || "Unknown error"));
+    } finally {
+      e.target.value = "";
+    }
+  });
+
 // Import Calendar (.ics) handler
 document
   .getElementById("importCalendarFile")
@@ -1719,89 +1471,138 @@ document
     const file = e.target.files[0];
     if (!file) return;
     try {
-      const text = await file.text();
-      const events = parseICS(text);
+      // The server reads the file like calendar subscriptions, into a project
+      // named after the file
+      const form = new FormData();
+      form.append("file", file);
+      const resp = await fetch("api/import_ics", {
+        method: "POST",
+        body: form,
+      });
+      if (!resp.ok) throw new Error(await resp.text());
+      const result = await resp.json();
 
-      if (events.length === 0) {
-        alert("No upcoming events found in the calendar file.");
-        return;
+      let message = `Imported ${result.added} todo(s) into "${result.project_name}"`;
+      if (result.duplicates > 0) {
+        message += `, skipped ${result.duplicates} already imported`;
       }
+      if (result.excluded > 0) {
+        message += `, ${result.excluded} past or excluded`;
+      }
+      alert(message);
+      await loadTodosByProject();
+    } catch (err) {
+      console.error("ICS import error:", err);
+      alert("Import failed: " + (err.message || "Unknown error"));
+    } finally {
+      e.target.value = "";
+    }
+  });
 
-      const nowUTC = new Date();
-      function getNextOccurrence(start, interval, unit) {
-        if (!start) return null;
-        const next = new Date(start.getTime());
-        const inc = interval || 1;
-        const step = unit;
-        const add = {
-          day: () => next.setUTCDate(next.getUTCDate() + inc),
-          week: () => next.setUTCDate(next.getUTCDate() + inc * 7),
-          month: () => next.setUTCMonth(next.getUTCMonth() + inc),
-          year: () => next.setUTCFullYear(next.getUTCFullYear() + inc),
-        }[step];
-        if (!add) return next; // unsupported
-        while (next < nowUTC) {
-          add();
-        }
-        return next;
+// Export todo.txt handler
+document
+  .getElementById("exportTodoTxt")
+  .addEventListener("click", function () {
+    // Dates and times are written in the browser's time zone
+    const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    const a = document.createElement("a");
+    a.href = `api/export_todo_txt?tz=${encodeURIComponent(tz)}`;
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
+  });
+
+// Export Markdown handler
+document
+  .getElementById("exportMarkdown")
+  .addEventListener("click", function () {
+    const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    const a = document.createElement("a");
+    a.href = `api/projects/export?format=md&tz=${encodeURIComponent(tz)}`;
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
+  });
+
+// Import todo.txt handler
+document
+  .getElementById("importTodoTxtFile")
+  .addEventListener("change", async function (e) {
+    const file = e.target.files[0];
+    if (!file) return;
+    try {
+      const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+      const resp = await fetch(
+        `api/import_todo_txt?tz=${encodeURIComponent(tz)}`,
+        {
+          method: "POST",
+          headers: { "Content-Type": "text/plain" },
+          body: await file.text(),
+        },
+      );
+      if (!resp.ok) throw new Error(await resp.text());
+      const result = await resp.json();
+
+      let message = `Imported ${result.added} todo(s)`;
+      if (result.created_projects.length > 0) {
+        message += ` and created ${result.created_projects.join(", ")}`;
+      }
+      for (const error of result.errors) {
+        message += `\nLine ${error.line}: ${error.error}`;
       }
+      alert(message);
+      await loadTodosByProject();
+    } catch (err) {
+      console.error("todo.txt import error:", err);
+      alert("Import failed: " + (err.message || "Unknown error"));
+    } finally {
+      e.target.value = "";
+    }
+  });
 
-      // Create a new project named after the uploaded file
-      const projectTitle =
-        file.name.replace(/\.(ics|calendar)$/i, "") || "Imported Calendar";
-      let projectId = 1;
-      try {
-        const projResp = await fetch("/api/projects", {
+// Export Taskwarrior handler
+document
+  .getElementById("exportTaskwarrior")
+  .addEventListener("click", function () {
+    // All-day todos are due at midnight in the browser's time zone
+    const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+    const a = document.createElement("a");
+    a.href = `api/export_taskwarrior?tz=${encodeURIComponent(tz)}`;
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
+  });
+
+// Import Taskwarrior handler
+document
+  .getElementById("importTaskwarriorFile")
+  .addEventListener("change", async function (e) {
+    const file = e.target.files[0];
+    if (!file) return;
+    try {
+      const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+      const resp = await fetch(
+        `api/import_taskwarrior?tz=${encodeURIComponent(tz)}`,
+        {
           method: "POST",
           headers: { "Content-Type": "application/json" },
-          body: JSON.stringify({ title: projectTitle }),
-        });
-        if (!projResp.ok) throw new Error("Failed to create project");
-        const projData = await projResp.json();
-        projectId = projData.id;
-      } catch (projErr) {
-        console.error(
-          "Project creation failed, falling back to default project",
-          projErr,
-        );
-      }
+          body: await file.text(),
+        },
+      );
+      if (!resp.ok) throw new Error(await resp.text());
+      const result = await resp.json();
 
-      for (const ev of events) {
-        // Build payload for each event as a todo
-        const todoPayload = {
-          title: ev.summary || "Untitled event",
-          completed: false,
-          project_id: projectId,
-          // Determine correct due date
-          due_date: (() => {
-            if (!ev.date) return null;
-            const nextDate = ev.recurrenceUnit
-              ? getNextOccurrence(
-                  ev.date,
-                  ev.recurrenceInterval,
-                  ev.recurrenceUnit,
-                )
-              : ev.date;
-            return toRFC3339NoMillis(nextDate);
-          })(),
-          recurrence_interval: ev.recurrenceInterval,
-          recurrence_unit: ev.recurrenceUnit,
-        };
-        try {
-          await fetch("/api/todo", {
-            method: "POST",
-            headers: { "Content-Type": "application/json" },
-            body: JSON.stringify(todoPayload),
-          });
-        } catch (err) {
-          console.error("Failed to create todo for event", ev, err);
-        }
+      let message = `Imported ${result.added} new and ${result.updated} updated todo(s)`;
+      if (result.created_projects.length > 0) {
+        message += ` and created ${result.created_projects.join(", ")}`;
       }
-
-      alert("Calendar import completed");
+      for (const error of result.errors) {
+        message += `\n${error.title || error.id}: ${error.error}`;
+      }
+      alert(message);
       await loadTodosByProject();
     } catch (err) {
-      console.error("ICS import error:", err);
+      console.error("Taskwarrior import error:", err);
       alert("Import failed: " + (err.message || "Unknown error"));
     } finally {
       e.target.value = "";
@@ -1851,9 +1652,12 @@ async function addTodo(textarea) {
       title: textarea.value,
       completed: false,
       project_id: Number(textarea.dataset.id),
+      // Let the server pick dates, recurrence and @project out of the text
+      parse: true,
+      time_zone: Intl.DateTimeFormat().resolvedOptions().timeZone,
     };
 
-    const response = await fetch("/api/todo", {
+    const response = await fetch("api/todo", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
@@ -1866,14 +1670,47 @@ async function addTodo(textarea) {
       throw new Error(`Failed to add todo: ${errorData.message}`);
     }
 
+    const created = await response.json();
     textarea.value = "";
     await loadTodosByProject();
+    showParsedSummary(created.parsed);
   } catch (error) {
     console.error("Error adding todo:", error);
     alert("Failed to add todo. Please try again.");
   }
 }
 
+// Show what the server understood from a natural-language todo
+function showParsedSummary(parsed) {
+  if (!parsed) return;
+  const parts = [];
+  if (parsed.due_date) {
+    const due = new Date(parsed.due_date);
+    parts.push(
+      parsed.has_time
+        ? `due ${due.toLocaleString([], { dateStyle: "medium", timeStyle: "short" })}`
+        : `due ${due.toLocaleDateString([], { dateStyle: "medium" })}`,
+    );
+  }
+  if (parsed.recurrence_interval && parsed.recurrence_unit) {
+    parts.push(
+      `every ${parsed.recurrence_interval} ${parsed.recurrence_unit}(s)`,
+    );
+  }
+  if (parsed.project) parts.push(`in ${parsed.project}`);
+  if (parts.length === 0) return;
+  showToast(`Added "${parsed.title}" ${parts.join(", ")}`);
+}
+
+// Display a short-lived message at the bottom of the page
+function showToast(message) {
+  const toast = document.createElement("div");
+  toast.className = "toast";
+  toast.textContent = message;
+  document.body.appendChild(toast);
+  setTimeout(() => toast.remove(), 4000);
+}
+
 async function editTodo(id, element) {
   const originalText = element.innerText;
 
@@ -1965,10 +1802,12 @@ async function saveEdit(textarea, originalText) {
     const dueInput = li ? li.querySelector(".todo-date-input") : null;
     const timeInput = li ? li.querySelector(".todo-time-input") : null;
     let dueDate = null;
+    let allDay;
 
     // If date is explicitly cleared, clear the entire due date
     if (dueInput && dueInput.value === "") {
       dueDate = ""; // Send empty string to clear the date
+      allDay = false;
     }
     // If time is set but no date, use today's date
     else if (timeInput?.value && (!dueInput || !dueInput.value)) {
@@ -1986,8 +1825,14 @@ async function saveEdit(textarea, originalText) {
       );
       // Convert to UTC and format as strict RFC3339 (no ms)
       dueDate = toRFC3339NoMillis(localDate);
+      allDay = false;
+    }
+    // A date without a time is all-day, stored as midnight UTC
+    else if (dueInput?.value && !timeInput?.value) {
+      dueDate = `${dueInput.value}T00:00:00Z`;
+      allDay = true;
     }
-    // If date is set, use it with optional time
+    // If date and time are set, combine them
     else if (dueInput?.value) {
       const dateParts = dueInput.value.split("-");
       // Create date in local timezone
@@ -1997,15 +1842,12 @@ async function saveEdit(textarea, originalText) {
         parseInt(dateParts[2]),
       );
 
-      if (timeInput?.value) {
-        const [hours, minutes] = timeInput.value.split(":").map(Number);
-        localDate.setHours(hours, minutes, 0, 0);
-      } else {
-        localDate.setHours(0, 0, 0, 0);
-      }
+      const [hours, minutes] = timeInput.value.split(":").map(Number);
+      localDate.setHours(hours, minutes, 0, 0);
 
       // Convert to UTC and format as strict RFC3339 (no ms)
       dueDate = toRFC3339NoMillis(localDate);
+      allDay = false;
     }
     // Only use the existing due date if we're not explicitly clearing the date
     else if (dueInput?.dataset.due && !dueInput.value) {
@@ -2031,13 +1873,14 @@ async function saveEdit(textarea, originalText) {
       title: newTitle,
       completed: completed,
       due_date: dueDate,
+      all_day: allDay,
       recurrence_interval:
         countEl && countEl.value ? Number(countEl.value) : null,
       recurrence_unit: unitEl && unitEl.value ? unitEl.value : null,
       position: Number(li.dataset.position),
     };
 
-    const response = await fetch("/api/todo", {
+    const response = await fetch("api/todo", {
       method: "PUT",
       headers: {
         "Content-Type": "application/json",
@@ -2091,6 +1934,7 @@ async function toggleTodo(id) {
   const dueInput = todoItem.querySelector(".todo-date-input");
   const timeInput = todoItem.querySelector(".todo-time-input");
   let dueDate = null;
+  let allDay;
 
   // If time is set but no date, use today's date
   if (timeInput?.value && (!dueInput || !dueInput.value)) {
@@ -2108,8 +1952,14 @@ async function toggleTodo(id) {
     );
     // Convert to UTC and format as RFC3339 with 'Z' timezone
     dueDate = localDate.toISOString();
+    allDay = false;
   }
-  // If date is set, use it with optional time
+  // A date without a time is all-day, stored as midnight UTC
+  else if (dueInput?.value && !timeInput?.value) {
+    dueDate = `${dueInput.value}T00:00:00Z`;
+    allDay = true;
+  }
+  // If date and time are set, combine them
   else if (dueInput?.value) {
     const dateParts = dueInput.value.split("-");
     // Create date in local timezone
@@ -2119,15 +1969,12 @@ async function toggleTodo(id) {
       parseInt(dateParts[2]),
     );
 
-    if (timeInput?.value) {
-      const [hours, minutes] = timeInput.value.split(":").map(Number);
-      localDate.setHours(hours, minutes, 0, 0);
-    } else {
-      localDate.setHours(0, 0, 0, 0);
-    }
+    const [hours, minutes] = timeInput.value.split(":").map(Number);
+    localDate.setHours(hours, minutes, 0, 0);
 
     // Convert to UTC and format as RFC3339 with 'Z' timezone
     dueDate = localDate.toISOString();
+    allDay = false;
   }
   // Keep the existing due date if no new date is selected
   else if (dueInput?.dataset.due) {
@@ -2140,7 +1987,7 @@ async function toggleTodo(id) {
   const recUnit = unitEl && unitEl.value ? unitEl.value : null;
 
   try {
-    const response = await fetch("/api/todo", {
+    const response = await fetch("api/todo", {
       method: "PUT",
       headers: {
         "Content-Type": "application/json",
@@ -2150,6 +1997,7 @@ async function toggleTodo(id) {
         title: title,
         completed: checkbox.checked,
         due_date: dueDate,
+        all_day: allDay,
         recurrence_interval: recInt,
         recurrence_unit: recUnit,
       }),
@@ -2168,7 +2016,7 @@ async function toggleTodo(id) {
 
 async function deleteTodo(id) {
   try {
-    const response = await fetch(`/api/todo?id=${id}`, {
+    const response = await fetch(`api/todo?id=${id}`, {
       method: "DELETE",
     });
 
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"todo-app/todotxt"
+)
+
+const todoTxtMaxSize = 10 << 20
+
+// recPattern matches the rec: extension, e.g. rec:1w or rec:+2m. The app
+// always repeats from the due date, as the "+" form does.
+var recPattern = regexp.MustCompile(`^\+?(\d*)([dwmy])$`)
+
+var recUnits = map[string]string{"d": "days", "w": "weeks", "m": "months", "y": "years"}
+
+// todoTxtPriority maps a priority to a letter, 1 (highest) being A.
+func todoTxtPriority(priority int) string {
+	if priority < 1 || priority > 9 {
+		return ""
+	}
+	return string(rune('A' + priority - 1))
+}
+
+// priorityFromTodoTxt maps a letter to a priority. Letters past I are the
+// lowest priority, 9.
+func priorityFromTodoTxt(letter string) int {
+	if letter == "" {
+		return 0
+	}
+	return min(int(letter[0]-'A')+1, 9)
+}
+
+// todoTxtLocation reads the "tz" query parameter, which decides the dates
+// and times of the file.
+func todoTxtLocation(r *http.Request) (*time.Location, error) {
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		return time.LoadLocation(tz)
+	}
+	return time.Local, nil
+}
+
+// todoTxtDate is the start of a todo.txt date in loc, the other way round
+// from allDayDueDate, so that dates read back as they were written.
+func todoTxtDate(date time.Time, loc *time.Location) time.Time {
+	year, month, day := date.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc).UTC()
+}
+
+// todoTxtLine formats a todo. The project becomes a +project, and the due
+// date, recurrence and, for done todos, the priority become due:, rec: and
+// pri: tags.
+func todoTxtLine(todo Todo, projectTitle string, loc *time.Location) string {
+	task := todotxt.Task{Done: todo.Completed}
+	created := allDayDueDate(todo.CreatedAt.In(loc))
+	task.Created = &created
+	if todo.Completed && todo.CompletedAt != nil {
+		completed := allDayDueDate(todo.CompletedAt.In(loc))
+		task.Completed = &completed
+	}
+
+	words := []string{todo.Title, "+" + todotxt.Name(projectTitle)}
+	if todo.Completed {
+		if letter := todoTxtPriority(todo.Priority); letter != "" {
+			words = append(words, "pri:"+letter)
+		}
+	} else {
+		task.Priority = todoTxtPriority(todo.Priority)
+	}
+	if todo.DueDate != nil {
+		if todo.AllDay {
+			words = append(words, "due:"+todo.DueDate.UTC().Format("2006-01-02"))
+		} else {
+			words = append(words, "due:"+todo.DueDate.In(loc).Format("2006-01-02T15:04"))
+		}
+	}
+	if todo.RecurrenceInterval != nil && todo.RecurrenceUnit != nil && *todo.RecurrenceInterval > 0 {
+		unit := strings.ToLower(*todo.RecurrenceUnit)
+		if unit != "" {
+			words = append(words, fmt.Sprintf("rec:+%d%c", *todo.RecurrenceInterval, unit[0]))
+		}
+	}
+	task.Text = strings.Join(words, " ")
+	return task.String()
+}
+
+// exportTodoTxtHandler writes todos as a todo.txt file, all of them or
+// those of the "project" query parameter (id or title). "completed=false"
+// leaves done todos out.
+func exportTodoTxtHandler(w http.ResponseWriter, r *http.Request) {
+	loc, err := todoTxtLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT t.title, t.completed, t.created_at, t.completed_at, datetime(t.due_date), t.all_day,
+		       t.recurrence_interval, t.recurrence_unit, t.priority, p.title
+		FROM todos t
+		JOIN projects p ON p.id = t.project_id
+		WHERE 1 = 1`
+	args := []interface{}{}
+	if ref := r.URL.Query().Get("project"); ref != "" {
+		project, err := findProjectForCalendar(ref)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		query += " AND t.project_id = ?"
+		args = append(args, project.ID)
+	}
+	if r.URL.Query().Get("completed") == "false" {
+		query += " AND t.completed = 0"
+	}
+	query += " ORDER BY p.position, p.id, t.position, t.id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var out strings.Builder
+	for rows.Next() {
+		var todo Todo
+		var dueDateStr sql.NullString
+		var projectTitle string
+		if err := rows.Scan(
+			&todo.Title,
+			&todo.Completed,
+			&todo.CreatedAt,
+			&todo.CompletedAt,
+			&dueDateStr,
+			&todo.AllDay,
+			&todo.RecurrenceInterval,
+			&todo.RecurrenceUnit,
+			&todo.Priority,
+			&projectTitle,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		todo.DueDate, err = parseDBDateTime(dueDateStr)
+		if err != nil {
+			logWarn("Warning: could not parse due date '%s': %v", dueDateStr.String, err)
+		}
+		out.WriteString(todoTxtLine(todo, projectTitle, loc))
+		out.WriteString("\n")
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="todo.txt"`)
+	io.WriteString(w, out.String())
+}
+
+// TodoTxtImport is the result of a todo.txt import.
+type TodoTxtImport struct {
+	Added           int               `json:"added"`
+	CreatedProjects []string          `json:"created_projects"`
+	Errors          []ImportItemError `json:"errors"`
+}
+
+// importTodoTxtHandler imports a todo.txt file in one transaction. Tasks go
+// to the project of their last +project, found by title or created, and
+// otherwise to the "project" query parameter (id or title, the default
+// project when absent). due:, rec: and pri: tags become the due date,
+// recurrence and priority; other tags, @contexts and other +projects stay
+// in the title. Lines that cannot be read fully are reported.
+func importTodoTxtHandler(w http.ResponseWriter, r *http.Request) {
+	loc, err := todoTxtLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, todoTxtMaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defaultProject := Project{ID: 1}
+	if ref := r.URL.Query().Get("project"); ref != "" {
+		if defaultProject, err = findProjectForCalendar(ref); err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result := TodoTxtImport{CreatedProjects: make([]string, 0), Errors: make([]ImportItemError, 0)}
+	projects := newProjectResolver(tx)
+	now := time.Now().UTC()
+
+	for i, line := range strings.Split(string(body), "\n") {
+		task, ok := todotxt.Parse(line)
+		if !ok {
+			continue
+		}
+		lineError := func(format string, args ...interface{}) {
+			result.Errors = append(result.Errors, ImportItemError{
+				Line:  i + 1,
+				Title: task.Text,
+				Error: fmt.Sprintf(format, args...),
+			})
+		}
+
+		todo := Todo{
+			Completed: task.Done,
+			Priority:  priorityFromTodoTxt(task.Priority),
+			ProjectID: defaultProject.ID,
+			CreatedAt: now,
+		}
+		if task.Created != nil {
+			todo.CreatedAt = todoTxtDate(*task.Created, loc)
+		}
+		if task.Done {
+			completedAt := now
+			if task.Completed != nil {
+				completedAt = todoTxtDate(*task.Completed, loc)
+			}
+			todo.CompletedAt = &completedAt
+		}
+
+		// Tags are only taken out of the title once they have been understood
+		used := make(map[string]bool)
+		// Exports put the project last, after any +projects of the title
+		projectName := ""
+		if names := task.Projects(); len(names) > 0 {
+			projectName = names[len(names)-1]
+			used["+"+projectName] = true
+		}
+		if value, ok := task.Tag("due"); ok {
+			if due, err := time.Parse("2006-01-02", value); err == nil {
+				todo.DueDate = &due
+				todo.AllDay = true
+				used["due:"+value] = true
+			} else if due, err := time.ParseInLocation("2006-01-02T15:04", value, loc); err == nil {
+				due = due.UTC()
+				todo.DueDate = &due
+				used["due:"+value] = true
+			} else {
+				lineError("invalid due date %q, kept in the title", value)
+			}
+		}
+		if value, ok := task.Tag("rec"); ok {
+			if m := recPattern.FindStringSubmatch(value); m != nil {
+				interval := 1
+				if m[1] != "" {
+					interval, _ = strconv.Atoi(m[1])
+				}
+				if interval > 0 {
+					unit := recUnits[m[2]]
+					todo.RecurrenceInterval = &interval
+					todo.RecurrenceUnit = &unit
+					used["rec:"+value] = true
+				}
+			}
+			if !used["rec:"+value] {
+				lineError("unsupported recurrence %q, kept in the title", value)
+			}
+		}
+		if value, ok := task.Tag("pri"); ok && len(value) == 1 && value[0] >= 'A' && value[0] <= 'Z' {
+			if todo.Priority == 0 {
+				todo.Priority = priorityFromTodoTxt(value)
+			}
+			used["pri:"+value] = true
+		}
+
+		todo.Title = task.Without(func(word string) bool { return used[word] })
+		if todo.Title == "" {
+			lineError("task has no description, skipped")
+			continue
+		}
+		if projectName != "" {
+			if todo.ProjectID, err = projects.name(projectName); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		position, err := projects.position(todo.ProjectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO todos (title, completed, created_at, completed_at, project_id, due_date, all_day, recurrence_interval, recurrence_unit, priority, position)
+			 VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?)`,
+			todo.Title, todo.Completed, todo.CreatedAt.Format("2006-01-02 15:04:05"), todo.CompletedAt, todo.ProjectID,
+			formatDueDate(todo.DueDate), todo.AllDay, todo.RecurrenceInterval, todo.RecurrenceUnit, todo.Priority, position,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Added++
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.CreatedProjects = append(result.CreatedProjects, projects.created...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
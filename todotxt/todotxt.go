@@ -0,0 +1,129 @@
+// Package todotxt reads and writes lines in the todo.txt format
+// (https://github.com/todotxt/todo.txt), e.g.
+// "x (A) 2024-01-05 2024-01-01 Call Mom +Family @phone due:2024-01-10".
+package todotxt
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+var priorityPattern = regexp.MustCompile(`^\(([A-Z])\)$`)
+
+// Task is one line of a todo.txt file. Dates are calendar dates, as
+// midnight UTC.
+type Task struct {
+	Done      bool
+	Priority  string // "A" (highest) to "Z", or ""
+	Completed *time.Time
+	Created   *time.Time
+	// Description, with its +projects, @contexts and key:value tags
+	Text string
+}
+
+// Parse reads a line. It reports false for blank lines.
+func Parse(line string) (Task, bool) {
+	var task Task
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return task, false
+	}
+
+	if words[0] == "x" {
+		task.Done = true
+		words = words[1:]
+	}
+	if len(words) > 0 {
+		if m := priorityPattern.FindStringSubmatch(words[0]); m != nil {
+			task.Priority = m[1]
+			words = words[1:]
+		}
+	}
+	// A done task has its completion date first, then its creation date
+	if task.Done && len(words) > 0 {
+		if date, ok := parseDate(words[0]); ok {
+			task.Completed = &date
+			words = words[1:]
+		}
+	}
+	if len(words) > 0 {
+		if date, ok := parseDate(words[0]); ok {
+			task.Created = &date
+			words = words[1:]
+		}
+	}
+
+	task.Text = strings.Join(words, " ")
+	return task, true
+}
+
+func parseDate(s string) (time.Time, bool) {
+	if len(s) != len(dateLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(dateLayout, s)
+	return t, err == nil
+}
+
+// String formats the task as a line.
+func (t Task) String() string {
+	var parts []string
+	if t.Done {
+		parts = append(parts, "x")
+	}
+	if t.Priority != "" {
+		parts = append(parts, "("+t.Priority+")")
+	}
+	if t.Done && t.Completed != nil {
+		parts = append(parts, t.Completed.Format(dateLayout))
+	}
+	if t.Created != nil {
+		parts = append(parts, t.Created.Format(dateLayout))
+	}
+	if t.Text != "" {
+		parts = append(parts, t.Text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Projects returns the names of the +projects in the description.
+func (t Task) Projects() []string {
+	var projects []string
+	for _, word := range strings.Fields(t.Text) {
+		if name, ok := strings.CutPrefix(word, "+"); ok && name != "" {
+			projects = append(projects, name)
+		}
+	}
+	return projects
+}
+
+// Tag returns the value of the first key:value tag with the given key.
+func (t Task) Tag(key string) (string, bool) {
+	for _, word := range strings.Fields(t.Text) {
+		if value, ok := strings.CutPrefix(word, key+":"); ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Without returns the description without the words drop reports true
+// for.
+func (t Task) Without(drop func(word string) bool) string {
+	var kept []string
+	for _, word := range strings.Fields(t.Text) {
+		if !drop(word) {
+			kept = append(kept, word)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// Name turns a project title into a +project name, which cannot hold
+// spaces.
+func Name(title string) string {
+	return strings.Join(strings.Fields(title), "_")
+}
@@ -0,0 +1,101 @@
+package todotxt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line      string
+		done      bool
+		priority  string
+		completed string
+		created   string
+		text      string
+	}{
+		{line: "Call Mom", text: "Call Mom"},
+		{line: "(A) Call Mom +Family @phone", priority: "A", text: "Call Mom +Family @phone"},
+		{line: "2024-01-01 Call Mom", created: "2024-01-01", text: "Call Mom"},
+		{line: "(B) 2024-01-01 Call Mom due:2024-01-10", priority: "B", created: "2024-01-01", text: "Call Mom due:2024-01-10"},
+		{line: "x 2024-01-05 2024-01-01 Call Mom", done: true, completed: "2024-01-05", created: "2024-01-01", text: "Call Mom"},
+		{line: "x (A) 2024-01-05 Call Mom", done: true, priority: "A", completed: "2024-01-05", text: "Call Mom"},
+		{line: "  x   Call   Mom  ", done: true, text: "Call Mom"},
+		// Not a priority, not done and not a date
+		{line: "(a) lowercase", text: "(a) lowercase"},
+		{line: "xylophone lessons", text: "xylophone lessons"},
+		{line: "2024-13-01 is no date", text: "2024-13-01 is no date"},
+		{line: "Call Mom (A)", text: "Call Mom (A)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			task, ok := Parse(tt.line)
+			if !ok {
+				t.Fatal("Parse reported a blank line")
+			}
+			if task.Done != tt.done || task.Priority != tt.priority || task.Text != tt.text {
+				t.Errorf("task = done %v, priority %q, text %q, want done %v, priority %q, text %q",
+					task.Done, task.Priority, task.Text, tt.done, tt.priority, tt.text)
+			}
+			if got := formatDate(task.Completed); got != tt.completed {
+				t.Errorf("completed = %q, want %q", got, tt.completed)
+			}
+			if got := formatDate(task.Created); got != tt.created {
+				t.Errorf("created = %q, want %q", got, tt.created)
+			}
+		})
+	}
+
+	if _, ok := Parse("   "); ok {
+		t.Error("Parse of a blank line reported a task")
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"Call Mom",
+		"(A) 2024-01-01 Call Mom +Family @phone due:2024-01-10",
+		"x (C) 2024-01-05 2024-01-01 Call Mom",
+		"x 2024-01-05 Call Mom",
+	} {
+		task, _ := Parse(line)
+		if got := task.String(); got != line {
+			t.Errorf("String() = %q, want %q", got, line)
+		}
+	}
+}
+
+func TestDescription(t *testing.T) {
+	task, _ := Parse("Call Mom +Family +Home_Stuff @phone due:2024-01-10 rec:1w + due:")
+
+	if got, want := task.Projects(), []string{"Family", "Home_Stuff"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Projects() = %q, want %q", got, want)
+	}
+	if value, ok := task.Tag("due"); !ok || value != "2024-01-10" {
+		t.Errorf("Tag(due) = %q, %v, want 2024-01-10", value, ok)
+	}
+	if _, ok := task.Tag("t"); ok {
+		t.Error("Tag(t) found a tag that is not there")
+	}
+
+	without := task.Without(func(word string) bool {
+		return strings.HasPrefix(word, "+") || strings.HasPrefix(word, "due:")
+	})
+	if want := "Call Mom @phone rec:1w"; without != want {
+		t.Errorf("Without() = %q, want %q", without, want)
+	}
+
+	if got, want := Name("  Home   Stuff "), "Home_Stuff"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+}
+
+func formatDate(date *time.Time) string {
+	if date == nil {
+		return ""
+	}
+	return date.Format(dateLayout)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// generateAPIToken returns a new random token. Only its hash is stored, so the
+// plain value can be shown to the user exactly once.
+func generateAPIToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenFromRequest reads a token from the Authorization header, falling back
+// to the "token" query parameter for clients that cannot set headers.
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// validateAPIToken checks a token against the stored hashes and records its use.
+func validateAPIToken(token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	var id int
+	err := db.QueryRow("SELECT id FROM api_tokens WHERE token_hash = ?", hashAPIToken(token)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now().UTC(), id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// requireAPIToken rejects requests that do not carry a valid API token.
+func requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, err := validateAPIToken(tokenFromRequest(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="todo-app"`)
+			http.Error(w, "Invalid or missing API token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func getAPITokens(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, name, created_at, last_used_at FROM api_tokens ORDER BY id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var token APIToken
+		if err := rows.Scan(&token.ID, &token.Name, &token.CreatedAt, &token.LastUsedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tokens = append(tokens, token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func addAPIToken(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestData.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	plain, err := generateAPIToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO api_tokens (name, token_hash) VALUES (?, ?)", requestData.Name, hashAPIToken(plain))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var token APIToken
+	err = db.QueryRow("SELECT id, name, created_at, last_used_at FROM api_tokens WHERE id = ?", id).
+		Scan(&token.ID, &token.Name, &token.CreatedAt, &token.LastUsedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token.Token = plain
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
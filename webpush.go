@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Subject sent with VAPID requests so push services can contact the operator
+const defaultVAPIDSubject = "https://github.com/BeringLogic/todo-app"
+
+// How long a push service keeps an undelivered message
+const pushTTL = 24 * time.Hour
+
+// PushSubscription is the JSON the browser's PushManager.subscribe() returns.
+type PushSubscription struct {
+	ID       int    `json:"id,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func getSetting(key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setSetting(key, value string) error {
+	_, err := db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+var (
+	vapidKeyOnce sync.Once
+	vapidKey     *ecdsa.PrivateKey
+	vapidKeyErr  error
+)
+
+// vapidPrivateKey returns the server's VAPID key, generating and storing one
+// on first use so existing browser subscriptions survive restarts.
+func vapidPrivateKey() (*ecdsa.PrivateKey, error) {
+	vapidKeyOnce.Do(func() {
+		var encoded string
+		encoded, vapidKeyErr = getSetting("vapid_private_key")
+		if vapidKeyErr != nil {
+			return
+		}
+
+		if encoded != "" {
+			var der []byte
+			der, vapidKeyErr = base64.StdEncoding.DecodeString(encoded)
+			if vapidKeyErr != nil {
+				return
+			}
+			vapidKey, vapidKeyErr = x509.ParseECPrivateKey(der)
+			return
+		}
+
+		vapidKey, vapidKeyErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if vapidKeyErr != nil {
+			return
+		}
+		var der []byte
+		der, vapidKeyErr = x509.MarshalECPrivateKey(vapidKey)
+		if vapidKeyErr != nil {
+			return
+		}
+		vapidKeyErr = setSetting("vapid_private_key", base64.StdEncoding.EncodeToString(der))
+	})
+	return vapidKey, vapidKeyErr
+}
+
+// vapidPublicKey returns the uncompressed public key, base64url encoded, as
+// the browser expects it for applicationServerKey.
+func vapidPublicKey() (string, error) {
+	key, err := vapidPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes()), nil
+}
+
+// vapidAuthorization builds the Authorization header value (RFC 8292) for a
+// push service endpoint.
+func vapidAuthorization(endpoint string) (string, error) {
+	key, err := vapidPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := vapidPublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	subject := config.VAPIDSubject
+	if subject == "" {
+		subject = defaultVAPIDSubject
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants the raw 64-byte r||s signature, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, publicKey), nil
+}
+
+// decodePushKey accepts both base64url and standard base64, with or without
+// padding, since browsers and libraries differ.
+func decodePushKey(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid base64 key")
+}
+
+// encryptPushPayload encrypts a message for one subscription using the
+// aes128gcm content encoding (RFC 8188) with Web Push key derivation (RFC 8291).
+func encryptPushPayload(sub PushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublicBytes, err := decodePushKey(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %v", err)
+	}
+	authSecret, err := decodePushKey(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %v", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %v", err)
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := "WebPush: info\x00" + string(uaPublicBytes) + string(asPublicBytes)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record, terminated by the 0x02 last-record delimiter
+	record := append(append([]byte{}, plaintext...), 0x02)
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(4096))
+	body.WriteByte(byte(len(asPublicBytes)))
+	body.Write(asPublicBytes)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+// errPushSubscriptionGone means the push service no longer knows the
+// subscription and it should be forgotten.
+var errPushSubscriptionGone = fmt.Errorf("push subscription expired")
+
+func sendPush(ctx context.Context, sub PushSubscription, notification Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errPushSubscriptionGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status code %d, body: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+func queryPushSubscriptions() ([]PushSubscription, error) {
+	rows, err := db.Query("SELECT id, endpoint, p256dh, auth, user_agent, created_at FROM push_subscriptions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make([]PushSubscription, 0)
+	for rows.Next() {
+		var sub PushSubscription
+		if err := rows.Scan(&sub.ID, &sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth, &sub.UserAgent, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, rows.Err()
+}
+
+// pushToSubscriptions sends a notification to every registered browser and
+// drops subscriptions the push service reports as gone.
+func pushToSubscriptions(ctx context.Context, notification Notification) error {
+	subscriptions, err := queryPushSubscriptions()
+	if err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return fmt.Errorf("no browser is subscribed to push notifications")
+	}
+
+	var firstErr error
+	for _, sub := range subscriptions {
+		err := sendPush(ctx, sub, notification)
+		if err == errPushSubscriptionGone {
+			logInfo("Removing expired push subscription %d", sub.ID)
+			if _, err := db.Exec("DELETE FROM push_subscriptions WHERE id = ?", sub.ID); err != nil {
+				logError("Error removing push subscription %d: %v", sub.ID, err)
+			}
+			continue
+		}
+		if err != nil {
+			logError("Error sending push notification to subscription %d: %v", sub.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// webPushNotifier delivers to every subscribed browser. It has no settings.
+type webPushNotifier struct{}
+
+func newWebPushNotifier(config json.RawMessage) (Notifier, error) {
+	return webPushNotifier{}, nil
+}
+
+func (webPushNotifier) Notify(ctx context.Context, notification Notification) error {
+	return pushToSubscriptions(ctx, notification)
+}
+
+// ensureWebPushChannel creates a "webpush" notification channel the first
+// time a browser subscribes, so reminders reach it without extra setup.
+func ensureWebPushChannel() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notification_channels WHERE type = 'webpush'").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := db.Exec("INSERT INTO notification_channels (name, type, config, enabled) VALUES ('Browser', 'webpush', '{}', TRUE)")
+	return err
+}
+
+// Upper bound of the window checked by the next sendDueNotifications call
+var lastDueNotificationCheck = time.Now().UTC()
+
+// sendDueNotifications pushes a notification for every incomplete todo that
+// became due since the previous check.
+func sendDueNotifications() {
+	now := time.Now().UTC()
+	since := lastDueNotificationCheck
+	lastDueNotificationCheck = now
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM push_subscriptions").Scan(&count); err != nil {
+		logError("Error counting push subscriptions: %v", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, title, project_id, datetime(due_date), all_day
+		FROM todos
+		WHERE completed = 0 AND due_date IS NOT NULL
+		  AND datetime(due_date) > datetime(?) AND datetime(due_date) <= datetime(?)
+	`, since.Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logError("Error getting due todos: %v", err)
+		return
+	}
+
+	var notifications []Notification
+	for rows.Next() {
+		notification := Notification{Event: "due"}
+		var dueDateStr sql.NullString
+		if err := rows.Scan(&notification.TodoID, &notification.Title, &notification.ProjectID, &dueDateStr, &notification.AllDay); err != nil {
+			logError("Error scanning due todo: %v", err)
+			continue
+		}
+		notification.DueDate, _ = parseDBDateTime(dueDateStr)
+		notification.Message = reminderMessage(notification.DueDate, notification.AllDay)
+		notifications = append(notifications, notification)
+	}
+	rows.Close()
+
+	for _, notification := range notifications {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := pushToSubscriptions(ctx, notification); err != nil {
+			logError("Error sending due notification for todo %d: %v", notification.TodoID, err)
+		}
+		cancel()
+	}
+}
+
+func getVAPIDPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	publicKey, err := vapidPublicKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": publicKey})
+}
+
+func getPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := queryPushSubscriptions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// addPushSubscription registers a browser, or refreshes its keys when the
+// endpoint is already known.
+func addPushSubscription(w http.ResponseWriter, r *http.Request) {
+	var sub PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" {
+		http.Error(w, "A valid https endpoint is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := encryptPushPayload(sub, nil); err != nil {
+		http.Error(w, "Invalid subscription keys: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.UserAgent = r.UserAgent()
+
+	err := db.QueryRow(`
+		INSERT INTO push_subscriptions (endpoint, p256dh, auth, user_agent) VALUES (?, ?, ?, ?)
+		ON CONFLICT(endpoint) DO UPDATE SET p256dh = excluded.p256dh, auth = excluded.auth, user_agent = excluded.user_agent
+		RETURNING id, created_at
+	`, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, sub.UserAgent).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := ensureWebPushChannel(); err != nil {
+		logError("Error creating web push notification channel: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// deletePushSubscription removes a subscription by endpoint, which is all
+// the browser knows about it after unsubscribing.
+func deletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", requestData.Endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if rowsAffected == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}